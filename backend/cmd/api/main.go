@@ -12,14 +12,21 @@ import (
 	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/auth"
 	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/billing"
 	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/config"
+	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/entities"
+	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/entitlements"
+	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/lifecycle"
 	applogger "github.com/emrecetinkayadev/vpn-tridot/backend/internal/logger"
 	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/metrics"
+	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/nodes"
+	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/nodestream"
 	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/peers"
 	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/platform/hash"
 	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/platform/hcaptcha"
 	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/platform/jwt"
 	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/platform/secrets"
+	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/reencrypt"
 	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/regions"
+	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/routing"
 	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/server"
 	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/server/handlers/auth"
 	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/server/handlers/billing"
@@ -75,6 +82,14 @@ func main() {
 		log.Fatalf("ping database: %v", err)
 	}
 
+	keyring, err := secrets.NewManager(cfg.Security.Secrets).FieldKeyring(context.Background(), cfg.Security.FieldEncryption)
+	if err != nil {
+		log.Fatalf("load field encryption keys: %v", err)
+	}
+	if keyring == nil {
+		logger.Warn("field encryption disabled; secrets are stored in plaintext")
+	}
+
 	hasher, err := hash.NewArgon2Hasher(cfg.Auth.ArgonMemory, cfg.Auth.ArgonIterations, cfg.Auth.ArgonSaltLength, cfg.Auth.ArgonKeyLength, cfg.Auth.ArgonParallelism)
 	if err != nil {
 		log.Fatalf("init hasher: %v", err)
@@ -86,6 +101,7 @@ func main() {
 	}
 
 	authRepo := postgres.NewAuthRepository(store.Pool())
+	authRepo.UseKeyring(keyring)
 	authService := auth.NewService(authRepo, hasher, jwtManager, cfg.Auth)
 	hcaptchaVerifier := hcaptcha.New(cfg.Security.HCaptcha)
 	authHandler := authhandler.New(authService, hcaptchaVerifier, logger)
@@ -96,10 +112,10 @@ func main() {
 	if err := regionsService.SeedDefaultRegions(context.Background()); err != nil {
 		log.Fatalf("seed regions: %v", err)
 	}
-	regionHandler := regionshandler.New(regionsService, logger)
-	nodeHandler := nodeshandler.New(regionsService, cfg.Node, logger)
-
 	billingRepo := postgres.NewBillingRepository(store.Pool())
+	entitlementsService := entitlements.NewService(billingRepo)
+	regionHandler := regionshandler.New(regionsService, entitlementsService, logger)
+
 	providers := map[string]billing.PaymentProvider{}
 	if stripeProvider := billing.NewStripeProvider(cfg.Billing.Stripe); stripeProvider != nil {
 		providers[stripeProvider.Name()] = stripeProvider
@@ -111,11 +127,36 @@ func main() {
 	if err := billingService.SeedDefaultPlans(context.Background()); err != nil {
 		log.Fatalf("seed plans: %v", err)
 	}
-	billingHandler := billinghandler.New(billingService, logger)
+	billingHandler := billinghandler.New(billingService, entitlementsService, logger)
 
 	peersRepo := postgres.NewPeersRepository(store.Pool())
-	peersService := peers.NewService(peersRepo, regionsService, authRepo)
+	peersRepo.UseKeyring(keyring)
+	peersService, err := peers.NewService(peersRepo, regionsService, authRepo, entitlementsService, cfg.Peers)
+	if err != nil {
+		log.Fatalf("init peers service: %v", err)
+	}
+	if cfg.Peers.GeoIPFile != "" {
+		geo, err := routing.LoadGeoIP(cfg.Peers.GeoIPFile)
+		if err != nil {
+			log.Fatalf("load geoip ranges: %v", err)
+		}
+		peersService.UseGeoIP(geo)
+	}
 	peersHandler := peershandler.New(peersService, logger)
+	lifecycleWorker := lifecycle.NewWorker(peersRepo, cfg.Billing, logger)
+	billingService.OnSubscriptionChange(func(entities.Subscription) { lifecycleWorker.Trigger() })
+	nodeHandler := nodeshandler.New(regionsService, peersService, cfg.Node, logger)
+	nodeIdentity, err := nodes.NewVerifier(cfg.Node.Identity)
+	if err != nil {
+		log.Fatalf("load node client ca: %v", err)
+	}
+	if nodeIdentity != nil {
+		nodeHandler.UseIdentity(nodeIdentity)
+	} else {
+		logger.Warn("node client certificates not verified; node endpoints rely on the provision token")
+	}
+	nodeEvents := nodestream.NewHub(logger)
+	nodeHandler.UseStream(nodeEvents)
 
 	deps := setup.Dependencies{
 		AuthHandler:    authHandler,
@@ -131,6 +172,14 @@ func main() {
 	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer stop()
 
+	go lifecycleWorker.Run(ctx)
+	go peersService.RunConfigPurge(ctx, logger)
+	go nodeEvents.Run(ctx, postgres.NewNodeEventsListener(store.Pool()))
+	if keyring != nil {
+		fieldsRepo := postgres.NewFieldsRepository(store.Pool(), keyring)
+		go reencrypt.NewWorker(fieldsRepo, cfg.Security.FieldEncryption, logger).Run(ctx)
+	}
+
 	if err := srv.Run(ctx); err != nil {
 		logger.Error("server shutdown", zap.Error(err))
 	}
@@ -36,6 +36,7 @@ type Service struct {
 	users     UserStore
 	providers map[string]PaymentProvider
 	cfg       config.BillingConfig
+	onChange  func(entities.Subscription)
 }
 
 func NewService(repo Repository, users UserStore, providers map[string]PaymentProvider, cfg config.BillingConfig) *Service {
@@ -49,6 +50,12 @@ func NewService(repo Repository, users UserStore, providers map[string]PaymentPr
 	return &Service{repo: repo, users: users, providers: prov, cfg: cfg}
 }
 
+// OnSubscriptionChange registers fn to be called after a webhook stored a
+// subscription, e.g. to reconcile peer status right away.
+func (s *Service) OnSubscriptionChange(fn func(entities.Subscription)) {
+	s.onChange = fn
+}
+
 // SeedDefaultPlans ensures core plans exist in the database.
 func (s *Service) SeedDefaultPlans(ctx context.Context) error {
 	defaults := []struct {
@@ -221,8 +228,7 @@ func (s *Service) handleCheckoutCompleted(ctx context.Context, provider string,
 		ProviderSubscriptionID: event.SubscriptionID,
 	}
 
-	_, err = s.repo.UpsertSubscription(ctx, sub)
-	return err
+	return s.saveSubscription(ctx, sub)
 }
 
 func (s *Service) handleSubscriptionUpdated(ctx context.Context, provider string, event *WebhookEvent) error {
@@ -297,8 +303,7 @@ func (s *Service) handleSubscriptionUpdated(ctx context.Context, provider string
 		ProviderSubscriptionID: event.SubscriptionID,
 	}
 
-	_, err = s.repo.UpsertSubscription(ctx, sub)
-	return err
+	return s.saveSubscription(ctx, sub)
 }
 
 func (s *Service) handleSubscriptionCanceled(ctx context.Context, provider string, event *WebhookEvent) error {
@@ -327,8 +332,7 @@ func (s *Service) handleSubscriptionCanceled(ctx context.Context, provider strin
 		ProviderSubscriptionID: existing.ProviderSubscriptionID,
 	}
 
-	_, err = s.repo.UpsertSubscription(ctx, sub)
-	return err
+	return s.saveSubscription(ctx, sub)
 }
 
 func (s *Service) handlePaymentSucceeded(ctx context.Context, provider string, event *WebhookEvent) error {
@@ -379,13 +383,23 @@ func (s *Service) handlePaymentSucceeded(ctx context.Context, provider string, e
 			ProviderCustomerID:     sub.ProviderCustomerID,
 			ProviderSubscriptionID: sub.ProviderSubscriptionID,
 		}
-		_, err = s.repo.UpsertSubscription(ctx, updates)
-		return err
+		return s.saveSubscription(ctx, updates)
 	}
 
 	return nil
 }
 
+func (s *Service) saveSubscription(ctx context.Context, sub entities.Subscription) error {
+	saved, err := s.repo.UpsertSubscription(ctx, sub)
+	if err != nil {
+		return err
+	}
+	if s.onChange != nil {
+		s.onChange(saved)
+	}
+	return nil
+}
+
 func computePeriodEnd(plan entities.Plan, start time.Time) time.Time {
 	interval := plan.IntervalCount
 	if interval <= 0 {
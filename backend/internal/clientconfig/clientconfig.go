@@ -0,0 +1,136 @@
+// Package clientconfig renders a peer's WireGuard client configuration in the
+// formats different clients import: wg-quick, QR codes, the mobile apps,
+// routers and desktop network managers.
+package clientconfig
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// DefaultFormat is the wg-quick .conf format.
+const DefaultFormat = "conf"
+
+// ErrUnknownFormat is returned for a format no exporter is registered for.
+var ErrUnknownFormat = errors.New("unknown config format")
+
+// Config is a rendered-format-independent client configuration.
+type Config struct {
+	// PeerID identifies the peer; exporters derive stable identifiers from it.
+	PeerID string `json:"peer_id"`
+	Name   string `json:"name"`
+	// PrivateKey is empty when the client keeps its own private key.
+	PrivateKey      string   `json:"private_key,omitempty"`
+	Addresses       []string `json:"addresses"`
+	DNS             []string `json:"dns,omitempty"`
+	MTU             *int     `json:"mtu,omitempty"`
+	Keepalive       int      `json:"keepalive"`
+	ServerPublicKey string   `json:"server_public_key"`
+	PresharedKey    string   `json:"preshared_key,omitempty"`
+	Endpoint        string   `json:"endpoint"`
+	AllowedIPs      []string `json:"allowed_ips"`
+}
+
+// Exporter renders a Config in one client format.
+type Exporter interface {
+	// Format is the name clients pass to select the exporter.
+	Format() string
+	ContentType() string
+	// Extension is the file extension, without the dot, for downloads.
+	Extension() string
+	Export(cfg Config) ([]byte, error)
+}
+
+// Registry looks up exporters by format name.
+type Registry struct {
+	exporters map[string]Exporter
+}
+
+// NewRegistry returns a registry holding the given exporters. A later
+// exporter replaces an earlier one with the same format.
+func NewRegistry(exporters ...Exporter) *Registry {
+	r := &Registry{exporters: make(map[string]Exporter, len(exporters))}
+	for _, exporter := range exporters {
+		r.Register(exporter)
+	}
+	return r
+}
+
+// DefaultRegistry returns a registry with every built-in format.
+func DefaultRegistry() *Registry {
+	return NewRegistry(
+		WGQuick{},
+		QRSVG{},
+		MobileJSON{},
+		OpenWrt{},
+		MikroTik{},
+		NetworkManager{},
+		MobileConfig{},
+	)
+}
+
+func (r *Registry) Register(exporter Exporter) {
+	r.exporters[strings.ToLower(exporter.Format())] = exporter
+}
+
+// Get returns the exporter for format; an empty format selects DefaultFormat.
+func (r *Registry) Get(format string) (Exporter, error) {
+	format = strings.ToLower(strings.TrimSpace(format))
+	if format == "" {
+		format = DefaultFormat
+	}
+	exporter, ok := r.exporters[format]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownFormat, format)
+	}
+	return exporter, nil
+}
+
+// Formats lists the registered format names in sorted order.
+func (r *Registry) Formats() []string {
+	formats := make([]string, 0, len(r.exporters))
+	for format := range r.exporters {
+		formats = append(formats, format)
+	}
+	sort.Strings(formats)
+	return formats
+}
+
+// splitEndpoint splits host:port, accepting bracketed IPv6 hosts.
+func splitEndpoint(endpoint string) (string, int, error) {
+	host, portStr, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		return "", 0, fmt.Errorf("parse endpoint %q: %w", endpoint, err)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port <= 0 || port > 65535 {
+		return "", 0, fmt.Errorf("parse endpoint %q: invalid port", endpoint)
+	}
+	return host, port, nil
+}
+
+// splitFamilies separates IPv4 and IPv6 entries of addresses or prefixes.
+// Entries that do not parse are skipped.
+func splitFamilies(values []string) (v4, v6 []string) {
+	for _, value := range values {
+		host := value
+		if i := strings.IndexByte(host, '/'); i >= 0 {
+			host = host[:i]
+		}
+		addr, err := netip.ParseAddr(host)
+		if err != nil {
+			continue
+		}
+		if addr.Is4() {
+			v4 = append(v4, value)
+		} else {
+			v6 = append(v6, value)
+		}
+	}
+	return v4, v6
+}
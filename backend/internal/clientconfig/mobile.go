@@ -0,0 +1,62 @@
+package clientconfig
+
+import "encoding/json"
+
+// mobileDocumentVersion is bumped on incompatible changes to the document.
+const mobileDocumentVersion = 1
+
+// MobileJSON renders the document the mobile apps read through
+// packages/mobile-core (ClientConfigDocument).
+type MobileJSON struct{}
+
+type mobileDocument struct {
+	Version    int          `json:"version"`
+	PeerID     string       `json:"peerId"`
+	Name       string       `json:"name"`
+	PrivateKey string       `json:"privateKey,omitempty"`
+	Tunnel     mobileTunnel `json:"tunnel"`
+}
+
+// mobileTunnel mirrors WireGuardTunnelSpec.
+type mobileTunnel struct {
+	Address             []string `json:"address"`
+	DNS                 []string `json:"dns"`
+	Endpoint            string   `json:"endpoint"`
+	ServerPublicKey     string   `json:"serverPublicKey"`
+	PresharedKey        string   `json:"presharedKey,omitempty"`
+	AllowedIPs          []string `json:"allowedIPs"`
+	PersistentKeepalive int      `json:"persistentKeepalive"`
+	MTU                 *int     `json:"mtu,omitempty"`
+}
+
+func (MobileJSON) Format() string      { return "json" }
+func (MobileJSON) ContentType() string { return "application/json" }
+func (MobileJSON) Extension() string   { return "json" }
+
+func (MobileJSON) Export(cfg Config) ([]byte, error) {
+	doc := mobileDocument{
+		Version:    mobileDocumentVersion,
+		PeerID:     cfg.PeerID,
+		Name:       cfg.Name,
+		PrivateKey: cfg.PrivateKey,
+		Tunnel: mobileTunnel{
+			Address:             nonNil(cfg.Addresses),
+			DNS:                 nonNil(cfg.DNS),
+			Endpoint:            cfg.Endpoint,
+			ServerPublicKey:     cfg.ServerPublicKey,
+			PresharedKey:        cfg.PresharedKey,
+			AllowedIPs:          nonNil(cfg.AllowedIPs),
+			PersistentKeepalive: cfg.Keepalive,
+			MTU:                 cfg.MTU,
+		},
+	}
+	return json.MarshalIndent(doc, "", "  ")
+}
+
+// nonNil keeps empty lists as [] rather than null in JSON.
+func nonNil(values []string) []string {
+	if values == nil {
+		return []string{}
+	}
+	return values
+}
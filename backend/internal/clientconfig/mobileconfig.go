@@ -0,0 +1,86 @@
+package clientconfig
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+const (
+	mobileConfigIdentifier = "com.vpntridot.peer"
+	// wireGuardBundleID is the VPNSubType of the WireGuard iOS app; the macOS
+	// app accepts the same profile.
+	wireGuardBundleID = "com.wireguard.ios"
+)
+
+// MobileConfig renders an Apple configuration profile that installs the
+// tunnel into the WireGuard app on iOS and macOS. Identifiers derive from the
+// peer id, so installing a newer profile replaces the previous one.
+type MobileConfig struct{}
+
+func (MobileConfig) Format() string      { return "mobileconfig" }
+func (MobileConfig) ContentType() string { return "application/x-apple-aspen-config" }
+func (MobileConfig) Extension() string   { return "mobileconfig" }
+
+func (MobileConfig) Export(cfg Config) ([]byte, error) {
+	host, _, err := splitEndpoint(cfg.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	base, err := uuid.Parse(cfg.PeerID)
+	if err != nil {
+		return nil, fmt.Errorf("mobileconfig needs the peer id: %w", err)
+	}
+	profileUUID := uuid.NewSHA1(base, []byte("profile")).String()
+	payloadUUID := uuid.NewSHA1(base, []byte("vpn")).String()
+	identifier := mobileConfigIdentifier + "." + base.String()
+
+	name := cfg.Name
+	if name == "" {
+		name = "WireGuard"
+	}
+
+	var b bytes.Buffer
+	b.WriteString(xml.Header)
+	b.WriteString(`<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">` + "\n")
+	b.WriteString(`<plist version="1.0">` + "\n<dict>\n")
+	b.WriteString("<key>PayloadContent</key>\n<array>\n<dict>\n")
+	plistString(&b, "PayloadDisplayName", "VPN")
+	plistString(&b, "PayloadType", "com.apple.vpn.managed")
+	plistInteger(&b, "PayloadVersion", 1)
+	plistString(&b, "PayloadIdentifier", identifier+".vpn")
+	plistString(&b, "PayloadUUID", payloadUUID)
+	plistString(&b, "UserDefinedName", name)
+	plistString(&b, "VPNType", "VPN")
+	plistString(&b, "VPNSubType", wireGuardBundleID)
+	b.WriteString("<key>VendorConfig</key>\n<dict>\n")
+	plistString(&b, "WgQuickConfig", RenderWGQuick(cfg))
+	b.WriteString("</dict>\n")
+	b.WriteString("<key>VPN</key>\n<dict>\n")
+	plistString(&b, "RemoteAddress", host)
+	plistString(&b, "AuthenticationMethod", "Password")
+	b.WriteString("</dict>\n")
+	b.WriteString("</dict>\n</array>\n")
+	plistString(&b, "PayloadDisplayName", name)
+	plistString(&b, "PayloadIdentifier", identifier)
+	plistString(&b, "PayloadType", "Configuration")
+	plistString(&b, "PayloadUUID", profileUUID)
+	plistInteger(&b, "PayloadVersion", 1)
+	b.WriteString("</dict>\n</plist>\n")
+	return b.Bytes(), nil
+}
+
+// plistEscaper escapes XML markup but keeps newlines literal, so the
+// embedded wg-quick config stays readable.
+var plistEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+func plistString(b *bytes.Buffer, key, value string) {
+	fmt.Fprintf(b, "<key>%s</key>\n<string>%s</string>\n", key, plistEscaper.Replace(value))
+}
+
+func plistInteger(b *bytes.Buffer, key string, value int) {
+	fmt.Fprintf(b, "<key>%s</key>\n<integer>%d</integer>\n", key, value)
+}
@@ -0,0 +1,83 @@
+package clientconfig
+
+import (
+	"fmt"
+	"strings"
+)
+
+const networkManagerInterface = "wg-tridot"
+
+// NetworkManager renders a keyfile for /etc/NetworkManager/system-connections.
+// NetworkManager ignores keyfiles that are not owned by root with mode 0600.
+type NetworkManager struct{}
+
+func (NetworkManager) Format() string      { return "networkmanager" }
+func (NetworkManager) ContentType() string { return "text/plain; charset=utf-8" }
+func (NetworkManager) Extension() string   { return "nmconnection" }
+
+func (NetworkManager) Export(cfg Config) ([]byte, error) {
+	var sb strings.Builder
+
+	sb.WriteString("[connection]\n")
+	fmt.Fprintf(&sb, "id=%s\n", keyfileEscape(cfg.Name))
+	if cfg.PeerID != "" {
+		fmt.Fprintf(&sb, "uuid=%s\n", cfg.PeerID)
+	}
+	sb.WriteString("type=wireguard\n")
+	fmt.Fprintf(&sb, "interface-name=%s\n", networkManagerInterface)
+	sb.WriteString("autoconnect=false\n")
+
+	sb.WriteString("\n[wireguard]\n")
+	if cfg.PrivateKey != "" {
+		fmt.Fprintf(&sb, "private-key=%s\n", cfg.PrivateKey)
+	}
+	if cfg.MTU != nil {
+		fmt.Fprintf(&sb, "mtu=%d\n", *cfg.MTU)
+	}
+
+	fmt.Fprintf(&sb, "\n[wireguard-peer.%s]\n", cfg.ServerPublicKey)
+	fmt.Fprintf(&sb, "endpoint=%s\n", cfg.Endpoint)
+	if cfg.PresharedKey != "" {
+		fmt.Fprintf(&sb, "preshared-key=%s\n", cfg.PresharedKey)
+		sb.WriteString("preshared-key-flags=0\n")
+	}
+	fmt.Fprintf(&sb, "persistent-keepalive=%d\n", cfg.Keepalive)
+	fmt.Fprintf(&sb, "allowed-ips=%s\n", keyfileList(cfg.AllowedIPs))
+
+	addr4, addr6 := splitFamilies(cfg.Addresses)
+	dns4, dns6 := splitFamilies(cfg.DNS)
+	writeKeyfileIP(&sb, "ipv4", addr4, dns4)
+	writeKeyfileIP(&sb, "ipv6", addr6, dns6)
+
+	return []byte(sb.String()), nil
+}
+
+func writeKeyfileIP(sb *strings.Builder, section string, addresses, dns []string) {
+	fmt.Fprintf(sb, "\n[%s]\n", section)
+	if len(addresses) == 0 {
+		sb.WriteString("method=disabled\n")
+		return
+	}
+	sb.WriteString("method=manual\n")
+	for i, address := range addresses {
+		fmt.Fprintf(sb, "address%d=%s\n", i+1, address)
+	}
+	if len(dns) > 0 {
+		fmt.Fprintf(sb, "dns=%s\n", keyfileList(dns))
+		// Route every DNS lookup through the tunnel's servers.
+		sb.WriteString("dns-search=~;\n")
+	}
+}
+
+// keyfileList renders a GKeyFile list, which is ';' terminated.
+func keyfileList(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	return strings.Join(values, ";") + ";"
+}
+
+func keyfileEscape(value string) string {
+	replacer := strings.NewReplacer(`\`, `\\`, "\n", `\n`, "\t", `\t`, "\r", `\r`)
+	return replacer.Replace(value)
+}
@@ -0,0 +1,45 @@
+package clientconfig
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/boombuler/barcode/qr"
+)
+
+// qrQuietZone is the blank border, in modules, scanners need around a code.
+const qrQuietZone = 4
+
+// QRSVG renders the wg-quick config as an SVG QR code for the mobile apps'
+// "scan from QR code" import.
+type QRSVG struct{}
+
+func (QRSVG) Format() string      { return "qr-svg" }
+func (QRSVG) ContentType() string { return "image/svg+xml" }
+func (QRSVG) Extension() string   { return "svg" }
+
+func (QRSVG) Export(cfg Config) ([]byte, error) {
+	code, err := qr.Encode(RenderWGQuick(cfg), qr.M, qr.Auto)
+	if err != nil {
+		return nil, fmt.Errorf("generate qr: %w", err)
+	}
+
+	bounds := code.Bounds()
+	size := bounds.Dx() + 2*qrQuietZone
+	var path strings.Builder
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if r, _, _, _ := code.At(x, y).RGBA(); r != 0 {
+				continue
+			}
+			fmt.Fprintf(&path, "M%d %dh1v1h-1z", x-bounds.Min.X+qrQuietZone, y-bounds.Min.Y+qrQuietZone)
+		}
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %d %d" width="256" height="256" shape-rendering="crispEdges">`, size, size)
+	sb.WriteString(`<rect width="100%" height="100%" fill="#ffffff"/>`)
+	fmt.Fprintf(&sb, `<path fill="#000000" d="%s"/>`, path.String())
+	sb.WriteString("</svg>\n")
+	return []byte(sb.String()), nil
+}
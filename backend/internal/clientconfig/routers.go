@@ -0,0 +1,120 @@
+package clientconfig
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	// openWrtInterface is the UCI network section; UCI names only allow
+	// letters, digits and underscores.
+	openWrtInterface  = "wg_tridot"
+	mikroTikInterface = "wg-tridot"
+)
+
+// OpenWrt renders UCI batch commands for /etc/config/network, applied with
+// `uci batch < file && uci commit network`.
+type OpenWrt struct{}
+
+func (OpenWrt) Format() string      { return "openwrt" }
+func (OpenWrt) ContentType() string { return "text/plain; charset=utf-8" }
+func (OpenWrt) Extension() string   { return "uci" }
+
+func (OpenWrt) Export(cfg Config) ([]byte, error) {
+	host, port, err := splitEndpoint(cfg.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	iface := "network." + openWrtInterface
+	peer := "network." + openWrtInterface + "_server"
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "set %s=interface\n", iface)
+	fmt.Fprintf(&sb, "set %s.proto='wireguard'\n", iface)
+	if cfg.PrivateKey != "" {
+		fmt.Fprintf(&sb, "set %s.private_key=%s\n", iface, uciQuote(cfg.PrivateKey))
+	}
+	for _, address := range cfg.Addresses {
+		fmt.Fprintf(&sb, "add_list %s.addresses=%s\n", iface, uciQuote(address))
+	}
+	for _, dns := range cfg.DNS {
+		fmt.Fprintf(&sb, "add_list %s.dns=%s\n", iface, uciQuote(dns))
+	}
+	if cfg.MTU != nil {
+		fmt.Fprintf(&sb, "set %s.mtu='%d'\n", iface, *cfg.MTU)
+	}
+
+	fmt.Fprintf(&sb, "set %s=wireguard_%s\n", peer, openWrtInterface)
+	fmt.Fprintf(&sb, "set %s.description=%s\n", peer, uciQuote(cfg.Name))
+	fmt.Fprintf(&sb, "set %s.public_key=%s\n", peer, uciQuote(cfg.ServerPublicKey))
+	if cfg.PresharedKey != "" {
+		fmt.Fprintf(&sb, "set %s.preshared_key=%s\n", peer, uciQuote(cfg.PresharedKey))
+	}
+	fmt.Fprintf(&sb, "set %s.endpoint_host=%s\n", peer, uciQuote(host))
+	fmt.Fprintf(&sb, "set %s.endpoint_port='%d'\n", peer, port)
+	fmt.Fprintf(&sb, "set %s.persistent_keepalive='%d'\n", peer, cfg.Keepalive)
+	fmt.Fprintf(&sb, "set %s.route_allowed_ips='1'\n", peer)
+	for _, allowed := range cfg.AllowedIPs {
+		fmt.Fprintf(&sb, "add_list %s.allowed_ips=%s\n", peer, uciQuote(allowed))
+	}
+	return []byte(sb.String()), nil
+}
+
+// uciQuote single-quotes a UCI value; embedded quotes close and reopen it.
+func uciQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
+
+// MikroTik renders a RouterOS v7 script, imported with `/import file=...`.
+// DNS servers are left as a comment since they are router-wide settings.
+type MikroTik struct{}
+
+func (MikroTik) Format() string      { return "mikrotik" }
+func (MikroTik) ContentType() string { return "text/plain; charset=utf-8" }
+func (MikroTik) Extension() string   { return "rsc" }
+
+func (MikroTik) Export(cfg Config) ([]byte, error) {
+	host, port, err := splitEndpoint(cfg.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "# %s\n", strings.ReplaceAll(cfg.Name, "\n", " "))
+	fmt.Fprintf(&sb, "/interface wireguard add name=%s", mikroTikInterface)
+	if cfg.PrivateKey != "" {
+		fmt.Fprintf(&sb, " private-key=%s", routerOSQuote(cfg.PrivateKey))
+	}
+	if cfg.MTU != nil {
+		fmt.Fprintf(&sb, " mtu=%d", *cfg.MTU)
+	}
+	sb.WriteString("\n")
+
+	fmt.Fprintf(&sb, "/interface wireguard peers add interface=%s public-key=%s", mikroTikInterface, routerOSQuote(cfg.ServerPublicKey))
+	if cfg.PresharedKey != "" {
+		fmt.Fprintf(&sb, " preshared-key=%s", routerOSQuote(cfg.PresharedKey))
+	}
+	fmt.Fprintf(&sb, " endpoint-address=%s endpoint-port=%d", routerOSQuote(host), port)
+	fmt.Fprintf(&sb, " allowed-address=%s persistent-keepalive=%ds", strings.Join(cfg.AllowedIPs, ","), cfg.Keepalive)
+	fmt.Fprintf(&sb, " comment=%s\n", routerOSQuote(cfg.Name))
+
+	v4, v6 := splitFamilies(cfg.Addresses)
+	for _, address := range v4 {
+		fmt.Fprintf(&sb, "/ip address add address=%s interface=%s\n", address, mikroTikInterface)
+	}
+	for _, address := range v6 {
+		fmt.Fprintf(&sb, "/ipv6 address add address=%s interface=%s advertise=no\n", address, mikroTikInterface)
+	}
+	if len(cfg.DNS) > 0 {
+		fmt.Fprintf(&sb, "# DNS: /ip dns set servers=%s\n", strings.Join(cfg.DNS, ","))
+	}
+	return []byte(sb.String()), nil
+}
+
+// routerOSQuote double-quotes a RouterOS string, escaping its special
+// characters.
+func routerOSQuote(value string) string {
+	replacer := strings.NewReplacer(`\`, `\\`, `"`, `\"`, `$`, `\$`, "\n", `\n`)
+	return `"` + replacer.Replace(value) + `"`
+}
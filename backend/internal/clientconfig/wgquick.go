@@ -0,0 +1,48 @@
+package clientconfig
+
+import (
+	"fmt"
+	"strings"
+)
+
+// WGQuick renders the wg-quick INI format understood by the official
+// WireGuard apps.
+type WGQuick struct{}
+
+func (WGQuick) Format() string      { return DefaultFormat }
+func (WGQuick) ContentType() string { return "text/plain; charset=utf-8" }
+func (WGQuick) Extension() string   { return "conf" }
+
+func (WGQuick) Export(cfg Config) ([]byte, error) {
+	return []byte(RenderWGQuick(cfg)), nil
+}
+
+// RenderWGQuick returns the wg-quick text for cfg.
+func RenderWGQuick(cfg Config) string {
+	var sb strings.Builder
+
+	sb.WriteString("[Interface]\n")
+	if cfg.PrivateKey != "" {
+		sb.WriteString(fmt.Sprintf("PrivateKey = %s\n", cfg.PrivateKey))
+	}
+	if len(cfg.Addresses) > 0 {
+		sb.WriteString(fmt.Sprintf("Address = %s\n", strings.Join(cfg.Addresses, ", ")))
+	}
+	if len(cfg.DNS) > 0 {
+		sb.WriteString(fmt.Sprintf("DNS = %s\n", strings.Join(cfg.DNS, ",")))
+	}
+	if cfg.MTU != nil {
+		sb.WriteString(fmt.Sprintf("MTU = %d\n", *cfg.MTU))
+	}
+	sb.WriteString(fmt.Sprintf("PersistentKeepalive = %d\n", cfg.Keepalive))
+
+	sb.WriteString("\n[Peer]\n")
+	sb.WriteString(fmt.Sprintf("PublicKey = %s\n", cfg.ServerPublicKey))
+	if cfg.PresharedKey != "" {
+		sb.WriteString(fmt.Sprintf("PresharedKey = %s\n", cfg.PresharedKey))
+	}
+	sb.WriteString(fmt.Sprintf("Endpoint = %s\n", cfg.Endpoint))
+	sb.WriteString(fmt.Sprintf("AllowedIPs = %s\n", strings.Join(cfg.AllowedIPs, ", ")))
+
+	return sb.String()
+}
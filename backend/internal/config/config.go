@@ -3,6 +3,8 @@ package config
 import (
 	"errors"
 	"fmt"
+	"net/netip"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
@@ -19,6 +21,7 @@ type Config struct {
 	RateLimit     RateLimitConfig
 	Billing       BillingConfig
 	Node          NodeConfig
+	Peers         PeersConfig
 	Security      SecurityConfig
 	Observability ObservabilityConfig
 }
@@ -34,6 +37,9 @@ type HTTPConfig struct {
 	ReadTimeout     time.Duration
 	WriteTimeout    time.Duration
 	ShutdownTimeout time.Duration
+	// TLSCertFile and TLSKeyFile make the API serve HTTPS itself.
+	TLSCertFile string
+	TLSKeyFile  string
 }
 
 type LogConfig struct {
@@ -104,10 +110,57 @@ type BillingConfig struct {
 	DefaultCurrency string
 	Stripe          StripeConfig
 	Iyzico          IyzicoConfig
+	// GracePeriod is how long peers stay active after a subscription lapses.
+	GracePeriod time.Duration
+	// LifecycleInterval is how often peer status is reconciled with
+	// subscriptions.
+	LifecycleInterval time.Duration
 }
 
 type NodeConfig struct {
 	ProvisionToken string
+	// StreamPingInterval is how often idle node streams are pinged.
+	StreamPingInterval time.Duration
+	// StreamPollInterval is pushed to nodes with a connected stream as
+	// their peer poll interval; zero leaves their own interval in place.
+	StreamPollInterval time.Duration
+	Identity           NodeIdentityConfig
+}
+
+// NodeIdentityConfig binds node records to mTLS client certificates.
+type NodeIdentityConfig struct {
+	// ClientCAFile holds the CAs node certificates must chain to. Setting it
+	// makes every node endpoint require the certificate the node is bound to.
+	ClientCAFile string
+	// CertHeader names the header a TLS-terminating proxy forwards the
+	// client certificate in (URL-encoded PEM). Empty means the API
+	// terminates TLS itself.
+	CertHeader string
+	// TrustedProxies are the addresses CertHeader is accepted from. Requests
+	// from anywhere else are rejected, so clients cannot forge the header
+	// by reaching the API around the proxy.
+	TrustedProxies []netip.Prefix
+	// TrustDomain binds nodes by the SPIFFE ID
+	// spiffe://<trust domain>/node/<hostname> instead of the certificate
+	// fingerprint.
+	TrustDomain string
+}
+
+type PeersConfig struct {
+	// ConfigTTL is how long config tokens and download links stay valid.
+	ConfigTTL time.Duration
+	// ConfigLinkSecret signs public config download links; without it
+	// only the authenticated download is available.
+	ConfigLinkSecret string
+	// PublicBaseURL is the externally reachable API origin links point at.
+	PublicBaseURL  string
+	DeepLinkScheme string
+	// ConfigPurgeInterval is how often configs of used or expired tokens
+	// are wiped.
+	ConfigPurgeInterval time.Duration
+	// GeoIPFile is a "prefix,country" CIDR list backing the
+	// exclude_country routing preset; empty disables the preset.
+	GeoIPFile string
 }
 
 type StripeConfig struct {
@@ -129,6 +182,8 @@ type SecurityConfig struct {
 	CSRF     CSRFConfig
 	Secrets  SecretsConfig
 	Admin    AdminSecurityConfig
+
+	FieldEncryption FieldEncryptionConfig
 }
 
 type HCaptchaConfig struct {
@@ -161,6 +216,20 @@ type SecretsConfig struct {
 	Vault VaultConfig
 }
 
+// FieldEncryptionConfig configures encryption of secrets stored in Postgres.
+type FieldEncryptionConfig struct {
+	// Keys is "id:base64key,..." with 32-byte keys, normally provided by
+	// the SOPS or Vault secrets; empty leaves the fields in plaintext.
+	Keys string
+	// PrimaryKey is the id new values are sealed with; it may be omitted
+	// when there is a single key.
+	PrimaryKey string
+	// ReencryptInterval is how often values sealed with other keys, or
+	// still in plaintext, are sealed with the primary key.
+	ReencryptInterval  time.Duration
+	ReencryptBatchSize int
+}
+
 type AdminSecurityConfig struct {
 	IPAllowlist []string
 }
@@ -216,6 +285,8 @@ func Load() (Config, error) {
 	cfg.HTTP.ReadTimeout = readTimeout
 	cfg.HTTP.WriteTimeout = writeTimeout
 	cfg.HTTP.ShutdownTimeout = shutdownTimeout
+	cfg.HTTP.TLSCertFile = getEnv("HTTP_TLS_CERT_FILE", "")
+	cfg.HTTP.TLSKeyFile = getEnv("HTTP_TLS_KEY_FILE", "")
 
 	cfg.Log.Level = getEnv("LOG_LEVEL", "info")
 	logRequestsEnabled, err := boolFromEnv("LOG_REQUESTS_ENABLED", true)
@@ -311,8 +382,46 @@ func Load() (Config, error) {
 	cfg.Billing.Iyzico.APIKey = getEnv("IYZICO_API_KEY", "")
 	cfg.Billing.Iyzico.SecretKey = getEnv("IYZICO_SECRET_KEY", "")
 	cfg.Billing.Iyzico.BaseURL = getEnv("IYZICO_BASE_URL", "")
+	cfg.Billing.GracePeriod, err = durationFromEnv("BILLING_GRACE_PERIOD", 72*time.Hour)
+	if err != nil {
+		return Config{}, fmt.Errorf("parse BILLING_GRACE_PERIOD: %w", err)
+	}
+	cfg.Billing.LifecycleInterval, err = durationFromEnv("BILLING_LIFECYCLE_INTERVAL", 5*time.Minute)
+	if err != nil {
+		return Config{}, fmt.Errorf("parse BILLING_LIFECYCLE_INTERVAL: %w", err)
+	}
 
 	cfg.Node.ProvisionToken = getEnv("NODE_PROVISION_TOKEN", "")
+	cfg.Node.Identity = NodeIdentityConfig{
+		ClientCAFile: getEnv("NODE_CLIENT_CA_FILE", ""),
+		CertHeader:   getEnv("NODE_CLIENT_CERT_HEADER", ""),
+		TrustDomain:  getEnv("NODE_SPIFFE_TRUST_DOMAIN", ""),
+	}
+	cfg.Node.Identity.TrustedProxies, err = prefixesFromEnv("NODE_CLIENT_CERT_TRUSTED_PROXIES")
+	if err != nil {
+		return Config{}, fmt.Errorf("parse NODE_CLIENT_CERT_TRUSTED_PROXIES: %w", err)
+	}
+	cfg.Node.StreamPingInterval, err = durationFromEnv("NODE_STREAM_PING_INTERVAL", 30*time.Second)
+	if err != nil {
+		return Config{}, fmt.Errorf("parse NODE_STREAM_PING_INTERVAL: %w", err)
+	}
+	cfg.Node.StreamPollInterval, err = durationFromEnv("NODE_STREAM_POLL_INTERVAL", 2*time.Minute)
+	if err != nil {
+		return Config{}, fmt.Errorf("parse NODE_STREAM_POLL_INTERVAL: %w", err)
+	}
+
+	cfg.Peers.ConfigTTL, err = durationFromEnv("PEER_CONFIG_TTL", 24*time.Hour)
+	if err != nil {
+		return Config{}, fmt.Errorf("parse PEER_CONFIG_TTL: %w", err)
+	}
+	cfg.Peers.ConfigLinkSecret = getEnv("PEER_CONFIG_LINK_SECRET", "")
+	cfg.Peers.PublicBaseURL = strings.TrimSuffix(getEnv("PUBLIC_API_URL", ""), "/")
+	cfg.Peers.DeepLinkScheme = getEnv("PEER_CONFIG_DEEP_LINK_SCHEME", "tridot")
+	cfg.Peers.ConfigPurgeInterval, err = durationFromEnv("PEER_CONFIG_PURGE_INTERVAL", 15*time.Minute)
+	if err != nil {
+		return Config{}, fmt.Errorf("parse PEER_CONFIG_PURGE_INTERVAL: %w", err)
+	}
+	cfg.Peers.GeoIPFile = getEnv("ROUTING_GEOIP_FILE", "")
 
 	hCaptchaEnabled, err := boolFromEnv("HCAPTCHA_ENABLED", false)
 	if err != nil {
@@ -391,6 +500,17 @@ func Load() (Config, error) {
 	}
 	cfg.Security.Secrets.Vault.TLSSkipVerify = tlsSkip
 
+	cfg.Security.FieldEncryption.Keys = getEnv("FIELD_ENCRYPTION_KEYS", "")
+	cfg.Security.FieldEncryption.PrimaryKey = getEnv("FIELD_ENCRYPTION_PRIMARY_KEY", "")
+	cfg.Security.FieldEncryption.ReencryptInterval, err = durationFromEnv("FIELD_ENCRYPTION_REENCRYPT_INTERVAL", time.Hour)
+	if err != nil {
+		return Config{}, fmt.Errorf("parse FIELD_ENCRYPTION_REENCRYPT_INTERVAL: %w", err)
+	}
+	cfg.Security.FieldEncryption.ReencryptBatchSize, err = intFromEnv("FIELD_ENCRYPTION_REENCRYPT_BATCH", 500)
+	if err != nil {
+		return Config{}, fmt.Errorf("parse FIELD_ENCRYPTION_REENCRYPT_BATCH: %w", err)
+	}
+
 	metricsEnabled, err := boolFromEnv("METRICS_ENABLED", true)
 	if err != nil {
 		return Config{}, fmt.Errorf("parse METRICS_ENABLED: %w", err)
@@ -454,9 +574,52 @@ func validate(cfg Config) error {
 	if cfg.Billing.DefaultCurrency == "" {
 		return errors.New("billing default currency is required")
 	}
+	if cfg.Billing.GracePeriod < 0 {
+		return errors.New("billing grace period cannot be negative")
+	}
+	if cfg.Billing.LifecycleInterval <= 0 {
+		return errors.New("billing lifecycle interval must be positive")
+	}
 	if cfg.Node.ProvisionToken == "" {
 		return errors.New("node provision token is required")
 	}
+	if (cfg.HTTP.TLSCertFile == "") != (cfg.HTTP.TLSKeyFile == "") {
+		return errors.New("http tls cert and key must be set together")
+	}
+	if cfg.Node.Identity.ClientCAFile != "" && cfg.Node.Identity.CertHeader == "" && cfg.HTTP.TLSCertFile == "" {
+		return errors.New("node client ca requires http tls or a client cert header")
+	}
+	if cfg.Node.Identity.CertHeader != "" && len(cfg.Node.Identity.TrustedProxies) == 0 {
+		return errors.New("node client cert header requires trusted proxies")
+	}
+	if cfg.Node.StreamPingInterval <= 0 {
+		return errors.New("node stream ping interval must be positive")
+	}
+	if cfg.Node.StreamPollInterval < 0 {
+		return errors.New("node stream poll interval must not be negative")
+	}
+	if cfg.Peers.ConfigTTL <= 0 {
+		return errors.New("peer config ttl must be greater than zero")
+	}
+	if cfg.Peers.ConfigPurgeInterval <= 0 {
+		return errors.New("peer config purge interval must be positive")
+	}
+	if cfg.Peers.ConfigLinkSecret != "" {
+		if len(cfg.Peers.ConfigLinkSecret) < 32 {
+			return errors.New("peer config link secret must be at least 32 bytes")
+		}
+		if u, err := url.Parse(cfg.Peers.PublicBaseURL); err != nil || u.Scheme == "" || u.Host == "" {
+			return errors.New("public api url is required when config links are enabled")
+		}
+	}
+	if cfg.Security.FieldEncryption.Keys != "" {
+		if cfg.Security.FieldEncryption.ReencryptInterval <= 0 {
+			return errors.New("field re-encryption interval must be positive")
+		}
+		if cfg.Security.FieldEncryption.ReencryptBatchSize <= 0 {
+			return errors.New("field re-encryption batch size must be positive")
+		}
+	}
 	if cfg.Observability.Metrics.Enabled {
 		if cfg.Observability.Metrics.Path == "" {
 			return errors.New("metrics path is required when metrics are enabled")
@@ -610,6 +773,24 @@ func stringSliceFromEnv(key, fallback string) []string {
 	return result
 }
 
+// prefixesFromEnv parses a comma-separated list of CIDRs; a bare address
+// stands for itself.
+func prefixesFromEnv(key string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, value := range stringSliceFromEnv(key, "") {
+		if addr, err := netip.ParseAddr(value); err == nil {
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
 func upperSlice(values []string) []string {
 	if len(values) == 0 {
 		return values
@@ -16,9 +16,13 @@ type Plan struct {
 	BillingPeriod string
 	IntervalCount int
 	DeviceLimit   int
-	IsActive      bool
-	CreatedAt     time.Time
-	UpdatedAt     time.Time
+	// AllowedRegions lists the region codes the plan may use; empty allows
+	// every region. AddOns names extra features the plan unlocks.
+	AllowedRegions []string
+	AddOns         []string
+	IsActive       bool
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
 }
 
 type Subscription struct {
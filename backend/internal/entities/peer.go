@@ -25,6 +25,16 @@ type Peer struct {
 	LastHandshakeAt *time.Time
 	BytesTX         int64
 	BytesRX         int64
+	Routing         PeerRouting
+}
+
+// PeerRouting selects which destinations the client sends through the
+// tunnel. Country applies to the exclude_country preset and Exclude to the
+// custom one.
+type PeerRouting struct {
+	Preset  string   `json:"preset"`
+	Country string   `json:"country,omitempty"`
+	Exclude []string `json:"exclude,omitempty"`
 }
 
 func (p Peer) IsActive() bool {
@@ -34,3 +44,54 @@ func (p Peer) IsActive() bool {
 func stringsEqualFold(a, b string) bool {
 	return strings.EqualFold(a, b)
 }
+
+// PeerChange is the node-facing view of a peer at a given revision. Removed
+// marks peers that must no longer be configured on the node.
+type PeerChange struct {
+	PublicKey    string
+	PresharedKey *string
+	AllowedIPs   string
+	Keepalive    *int
+	// MeshGroup is set when the owner enabled the device mesh; peers with
+	// the same group may reach each other on the node.
+	MeshGroup string
+	Removed   bool
+	Revision  int64
+}
+
+// PeerStat is a raw counter sample for one peer reported by its node. Bytes
+// are counted from the node's side: RX was received from the client.
+type PeerStat struct {
+	PublicKey       string
+	RxBytes         int64
+	TxBytes         int64
+	LastHandshakeAt *time.Time
+	// Epoch identifies the device instance the counters belong to; empty
+	// when the node did not report one.
+	Epoch string
+}
+
+// PeerPlacement narrows the nodes a new peer may land on. NodeID pins one
+// node; otherwise the best active node in RegionID, or in any active region
+// when RegionID is nil, is chosen. A non-empty RegionCodes further limits the
+// candidates to those regions, and ExcludeNodeID (the current node of a peer
+// being migrated) is never chosen.
+type PeerPlacement struct {
+	NodeID        uuid.UUID
+	RegionID      uuid.UUID
+	RegionCodes   []string
+	ExcludeNodeID uuid.UUID
+}
+
+// PeerTransition records a lifecycle status change of a peer, such as a
+// revocation after its subscription lapsed.
+type PeerTransition struct {
+	PeerID         uuid.UUID
+	UserID         uuid.UUID
+	NodeID         uuid.UUID
+	SubscriptionID *uuid.UUID
+	FromStatus     string
+	ToStatus       string
+	Reason         string
+	CreatedAt      time.Time
+}
@@ -33,9 +33,21 @@ type Node struct {
 	Status        string
 	CapacityScore int
 	TunnelPort    int
-	LastSeenAt    *time.Time
-	CreatedAt     time.Time
-	UpdatedAt     time.Time
+	// TunnelAddress is the node's interface address (e.g. 10.8.0.1/24); its
+	// subnet is the pool peer addresses come from.
+	TunnelAddress string
+	// TunnelIPv6Prefix is the ULA prefix peers on this node get addresses from.
+	TunnelIPv6Prefix *string
+	IPv6Enabled      bool
+	// CertIdentity is the client certificate the node is bound to: a SPIFFE
+	// ID or "sha256:<fingerprint>". Nil until the node registers over mTLS.
+	CertIdentity *string
+	// CertName is the subject and SANs of the bound certificate; a renewed
+	// certificate with the same name may re-bind the node.
+	CertName   *string
+	LastSeenAt *time.Time
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
 }
 
 type NodeHealth struct {
@@ -44,3 +56,18 @@ type NodeHealth struct {
 	ThroughputMbps  float64
 	PacketLossRatio float64
 }
+
+// Node event types published when a node's desired state changes.
+const (
+	NodeEventPeers = "peers"
+	NodeEventDrain = "drain"
+)
+
+// NodeEvent is a change to a node's desired state: a new peer revision
+// (Revision) or a status change (Drain is true unless the node is active).
+type NodeEvent struct {
+	NodeID   uuid.UUID
+	Type     string
+	Revision int64
+	Drain    bool
+}
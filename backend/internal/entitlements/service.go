@@ -0,0 +1,100 @@
+package entitlements
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+
+	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/entities"
+)
+
+var (
+	ErrNoActiveSubscription = errors.New("active subscription required")
+	ErrRegionNotAllowed     = errors.New("region not included in plan")
+)
+
+// Repository loads the subscription a user's entitlements derive from.
+type Repository interface {
+	// GetActiveSubscription returns the user's trialing or active
+	// subscription and its plan, or pgx.ErrNoRows.
+	GetActiveSubscription(ctx context.Context, userID uuid.UUID) (entities.Subscription, entities.Plan, error)
+}
+
+// Entitlements is what a user's current plan allows.
+type Entitlements struct {
+	UserID             uuid.UUID
+	PlanCode           string
+	SubscriptionStatus string
+	PeriodEnd          time.Time
+	DeviceLimit        int
+	// Regions lists allowed region codes; empty allows every region.
+	Regions []string
+	AddOns  []string
+}
+
+// AllowsRegion reports whether the plan may use the region.
+func (e Entitlements) AllowsRegion(code string) bool {
+	if len(e.Regions) == 0 {
+		return true
+	}
+	for _, allowed := range e.Regions {
+		if strings.EqualFold(allowed, code) {
+			return true
+		}
+	}
+	return false
+}
+
+// HasAddOn reports whether the plan unlocks the named add-on.
+func (e Entitlements) HasAddOn(name string) bool {
+	for _, addOn := range e.AddOns {
+		if strings.EqualFold(addOn, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Service resolves entitlements from the user's subscription. Nothing is
+// cached, so plan and subscription changes apply to the next request.
+type Service struct {
+	repo Repository
+}
+
+func NewService(repo Repository) *Service {
+	return &Service{repo: repo}
+}
+
+// Resolve returns the user's entitlements, or ErrNoActiveSubscription when
+// the user has no trialing or active subscription.
+func (s *Service) Resolve(ctx context.Context, userID uuid.UUID) (Entitlements, error) {
+	if userID == uuid.Nil {
+		return Entitlements{}, errors.New("user id required")
+	}
+
+	sub, plan, err := s.repo.GetActiveSubscription(ctx, userID)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return Entitlements{}, ErrNoActiveSubscription
+		}
+		return Entitlements{}, err
+	}
+
+	regions := make([]string, 0, len(plan.AllowedRegions))
+	for _, code := range plan.AllowedRegions {
+		regions = append(regions, strings.ToUpper(code))
+	}
+	return Entitlements{
+		UserID:             userID,
+		PlanCode:           plan.Code,
+		SubscriptionStatus: sub.Status,
+		PeriodEnd:          sub.CurrentPeriodEnd,
+		DeviceLimit:        plan.DeviceLimit,
+		Regions:            regions,
+		AddOns:             plan.AddOns,
+	}, nil
+}
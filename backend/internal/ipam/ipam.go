@@ -0,0 +1,184 @@
+// Package ipam assigns peer tunnel addresses from a node's address pool.
+package ipam
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// DefaultNodeAddress is the tunnel address assumed for nodes that do not
+// report their own. The pool is its subnet.
+const DefaultNodeAddress = "10.8.0.1/24"
+
+var (
+	ErrOutOfPool     = errors.New("address outside node pool")
+	ErrReserved      = errors.New("address reserved")
+	ErrAddressInUse  = errors.New("address already assigned")
+	ErrPoolExhausted = errors.New("address pool exhausted")
+)
+
+// Pool is a node's IPv4 tunnel subnet plus, on IPv6 enabled nodes, its /64.
+// The network, broadcast and node addresses are never handed out.
+type Pool struct {
+	node    netip.Prefix
+	prefix  netip.Prefix
+	prefix6 netip.Prefix
+}
+
+// NewPool builds a pool from the node's interface address (e.g. 10.8.0.1/24)
+// and an optional IPv6 tunnel prefix.
+func NewPool(nodeAddress, ipv6Prefix string) (Pool, error) {
+	node, err := netip.ParsePrefix(nodeAddress)
+	if err != nil || !node.Addr().Is4() {
+		return Pool{}, fmt.Errorf("invalid node tunnel address %q", nodeAddress)
+	}
+	if node.Bits() > 30 {
+		return Pool{}, fmt.Errorf("node tunnel address %q leaves no room for peers", nodeAddress)
+	}
+	pool := Pool{node: node, prefix: node.Masked()}
+	if ipv6Prefix != "" {
+		prefix6, err := netip.ParsePrefix(ipv6Prefix)
+		if err != nil || !prefix6.Addr().Is6() || prefix6.Bits() > 96 {
+			return Pool{}, fmt.Errorf("invalid node ipv6 prefix %q", ipv6Prefix)
+		}
+		pool.prefix6 = prefix6.Masked()
+	}
+	return pool, nil
+}
+
+// Prefix returns the IPv4 subnet addresses are assigned from.
+func (p Pool) Prefix() netip.Prefix { return p.prefix }
+
+// Prefix6 returns the IPv6 tunnel prefix; it is invalid for IPv4-only pools.
+func (p Pool) Prefix6() netip.Prefix { return p.prefix6 }
+
+// NodeAddress returns the node's own tunnel address.
+func (p Pool) NodeAddress() netip.Addr { return p.node.Addr() }
+
+// Check reports whether addr may be assigned to a peer.
+func (p Pool) Check(addr netip.Addr) error {
+	if addr.Is6() {
+		if !p.prefix6.IsValid() || !p.prefix6.Contains(addr) {
+			return fmt.Errorf("%w: %s", ErrOutOfPool, addr)
+		}
+		if addr == p.prefix6.Addr() || addr == p.ipv6For(p.node.Addr()) {
+			return fmt.Errorf("%w: %s", ErrReserved, addr)
+		}
+		return nil
+	}
+	if !p.prefix.Contains(addr) {
+		return fmt.Errorf("%w: %s", ErrOutOfPool, addr)
+	}
+	if addr == p.prefix.Addr() || addr == p.broadcast() || addr == p.node.Addr() {
+		return fmt.Errorf("%w: %s", ErrReserved, addr)
+	}
+	return nil
+}
+
+// Assignment is the address pair handed to one peer.
+type Assignment struct {
+	IPv4 netip.Addr
+	IPv6 netip.Addr
+}
+
+// String renders the assignment in the peer's AllowedIPs format.
+func (a Assignment) String() string {
+	out := netip.PrefixFrom(a.IPv4, 32).String()
+	if a.IPv6.IsValid() {
+		out += ", " + netip.PrefixFrom(a.IPv6, 128).String()
+	}
+	return out
+}
+
+// Addrs lists the assigned addresses.
+func (a Assignment) Addrs() []netip.Addr {
+	if a.IPv6.IsValid() {
+		return []netip.Addr{a.IPv4, a.IPv6}
+	}
+	return []netip.Addr{a.IPv4}
+}
+
+// Assign picks the lowest free IPv4 address when requested is empty, or
+// validates a requested "a.b.c.d/32[, v6/128]" list otherwise. On IPv6 nodes
+// the /128 embeds the IPv4 address unless one was requested explicitly.
+func (p Pool) Assign(requested string, used []netip.Addr) (Assignment, error) {
+	taken := make(map[netip.Addr]bool, len(used))
+	for _, addr := range used {
+		taken[addr] = true
+	}
+
+	var out Assignment
+	if strings.TrimSpace(requested) == "" {
+		addr, err := p.next(taken)
+		if err != nil {
+			return Assignment{}, err
+		}
+		out.IPv4 = addr
+	} else {
+		for _, part := range strings.Split(requested, ",") {
+			prefix, err := netip.ParsePrefix(strings.TrimSpace(part))
+			if err != nil {
+				return Assignment{}, fmt.Errorf("invalid allowed ip %q: %w", part, err)
+			}
+			if prefix.Bits() != prefix.Addr().BitLen() {
+				return Assignment{}, fmt.Errorf("allowed ip %s must be a single address", prefix)
+			}
+			addr := prefix.Addr()
+			if err := p.Check(addr); err != nil {
+				return Assignment{}, err
+			}
+			if taken[addr] {
+				return Assignment{}, fmt.Errorf("%w: %s", ErrAddressInUse, addr)
+			}
+			switch {
+			case addr.Is4() && !out.IPv4.IsValid():
+				out.IPv4 = addr
+			case addr.Is6() && !out.IPv6.IsValid():
+				out.IPv6 = addr
+			default:
+				return Assignment{}, fmt.Errorf("allowed ips %q: one address per family", requested)
+			}
+		}
+		if !out.IPv4.IsValid() {
+			return Assignment{}, fmt.Errorf("allowed ips %q: ipv4 address required", requested)
+		}
+	}
+
+	if p.prefix6.IsValid() && !out.IPv6.IsValid() {
+		out.IPv6 = p.ipv6For(out.IPv4)
+		if taken[out.IPv6] {
+			return Assignment{}, fmt.Errorf("%w: %s", ErrAddressInUse, out.IPv6)
+		}
+	}
+	return out, nil
+}
+
+func (p Pool) next(taken map[netip.Addr]bool) (netip.Addr, error) {
+	last := p.broadcast()
+	for addr := p.prefix.Addr().Next(); addr.IsValid() && addr.Less(last); addr = addr.Next() {
+		if addr == p.node.Addr() || taken[addr] {
+			continue
+		}
+		return addr, nil
+	}
+	return netip.Addr{}, fmt.Errorf("%w: %s", ErrPoolExhausted, p.prefix)
+}
+
+func (p Pool) broadcast() netip.Addr {
+	addr := p.prefix.Addr().As4()
+	for i := p.prefix.Bits(); i < 32; i++ {
+		addr[i/8] |= 1 << (7 - i%8)
+	}
+	return netip.AddrFrom4(addr)
+}
+
+// ipv6For embeds v4 in the low 32 bits of the IPv6 prefix so both families
+// map one to one.
+func (p Pool) ipv6For(v4 netip.Addr) netip.Addr {
+	addr := p.prefix6.Addr().As16()
+	host := v4.As4()
+	copy(addr[12:], host[:])
+	return netip.AddrFrom16(addr)
+}
@@ -0,0 +1,115 @@
+// Package lifecycle keeps peer status in line with subscription state.
+package lifecycle
+
+import (
+	"context"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/config"
+	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/entities"
+)
+
+// Repository applies lifecycle transitions and records them.
+type Repository interface {
+	// RevokeLapsedPeers revokes the active peers of users whose subscription
+	// lapsed at or before lapsedBefore.
+	RevokeLapsedPeers(ctx context.Context, lapsedBefore time.Time) ([]entities.PeerTransition, error)
+	// RestoreEntitledPeers reactivates peers revoked for a lapsed
+	// subscription whose user is subscribed again.
+	RestoreEntitledPeers(ctx context.Context) ([]entities.PeerTransition, error)
+}
+
+// Result summarises one reconcile pass.
+type Result struct {
+	Revoked  []entities.PeerTransition
+	Restored []entities.PeerTransition
+}
+
+// Worker periodically revokes peers of lapsed subscriptions once the grace
+// period has passed and restores them when the subscription is active again.
+// Revoked peers drop out of their node's desired state through the regular
+// peer revision tracking.
+type Worker struct {
+	repo     Repository
+	grace    time.Duration
+	interval time.Duration
+	logger   *zap.Logger
+	now      func() time.Time
+	trigger  chan struct{}
+}
+
+func NewWorker(repo Repository, cfg config.BillingConfig, logger *zap.Logger) *Worker {
+	return &Worker{
+		repo:     repo,
+		grace:    cfg.GracePeriod,
+		interval: cfg.LifecycleInterval,
+		logger:   logger,
+		now:      time.Now,
+		trigger:  make(chan struct{}, 1),
+	}
+}
+
+// Trigger requests a reconcile pass without waiting for the next tick. It
+// never blocks; requests made while one is pending are coalesced.
+func (w *Worker) Trigger() {
+	select {
+	case w.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// Run reconciles on start, on every interval tick and on Trigger until ctx is
+// done.
+func (w *Worker) Run(ctx context.Context) {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := w.Reconcile(ctx); err != nil && ctx.Err() == nil {
+			w.logger.Error("peer lifecycle reconcile failed", zap.Error(err))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-w.trigger:
+		}
+	}
+}
+
+// Reconcile restores peers of entitled users, then revokes peers of users
+// whose subscription lapsed more than the grace period ago.
+func (w *Worker) Reconcile(ctx context.Context) (Result, error) {
+	var result Result
+
+	restored, err := w.repo.RestoreEntitledPeers(ctx)
+	if err != nil {
+		return result, err
+	}
+	result.Restored = restored
+	w.log(restored)
+
+	revoked, err := w.repo.RevokeLapsedPeers(ctx, w.now().Add(-w.grace))
+	if err != nil {
+		return result, err
+	}
+	result.Revoked = revoked
+	w.log(revoked)
+
+	return result, nil
+}
+
+func (w *Worker) log(transitions []entities.PeerTransition) {
+	for _, t := range transitions {
+		w.logger.Info("peer lifecycle transition",
+			zap.Stringer("peer_id", t.PeerID),
+			zap.Stringer("user_id", t.UserID),
+			zap.Stringer("node_id", t.NodeID),
+			zap.String("from", t.FromStatus),
+			zap.String("to", t.ToStatus),
+			zap.String("reason", t.Reason),
+		)
+	}
+}
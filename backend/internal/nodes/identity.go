@@ -0,0 +1,232 @@
+// Package nodes authenticates node agents by their mTLS client certificate.
+// A node record is bound to the certificate it first registers with, either
+// by the certificate's SHA-256 fingerprint or, with a trust domain, by its
+// SPIFFE ID (spiffe://<trust domain>/node/<hostname>), which survives
+// certificate rotation. A fingerprint-bound node moves to a renewed
+// certificate when it registers again with one carrying the same subject and
+// SANs.
+package nodes
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/config"
+)
+
+var (
+	ErrNoCertificate        = errors.New("client certificate required")
+	ErrUntrustedCertificate = errors.New("client certificate not trusted")
+	ErrIdentityMismatch     = errors.New("client certificate does not match node")
+	ErrUntrustedProxy       = errors.New("request did not come through a trusted proxy")
+)
+
+// Identity describes a verified node client certificate.
+type Identity struct {
+	// Fingerprint is "sha256:" followed by the hex SHA-256 of the certificate.
+	Fingerprint string
+	// SPIFFEID is the certificate's spiffe:// URI SAN, if it has one.
+	SPIFFEID string
+	// Name is the certificate's subject and SANs, which a renewed
+	// certificate keeps. It is empty when the certificate names nothing.
+	Name string
+}
+
+// Verifier checks node client certificates against the node CA.
+type Verifier struct {
+	roots       *x509.CertPool
+	header      string
+	proxies     []netip.Prefix
+	trustDomain string
+}
+
+// NewVerifier returns nil when no client CA is configured, which leaves node
+// endpoints authorized by the provision token alone.
+func NewVerifier(cfg config.NodeIdentityConfig) (*Verifier, error) {
+	if cfg.ClientCAFile == "" {
+		return nil, nil
+	}
+	roots, err := LoadCertPool(cfg.ClientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	return &Verifier{roots: roots, header: cfg.CertHeader, proxies: cfg.TrustedProxies, trustDomain: cfg.TrustDomain}, nil
+}
+
+// LoadCertPool reads the PEM certificates in path.
+func LoadCertPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read node client ca: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates in %s", path)
+	}
+	return pool, nil
+}
+
+// Identify verifies the client certificate of r and returns its identity.
+// Behind a TLS-terminating proxy the certificate is read from the configured
+// header, which is only accepted from the trusted proxy addresses; otherwise
+// it comes from the TLS connection.
+func (v *Verifier) Identify(r *http.Request) (Identity, error) {
+	var chain []*x509.Certificate
+	if v.header != "" {
+		if !v.fromTrustedProxy(r) {
+			return Identity{}, ErrUntrustedProxy
+		}
+		raw := r.Header.Get(v.header)
+		if raw == "" {
+			return Identity{}, ErrNoCertificate
+		}
+		parsed, err := parseCertHeader(raw)
+		if err != nil {
+			return Identity{}, fmt.Errorf("%w: %v", ErrUntrustedCertificate, err)
+		}
+		chain = parsed
+	} else if r.TLS != nil {
+		chain = r.TLS.PeerCertificates
+	}
+	if len(chain) == 0 {
+		return Identity{}, ErrNoCertificate
+	}
+
+	leaf := chain[0]
+	intermediates := x509.NewCertPool()
+	for _, cert := range chain[1:] {
+		intermediates.AddCert(cert)
+	}
+	if _, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         v.roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}); err != nil {
+		return Identity{}, fmt.Errorf("%w: %v", ErrUntrustedCertificate, err)
+	}
+	return identityOf(leaf), nil
+}
+
+func (v *Verifier) fromTrustedProxy(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range v.proxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Binding returns the identity a node registering as hostname is bound to:
+// its SPIFFE ID, which must name that hostname, when a trust domain is
+// configured, and the certificate fingerprint otherwise.
+func (v *Verifier) Binding(id Identity, hostname string) (string, error) {
+	if v.trustDomain == "" {
+		return id.Fingerprint, nil
+	}
+	want := SPIFFEID(v.trustDomain, hostname)
+	if id.SPIFFEID != want {
+		return "", fmt.Errorf("%w: expected %s", ErrIdentityMismatch, want)
+	}
+	return want, nil
+}
+
+// Matches reports whether id is the certificate a node is bound to. Unbound
+// nodes match no certificate.
+func (v *Verifier) Matches(id Identity, bound *string) bool {
+	if bound == nil {
+		return false
+	}
+	return *bound == id.Fingerprint || (id.SPIFFEID != "" && *bound == id.SPIFFEID)
+}
+
+// SPIFFEID is the ID a node certificate carries in the trust domain.
+func SPIFFEID(trustDomain, hostname string) string {
+	return (&url.URL{Scheme: "spiffe", Host: trustDomain, Path: "/node/" + hostname}).String()
+}
+
+func identityOf(cert *x509.Certificate) Identity {
+	sum := sha256.Sum256(cert.Raw)
+	id := Identity{Fingerprint: "sha256:" + hex.EncodeToString(sum[:])}
+	for _, uri := range cert.URIs {
+		if uri.Scheme == "spiffe" {
+			id.SPIFFEID = uri.String()
+			break
+		}
+	}
+	id.Name = certName(cert)
+	return id
+}
+
+// certName renders the subject and the sorted SANs of cert, e.g.
+// "CN=ist-1;dns:ist-1.example.com".
+func certName(cert *x509.Certificate) string {
+	var sans []string
+	for _, name := range cert.DNSNames {
+		sans = append(sans, "dns:"+name)
+	}
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, "ip:"+ip.String())
+	}
+	for _, uri := range cert.URIs {
+		sans = append(sans, "uri:"+uri.String())
+	}
+	for _, email := range cert.EmailAddresses {
+		sans = append(sans, "email:"+email)
+	}
+	subject := cert.Subject.String()
+	if subject == "" && len(sans) == 0 {
+		return ""
+	}
+	sort.Strings(sans)
+	return strings.Join(append([]string{subject}, sans...), ";")
+}
+
+// parseCertHeader decodes a URL-encoded PEM chain, as forwarded by nginx in
+// $ssl_client_escaped_cert.
+func parseCertHeader(raw string) ([]*x509.Certificate, error) {
+	decoded, err := url.PathUnescape(raw)
+	if err != nil {
+		return nil, err
+	}
+	var chain []*x509.Certificate
+	rest := []byte(decoded)
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, cert)
+	}
+	if len(chain) == 0 {
+		return nil, errors.New("no certificate in header")
+	}
+	return chain, nil
+}
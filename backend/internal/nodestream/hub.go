@@ -0,0 +1,198 @@
+// Package nodestream pushes node events to the control streams of connected
+// nodes. Events come from Postgres notifications, so every API replica sees
+// every event and a node's stream may be served by any of them.
+package nodestream
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+
+	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/entities"
+	"github.com/emrecetinkayadev/vpn-tridot/nodeproto"
+)
+
+// ErrUnavailable is returned by Subscribe while the hub is not receiving
+// events; nodes keep polling until it is.
+var ErrUnavailable = errors.New("node event stream unavailable")
+
+// Source delivers node events. Listen calls ready once it receives events and
+// handle for each event, until ctx is done or it fails.
+type Source interface {
+	Listen(ctx context.Context, ready func(), handle func(entities.NodeEvent)) error
+}
+
+// Hub fans node events out to the subscriptions of the nodes they concern.
+type Hub struct {
+	logger *zap.Logger
+	retry  time.Duration
+
+	mu        sync.Mutex
+	listening bool
+	subs      map[uuid.UUID]map[*Subscription]struct{}
+}
+
+func NewHub(logger *zap.Logger) *Hub {
+	return &Hub{
+		logger: logger,
+		retry:  5 * time.Second,
+		subs:   make(map[uuid.UUID]map[*Subscription]struct{}),
+	}
+}
+
+// Run receives events from source until ctx is done, reconnecting after
+// failures. Events published while the source is down are lost, so every
+// subscription is closed when it fails; their nodes reconnect and start
+// again from a fresh snapshot.
+func (h *Hub) Run(ctx context.Context, source Source) {
+	defer h.stop()
+	for {
+		err := source.Listen(ctx, h.start, h.Publish)
+		h.stop()
+		if ctx.Err() != nil {
+			return
+		}
+		h.logger.Warn("node event listener failed", zap.Error(err))
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(h.retry):
+		}
+	}
+}
+
+// Subscribe registers a stream for nodeID. The caller must Close it.
+func (h *Hub) Subscribe(nodeID uuid.UUID) (*Subscription, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.listening {
+		return nil, ErrUnavailable
+	}
+	sub := &Subscription{
+		hub:    h,
+		nodeID: nodeID,
+		ready:  make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+	if h.subs[nodeID] == nil {
+		h.subs[nodeID] = make(map[*Subscription]struct{})
+	}
+	h.subs[nodeID][sub] = struct{}{}
+	return sub, nil
+}
+
+// Publish queues event on every subscription of its node.
+func (h *Hub) Publish(event entities.NodeEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for sub := range h.subs[event.NodeID] {
+		sub.queue(event)
+	}
+}
+
+func (h *Hub) start() {
+	h.mu.Lock()
+	h.listening = true
+	h.mu.Unlock()
+}
+
+// stop closes every subscription and refuses new ones until the source is
+// listening again.
+func (h *Hub) stop() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.listening = false
+	for nodeID, subs := range h.subs {
+		for sub := range subs {
+			close(sub.done)
+		}
+		delete(h.subs, nodeID)
+	}
+}
+
+func (h *Hub) remove(sub *Subscription) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	subs, ok := h.subs[sub.nodeID]
+	if !ok {
+		return
+	}
+	if _, ok := subs[sub]; !ok {
+		return
+	}
+	delete(subs, sub)
+	close(sub.done)
+	if len(subs) == 0 {
+		delete(h.subs, sub.nodeID)
+	}
+}
+
+// Subscription receives the events of one node. Events are coalesced until
+// read: only the latest peer revision and drain state are kept, so a slow
+// stream never falls behind a burst of changes.
+type Subscription struct {
+	hub    *Hub
+	nodeID uuid.UUID
+	ready  chan struct{}
+	done   chan struct{}
+
+	mu       sync.Mutex
+	revision int64
+	drain    *bool
+}
+
+// Ready is signalled when Pending has messages.
+func (s *Subscription) Ready() <-chan struct{} {
+	return s.ready
+}
+
+// Done is closed when the subscription ends; the stream should be closed.
+func (s *Subscription) Done() <-chan struct{} {
+	return s.done
+}
+
+// Pending returns the messages queued since the last call.
+func (s *Subscription) Pending() []nodeproto.StreamMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var msgs []nodeproto.StreamMessage
+	if s.drain != nil {
+		msgs = append(msgs, nodeproto.StreamMessage{Type: nodeproto.StreamDrain, Drain: s.drain})
+		s.drain = nil
+	}
+	if s.revision > 0 {
+		msgs = append(msgs, nodeproto.StreamMessage{Type: nodeproto.StreamPeers, Revision: s.revision})
+		s.revision = 0
+	}
+	return msgs
+}
+
+// Close unsubscribes. It is safe to call more than once.
+func (s *Subscription) Close() {
+	s.hub.remove(s)
+}
+
+func (s *Subscription) queue(event entities.NodeEvent) {
+	s.mu.Lock()
+	switch event.Type {
+	case entities.NodeEventPeers:
+		if event.Revision > s.revision {
+			s.revision = event.Revision
+		}
+	case entities.NodeEventDrain:
+		drain := event.Drain
+		s.drain = &drain
+	default:
+		s.mu.Unlock()
+		return
+	}
+	s.mu.Unlock()
+	select {
+	case s.ready <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,167 @@
+package peers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"go.uber.org/zap"
+
+	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/entities"
+)
+
+// configLinkPath is where public config links are served, below the API
+// base URL.
+const configLinkPath = "/api/v1/config-links/"
+
+var (
+	ErrConfigLinksDisabled = errors.New("config links disabled")
+	ErrConfigLinkInvalid   = errors.New("config link invalid")
+	ErrConfigLinkNotFound  = errors.New("config link not found")
+)
+
+// ConfigLink is an outstanding config token, usable through the signed
+// public link or the authenticated download.
+type ConfigLink struct {
+	ID         uuid.UUID `json:"id"`
+	PeerID     uuid.UUID `json:"peer_id"`
+	DeviceName string    `json:"device_name"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// ListConfigLinks returns the user's unused, unexpired config links.
+func (s *Service) ListConfigLinks(ctx context.Context, userID uuid.UUID) ([]ConfigLink, error) {
+	records, err := s.tokenStore.ListActiveUserTokens(ctx, userID, tokenTypePeerConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	links := make([]ConfigLink, 0, len(records))
+	for _, record := range records {
+		link := ConfigLink{ID: record.ID, ExpiresAt: record.ExpiresAt, CreatedAt: record.CreatedAt}
+		if record.Metadata != nil {
+			var meta configTokenMetadata
+			if err := json.Unmarshal([]byte(*record.Metadata), &meta); err == nil {
+				link.PeerID = meta.PeerID
+				if meta.Client != nil {
+					link.DeviceName = meta.Client.Name
+				}
+			}
+		}
+		links = append(links, link)
+	}
+	return links, nil
+}
+
+// RevokeConfigLink invalidates an outstanding link and wipes its config.
+func (s *Service) RevokeConfigLink(ctx context.Context, userID, linkID uuid.UUID) error {
+	record, err := s.tokenStore.GetUserTokenByID(ctx, linkID)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return ErrConfigLinkNotFound
+		}
+		return err
+	}
+	if record.UserID != userID || record.TokenType != tokenTypePeerConfig {
+		return ErrConfigLinkNotFound
+	}
+
+	if err := s.tokenStore.ConsumeAndWipeUserToken(ctx, record.ID); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return ErrConfigLinkNotFound
+		}
+		return err
+	}
+	return nil
+}
+
+// ExportConfigByLink serves a signed public link: it checks the signature and
+// expiry, renders the config in format and consumes the link. Like
+// ExportConfigByToken, a bad format leaves the link usable.
+func (s *Service) ExportConfigByLink(ctx context.Context, linkID uuid.UUID, expires int64, signature, format string) (ExportedConfig, error) {
+	if s.links == nil {
+		return ExportedConfig{}, ErrConfigLinksDisabled
+	}
+	if !s.links.Verify(linkID.String(), expires, signature) {
+		return ExportedConfig{}, ErrConfigLinkInvalid
+	}
+	if time.Now().Unix() > expires {
+		return ExportedConfig{}, ErrConfigTokenExpired
+	}
+
+	exporter, err := s.exporters.Get(format)
+	if err != nil {
+		return ExportedConfig{}, err
+	}
+
+	record, err := s.tokenStore.GetUserTokenByID(ctx, linkID)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return ExportedConfig{}, ErrConfigLinkInvalid
+		}
+		return ExportedConfig{}, err
+	}
+	if record.TokenType != tokenTypePeerConfig || record.ExpiresAt.Unix() != expires {
+		return ExportedConfig{}, ErrConfigLinkInvalid
+	}
+
+	meta, err := s.readConfigToken(ctx, record)
+	if err != nil {
+		return ExportedConfig{}, err
+	}
+
+	return s.exportConfig(ctx, record, meta, exporter)
+}
+
+// PurgeConfigTokens wipes the configs held by used and expired tokens.
+func (s *Service) PurgeConfigTokens(ctx context.Context) (int64, error) {
+	return s.tokenStore.WipeUserTokenMetadata(ctx, tokenTypePeerConfig, time.Now())
+}
+
+// RunConfigPurge calls PurgeConfigTokens every ConfigPurgeInterval until ctx
+// is cancelled.
+func (s *Service) RunConfigPurge(ctx context.Context, logger *zap.Logger) {
+	ticker := time.NewTicker(s.cfg.ConfigPurgeInterval)
+	defer ticker.Stop()
+
+	for {
+		wiped, err := s.PurgeConfigTokens(ctx)
+		switch {
+		case err != nil && ctx.Err() == nil:
+			logger.Error("purge peer configs failed", zap.Error(err))
+		case wiped > 0:
+			logger.Info("purged peer configs", zap.Int64("count", wiped))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// configLinkURL returns the signed public download URL for a token. An empty
+// format leaves the default to the server.
+func (s *Service) configLinkURL(record entities.UserToken, format string) string {
+	query := url.Values{}
+	query.Set("expires", strconv.FormatInt(record.ExpiresAt.Unix(), 10))
+	query.Set("sig", s.links.Sign(record.ID.String(), record.ExpiresAt))
+	if format != "" {
+		query.Set("format", format)
+	}
+	return s.cfg.PublicBaseURL + configLinkPath + record.ID.String() + "?" + query.Encode()
+}
+
+// configDeepLink wraps the JSON download link in the mobile app's scheme,
+// e.g. tridot://config?url=https%3A%2F%2F...
+func (s *Service) configDeepLink(record entities.UserToken) string {
+	query := url.Values{}
+	query.Set("url", s.configLinkURL(record, "json"))
+	return s.cfg.DeepLinkScheme + "://config?" + query.Encode()
+}
@@ -9,6 +9,8 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net/netip"
+	"sort"
 	"strings"
 	"time"
 
@@ -19,70 +21,155 @@ import (
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 	"image/png"
 
+	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/clientconfig"
+	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/config"
 	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/entities"
+	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/entitlements"
+	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/ipam"
 	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/platform/random"
+	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/platform/signedurl"
+	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/routing"
+	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/storage/postgres"
 )
 
 const (
-	defaultDeviceLimit    = 5
 	tokenTypePeerConfig   = "peer_config"
 	tokenByteLength       = 32
-	tokenTTL              = 24 * time.Hour
-	defaultAllowedIPs     = "10.0.0.2/32"
 	defaultDNSServers     = "1.1.1.1"
 	defaultPersistentKeep = 25
+	// RegionRecommended lets the backend pick the region as well as the node.
+	RegionRecommended = "recommended"
 )
 
 var (
 	ErrDeviceLimitReached = errors.New("device limit reached")
 	ErrPeerNotFound       = errors.New("peer not found")
+	ErrNodeNotFound       = errors.New("node not found")
+	ErrRegionNotFound     = errors.New("region not found")
+	ErrNoNodeAvailable    = errors.New("no node available")
+	ErrPeerInactive       = errors.New("peer is not active")
+	ErrPublicKeyInUse     = errors.New("public key already in use")
+	ErrConfigTokenStale   = errors.New("config token superseded")
+	ErrSameNode           = errors.New("peer already on node")
+	// ErrFormatUnavailable is returned for tokens issued before config
+	// export, which only hold the wg-quick text.
+	ErrFormatUnavailable  = errors.New("config format unavailable for token")
+	ErrConfigTokenUsed    = errors.New("config token already used")
+	ErrConfigTokenExpired = errors.New("config token expired")
 )
 
 // Repository abstracts storage operations.
 type Repository interface {
 	ListByUser(ctx context.Context, userID uuid.UUID) ([]entities.Peer, error)
 	CountByUser(ctx context.Context, userID uuid.UUID) (int, error)
-	Create(ctx context.Context, peer entities.Peer) (entities.Peer, error)
+	// Create places the peer on a node and inserts it in one transaction.
+	// assign returns the peer's AllowedIPs given the chosen node and the
+	// addresses already used there. pgx.ErrNoRows means no node qualified.
+	Create(ctx context.Context, peer entities.Peer, placement entities.PeerPlacement, assign func(node entities.Node, used []netip.Addr) (string, error)) (entities.Peer, entities.Node, error)
 	GetByID(ctx context.Context, id uuid.UUID, userID uuid.UUID) (entities.Peer, error)
 	Rename(ctx context.Context, id uuid.UUID, userID uuid.UUID, name string) (entities.Peer, error)
+	// Migrate moves an active peer to the node chosen like in Create, with
+	// new addresses and the peer's (possibly new) keys, in one transaction.
+	// It returns postgres.ErrPeerNotActive when the peer is gone or no
+	// longer active.
+	Migrate(ctx context.Context, peer entities.Peer, placement entities.PeerPlacement, assign func(node entities.Node, used []netip.Addr) (string, error)) (entities.Peer, entities.Node, error)
+	// Rotate swaps the keys of an active peer; pgx.ErrNoRows otherwise.
+	Rotate(ctx context.Context, id uuid.UUID, userID uuid.UUID, publicKey string, presharedKey *string) (entities.Peer, error)
+	// SetRouting stores the routing preset of an active peer; pgx.ErrNoRows
+	// when the peer is missing or not active.
+	SetRouting(ctx context.Context, id uuid.UUID, userID uuid.UUID, routing entities.PeerRouting) (entities.Peer, error)
 	Delete(ctx context.Context, id uuid.UUID, userID uuid.UUID) error
+	DeviceMesh(ctx context.Context, userID uuid.UUID) (bool, error)
+	// SetDeviceMesh stores the setting and updates the group marker of all
+	// the user's peers.
+	SetDeviceMesh(ctx context.Context, userID uuid.UUID, enabled bool) error
 	UsageSummaryByUser(ctx context.Context, userID uuid.UUID) (entities.UsageSummary, error)
+	NodePeerRevision(ctx context.Context, nodeID uuid.UUID) (int64, error)
+	ListActiveByNode(ctx context.Context, nodeID uuid.UUID) ([]entities.PeerChange, error)
+	ListChangesByNode(ctx context.Context, nodeID uuid.UUID, since int64) ([]entities.PeerChange, error)
+	ApplyPeerStats(ctx context.Context, nodeID uuid.UUID, stats []entities.PeerStat) (int, error)
 }
 
-// NodeStore exposes node metadata required for config generation.
+// NodeStore exposes node and region metadata.
 type NodeStore interface {
 	GetNodeByID(ctx context.Context, id uuid.UUID) (entities.Node, error)
+	GetRegionByCode(ctx context.Context, code string) (entities.Region, error)
 }
 
 // TokenStore reuses the auth repository for managing single-use tokens.
 type TokenStore interface {
 	CreateUserToken(ctx context.Context, token entities.UserToken) (entities.UserToken, error)
 	GetUserToken(ctx context.Context, tokenType, tokenHash string) (entities.UserToken, error)
-	ConsumeUserToken(ctx context.Context, tokenID uuid.UUID) error
+	GetUserTokenByID(ctx context.Context, tokenID uuid.UUID) (entities.UserToken, error)
+	ListActiveUserTokens(ctx context.Context, userID uuid.UUID, tokenType string) ([]entities.UserToken, error)
+	// ConsumeAndWipeUserToken consumes the token and drops its metadata;
+	// pgx.ErrNoRows means it was already consumed.
+	ConsumeAndWipeUserToken(ctx context.Context, tokenID uuid.UUID) error
+	WipeUserTokenMetadata(ctx context.Context, tokenType string, expiredBefore time.Time) (int64, error)
+}
+
+// Entitlements resolves what the user's plan allows.
+type Entitlements interface {
+	Resolve(ctx context.Context, userID uuid.UUID) (entitlements.Entitlements, error)
 }
 
 // Service handles peer lifecycle.
 type Service struct {
-	repo       Repository
-	nodeStore  NodeStore
-	tokenStore TokenStore
+	repo         Repository
+	nodeStore    NodeStore
+	tokenStore   TokenStore
+	entitlements Entitlements
+	exporters    *clientconfig.Registry
+	cfg          config.PeersConfig
+	// links signs public config download links; nil disables them.
+	links   *signedurl.Signer
+	planner *routing.Planner
 }
 
-func NewService(repo Repository, nodeStore NodeStore, tokenStore TokenStore) *Service {
-	return &Service{repo: repo, nodeStore: nodeStore, tokenStore: tokenStore}
+// NewService fails when config links are enabled with an unusable signing
+// secret; an empty secret turns links off.
+func NewService(repo Repository, nodeStore NodeStore, tokenStore TokenStore, entitlements Entitlements, cfg config.PeersConfig) (*Service, error) {
+	s := &Service{
+		repo:         repo,
+		nodeStore:    nodeStore,
+		tokenStore:   tokenStore,
+		entitlements: entitlements,
+		exporters:    clientconfig.DefaultRegistry(),
+		cfg:          cfg,
+		planner:      routing.NewPlanner(nil),
+	}
+	if cfg.ConfigLinkSecret != "" {
+		signer, err := signedurl.NewSigner(cfg.ConfigLinkSecret)
+		if err != nil {
+			return nil, fmt.Errorf("config links: %w", err)
+		}
+		s.links = signer
+	}
+	return s, nil
 }
 
-// CreatePeerInput defines payload for peer creation.
+// UseGeoIP enables the exclude_country routing preset with geo's ranges.
+func (s *Service) UseGeoIP(geo *routing.GeoIP) {
+	s.planner = routing.NewPlanner(geo)
+}
+
+// CreatePeerInput defines payload for peer creation. The peer is placed in
+// RegionID or RegionCode, and with neither set (or RegionCode "recommended")
+// in the best region overall. NodeID pins it to a node, which must still be
+// active with free addresses; the public API never sets it.
 type CreatePeerInput struct {
 	UserID       uuid.UUID
 	NodeID       uuid.UUID
 	RegionID     uuid.UUID
+	RegionCode   string
 	DeviceName   string
 	ClientPubKey string
 	AllowedIPs   string
 	DNSServers   []string
 	Keepalive    *int
 	MTU          *int
+	// Routing is the split-tunnel preset; empty means full tunnel.
+	Routing entities.PeerRouting
 }
 
 // CreatePeerOutput returns created peer and configuration artifacts.
@@ -92,6 +179,42 @@ type CreatePeerOutput struct {
 	Config           string
 	ConfigToken      string
 	ConfigQR         string
+	// ConfigURL and ConfigDeepLink are the signed public download link and
+	// its app deep link; empty when links are disabled.
+	ConfigURL      string
+	ConfigDeepLink string
+}
+
+// DesiredPeers is the peer set a node should converge to. When Full is false
+// Peers and Removed only describe changes after the requested revision.
+type DesiredPeers struct {
+	NodeID   uuid.UUID
+	Revision int64
+	Full     bool
+	Peers    []entities.PeerChange
+	Removed  []string
+}
+
+// IngestStats applies a node's per-peer counters. Duplicate keys in a batch
+// keep the last sample; peers unknown to the node are ignored.
+func (s *Service) IngestStats(ctx context.Context, nodeID uuid.UUID, stats []entities.PeerStat) (int, error) {
+	if nodeID == uuid.Nil {
+		return 0, errors.New("node id required")
+	}
+	deduped := make([]entities.PeerStat, 0, len(stats))
+	index := make(map[string]int, len(stats))
+	for _, stat := range stats {
+		if stat.RxBytes < 0 || stat.TxBytes < 0 {
+			return 0, fmt.Errorf("peer %s: negative counter", stat.PublicKey)
+		}
+		if i, ok := index[stat.PublicKey]; ok {
+			deduped[i] = stat
+			continue
+		}
+		index[stat.PublicKey] = len(deduped)
+		deduped = append(deduped, stat)
+	}
+	return s.repo.ApplyPeerStats(ctx, nodeID, deduped)
 }
 
 func (s *Service) ListPeers(ctx context.Context, userID uuid.UUID) ([]entities.Peer, error) {
@@ -103,38 +226,42 @@ func (s *Service) UsageSummary(ctx context.Context, userID uuid.UUID) (entities.
 	return s.repo.UsageSummaryByUser(ctx, userID)
 }
 
+// DeviceMesh reports whether the user's devices may reach each other through
+// the nodes they share.
+func (s *Service) DeviceMesh(ctx context.Context, userID uuid.UUID) (bool, error) {
+	return s.repo.DeviceMesh(ctx, userID)
+}
+
+// SetDeviceMesh turns the user's device mesh on or off. Nodes isolate every
+// peer by default; with the mesh enabled, peers of the same user on one node
+// can reach each other. Existing and future peers follow the setting.
+func (s *Service) SetDeviceMesh(ctx context.Context, userID uuid.UUID, enabled bool) error {
+	return s.repo.SetDeviceMesh(ctx, userID, enabled)
+}
+
 func (s *Service) CreatePeer(ctx context.Context, input CreatePeerInput) (CreatePeerOutput, error) {
 	if input.UserID == uuid.Nil {
 		return CreatePeerOutput{}, errors.New("user id required")
 	}
-	if input.NodeID == uuid.Nil || input.RegionID == uuid.Nil {
-		return CreatePeerOutput{}, errors.New("node and region required")
-	}
 	if strings.TrimSpace(input.DeviceName) == "" {
 		return CreatePeerOutput{}, errors.New("device name required")
 	}
 
+	ent, err := s.entitlements.Resolve(ctx, input.UserID)
+	if err != nil {
+		return CreatePeerOutput{}, err
+	}
 	count, err := s.repo.CountByUser(ctx, input.UserID)
 	if err != nil {
 		return CreatePeerOutput{}, err
 	}
-	if count >= defaultDeviceLimit {
+	if count >= ent.DeviceLimit {
 		return CreatePeerOutput{}, ErrDeviceLimitReached
 	}
 
-	var clientPrivate wgtypes.Key
-	var clientPublic wgtypes.Key
-	if input.ClientPubKey == "" {
-		clientPrivate, err = wgtypes.GeneratePrivateKey()
-		if err != nil {
-			return CreatePeerOutput{}, fmt.Errorf("generate client key: %w", err)
-		}
-		clientPublic = clientPrivate.PublicKey()
-	} else {
-		clientPublic, err = wgtypes.ParseKey(input.ClientPubKey)
-		if err != nil {
-			return CreatePeerOutput{}, fmt.Errorf("parse client public key: %w", err)
-		}
+	clientPrivate, clientPublic, err := clientKeys(input.ClientPubKey)
+	if err != nil {
+		return CreatePeerOutput{}, err
 	}
 
 	preshared, err := wgtypes.GenerateKey()
@@ -142,10 +269,16 @@ func (s *Service) CreatePeer(ctx context.Context, input CreatePeerInput) (Create
 		return CreatePeerOutput{}, fmt.Errorf("generate preshared key: %w", err)
 	}
 
-	allowed := input.AllowedIPs
-	if allowed == "" {
-		allowed = defaultAllowedIPs
+	placement, err := s.placement(ctx, input.NodeID, input.RegionID, input.RegionCode, ent)
+	if err != nil {
+		return CreatePeerOutput{}, err
 	}
+
+	peerRouting, err := s.planner.Normalize(input.Routing)
+	if err != nil {
+		return CreatePeerOutput{}, err
+	}
+
 	var dns []string
 	if len(input.DNSServers) == 0 {
 		dns = []string{defaultDNSServers}
@@ -155,59 +288,238 @@ func (s *Service) CreatePeer(ctx context.Context, input CreatePeerInput) (Create
 
 	peer := entities.Peer{
 		UserID:       input.UserID,
-		NodeID:       input.NodeID,
-		RegionID:     input.RegionID,
 		DeviceName:   input.DeviceName,
 		PublicKey:    clientPublic.String(),
 		PresharedKey: ptrString(preshared.String()),
-		AllowedIPs:   allowed,
 		DNSServers:   dns,
 		Keepalive:    input.Keepalive,
 		MTU:          input.MTU,
 		Status:       "active",
+		Routing:      peerRouting,
 	}
 
-	peer, err = s.repo.Create(ctx, peer)
+	peer, node, err := s.repo.Create(ctx, peer, placement, assignAddresses(input.AllowedIPs))
 	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return CreatePeerOutput{}, ErrNoNodeAvailable
+		}
 		return CreatePeerOutput{}, err
 	}
 
-	node, err := s.nodeStore.GetNodeByID(ctx, input.NodeID)
+	return s.issueConfig(ctx, peer, node, clientPrivate)
+}
+
+func (s *Service) RenamePeer(ctx context.Context, userID, peerID uuid.UUID, name string) (entities.Peer, error) {
+	if strings.TrimSpace(name) == "" {
+		return entities.Peer{}, errors.New("device name required")
+	}
+	peer, err := s.repo.Rename(ctx, peerID, userID, name)
 	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return entities.Peer{}, ErrPeerNotFound
+		}
+		return entities.Peer{}, err
+	}
+	return peer, nil
+}
+
+// SetPeerRouting changes the peer's split-tunnel preset and issues a config
+// with the new AllowedIPs. Private keys are not stored, so the config has no
+// PrivateKey; clients keep theirs, or rotate to get a complete config.
+func (s *Service) SetPeerRouting(ctx context.Context, userID, peerID uuid.UUID, peerRouting entities.PeerRouting) (CreatePeerOutput, error) {
+	current, err := s.repo.GetByID(ctx, peerID, userID)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return CreatePeerOutput{}, ErrPeerNotFound
+		}
 		return CreatePeerOutput{}, err
 	}
+	if !current.IsActive() {
+		return CreatePeerOutput{}, ErrPeerInactive
+	}
 
-	config := buildConfig(peer, node, clientPrivate.String())
-	qrCode, err := generateQRCode(config)
+	peerRouting, err = s.planner.Normalize(peerRouting)
 	if err != nil {
 		return CreatePeerOutput{}, err
 	}
-	token, err := s.issueConfigToken(ctx, peer.UserID, peer.ID, config)
+
+	peer, err := s.repo.SetRouting(ctx, peerID, userID, peerRouting)
 	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return CreatePeerOutput{}, ErrPeerInactive
+		}
 		return CreatePeerOutput{}, err
 	}
 
-	return CreatePeerOutput{
-		Peer:             peer,
-		ClientPrivateKey: clientPrivate.String(),
-		Config:           config,
-		ConfigToken:      token,
-		ConfigQR:         qrCode,
-	}, nil
+	node, err := s.nodeStore.GetNodeByID(ctx, peer.NodeID)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return CreatePeerOutput{}, ErrNodeNotFound
+		}
+		return CreatePeerOutput{}, err
+	}
+
+	return s.issueConfig(ctx, peer, node, wgtypes.Key{})
 }
 
-func (s *Service) RenamePeer(ctx context.Context, userID, peerID uuid.UUID, name string) (entities.Peer, error) {
-	if strings.TrimSpace(name) == "" {
-		return entities.Peer{}, errors.New("device name required")
+// RotatePeer replaces a peer's keys and issues a fresh config, token and QR
+// code. Without clientPubKey a new keypair is generated server-side; the
+// preshared key is always regenerated. The node picks the change up through
+// the peer revision, and config tokens issued before the rotation stop working.
+func (s *Service) RotatePeer(ctx context.Context, userID, peerID uuid.UUID, clientPubKey string) (CreatePeerOutput, error) {
+	current, err := s.repo.GetByID(ctx, peerID, userID)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return CreatePeerOutput{}, ErrPeerNotFound
+		}
+		return CreatePeerOutput{}, err
 	}
-	peer, err := s.repo.Rename(ctx, peerID, userID, name)
+	if !current.IsActive() {
+		return CreatePeerOutput{}, ErrPeerInactive
+	}
+
+	clientPrivate, clientPublic, err := clientKeys(clientPubKey)
+	if err != nil {
+		return CreatePeerOutput{}, err
+	}
+	if clientPublic.String() == current.PublicKey {
+		return CreatePeerOutput{}, errors.New("client public key unchanged")
+	}
+
+	preshared, err := wgtypes.GenerateKey()
+	if err != nil {
+		return CreatePeerOutput{}, fmt.Errorf("generate preshared key: %w", err)
+	}
+
+	peer, err := s.repo.Rotate(ctx, peerID, userID, clientPublic.String(), ptrString(preshared.String()))
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return CreatePeerOutput{}, ErrPeerInactive
+		case errors.Is(err, postgres.ErrDuplicatePeer):
+			return CreatePeerOutput{}, ErrPublicKeyInUse
+		default:
+			return CreatePeerOutput{}, err
+		}
+	}
+
+	node, err := s.nodeStore.GetNodeByID(ctx, peer.NodeID)
+	if err != nil {
+		return CreatePeerOutput{}, fmt.Errorf("load peer node: %w", err)
+	}
+
+	return s.issueConfig(ctx, peer, node, clientPrivate)
+}
+
+// MigratePeerInput selects where an existing peer moves to, like the
+// placement fields of CreatePeerInput. ClientPubKey keeps (or replaces) the
+// client's key; when empty a new keypair is generated server-side.
+type MigratePeerInput struct {
+	UserID       uuid.UUID
+	PeerID       uuid.UUID
+	NodeID       uuid.UUID
+	RegionID     uuid.UUID
+	RegionCode   string
+	ClientPubKey string
+}
+
+// MigratePeer moves an active peer to another node, keeping its id, name and
+// usage. It gets a fresh address from the target node's pool; the old node
+// drops the peer and the new one adds it through their peer revisions. The
+// current node is never chosen, and a target given by NodeID must be active,
+// in an active region and have free addresses, like an automatic one. The preshared key is regenerated whenever the
+// public key changes.
+func (s *Service) MigratePeer(ctx context.Context, input MigratePeerInput) (CreatePeerOutput, error) {
+	current, err := s.repo.GetByID(ctx, input.PeerID, input.UserID)
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
-			return entities.Peer{}, ErrPeerNotFound
+			return CreatePeerOutput{}, ErrPeerNotFound
 		}
-		return entities.Peer{}, err
+		return CreatePeerOutput{}, err
 	}
-	return peer, nil
+	if !current.IsActive() {
+		return CreatePeerOutput{}, ErrPeerInactive
+	}
+	if input.NodeID != uuid.Nil && input.NodeID == current.NodeID {
+		return CreatePeerOutput{}, ErrSameNode
+	}
+
+	ent, err := s.entitlements.Resolve(ctx, input.UserID)
+	if err != nil {
+		return CreatePeerOutput{}, err
+	}
+	placement, err := s.placement(ctx, input.NodeID, input.RegionID, input.RegionCode, ent)
+	if err != nil {
+		return CreatePeerOutput{}, err
+	}
+	placement.ExcludeNodeID = current.NodeID
+
+	clientPrivate, clientPublic, err := clientKeys(input.ClientPubKey)
+	if err != nil {
+		return CreatePeerOutput{}, err
+	}
+	peer := current
+	if clientPublic.String() != current.PublicKey {
+		preshared, err := wgtypes.GenerateKey()
+		if err != nil {
+			return CreatePeerOutput{}, fmt.Errorf("generate preshared key: %w", err)
+		}
+		peer.PublicKey = clientPublic.String()
+		peer.PresharedKey = ptrString(preshared.String())
+	}
+
+	peer, node, err := s.repo.Migrate(ctx, peer, placement, assignAddresses(""))
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return CreatePeerOutput{}, ErrNoNodeAvailable
+		case errors.Is(err, postgres.ErrPeerNotActive):
+			return CreatePeerOutput{}, ErrPeerInactive
+		case errors.Is(err, postgres.ErrDuplicatePeer):
+			return CreatePeerOutput{}, ErrPublicKeyInUse
+		default:
+			return CreatePeerOutput{}, err
+		}
+	}
+
+	return s.issueConfig(ctx, peer, node, clientPrivate)
+}
+
+// issueConfig renders the peer's config and its one-time token and QR code.
+// clientPrivate is the zero key when the client holds its own private key.
+func (s *Service) issueConfig(ctx context.Context, peer entities.Peer, node entities.Node, clientPrivate wgtypes.Key) (CreatePeerOutput, error) {
+	var private string
+	if clientPrivate != (wgtypes.Key{}) {
+		private = clientPrivate.String()
+	}
+	client, err := s.buildClientConfig(peer, node, private)
+	if err != nil {
+		return CreatePeerOutput{}, err
+	}
+	rendered := clientconfig.RenderWGQuick(client)
+	// Split-tunnel configs with long exclude lists can outgrow a QR code;
+	// those are delivered through the token and links only.
+	qrCode, err := generateQRCode(rendered)
+	if err != nil {
+		qrCode = ""
+	}
+	token, record, err := s.issueConfigToken(ctx, peer, client, rendered)
+	if err != nil {
+		return CreatePeerOutput{}, err
+	}
+
+	out := CreatePeerOutput{
+		Peer:             peer,
+		ClientPrivateKey: private,
+		Config:           rendered,
+		ConfigToken:      token,
+		ConfigQR:         qrCode,
+	}
+	if s.links != nil {
+		out.ConfigURL = s.configLinkURL(record, "")
+		out.ConfigDeepLink = s.configDeepLink(record)
+	}
+	return out, nil
 }
 
 func (s *Service) DeletePeer(ctx context.Context, userID, peerID uuid.UUID) error {
@@ -220,107 +532,390 @@ func (s *Service) DeletePeer(ctx context.Context, userID, peerID uuid.UUID) erro
 	return nil
 }
 
+// PeerRevision returns the node's current peer revision.
+func (s *Service) PeerRevision(ctx context.Context, nodeID uuid.UUID) (int64, error) {
+	revision, err := s.repo.NodePeerRevision(ctx, nodeID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, ErrNodeNotFound
+	}
+	return revision, err
+}
+
+// DesiredPeers returns the peers a node must have configured. A positive since
+// revision yields only the changes after it; zero, or a revision the node
+// cannot have seen, yields the full set.
+func (s *Service) DesiredPeers(ctx context.Context, nodeID uuid.UUID, since int64) (DesiredPeers, error) {
+	if nodeID == uuid.Nil {
+		return DesiredPeers{}, errors.New("node id required")
+	}
+
+	revision, err := s.repo.NodePeerRevision(ctx, nodeID)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return DesiredPeers{}, ErrNodeNotFound
+		}
+		return DesiredPeers{}, err
+	}
+
+	out := DesiredPeers{NodeID: nodeID, Revision: revision}
+	if since <= 0 || since > revision {
+		peers, err := s.repo.ListActiveByNode(ctx, nodeID)
+		if err != nil {
+			return DesiredPeers{}, err
+		}
+		out.Full = true
+		out.Peers = peers
+		return out, nil
+	}
+	if since == revision {
+		return out, nil
+	}
+
+	changes, err := s.repo.ListChangesByNode(ctx, nodeID, since)
+	if err != nil {
+		return DesiredPeers{}, err
+	}
+
+	// A key can appear several times (e.g. removed then re-added); only the
+	// change with the highest revision decides its final state.
+	latest := make(map[string]entities.PeerChange, len(changes))
+	for _, change := range changes {
+		if prev, ok := latest[change.PublicKey]; ok && prev.Revision > change.Revision {
+			continue
+		}
+		latest[change.PublicKey] = change
+	}
+	for _, change := range latest {
+		if change.Removed {
+			out.Removed = append(out.Removed, change.PublicKey)
+			continue
+		}
+		out.Peers = append(out.Peers, change)
+	}
+	sort.Slice(out.Peers, func(i, j int) bool { return out.Peers[i].PublicKey < out.Peers[j].PublicKey })
+	sort.Strings(out.Removed)
+
+	return out, nil
+}
+
+// ExportedConfig is a client config rendered in a requested format.
+type ExportedConfig struct {
+	Format      string
+	ContentType string
+	Filename    string
+	Data        []byte
+}
+
+// ConfigFormats lists the formats ExportConfigByToken accepts.
+func (s *Service) ConfigFormats() []string {
+	return s.exporters.Formats()
+}
+
 // GetConfigByToken returns config text for a single-use token and invalidates it.
 func (s *Service) GetConfigByToken(ctx context.Context, userID uuid.UUID, token string) (string, error) {
+	record, meta, err := s.loadConfigToken(ctx, userID, token)
+	if err != nil {
+		return "", err
+	}
+
+	if err := s.consumeConfigToken(ctx, record); err != nil {
+		return "", err
+	}
+
+	return meta.Config, nil
+}
+
+// ExportConfigByToken renders the token's config in format and invalidates the
+// token. An unknown or unavailable format leaves the token usable.
+func (s *Service) ExportConfigByToken(ctx context.Context, userID uuid.UUID, token, format string) (ExportedConfig, error) {
+	exporter, err := s.exporters.Get(format)
+	if err != nil {
+		return ExportedConfig{}, err
+	}
+
+	record, meta, err := s.loadConfigToken(ctx, userID, token)
+	if err != nil {
+		return ExportedConfig{}, err
+	}
+
+	return s.exportConfig(ctx, record, meta, exporter)
+}
+
+// exportConfig renders meta with exporter and consumes the token.
+func (s *Service) exportConfig(ctx context.Context, record entities.UserToken, meta configTokenMetadata, exporter clientconfig.Exporter) (ExportedConfig, error) {
+	var (
+		data []byte
+		name string
+		err  error
+	)
+	switch {
+	case meta.Client != nil:
+		data, err = exporter.Export(*meta.Client)
+		if err != nil {
+			return ExportedConfig{}, fmt.Errorf("export %s config: %w", exporter.Format(), err)
+		}
+		name = meta.Client.Name
+	case exporter.Format() == clientconfig.DefaultFormat:
+		data = []byte(meta.Config)
+	default:
+		return ExportedConfig{}, fmt.Errorf("%w: %s", ErrFormatUnavailable, exporter.Format())
+	}
+
+	if err := s.consumeConfigToken(ctx, record); err != nil {
+		return ExportedConfig{}, err
+	}
+
+	return ExportedConfig{
+		Format:      exporter.Format(),
+		ContentType: exporter.ContentType(),
+		Filename:    configFilename(name, exporter.Extension()),
+		Data:        data,
+	}, nil
+}
+
+// consumeConfigToken invalidates the token and wipes the config it held.
+func (s *Service) consumeConfigToken(ctx context.Context, record entities.UserToken) error {
+	if err := s.tokenStore.ConsumeAndWipeUserToken(ctx, record.ID); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return ErrConfigTokenUsed
+		}
+		return err
+	}
+	return nil
+}
+
+// loadConfigToken validates a config token without consuming it.
+func (s *Service) loadConfigToken(ctx context.Context, userID uuid.UUID, token string) (entities.UserToken, configTokenMetadata, error) {
 	hash := hashToken(token)
-	tokenRecord, err := s.tokenStore.GetUserToken(ctx, tokenTypePeerConfig, hash)
+	record, err := s.tokenStore.GetUserToken(ctx, tokenTypePeerConfig, hash)
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
-			return "", errors.New("config token invalid")
+			return entities.UserToken{}, configTokenMetadata{}, errors.New("config token invalid")
 		}
-		return "", err
+		return entities.UserToken{}, configTokenMetadata{}, err
+	}
+
+	if record.UserID != userID {
+		return entities.UserToken{}, configTokenMetadata{}, errors.New("config token does not belong to user")
 	}
 
-	if tokenRecord.UserID != userID {
-		return "", errors.New("config token does not belong to user")
+	meta, err := s.readConfigToken(ctx, record)
+	if err != nil {
+		return entities.UserToken{}, configTokenMetadata{}, err
 	}
+	return record, meta, nil
+}
 
-	if tokenRecord.ExpiresAt.Before(time.Now()) {
-		return "", errors.New("config token expired")
+// readConfigToken checks that the token is still usable and decodes its
+// config.
+func (s *Service) readConfigToken(ctx context.Context, record entities.UserToken) (configTokenMetadata, error) {
+	if record.ConsumedAt != nil {
+		return configTokenMetadata{}, ErrConfigTokenUsed
 	}
 
-	if tokenRecord.Metadata == nil {
-		return "", errors.New("config metadata missing")
+	if record.ExpiresAt.Before(time.Now()) {
+		return configTokenMetadata{}, ErrConfigTokenExpired
+	}
+
+	if record.Metadata == nil {
+		return configTokenMetadata{}, errors.New("config metadata missing")
 	}
 
 	var meta configTokenMetadata
-	if err := json.Unmarshal([]byte(*tokenRecord.Metadata), &meta); err != nil {
-		return "", errors.New("invalid config metadata")
+	if err := json.Unmarshal([]byte(*record.Metadata), &meta); err != nil {
+		return configTokenMetadata{}, errors.New("invalid config metadata")
 	}
 
 	if meta.PeerID == uuid.Nil {
-		return "", errors.New("config metadata missing peer id")
+		return configTokenMetadata{}, errors.New("config metadata missing peer id")
 	}
 
-	if _, err := s.repo.GetByID(ctx, meta.PeerID, userID); err != nil {
-		return "", err
+	peer, err := s.repo.GetByID(ctx, meta.PeerID, record.UserID)
+	if err != nil {
+		return configTokenMetadata{}, err
 	}
-
-	if err := s.tokenStore.ConsumeUserToken(ctx, tokenRecord.ID); err != nil {
-		return "", err
+	// Tokens issued before a rotation or migration carry an outdated key or
+	// endpoint.
+	if (meta.PublicKey != "" && meta.PublicKey != peer.PublicKey) || (meta.NodeID != uuid.Nil && meta.NodeID != peer.NodeID) {
+		return configTokenMetadata{}, ErrConfigTokenStale
 	}
 
-	return meta.Config, nil
+	return meta, nil
 }
 
-func (s *Service) issueConfigToken(ctx context.Context, userID, peerID uuid.UUID, config string) (string, error) {
+func (s *Service) issueConfigToken(ctx context.Context, peer entities.Peer, client clientconfig.Config, rendered string) (string, entities.UserToken, error) {
 	raw, err := random.String(tokenByteLength)
 	if err != nil {
-		return "", err
+		return "", entities.UserToken{}, err
 	}
 
 	hash := hashToken(raw)
-	metaBytes, err := json.Marshal(configTokenMetadata{PeerID: peerID, Config: config})
+	metaBytes, err := json.Marshal(configTokenMetadata{
+		PeerID:    peer.ID,
+		NodeID:    peer.NodeID,
+		PublicKey: peer.PublicKey,
+		Config:    rendered,
+		Client:    &client,
+	})
 	if err != nil {
-		return "", err
+		return "", entities.UserToken{}, err
 	}
 	metaStr := string(metaBytes)
 
 	token := entities.UserToken{
-		UserID:    userID,
+		UserID:    peer.UserID,
 		TokenHash: hash,
 		TokenType: tokenTypePeerConfig,
-		ExpiresAt: time.Now().Add(tokenTTL),
+		ExpiresAt: time.Now().Add(s.cfg.ConfigTTL),
 		Metadata:  &metaStr,
 	}
-	if _, err := s.tokenStore.CreateUserToken(ctx, token); err != nil {
-		return "", err
+	record, err := s.tokenStore.CreateUserToken(ctx, token)
+	if err != nil {
+		return "", entities.UserToken{}, err
+	}
+
+	return raw, record, nil
+}
+
+// buildClientConfig collects what a client needs to connect to node. The
+// client's AllowedIPs follow the peer's routing preset; the tunnel subnet and
+// DNS servers are always routed through the tunnel.
+func (s *Service) buildClientConfig(peer entities.Peer, node entities.Node, clientPrivate string) (clientconfig.Config, error) {
+	cfg := clientconfig.Config{
+		PeerID:          peer.ID.String(),
+		Name:            peer.DeviceName,
+		PrivateKey:      clientPrivate,
+		DNS:             peer.DNSServers,
+		MTU:             peer.MTU,
+		Keepalive:       defaultPersistentKeep,
+		ServerPublicKey: node.PublicKey,
+		Endpoint:        node.Endpoint,
+	}
+	for _, address := range strings.Split(peer.AllowedIPs, ",") {
+		if address = strings.TrimSpace(address); address != "" {
+			cfg.Addresses = append(cfg.Addresses, address)
+		}
+	}
+	if peer.Keepalive != nil {
+		cfg.Keepalive = *peer.Keepalive
+	}
+	if peer.PresharedKey != nil {
+		cfg.PresharedKey = *peer.PresharedKey
 	}
 
-	return raw, nil
+	var keep []netip.Prefix
+	if pool, err := nodePool(node); err == nil {
+		keep = append(keep, pool.Prefix())
+		if prefix6 := pool.Prefix6(); prefix6.IsValid() {
+			keep = append(keep, prefix6)
+		}
+	}
+	for _, server := range peer.DNSServers {
+		if addr, err := netip.ParseAddr(strings.TrimSpace(server)); err == nil {
+			addr = addr.Unmap()
+			keep = append(keep, netip.PrefixFrom(addr, addr.BitLen()))
+		}
+	}
+	// Only route IPv6 into the tunnel when the node can carry it; otherwise
+	// the client would blackhole all of its IPv6 traffic.
+	allowed, err := s.planner.AllowedIPs(peer.Routing, node.IPv6Enabled, keep)
+	if err != nil {
+		return clientconfig.Config{}, err
+	}
+	cfg.AllowedIPs = allowed
+	return cfg, nil
 }
 
-func buildConfig(peer entities.Peer, node entities.Node, clientPrivate string) string {
-	var sb strings.Builder
+// configFilename builds a download name from the device name, keeping only
+// characters that are safe in a Content-Disposition header and file systems.
+func configFilename(deviceName, extension string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_':
+			return r
+		case r == ' ' || r == '.':
+			return '-'
+		default:
+			return -1
+		}
+	}, deviceName)
+	name = strings.Trim(name, "-")
+	if name == "" {
+		name = "tridot"
+	}
+	return name + "." + extension
+}
 
-	sb.WriteString("[Interface]\n")
-	if clientPrivate != "" {
-		sb.WriteString(fmt.Sprintf("PrivateKey = %s\n", clientPrivate))
+// placement turns the requested node or region into placement constraints.
+// Regions outside the plan are rejected by code here and filtered out of node
+// selection otherwise.
+func (s *Service) placement(ctx context.Context, nodeID, regionID uuid.UUID, regionCode string, ent entitlements.Entitlements) (entities.PeerPlacement, error) {
+	placement := entities.PeerPlacement{NodeID: nodeID, RegionID: regionID, RegionCodes: ent.Regions}
+	code := strings.TrimSpace(regionCode)
+	if placement.RegionID != uuid.Nil || code == "" || strings.EqualFold(code, RegionRecommended) {
+		return placement, nil
 	}
-	if peer.AllowedIPs != "" {
-		sb.WriteString(fmt.Sprintf("Address = %s\n", peer.AllowedIPs))
+
+	region, err := s.nodeStore.GetRegionByCode(ctx, strings.ToUpper(code))
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return entities.PeerPlacement{}, fmt.Errorf("%w: %s", ErrRegionNotFound, code)
+		}
+		return entities.PeerPlacement{}, err
 	}
-	if len(peer.DNSServers) > 0 {
-		sb.WriteString(fmt.Sprintf("DNS = %s\n", strings.Join(peer.DNSServers, ",")))
+	if !region.IsActive {
+		return entities.PeerPlacement{}, fmt.Errorf("%w: %s", ErrRegionNotFound, code)
 	}
-	if peer.MTU != nil {
-		sb.WriteString(fmt.Sprintf("MTU = %d\n", *peer.MTU))
+	if !ent.AllowsRegion(region.Code) {
+		return entities.PeerPlacement{}, fmt.Errorf("%w: %s", entitlements.ErrRegionNotAllowed, region.Code)
 	}
-	if peer.Keepalive != nil {
-		sb.WriteString(fmt.Sprintf("PersistentKeepalive = %d\n", *peer.Keepalive))
-	} else {
-		sb.WriteString(fmt.Sprintf("PersistentKeepalive = %d\n", defaultPersistentKeep))
+	placement.RegionID = region.ID
+	return placement, nil
+}
+
+// clientKeys parses the client's public key, or generates a keypair when it
+// is empty. The private key is zero for client-supplied keys.
+func clientKeys(clientPubKey string) (wgtypes.Key, wgtypes.Key, error) {
+	if clientPubKey == "" {
+		private, err := wgtypes.GeneratePrivateKey()
+		if err != nil {
+			return wgtypes.Key{}, wgtypes.Key{}, fmt.Errorf("generate client key: %w", err)
+		}
+		return private, private.PublicKey(), nil
+	}
+	public, err := wgtypes.ParseKey(clientPubKey)
+	if err != nil {
+		return wgtypes.Key{}, wgtypes.Key{}, fmt.Errorf("parse client public key: %w", err)
 	}
+	return wgtypes.Key{}, public, nil
+}
 
-	sb.WriteString("\n[Peer]\n")
-	sb.WriteString(fmt.Sprintf("PublicKey = %s\n", node.PublicKey))
-	if peer.PresharedKey != nil {
-		sb.WriteString(fmt.Sprintf("PresharedKey = %s\n", *peer.PresharedKey))
+// assignAddresses returns the repository callback that assigns the peer's
+// AllowedIPs from the chosen node's pool.
+func assignAddresses(requested string) func(node entities.Node, used []netip.Addr) (string, error) {
+	return func(node entities.Node, used []netip.Addr) (string, error) {
+		pool, err := nodePool(node)
+		if err != nil {
+			return "", err
+		}
+		assignment, err := pool.Assign(requested, used)
+		if err != nil {
+			return "", err
+		}
+		return assignment.String(), nil
 	}
-	sb.WriteString(fmt.Sprintf("Endpoint = %s\n", node.Endpoint))
-	sb.WriteString("AllowedIPs = 0.0.0.0/0, ::/0\n")
+}
 
-	return sb.String()
+func nodePool(node entities.Node) (ipam.Pool, error) {
+	address := node.TunnelAddress
+	if address == "" {
+		address = ipam.DefaultNodeAddress
+	}
+	var prefix6 string
+	if node.IPv6Enabled && node.TunnelIPv6Prefix != nil {
+		prefix6 = *node.TunnelIPv6Prefix
+	}
+	return ipam.NewPool(address, prefix6)
 }
 
 func generateQRCode(payload string) (string, error) {
@@ -349,6 +944,10 @@ func hashToken(token string) string {
 }
 
 type configTokenMetadata struct {
-	PeerID uuid.UUID `json:"peer_id"`
-	Config string    `json:"config"`
+	PeerID    uuid.UUID `json:"peer_id"`
+	NodeID    uuid.UUID `json:"node_id"`
+	PublicKey string    `json:"public_key,omitempty"`
+	Config    string    `json:"config"`
+	// Client is the structured config the export formats render from.
+	Client *clientconfig.Config `json:"client,omitempty"`
 }
@@ -0,0 +1,194 @@
+// Package fieldcrypt encrypts individual database fields with AES-256-GCM.
+// Every ciphertext names the key it was sealed with, so keys can be rotated:
+// new values use the primary key while older keys stay available for reading
+// until a re-encryption pass has moved every value to the primary.
+package fieldcrypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// KeySize is the length of a field encryption key.
+const KeySize = 32
+
+// prefix marks encrypted values: enc:v1:<key id>:<base64 nonce||ciphertext>.
+// Values without it are legacy plaintext.
+const prefix = "enc:v1:"
+
+var (
+	ErrUnknownKey = errors.New("unknown field encryption key")
+	ErrDecrypt    = errors.New("field decryption failed")
+	ErrNoKeyring  = errors.New("encrypted field but no keyring configured")
+)
+
+// Keyring holds the AEAD keys by id. A nil *Keyring disables encryption:
+// Seal returns plaintext and Open only accepts plaintext.
+type Keyring struct {
+	primary string
+	keys    map[string]cipher.AEAD
+}
+
+// NewKeyring builds a keyring that seals with primary and opens with any key.
+func NewKeyring(primary string, keys map[string][]byte) (*Keyring, error) {
+	if _, ok := keys[primary]; !ok {
+		return nil, fmt.Errorf("primary key %q not in keyring", primary)
+	}
+	k := &Keyring{primary: primary, keys: make(map[string]cipher.AEAD, len(keys))}
+	for id, key := range keys {
+		if id == "" || strings.Contains(id, ":") {
+			return nil, fmt.Errorf("invalid key id %q", id)
+		}
+		if len(key) != KeySize {
+			return nil, fmt.Errorf("key %q must be %d bytes, got %d", id, KeySize, len(key))
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		k.keys[id] = aead
+	}
+	return k, nil
+}
+
+// ParseKeys reads a key list of the form "id1:base64key,id2:base64key".
+func ParseKeys(spec string) (map[string][]byte, error) {
+	keys := make(map[string][]byte)
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		id, encoded, ok := strings.Cut(entry, ":")
+		if !ok {
+			return nil, fmt.Errorf("key entry %q must be id:base64", entry)
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("decode key %q: %w", id, err)
+		}
+		if _, dup := keys[id]; dup {
+			return nil, fmt.Errorf("duplicate key id %q", id)
+		}
+		keys[id] = key
+	}
+	return keys, nil
+}
+
+// Primary returns the id of the key new values are sealed with.
+func (k *Keyring) Primary() string {
+	if k == nil {
+		return ""
+	}
+	return k.primary
+}
+
+// KeyIDs returns the ids of all keys, sorted.
+func (k *Keyring) KeyIDs() []string {
+	if k == nil {
+		return nil
+	}
+	ids := make([]string, 0, len(k.keys))
+	for id := range k.keys {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Seal encrypts plaintext with the primary key. field (e.g. "peers.preshared_key")
+// is bound as additional data, so a value cannot be moved to another column.
+func (k *Keyring) Seal(field, plaintext string) (string, error) {
+	if k == nil {
+		return plaintext, nil
+	}
+	aead := k.keys[k.primary]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(plaintext), []byte(field))
+	return prefix + k.primary + ":" + base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+// Open decrypts a value produced by Seal. Plaintext values written before
+// encryption was enabled are returned unchanged.
+func (k *Keyring) Open(field, value string) (string, error) {
+	if !IsSealed(value) {
+		return value, nil
+	}
+	if k == nil {
+		return "", ErrNoKeyring
+	}
+	id, encoded, ok := strings.Cut(strings.TrimPrefix(value, prefix), ":")
+	if !ok {
+		return "", ErrDecrypt
+	}
+	aead, ok := k.keys[id]
+	if !ok {
+		return "", fmt.Errorf("%w: %q", ErrUnknownKey, id)
+	}
+	raw, err := base64.RawStdEncoding.DecodeString(encoded)
+	if err != nil || len(raw) < aead.NonceSize() {
+		return "", ErrDecrypt
+	}
+	plain, err := aead.Open(nil, raw[:aead.NonceSize()], raw[aead.NonceSize():], []byte(field))
+	if err != nil {
+		return "", ErrDecrypt
+	}
+	return string(plain), nil
+}
+
+// SealPtr is Seal for nullable columns.
+func (k *Keyring) SealPtr(field string, plaintext *string) (*string, error) {
+	if plaintext == nil {
+		return nil, nil
+	}
+	sealed, err := k.Seal(field, *plaintext)
+	if err != nil {
+		return nil, err
+	}
+	return &sealed, nil
+}
+
+// OpenPtr is Open for nullable columns.
+func (k *Keyring) OpenPtr(field string, value *string) (*string, error) {
+	if value == nil {
+		return nil, nil
+	}
+	plain, err := k.Open(field, *value)
+	if err != nil {
+		return nil, err
+	}
+	return &plain, nil
+}
+
+// NeedsRotation reports whether value should be re-sealed: it is plaintext
+// or sealed with a key other than the primary.
+func (k *Keyring) NeedsRotation(value string) bool {
+	if k == nil {
+		return false
+	}
+	return !strings.HasPrefix(value, SealedPrefix(k.primary))
+}
+
+// IsSealed reports whether value was produced by Seal.
+func IsSealed(value string) bool {
+	return strings.HasPrefix(value, prefix)
+}
+
+// SealedPrefix is the prefix of every value sealed with key id, usable in SQL
+// LIKE patterns to find values that still need re-encryption.
+func SealedPrefix(id string) string {
+	return prefix + id + ":"
+}
@@ -16,6 +16,7 @@ import (
 	"gopkg.in/yaml.v3"
 
 	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/config"
+	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/platform/fieldcrypt"
 )
 
 // Manager loads secrets from configured providers (SOPS, Vault) and exposes them.
@@ -73,6 +74,43 @@ func (m *Manager) Apply(values map[string]string) {
 	}
 }
 
+// FieldKeyring builds the keyring for database field encryption. Keys set in
+// the SOPS or Vault secrets take precedence over the configuration, so key
+// material does not have to live in the environment files. It returns nil
+// when no keys are configured.
+func (m *Manager) FieldKeyring(ctx context.Context, cfg config.FieldEncryptionConfig) (*fieldcrypt.Keyring, error) {
+	spec, primary := cfg.Keys, cfg.PrimaryKey
+	if m.Enabled() {
+		values, err := m.Load(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if v := values["FIELD_ENCRYPTION_KEYS"]; v != "" {
+			spec = v
+		}
+		if v := values["FIELD_ENCRYPTION_PRIMARY_KEY"]; v != "" {
+			primary = v
+		}
+	}
+	if strings.TrimSpace(spec) == "" {
+		return nil, nil
+	}
+
+	keys, err := fieldcrypt.ParseKeys(spec)
+	if err != nil {
+		return nil, fmt.Errorf("parse field encryption keys: %w", err)
+	}
+	if primary == "" {
+		if len(keys) != 1 {
+			return nil, errors.New("field encryption primary key is required with several keys")
+		}
+		for id := range keys {
+			primary = id
+		}
+	}
+	return fieldcrypt.NewKeyring(primary, keys)
+}
+
 func (m *Manager) loadSOPS() (map[string]string, error) {
 	path := m.cfg.SOPS.Path
 	if path == "" {
@@ -0,0 +1,65 @@
+// Package reencrypt moves encrypted database fields to the primary key.
+package reencrypt
+
+import (
+	"context"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/config"
+)
+
+// Repository re-seals encrypted fields.
+type Repository interface {
+	// ReencryptFields seals plaintext values and values sealed with a
+	// retired key with the primary key, batchSize rows at a time.
+	ReencryptFields(ctx context.Context, batchSize int) (updated, failed int64, err error)
+}
+
+// Worker periodically re-encrypts fields so that, after a key rotation, the
+// retired key can be removed from the keyring once failed reaches zero.
+type Worker struct {
+	repo      Repository
+	interval  time.Duration
+	batchSize int
+	logger    *zap.Logger
+}
+
+func NewWorker(repo Repository, cfg config.FieldEncryptionConfig, logger *zap.Logger) *Worker {
+	return &Worker{
+		repo:      repo,
+		interval:  cfg.ReencryptInterval,
+		batchSize: cfg.ReencryptBatchSize,
+		logger:    logger,
+	}
+}
+
+// Run re-encrypts on start and on every interval tick until ctx is done.
+func (w *Worker) Run(ctx context.Context) {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for {
+		if err := w.Pass(ctx); err != nil && ctx.Err() == nil {
+			w.logger.Error("field re-encryption failed", zap.Error(err))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Pass runs one re-encryption pass over all encrypted fields.
+func (w *Worker) Pass(ctx context.Context) error {
+	updated, failed, err := w.repo.ReencryptFields(ctx, w.batchSize)
+	if updated > 0 {
+		w.logger.Info("re-encrypted fields", zap.Int64("count", updated))
+	}
+	if failed > 0 {
+		w.logger.Warn("fields could not be decrypted for re-encryption", zap.Int64("count", failed))
+	}
+	return err
+}
@@ -12,14 +12,24 @@ import (
 
 	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/config"
 	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/entities"
+	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/entitlements"
+	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/ipam"
+	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/storage/postgres"
 )
 
+// ErrNodeNotFound is returned for unknown node ids.
+var ErrNodeNotFound = errors.New("node not found")
+
+// ErrNodeIdentityConflict means the node is bound to a different client
+// certificate, or the certificate to a different node.
+var ErrNodeIdentityConflict = errors.New("node is bound to a different certificate")
+
 // Repository describes persistence operations used by the regions service.
 type Repository interface {
 	UpsertRegion(ctx context.Context, region entities.Region) (entities.Region, error)
 	ListRegionsWithCapacity(ctx context.Context) ([]entities.RegionCapacity, error)
 	RegisterOrUpdateNode(ctx context.Context, node entities.Node) (entities.Node, error)
-	UpdateNodeHealth(ctx context.Context, nodeID uuid.UUID, capacityScore int) (entities.Node, error)
+	UpdateNodeHealth(ctx context.Context, nodeID uuid.UUID, capacityScore int, drain bool) (entities.Node, error)
 	GetRegionByCode(ctx context.Context, code string) (entities.Region, error)
 	GetNodeByID(ctx context.Context, id uuid.UUID) (entities.Node, error)
 }
@@ -57,6 +67,28 @@ func (s *Service) List(ctx context.Context) ([]entities.RegionCapacity, error) {
 	return s.repo.ListRegionsWithCapacity(ctx)
 }
 
+// RegionAccess is a region plus whether the user's plan may use it.
+type RegionAccess struct {
+	entities.RegionCapacity
+	Allowed bool
+}
+
+// ListForPlan returns all regions, marking those the entitlements allow.
+func (s *Service) ListForPlan(ctx context.Context, ent entitlements.Entitlements) ([]RegionAccess, error) {
+	regions, err := s.repo.ListRegionsWithCapacity(ctx)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]RegionAccess, 0, len(regions))
+	for _, region := range regions {
+		out = append(out, RegionAccess{
+			RegionCapacity: region,
+			Allowed:        ent.AllowsRegion(region.Region.Code),
+		})
+	}
+	return out, nil
+}
+
 // RegisterNode registers or updates a node associated with a region code.
 type RegisterNodeInput struct {
 	RegionCode string
@@ -66,6 +98,18 @@ type RegisterNodeInput struct {
 	PublicKey  string
 	Endpoint   string
 	TunnelPort int
+	// TunnelAddress is the node's tunnel interface address; empty falls back
+	// to ipam.DefaultNodeAddress.
+	TunnelAddress string
+	// TunnelIPv6Prefix and IPv6Enabled come from the node's announced
+	// capabilities; IPv6 is never enabled without a prefix.
+	TunnelIPv6Prefix *string
+	IPv6Enabled      bool
+	// CertIdentity binds the node to the certificate it registered with;
+	// nil when node identity verification is off. A node bound to another
+	// certificate is re-bound when CertName matches that certificate's name.
+	CertIdentity *string
+	CertName     *string
 }
 
 func (s *Service) RegisterNode(ctx context.Context, input RegisterNodeInput) (entities.Node, error) {
@@ -81,6 +125,14 @@ func (s *Service) RegisterNode(ctx context.Context, input RegisterNodeInput) (en
 		return entities.Node{}, err
 	}
 
+	tunnelAddress := input.TunnelAddress
+	if tunnelAddress == "" {
+		tunnelAddress = ipam.DefaultNodeAddress
+	}
+	if _, err := ipam.NewPool(tunnelAddress, ""); err != nil {
+		return entities.Node{}, err
+	}
+
 	node := entities.Node{
 		RegionID:      region.ID,
 		Hostname:      input.Hostname,
@@ -91,9 +143,19 @@ func (s *Service) RegisterNode(ctx context.Context, input RegisterNodeInput) (en
 		Status:        "active",
 		TunnelPort:    input.TunnelPort,
 		CapacityScore: 100,
+		TunnelAddress: tunnelAddress,
+
+		TunnelIPv6Prefix: input.TunnelIPv6Prefix,
+		IPv6Enabled:      input.IPv6Enabled && input.TunnelIPv6Prefix != nil,
+		CertIdentity:     input.CertIdentity,
+		CertName:         input.CertName,
 	}
 
-	return s.repo.RegisterOrUpdateNode(ctx, node)
+	registered, err := s.repo.RegisterOrUpdateNode(ctx, node)
+	if errors.Is(err, postgres.ErrNodeIdentityConflict) {
+		return entities.Node{}, ErrNodeIdentityConflict
+	}
+	return registered, err
 }
 
 // ReportHealth updates node health metrics and recalculates capacity score.
@@ -103,6 +165,9 @@ type HealthReportInput struct {
 	CPUPercent     float64
 	ThroughputMbps float64
 	PacketLoss     float64
+	// Drain is the agent's drain mode; turning it on or off moves the node
+	// to draining or back to active.
+	Drain bool
 }
 
 func (s *Service) ReportHealth(ctx context.Context, input HealthReportInput) (entities.Node, error) {
@@ -111,7 +176,12 @@ func (s *Service) ReportHealth(ctx context.Context, input HealthReportInput) (en
 	}
 
 	score := computeCapacityScore(input)
-	return s.repo.UpdateNodeHealth(ctx, input.NodeID, score)
+	return s.repo.UpdateNodeHealth(ctx, input.NodeID, score, input.Drain)
+}
+
+// GetRegionByCode looks up a region by its code.
+func (s *Service) GetRegionByCode(ctx context.Context, code string) (entities.Region, error) {
+	return s.repo.GetRegionByCode(ctx, code)
 }
 
 // GetNodeByID exposes node metadata for other services.
@@ -119,6 +189,19 @@ func (s *Service) GetNodeByID(ctx context.Context, id uuid.UUID) (entities.Node,
 	return s.repo.GetNodeByID(ctx, id)
 }
 
+// NodeCertIdentity returns the client certificate identity the node is bound
+// to, or nil while it is unbound.
+func (s *Service) NodeCertIdentity(ctx context.Context, id uuid.UUID) (*string, error) {
+	node, err := s.repo.GetNodeByID(ctx, id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrNodeNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return node.CertIdentity, nil
+}
+
 func computeCapacityScore(health HealthReportInput) int {
 	score := 100
 	score -= minInt(60, health.ActivePeers*4)
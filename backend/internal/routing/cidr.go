@@ -0,0 +1,110 @@
+package routing
+
+import (
+	"net/netip"
+	"sort"
+)
+
+// addrRange is an inclusive range of addresses of one family.
+type addrRange struct {
+	first, last netip.Addr
+}
+
+// Subtract returns the smallest set of prefixes covering every address in
+// base that is not in exclude. Families are handled independently.
+func Subtract(base, exclude []netip.Prefix) []netip.Prefix {
+	excluded := mergeRanges(exclude)
+
+	var out []netip.Prefix
+	for _, r := range mergeRanges(base) {
+		cur, open := r.first, true
+		for _, ex := range excluded {
+			if ex.first.Is4() != cur.Is4() || ex.last.Less(cur) || r.last.Less(ex.first) {
+				continue
+			}
+			if cur.Less(ex.first) {
+				out = append(out, rangePrefixes(cur, ex.first.Prev())...)
+			}
+			if !ex.last.Less(r.last) {
+				open = false
+				break
+			}
+			cur = ex.last.Next()
+		}
+		if open {
+			out = append(out, rangePrefixes(cur, r.last)...)
+		}
+	}
+	return out
+}
+
+// mergeRanges converts prefixes to sorted ranges, joining overlapping and
+// adjacent ones.
+func mergeRanges(prefixes []netip.Prefix) []addrRange {
+	ranges := make([]addrRange, 0, len(prefixes))
+	for _, p := range prefixes {
+		if !p.IsValid() {
+			continue
+		}
+		p = p.Masked()
+		ranges = append(ranges, addrRange{first: p.Addr(), last: lastAddr(p)})
+	}
+	// IPv4 sorts before IPv6, so each family forms one contiguous run.
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].first.Less(ranges[j].first) })
+
+	merged := ranges[:0]
+	for _, r := range ranges {
+		if n := len(merged); n > 0 && merged[n-1].first.Is4() == r.first.Is4() {
+			prev := &merged[n-1]
+			// An invalid Next means prev runs to the end of the family.
+			if next := prev.last.Next(); !next.IsValid() || !next.Less(r.first) {
+				if prev.last.Less(r.last) {
+					prev.last = r.last
+				}
+				continue
+			}
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+// rangePrefixes splits an inclusive range into the fewest aligned prefixes.
+func rangePrefixes(first, last netip.Addr) []netip.Prefix {
+	var out []netip.Prefix
+	for {
+		var p netip.Prefix
+		for bits := 0; bits <= first.BitLen(); bits++ {
+			candidate := netip.PrefixFrom(first, bits)
+			if candidate.Masked().Addr() != first || last.Less(lastAddr(candidate)) {
+				continue
+			}
+			p = candidate
+			break
+		}
+		out = append(out, p)
+		end := lastAddr(p)
+		if end == last {
+			return out
+		}
+		first = end.Next()
+	}
+}
+
+// lastAddr returns the highest address in p.
+func lastAddr(p netip.Prefix) netip.Addr {
+	p = p.Masked()
+	b := p.Addr().As16()
+	offset := 0
+	if p.Addr().Is4() {
+		offset = 96
+	}
+	for bit := offset + p.Bits(); bit < 128; bit++ {
+		b[bit/8] |= 1 << (7 - bit%8)
+	}
+	addr := netip.AddrFrom16(b)
+	if p.Addr().Is4() {
+		return addr.Unmap()
+	}
+	return addr
+}
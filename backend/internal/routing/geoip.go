@@ -0,0 +1,72 @@
+package routing
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"strings"
+)
+
+// GeoIP maps ISO 3166-1 alpha-2 country codes to their address ranges.
+type GeoIP struct {
+	countries map[string][]netip.Prefix
+}
+
+// LoadGeoIP reads a CIDR file with one "prefix,country" pair per line, such
+// as "85.96.0.0/12,TR". Blank lines and lines starting with # are skipped.
+func LoadGeoIP(path string) (*GeoIP, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open geoip file: %w", err)
+	}
+	defer f.Close()
+
+	geo, err := ParseGeoIP(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return geo, nil
+}
+
+// ParseGeoIP reads the format described at LoadGeoIP.
+func ParseGeoIP(r io.Reader) (*GeoIP, error) {
+	geo := &GeoIP{countries: make(map[string][]netip.Prefix)}
+
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		cidr, country, ok := strings.Cut(text, ",")
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected prefix,country", line)
+		}
+		prefix, err := netip.ParsePrefix(strings.TrimSpace(cidr))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		country = strings.ToUpper(strings.TrimSpace(country))
+		if len(country) != 2 {
+			return nil, fmt.Errorf("line %d: invalid country code %q", line, country)
+		}
+		geo.countries[country] = append(geo.countries[country], prefix.Masked())
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read geoip file: %w", err)
+	}
+	return geo, nil
+}
+
+// Country returns the prefixes of a country; nil when unknown or when g is
+// nil.
+func (g *GeoIP) Country(code string) []netip.Prefix {
+	if g == nil {
+		return nil
+	}
+	return g.countries[strings.ToUpper(code)]
+}
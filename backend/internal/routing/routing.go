@@ -0,0 +1,153 @@
+// Package routing computes the AllowedIPs a client routes through the tunnel
+// for a peer's split-tunnel preset.
+package routing
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/entities"
+)
+
+const (
+	// PresetFull routes everything through the tunnel.
+	PresetFull = "full"
+	// PresetExcludeLAN keeps private and link-local ranges on the local
+	// network, so printers and NAS stay reachable.
+	PresetExcludeLAN = "exclude_lan"
+	// PresetExcludeCountry keeps a country's address space off the tunnel.
+	PresetExcludeCountry = "exclude_country"
+	// PresetCustom excludes a user-supplied list of prefixes.
+	PresetCustom = "custom"
+
+	// MaxCustomExcludes bounds the custom exclude list.
+	MaxCustomExcludes = 256
+)
+
+var (
+	ErrUnknownPreset      = errors.New("unknown routing preset")
+	ErrInvalidExclude     = errors.New("invalid routing exclude")
+	ErrCountryUnavailable = errors.New("no geoip ranges for country")
+)
+
+var (
+	allIPv4 = netip.MustParsePrefix("0.0.0.0/0")
+	allIPv6 = netip.MustParsePrefix("::/0")
+
+	lanPrefixes = []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("172.16.0.0/12"),
+		netip.MustParsePrefix("192.168.0.0/16"),
+		netip.MustParsePrefix("169.254.0.0/16"),
+		netip.MustParsePrefix("fc00::/7"),
+		netip.MustParsePrefix("fe80::/10"),
+	}
+)
+
+// Planner turns routing presets into AllowedIPs.
+type Planner struct {
+	geo *GeoIP
+}
+
+// NewPlanner returns a planner; a nil geo disables the exclude_country
+// preset.
+func NewPlanner(geo *GeoIP) *Planner {
+	return &Planner{geo: geo}
+}
+
+// Normalize validates routing and returns its canonical form: an empty
+// preset means full, the country is upper case and excludes are masked
+// prefixes. Fields that do not apply to the preset are dropped.
+func (p *Planner) Normalize(r entities.PeerRouting) (entities.PeerRouting, error) {
+	preset := strings.ToLower(strings.TrimSpace(r.Preset))
+	switch preset {
+	case "", PresetFull:
+		return entities.PeerRouting{Preset: PresetFull}, nil
+	case PresetExcludeLAN:
+		return entities.PeerRouting{Preset: PresetExcludeLAN}, nil
+	case PresetExcludeCountry:
+		country := strings.ToUpper(strings.TrimSpace(r.Country))
+		if len(p.geo.Country(country)) == 0 {
+			return entities.PeerRouting{}, fmt.Errorf("%w: %q", ErrCountryUnavailable, country)
+		}
+		return entities.PeerRouting{Preset: PresetExcludeCountry, Country: country}, nil
+	case PresetCustom:
+		if len(r.Exclude) == 0 || len(r.Exclude) > MaxCustomExcludes {
+			return entities.PeerRouting{}, fmt.Errorf("%w: between 1 and %d entries required", ErrInvalidExclude, MaxCustomExcludes)
+		}
+		excludes := make([]string, 0, len(r.Exclude))
+		for _, value := range r.Exclude {
+			prefix, err := parsePrefix(value)
+			if err != nil {
+				return entities.PeerRouting{}, err
+			}
+			excludes = append(excludes, prefix.String())
+		}
+		return entities.PeerRouting{Preset: PresetCustom, Exclude: excludes}, nil
+	default:
+		return entities.PeerRouting{}, fmt.Errorf("%w: %s", ErrUnknownPreset, r.Preset)
+	}
+}
+
+// AllowedIPs returns the prefixes the client routes through the tunnel:
+// everything (IPv6 only when the node carries it) minus the preset's
+// excludes. Prefixes in keep, such as the tunnel subnet and DNS servers,
+// always stay routed.
+func (p *Planner) AllowedIPs(r entities.PeerRouting, ipv6 bool, keep []netip.Prefix) ([]string, error) {
+	r, err := p.Normalize(r)
+	if err != nil {
+		return nil, err
+	}
+
+	base := []netip.Prefix{allIPv4}
+	if ipv6 {
+		base = append(base, allIPv6)
+	}
+
+	var exclude []netip.Prefix
+	switch r.Preset {
+	case PresetExcludeLAN:
+		exclude = lanPrefixes
+	case PresetExcludeCountry:
+		exclude = p.geo.Country(r.Country)
+	case PresetCustom:
+		for _, value := range r.Exclude {
+			prefix, err := parsePrefix(value)
+			if err != nil {
+				return nil, err
+			}
+			exclude = append(exclude, prefix)
+		}
+	}
+
+	// Subtract yields IPv4 before IPv6, each in ascending order.
+	allowed := Subtract(base, Subtract(exclude, keep))
+	out := make([]string, 0, len(allowed))
+	for _, prefix := range allowed {
+		out = append(out, prefix.String())
+	}
+	return out, nil
+}
+
+// parsePrefix accepts a CIDR or a bare address, which becomes a host prefix.
+func parsePrefix(value string) (netip.Prefix, error) {
+	value = strings.TrimSpace(value)
+	if strings.Contains(value, "/") {
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("%w: %q", ErrInvalidExclude, value)
+		}
+		if prefix.Addr().Is4In6() {
+			return netip.Prefix{}, fmt.Errorf("%w: %q", ErrInvalidExclude, value)
+		}
+		return prefix.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(value)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("%w: %q", ErrInvalidExclude, value)
+	}
+	addr = addr.Unmap().WithZone("")
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
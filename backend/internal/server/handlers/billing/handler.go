@@ -1,23 +1,26 @@
 package billinghandler
 
 import (
+	"errors"
 	"net/http"
 
 	"github.com/gin-gonic/gin"
-	"github.com/google/uuid"
 	"go.uber.org/zap"
 
 	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/billing"
+	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/entitlements"
+	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/server/middleware"
 )
 
 // Handler wires billing endpoints to the service layer.
 type Handler struct {
-	service *billing.Service
-	logger  *zap.Logger
+	service      *billing.Service
+	entitlements *entitlements.Service
+	logger       *zap.Logger
 }
 
-func New(service *billing.Service, logger *zap.Logger) *Handler {
-	return &Handler{service: service, logger: logger}
+func New(service *billing.Service, entitlements *entitlements.Service, logger *zap.Logger) *Handler {
+	return &Handler{service: service, entitlements: entitlements, logger: logger}
 }
 
 // ListPlans returns active subscription plans.
@@ -45,7 +48,7 @@ func (h *Handler) CreateCheckoutSession(c *gin.Context) {
 		return
 	}
 
-	userID, ok := userIDFromContext(c)
+	userID, ok := middleware.UserID(c)
 	if !ok {
 		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
 		return
@@ -103,7 +106,7 @@ func (h *Handler) StripeWebhook(c *gin.Context) {
 
 // ListPayments exposes payment history for the authenticated user.
 func (h *Handler) ListPayments(c *gin.Context) {
-	userID, ok := userIDFromContext(c)
+	userID, ok := middleware.UserID(c)
 	if !ok {
 		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
 		return
@@ -119,22 +122,32 @@ func (h *Handler) ListPayments(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"payments": payments})
 }
 
-func userIDFromContext(c *gin.Context) (uuid.UUID, bool) {
-	value, exists := c.Get("user_id")
-	if !exists {
-		return uuid.UUID{}, false
+// Entitlements reports what the authenticated user's current plan allows.
+func (h *Handler) Entitlements(c *gin.Context) {
+	userID, ok := middleware.UserID(c)
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
 	}
 
-	switch v := value.(type) {
-	case uuid.UUID:
-		return v, true
-	case string:
-		uid, err := uuid.Parse(v)
-		if err != nil {
-			return uuid.UUID{}, false
+	ent, err := h.entitlements.Resolve(c.Request.Context(), userID)
+	if err != nil {
+		switch {
+		case errors.Is(err, entitlements.ErrNoActiveSubscription):
+			c.JSON(http.StatusPaymentRequired, gin.H{"error": err.Error()})
+		default:
+			h.logger.Error("resolve entitlements failed", zap.Error(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to resolve entitlements"})
 		}
-		return uid, true
-	default:
-		return uuid.UUID{}, false
+		return
 	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"plan_code":    ent.PlanCode,
+		"status":       ent.SubscriptionStatus,
+		"period_end":   ent.PeriodEnd,
+		"device_limit": ent.DeviceLimit,
+		"regions":      ent.Regions,
+		"add_ons":      ent.AddOns,
+	})
 }
@@ -1,90 +1,138 @@
 package nodeshandler
 
 import (
+	"errors"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 	"go.uber.org/zap"
 
 	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/config"
+	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/entities"
+	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/nodes"
+	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/nodestream"
+	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/peers"
 	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/regions"
+	"github.com/emrecetinkayadev/vpn-tridot/nodeproto"
 )
 
-// Handler manages node registration and health endpoints.
+// Handler manages node registration, health and desired state endpoints.
 type Handler struct {
 	service        *regions.Service
+	peers          *peers.Service
 	logger         *zap.Logger
 	provisionToken string
+	hub            *nodestream.Hub
+	identity       *nodes.Verifier
+	pingInterval   time.Duration
+	pollInterval   time.Duration
 }
 
-func New(service *regions.Service, cfg config.NodeConfig, logger *zap.Logger) *Handler {
-	return &Handler{service: service, logger: logger, provisionToken: cfg.ProvisionToken}
+func New(service *regions.Service, peerService *peers.Service, cfg config.NodeConfig, logger *zap.Logger) *Handler {
+	return &Handler{
+		service:        service,
+		peers:          peerService,
+		logger:         logger,
+		provisionToken: cfg.ProvisionToken,
+		pingInterval:   cfg.StreamPingInterval,
+		pollInterval:   cfg.StreamPollInterval,
+	}
+}
+
+// UseIdentity makes every node endpoint require the client certificate the
+// node is bound to. Registration binds a node on first use.
+func (h *Handler) UseIdentity(verifier *nodes.Verifier) {
+	h.identity = verifier
 }
 
 func (h *Handler) Register(c *gin.Context) {
-	if !h.validateToken(c) {
+	if !h.authorize(c) {
 		return
 	}
-
-	type request struct {
-		RegionCode string  `json:"region_code" binding:"required"`
-		Hostname   string  `json:"hostname" binding:"required"`
-		PublicIPv4 *string `json:"public_ipv4"`
-		PublicIPv6 *string `json:"public_ipv6"`
-		PublicKey  string  `json:"public_key"`
-		Endpoint   string  `json:"endpoint"`
-		TunnelPort int     `json:"tunnel_port"`
+	var identity nodes.Identity
+	if h.identity != nil {
+		var ok bool
+		if identity, ok = h.identify(c); !ok {
+			return
+		}
 	}
 
-	var req request
+	var req nodeproto.RegisterRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	if err := req.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 
-	node, err := h.service.RegisterNode(c.Request.Context(), regions.RegisterNodeInput{
-		RegionCode: req.RegionCode,
-		Hostname:   req.Hostname,
-		PublicIPv4: req.PublicIPv4,
-		PublicIPv6: req.PublicIPv6,
-		PublicKey:  req.PublicKey,
-		Endpoint:   req.Endpoint,
-		TunnelPort: req.TunnelPort,
-	})
+	input := regions.RegisterNodeInput{
+		RegionCode:    req.RegionCode,
+		Hostname:      req.Hostname,
+		PublicIPv4:    req.PublicIPv4,
+		PublicIPv6:    req.PublicIPv6,
+		PublicKey:     req.PublicKey,
+		Endpoint:      req.Endpoint,
+		TunnelPort:    req.TunnelPort,
+		TunnelAddress: req.TunnelAddress,
+		IPv6Enabled:   req.HasCapability(nodeproto.CapabilityIPv6),
+	}
+	if req.TunnelIPv6Prefix != "" {
+		input.TunnelIPv6Prefix = &req.TunnelIPv6Prefix
+	}
+	if h.identity != nil {
+		binding, err := h.identity.Binding(identity, req.Hostname)
+		if err != nil {
+			c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+			return
+		}
+		input.CertIdentity = &binding
+		if identity.Name != "" {
+			input.CertName = &identity.Name
+		}
+	}
+	node, err := h.service.RegisterNode(c.Request.Context(), input)
+	if errors.Is(err, regions.ErrNodeIdentityConflict) {
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
 	if err != nil {
 		h.logger.Error("register node failed", zap.Error(err))
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	c.JSON(http.StatusCreated, gin.H{"node_id": node.ID})
+	c.JSON(http.StatusCreated, nodeproto.RegisterResponse{NodeID: node.ID.String()})
 }
 
 func (h *Handler) ReportHealth(c *gin.Context) {
-	if !h.validateToken(c) {
+	if !h.authorize(c) {
 		return
 	}
 
-	type request struct {
-		NodeID         string  `json:"node_id" binding:"required"`
-		ActivePeers    int     `json:"active_peers"`
-		CPUPercent     float64 `json:"cpu_percent"`
-		ThroughputMbps float64 `json:"throughput_mbps"`
-		PacketLoss     float64 `json:"packet_loss"`
-	}
-
-	var req request
+	var req nodeproto.HealthReport
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	if err := req.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 
 	nodeID, err := uuid.Parse(req.NodeID)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid node_id"})
 		return
 	}
+	if !h.authorizeNode(c, nodeID) {
+		return
+	}
 
 	node, err := h.service.ReportHealth(c.Request.Context(), regions.HealthReportInput{
 		NodeID:         nodeID,
@@ -92,6 +140,7 @@ func (h *Handler) ReportHealth(c *gin.Context) {
 		CPUPercent:     req.CPUPercent,
 		ThroughputMbps: req.ThroughputMbps,
 		PacketLoss:     req.PacketLoss,
+		Drain:          req.Drain,
 	})
 	if err != nil {
 		h.logger.Error("node health update failed", zap.Error(err))
@@ -99,7 +148,157 @@ func (h *Handler) ReportHealth(c *gin.Context) {
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"capacity_score": node.CapacityScore})
+	c.JSON(http.StatusOK, nodeproto.HealthResponse{CapacityScore: node.CapacityScore})
+}
+
+// DesiredPeers returns the peer set a node should apply. Passing `since`
+// (the last revision the node applied) returns only the changes after it.
+func (h *Handler) DesiredPeers(c *gin.Context) {
+	if !h.authorize(c) {
+		return
+	}
+
+	nodeID, err := uuid.Parse(c.Query("node_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid node_id"})
+		return
+	}
+	if !h.authorizeNode(c, nodeID) {
+		return
+	}
+
+	var since int64
+	if raw := c.Query("since"); raw != "" {
+		since, err = strconv.ParseInt(raw, 10, 64)
+		if err != nil || since < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid since"})
+			return
+		}
+	}
+
+	desired, err := h.peers.DesiredPeers(c.Request.Context(), nodeID, since)
+	if err != nil {
+		if errors.Is(err, peers.ErrNodeNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		h.logger.Error("desired peers failed", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load desired peers"})
+		return
+	}
+
+	resp := nodeproto.DesiredPeersResponse{
+		NodeID:   desired.NodeID.String(),
+		Revision: desired.Revision,
+		Full:     desired.Full,
+		Peers:    make([]nodeproto.Peer, 0, len(desired.Peers)),
+		Removed:  desired.Removed,
+	}
+	for _, peer := range desired.Peers {
+		resp.Peers = append(resp.Peers, toProtoPeer(peer))
+	}
+	if resp.Removed == nil {
+		resp.Removed = []string{}
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
+
+// PeerStats ingests a batch of per-peer counters reported by a node.
+func (h *Handler) PeerStats(c *gin.Context) {
+	if !h.authorize(c) {
+		return
+	}
+
+	var req nodeproto.PeerStatsReport
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := req.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	nodeID, err := uuid.Parse(req.NodeID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid node_id"})
+		return
+	}
+	if !h.authorizeNode(c, nodeID) {
+		return
+	}
+
+	stats := make([]entities.PeerStat, 0, len(req.Peers))
+	for _, peer := range req.Peers {
+		stats = append(stats, entities.PeerStat{
+			PublicKey:       peer.PublicKey,
+			RxBytes:         int64(peer.RxBytes),
+			TxBytes:         int64(peer.TxBytes),
+			LastHandshakeAt: peer.LastHandshake,
+			Epoch:           req.Epoch,
+		})
+	}
+
+	updated, err := h.peers.IngestStats(c.Request.Context(), nodeID, stats)
+	if err != nil {
+		h.logger.Error("peer stats ingestion failed", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to apply peer stats"})
+		return
+	}
+
+	c.JSON(http.StatusOK, nodeproto.PeerStatsResponse{Updated: updated})
+}
+
+// authorize checks the provision token and the agent's protocol version, and
+// stamps the control plane's version on the response either way.
+func (h *Handler) authorize(c *gin.Context) bool {
+	nodeproto.SetHeader(c.Writer.Header())
+	if !h.validateToken(c) {
+		return false
+	}
+	if err := nodeproto.CheckHeader(c.Request.Header); err != nil {
+		c.AbortWithStatusJSON(http.StatusUpgradeRequired, nodeproto.ErrorResponse{
+			Error:            err.Error(),
+			SupportedVersion: nodeproto.SupportedRange(),
+		})
+		return false
+	}
+	return true
+}
+
+// identify verifies the request's client certificate.
+func (h *Handler) identify(c *gin.Context) (nodes.Identity, bool) {
+	identity, err := h.identity.Identify(c.Request)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return nodes.Identity{}, false
+	}
+	return identity, true
+}
+
+// authorizeNode rejects requests about nodeID that do not come from the
+// certificate the node is bound to. Unknown and unbound nodes are rejected
+// alike, so a certificate cannot probe for node ids.
+func (h *Handler) authorizeNode(c *gin.Context, nodeID uuid.UUID) bool {
+	if h.identity == nil {
+		return true
+	}
+	identity, ok := h.identify(c)
+	if !ok {
+		return false
+	}
+	bound, err := h.service.NodeCertIdentity(c.Request.Context(), nodeID)
+	if err != nil && !errors.Is(err, regions.ErrNodeNotFound) {
+		h.logger.Error("node identity lookup failed", zap.Error(err))
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "failed to verify node identity"})
+		return false
+	}
+	if !h.identity.Matches(identity, bound) {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": nodes.ErrIdentityMismatch.Error()})
+		return false
+	}
+	return true
 }
 
 func (h *Handler) validateToken(c *gin.Context) bool {
@@ -108,10 +307,26 @@ func (h *Handler) validateToken(c *gin.Context) bool {
 		return false
 	}
 
-	token := c.GetHeader("X-Provision-Token")
+	token := c.GetHeader(nodeproto.HeaderProvisionToken)
 	if token == "" || token != h.provisionToken {
 		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
 		return false
 	}
 	return true
 }
+
+func toProtoPeer(peer entities.PeerChange) nodeproto.Peer {
+	payload := nodeproto.Peer{PublicKey: peer.PublicKey, Group: peer.MeshGroup}
+	if peer.PresharedKey != nil {
+		payload.PresharedKey = *peer.PresharedKey
+	}
+	if peer.Keepalive != nil {
+		payload.PersistentKeepalive = *peer.Keepalive
+	}
+	for _, cidr := range strings.Split(peer.AllowedIPs, ",") {
+		if cidr = strings.TrimSpace(cidr); cidr != "" {
+			payload.AllowedIPs = append(payload.AllowedIPs, cidr)
+		}
+	}
+	return payload
+}
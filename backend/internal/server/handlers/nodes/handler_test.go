@@ -0,0 +1,252 @@
+package nodeshandler
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+
+	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/config"
+	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/entities"
+	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/nodes"
+	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/nodestream"
+	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/peers"
+	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/regions"
+	"github.com/emrecetinkayadev/vpn-tridot/nodeproto"
+)
+
+func newTestRouter() *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	h := New(nil, nil, config.NodeConfig{ProvisionToken: "secret"}, zap.NewNop())
+	engine := gin.New()
+	engine.GET("/peers", h.DesiredPeers)
+	return engine
+}
+
+func TestAuthorizeRejectsIncompatibleVersion(t *testing.T) {
+	engine := newTestRouter()
+
+	for _, version := range []string{"", strconv.Itoa(nodeproto.Version + 1)} {
+		req := httptest.NewRequest(http.MethodGet, "/peers?node_id=bad", nil)
+		req.Header.Set(nodeproto.HeaderProvisionToken, "secret")
+		if version != "" {
+			req.Header.Set(nodeproto.HeaderVersion, version)
+		}
+		rec := httptest.NewRecorder()
+		engine.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusUpgradeRequired {
+			t.Fatalf("version %q: expected 426, got %d", version, rec.Code)
+		}
+		if rec.Header().Get(nodeproto.HeaderVersion) != strconv.Itoa(nodeproto.Version) {
+			t.Fatalf("expected control plane version header on response")
+		}
+	}
+}
+
+func TestAuthorizeRejectsBearerToken(t *testing.T) {
+	engine := newTestRouter()
+
+	req := httptest.NewRequest(http.MethodGet, "/peers?node_id=bad", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	nodeproto.SetHeader(req.Header)
+	rec := httptest.NewRecorder()
+	engine.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401, got %d", rec.Code)
+	}
+}
+
+func TestAuthorizeAcceptsCurrentVersion(t *testing.T) {
+	engine := newTestRouter()
+
+	req := httptest.NewRequest(http.MethodGet, "/peers?node_id=bad", nil)
+	req.Header.Set(nodeproto.HeaderProvisionToken, "secret")
+	nodeproto.SetHeader(req.Header)
+	rec := httptest.NewRecorder()
+	engine.ServeHTTP(rec, req)
+
+	// Past authorization the handler rejects the malformed node_id.
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", rec.Code)
+	}
+}
+
+func TestStreamUnavailableUntilHubListens(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	h := New(nil, nil, config.NodeConfig{ProvisionToken: "secret"}, zap.NewNop())
+	engine := gin.New()
+	engine.GET("/stream", h.Stream)
+
+	send := func() int {
+		req := httptest.NewRequest(http.MethodGet, "/stream?node_id="+uuid.NewString(), nil)
+		req.Header.Set(nodeproto.HeaderProvisionToken, "secret")
+		nodeproto.SetHeader(req.Header)
+		rec := httptest.NewRecorder()
+		engine.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if code := send(); code != http.StatusServiceUnavailable {
+		t.Fatalf("without hub: expected 503, got %d", code)
+	}
+	// A hub that is not receiving events refuses streams; nodes keep polling.
+	h.UseStream(nodestream.NewHub(zap.NewNop()))
+	if code := send(); code != http.StatusServiceUnavailable {
+		t.Fatalf("hub not listening: expected 503, got %d", code)
+	}
+}
+
+func TestNodeEndpointsRequireClientCertificate(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "node-ca"},
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	verifier, err := nodes.NewVerifier(config.NodeIdentityConfig{ClientCAFile: caFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gin.SetMode(gin.TestMode)
+	h := New(nil, nil, config.NodeConfig{ProvisionToken: "secret"}, zap.NewNop())
+	h.UseIdentity(verifier)
+	engine := gin.New()
+	engine.POST("/register", h.Register)
+	engine.GET("/peers", h.DesiredPeers)
+
+	for _, req := range []*http.Request{
+		httptest.NewRequest(http.MethodPost, "/register", nil),
+		httptest.NewRequest(http.MethodGet, "/peers?node_id="+uuid.NewString(), nil),
+	} {
+		req.Header.Set(nodeproto.HeaderProvisionToken, "secret")
+		nodeproto.SetHeader(req.Header)
+		rec := httptest.NewRecorder()
+		engine.ServeHTTP(rec, req)
+
+		// The provision token alone no longer identifies a node.
+		if rec.Code != http.StatusUnauthorized {
+			t.Fatalf("%s: expected 401, got %d", req.URL.Path, rec.Code)
+		}
+	}
+}
+
+type healthRepoStub struct {
+	regions.Repository
+	drains []bool
+}
+
+func (r *healthRepoStub) UpdateNodeHealth(_ context.Context, nodeID uuid.UUID, score int, drain bool) (entities.Node, error) {
+	r.drains = append(r.drains, drain)
+	return entities.Node{ID: nodeID, CapacityScore: score}, nil
+}
+
+func TestReportHealthCarriesDrain(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	repo := &healthRepoStub{}
+	h := New(regions.NewService(repo, config.Config{}), nil, config.NodeConfig{ProvisionToken: "secret"}, zap.NewNop())
+	engine := gin.New()
+	engine.POST("/health", h.ReportHealth)
+
+	for _, body := range []string{`"drain":true`, `"drain":false`} {
+		req := httptest.NewRequest(http.MethodPost, "/health", strings.NewReader(`{"node_id":"`+uuid.NewString()+`",`+body+`}`))
+		req.Header.Set(nodeproto.HeaderProvisionToken, "secret")
+		nodeproto.SetHeader(req.Header)
+		rec := httptest.NewRecorder()
+		engine.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: expected 200, got %d: %s", body, rec.Code, rec.Body.String())
+		}
+	}
+	if len(repo.drains) != 2 || !repo.drains[0] || repo.drains[1] {
+		t.Fatalf("drain not passed to the node record: %v", repo.drains)
+	}
+}
+
+type nodeRepoStub struct {
+	regions.Repository
+	status string
+}
+
+func (r *nodeRepoStub) GetNodeByID(_ context.Context, id uuid.UUID) (entities.Node, error) {
+	return entities.Node{ID: id, Status: r.status}, nil
+}
+
+type revisionRepoStub struct {
+	peers.Repository
+}
+
+func (revisionRepoStub) NodePeerRevision(context.Context, uuid.UUID) (int64, error) {
+	return 42, nil
+}
+
+func TestStreamSnapshotAlwaysCarriesDrain(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	peerService, err := peers.NewService(revisionRepoStub{}, nil, nil, nil, config.PeersConfig{})
+	if err != nil {
+		t.Fatalf("peers service: %v", err)
+	}
+	for status, want := range map[string]bool{"active": false, "draining": true, "disabled": true} {
+		h := New(regions.NewService(&nodeRepoStub{status: status}, config.Config{}), peerService, config.NodeConfig{}, zap.NewNop())
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest(http.MethodGet, "/stream", nil)
+
+		msgs, err := h.streamSnapshot(c, uuid.New())
+		if err != nil {
+			t.Fatalf("%s: snapshot: %v", status, err)
+		}
+		last := msgs[len(msgs)-1]
+		if last.Type != nodeproto.StreamDrain || last.Drain == nil || *last.Drain != want {
+			t.Fatalf("%s: expected drain %v, got %+v", status, want, last)
+		}
+	}
+}
+
+func TestToProtoPeerCarriesMeshGroup(t *testing.T) {
+	peer := toProtoPeer(entities.PeerChange{
+		PublicKey:  "pk",
+		AllowedIPs: "10.8.0.2/32, fd00::2/128",
+		MeshGroup:  "group-a",
+	})
+	if peer.Group != "group-a" {
+		t.Fatalf("expected mesh group to be forwarded, got %q", peer.Group)
+	}
+	if len(peer.AllowedIPs) != 2 || peer.AllowedIPs[1] != "fd00::2/128" {
+		t.Fatalf("unexpected allowed ips %v", peer.AllowedIPs)
+	}
+
+	if isolated := toProtoPeer(entities.PeerChange{PublicKey: "pk"}); isolated.Group != "" {
+		t.Fatalf("expected no group for isolated peer, got %q", isolated.Group)
+	}
+}
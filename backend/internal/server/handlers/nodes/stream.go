@@ -0,0 +1,143 @@
+package nodeshandler
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+	"golang.org/x/net/websocket"
+
+	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/nodestream"
+	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/peers"
+	"github.com/emrecetinkayadev/vpn-tridot/nodeproto"
+)
+
+// streamWriteTimeout bounds a single message write to a node.
+const streamWriteTimeout = 10 * time.Second
+
+// UseStream enables the node stream, fed by hub.
+func (h *Handler) UseStream(hub *nodestream.Hub) {
+	h.hub = hub
+}
+
+// Stream upgrades to a WebSocket over which the node's peer revisions and
+// drain commands are pushed as they happen. It opens with the agent
+// settings, the current peer revision and, unless the node is active, a
+// drain command, so a node catches up on anything it missed while
+// disconnected.
+func (h *Handler) Stream(c *gin.Context) {
+	if !h.authorize(c) {
+		return
+	}
+	if h.hub == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "node stream disabled"})
+		return
+	}
+
+	nodeID, err := uuid.Parse(c.Query("node_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid node_id"})
+		return
+	}
+	if !h.authorizeNode(c, nodeID) {
+		return
+	}
+
+	// Subscribe before reading the snapshot so no change falls in between.
+	sub, err := h.hub.Subscribe(nodeID)
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	defer sub.Close()
+
+	initial, err := h.streamSnapshot(c, nodeID)
+	if err != nil {
+		if errors.Is(err, peers.ErrNodeNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		h.logger.Error("node stream snapshot failed", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load node state"})
+		return
+	}
+
+	server := websocket.Server{Handler: func(ws *websocket.Conn) {
+		h.serveStream(ws, sub, initial)
+	}}
+	server.ServeHTTP(c.Writer, c.Request)
+}
+
+func (h *Handler) streamSnapshot(c *gin.Context, nodeID uuid.UUID) ([]nodeproto.StreamMessage, error) {
+	revision, err := h.peers.PeerRevision(c.Request.Context(), nodeID)
+	if err != nil {
+		return nil, err
+	}
+	node, err := h.service.GetNodeByID(c.Request.Context(), nodeID)
+	if err != nil {
+		return nil, err
+	}
+
+	msgs := []nodeproto.StreamMessage{
+		{Type: nodeproto.StreamConfig, Config: &nodeproto.AgentSettings{
+			PingInterval: int(h.pingInterval / time.Second),
+			PollInterval: int(h.pollInterval / time.Second),
+		}},
+		{Type: nodeproto.StreamPeers, Revision: revision},
+	}
+	// Drain is always sent: a node that drained while disconnected must be
+	// told when an operator reactivated it in the meantime.
+	drain := node.Status != "active"
+	msgs = append(msgs, nodeproto.StreamMessage{Type: nodeproto.StreamDrain, Drain: &drain})
+	return msgs, nil
+}
+
+func (h *Handler) serveStream(ws *websocket.Conn, sub *nodestream.Subscription, initial []nodeproto.StreamMessage) {
+	defer ws.Close()
+	// The hijacked connection keeps the HTTP server's deadlines.
+	_ = ws.SetDeadline(time.Time{})
+
+	// Nodes never send anything; reading only notices when they hang up.
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		var discard string
+		for websocket.Message.Receive(ws, &discard) == nil {
+		}
+	}()
+
+	send := func(msgs []nodeproto.StreamMessage) bool {
+		for _, msg := range msgs {
+			_ = ws.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+			if err := websocket.JSON.Send(ws, msg); err != nil {
+				return false
+			}
+		}
+		return true
+	}
+	if !send(initial) {
+		return
+	}
+
+	ping := time.NewTicker(h.pingInterval)
+	defer ping.Stop()
+	for {
+		select {
+		case <-closed:
+			return
+		case <-sub.Done():
+			return
+		case <-sub.Ready():
+			if !send(sub.Pending()) {
+				return
+			}
+		case <-ping.C:
+			if !send([]nodeproto.StreamMessage{{Type: nodeproto.StreamPing}}) {
+				return
+			}
+		}
+	}
+}
@@ -2,13 +2,21 @@ package peershandler
 
 import (
 	"errors"
+	"fmt"
 	"net/http"
+	"strconv"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 	"go.uber.org/zap"
 
+	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/clientconfig"
+	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/entities"
+	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/entitlements"
+	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/ipam"
 	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/peers"
+	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/routing"
+	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/server/middleware"
 )
 
 // Handler manages peer CRUD endpoints.
@@ -22,7 +30,7 @@ func New(service *peers.Service, logger *zap.Logger) *Handler {
 }
 
 func (h *Handler) List(c *gin.Context) {
-	userID, ok := userIDFromContext(c)
+	userID, ok := middleware.UserID(c)
 	if !ok {
 		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
 		return
@@ -39,7 +47,7 @@ func (h *Handler) List(c *gin.Context) {
 }
 
 func (h *Handler) Usage(c *gin.Context) {
-	userID, ok := userIDFromContext(c)
+	userID, ok := middleware.UserID(c)
 	if !ok {
 		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
 		return
@@ -68,22 +76,71 @@ func (h *Handler) Usage(c *gin.Context) {
 	c.JSON(http.StatusOK, response)
 }
 
+// DeviceMesh returns whether the user's devices may reach each other.
+func (h *Handler) DeviceMesh(c *gin.Context) {
+	userID, ok := middleware.UserID(c)
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+
+	enabled, err := h.service.DeviceMesh(c.Request.Context(), userID)
+	if err != nil {
+		h.logger.Error("device mesh", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch device mesh"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"enabled": enabled})
+}
+
+// SetDeviceMesh turns the "my devices" mesh on or off for all of the user's
+// peers.
+func (h *Handler) SetDeviceMesh(c *gin.Context) {
+	userID, ok := middleware.UserID(c)
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+
+	var req struct {
+		Enabled *bool `json:"enabled" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := h.service.SetDeviceMesh(c.Request.Context(), userID, *req.Enabled); err != nil {
+		h.logger.Error("set device mesh", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update device mesh"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"enabled": *req.Enabled})
+}
+
 func (h *Handler) Create(c *gin.Context) {
-	userID, ok := userIDFromContext(c)
+	userID, ok := middleware.UserID(c)
 	if !ok {
 		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
 		return
 	}
 
+	// The backend picks the node: region_id or region_code limit placement
+	// to one region, and with neither (or "recommended") every region is
+	// considered.
 	type request struct {
-		NodeID       string   `json:"node_id" binding:"required"`
-		RegionID     string   `json:"region_id" binding:"required"`
+		RegionID     string   `json:"region_id"`
+		RegionCode   string   `json:"region_code"`
 		DeviceName   string   `json:"device_name" binding:"required"`
 		ClientPubKey string   `json:"client_public_key"`
 		AllowedIPs   string   `json:"allowed_ips"`
 		DNSServers   []string `json:"dns_servers"`
 		Keepalive    *int     `json:"keepalive"`
 		MTU          *int     `json:"mtu"`
+		// Routing is the split-tunnel preset; omitted means full tunnel.
+		Routing entities.PeerRouting `json:"routing"`
 	}
 
 	var req request
@@ -92,32 +149,46 @@ func (h *Handler) Create(c *gin.Context) {
 		return
 	}
 
-	nodeID, err := uuid.Parse(req.NodeID)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid node_id"})
-		return
-	}
-	regionID, err := uuid.Parse(req.RegionID)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid region_id"})
-		return
+	var regionID uuid.UUID
+	if req.RegionID != "" {
+		parsed, err := uuid.Parse(req.RegionID)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid region_id"})
+			return
+		}
+		regionID = parsed
 	}
 
 	output, err := h.service.CreatePeer(c.Request.Context(), peers.CreatePeerInput{
 		UserID:       userID,
-		NodeID:       nodeID,
 		RegionID:     regionID,
+		RegionCode:   req.RegionCode,
 		DeviceName:   req.DeviceName,
 		ClientPubKey: req.ClientPubKey,
 		AllowedIPs:   req.AllowedIPs,
 		DNSServers:   req.DNSServers,
 		Keepalive:    req.Keepalive,
 		MTU:          req.MTU,
+		Routing:      req.Routing,
 	})
 	if err != nil {
-		switch err {
-		case peers.ErrDeviceLimitReached:
+		switch {
+		case errors.Is(err, entitlements.ErrNoActiveSubscription):
+			c.JSON(http.StatusPaymentRequired, gin.H{"error": err.Error()})
+		case errors.Is(err, peers.ErrDeviceLimitReached), errors.Is(err, entitlements.ErrRegionNotAllowed):
 			c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		case errors.Is(err, peers.ErrRegionNotFound), errors.Is(err, peers.ErrNodeNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		case errors.Is(err, peers.ErrNoNodeAvailable):
+			h.logger.Warn("create peer: no node available", zap.String("region_code", req.RegionCode), zap.Stringer("region_id", regionID))
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		case errors.Is(err, ipam.ErrAddressInUse):
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		case errors.Is(err, ipam.ErrPoolExhausted):
+			h.logger.Warn("create peer: node address pool exhausted", zap.String("region_code", req.RegionCode), zap.Stringer("region_id", regionID), zap.Error(err))
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": ipam.ErrPoolExhausted.Error()})
+		case isRoutingError(err):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		default:
 			h.logger.Error("create peer", zap.Error(err))
 			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
@@ -131,11 +202,13 @@ func (h *Handler) Create(c *gin.Context) {
 		"config":             output.Config,
 		"config_token":       output.ConfigToken,
 		"config_qr":          output.ConfigQR,
+		"config_url":         output.ConfigURL,
+		"config_deep_link":   output.ConfigDeepLink,
 	})
 }
 
 func (h *Handler) Rename(c *gin.Context) {
-	userID, ok := userIDFromContext(c)
+	userID, ok := middleware.UserID(c)
 	if !ok {
 		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
 		return
@@ -171,8 +244,196 @@ func (h *Handler) Rename(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"peer": peer})
 }
 
+// Rotate replaces the peer's keys and returns a fresh config, token and QR.
+func (h *Handler) Rotate(c *gin.Context) {
+	userID, ok := middleware.UserID(c)
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+	peerID, err := uuid.Parse(c.Param("peerID"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid peer id"})
+		return
+	}
+
+	type request struct {
+		ClientPubKey string `json:"client_public_key"`
+	}
+
+	var req request
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	output, err := h.service.RotatePeer(c.Request.Context(), userID, peerID, req.ClientPubKey)
+	if err != nil {
+		switch {
+		case errors.Is(err, peers.ErrPeerNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		case errors.Is(err, peers.ErrPeerInactive), errors.Is(err, peers.ErrPublicKeyInUse):
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		default:
+			h.logger.Error("rotate peer", zap.Error(err))
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"peer":               output.Peer,
+		"client_private_key": output.ClientPrivateKey,
+		"config":             output.Config,
+		"config_token":       output.ConfigToken,
+		"config_qr":          output.ConfigQR,
+		"config_url":         output.ConfigURL,
+		"config_deep_link":   output.ConfigDeepLink,
+	})
+}
+
+// SetRouting changes the peer's split-tunnel preset and returns a config with
+// the new AllowedIPs. The config carries no private key.
+func (h *Handler) SetRouting(c *gin.Context) {
+	userID, ok := middleware.UserID(c)
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+	peerID, err := uuid.Parse(c.Param("peerID"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid peer id"})
+		return
+	}
+
+	var req entities.PeerRouting
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	output, err := h.service.SetPeerRouting(c.Request.Context(), userID, peerID, req)
+	if err != nil {
+		switch {
+		case errors.Is(err, peers.ErrPeerNotFound), errors.Is(err, peers.ErrNodeNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		case errors.Is(err, peers.ErrPeerInactive):
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		case isRoutingError(err):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		default:
+			h.logger.Error("set peer routing", zap.Error(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update routing"})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"peer":             output.Peer,
+		"config":           output.Config,
+		"config_token":     output.ConfigToken,
+		"config_qr":        output.ConfigQR,
+		"config_url":       output.ConfigURL,
+		"config_deep_link": output.ConfigDeepLink,
+	})
+}
+
+func isRoutingError(err error) bool {
+	return errors.Is(err, routing.ErrUnknownPreset) ||
+		errors.Is(err, routing.ErrInvalidExclude) ||
+		errors.Is(err, routing.ErrCountryUnavailable)
+}
+
+// Migrate moves the peer to another node or region and returns its new config.
+func (h *Handler) Migrate(c *gin.Context) {
+	userID, ok := middleware.UserID(c)
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+	peerID, err := uuid.Parse(c.Param("peerID"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid peer id"})
+		return
+	}
+
+	type request struct {
+		NodeID       string `json:"node_id"`
+		RegionID     string `json:"region_id"`
+		RegionCode   string `json:"region_code"`
+		ClientPubKey string `json:"client_public_key"`
+	}
+
+	var req request
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var nodeID, regionID uuid.UUID
+	if req.NodeID != "" {
+		parsed, err := uuid.Parse(req.NodeID)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid node_id"})
+			return
+		}
+		nodeID = parsed
+	}
+	if req.RegionID != "" {
+		parsed, err := uuid.Parse(req.RegionID)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid region_id"})
+			return
+		}
+		regionID = parsed
+	}
+
+	output, err := h.service.MigratePeer(c.Request.Context(), peers.MigratePeerInput{
+		UserID:       userID,
+		PeerID:       peerID,
+		NodeID:       nodeID,
+		RegionID:     regionID,
+		RegionCode:   req.RegionCode,
+		ClientPubKey: req.ClientPubKey,
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, entitlements.ErrNoActiveSubscription):
+			c.JSON(http.StatusPaymentRequired, gin.H{"error": err.Error()})
+		case errors.Is(err, entitlements.ErrRegionNotAllowed):
+			c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		case errors.Is(err, peers.ErrPeerNotFound), errors.Is(err, peers.ErrRegionNotFound), errors.Is(err, peers.ErrNodeNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		case errors.Is(err, peers.ErrPeerInactive), errors.Is(err, peers.ErrPublicKeyInUse), errors.Is(err, peers.ErrSameNode):
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		case errors.Is(err, peers.ErrNoNodeAvailable):
+			h.logger.Warn("migrate peer: no capacity", zap.Stringer("peer_id", peerID), zap.String("region_code", req.RegionCode), zap.Error(err))
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		case errors.Is(err, ipam.ErrPoolExhausted):
+			h.logger.Warn("migrate peer: node address pool exhausted", zap.Stringer("peer_id", peerID), zap.String("region_code", req.RegionCode), zap.Error(err))
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": ipam.ErrPoolExhausted.Error()})
+		default:
+			h.logger.Error("migrate peer", zap.Error(err))
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"peer":               output.Peer,
+		"client_private_key": output.ClientPrivateKey,
+		"config":             output.Config,
+		"config_token":       output.ConfigToken,
+		"config_qr":          output.ConfigQR,
+		"config_url":         output.ConfigURL,
+		"config_deep_link":   output.ConfigDeepLink,
+	})
+}
+
 func (h *Handler) Delete(c *gin.Context) {
-	userID, ok := userIDFromContext(c)
+	userID, ok := middleware.UserID(c)
 	if !ok {
 		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
 		return
@@ -197,7 +458,7 @@ func (h *Handler) Delete(c *gin.Context) {
 }
 
 func (h *Handler) DownloadConfig(c *gin.Context) {
-	userID, ok := userIDFromContext(c)
+	userID, ok := middleware.UserID(c)
 	if !ok {
 		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
 		return
@@ -208,31 +469,111 @@ func (h *Handler) DownloadConfig(c *gin.Context) {
 		return
 	}
 
-	config, err := h.service.GetConfigByToken(c.Request.Context(), userID, token)
+	// Without a format the wg-quick text is returned in JSON, as before
+	// export formats existed.
+	format := c.Query("format")
+	if format == "" {
+		config, err := h.service.GetConfigByToken(c.Request.Context(), userID, token)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"config": config})
+		return
+	}
+
+	exported, err := h.service.ExportConfigByToken(c.Request.Context(), userID, token, format)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		switch {
+		case errors.Is(err, clientconfig.ErrUnknownFormat):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "formats": h.service.ConfigFormats()})
+		default:
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		}
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"config": config})
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", exported.Filename))
+	c.Header("Cache-Control", "no-store")
+	c.Data(http.StatusOK, exported.ContentType, exported.Data)
 }
 
-func userIDFromContext(c *gin.Context) (uuid.UUID, bool) {
-	value, exists := c.Get("user_id")
-	if !exists {
-		return uuid.UUID{}, false
+// DownloadConfigLink serves a signed public config link. It needs no session;
+// the signature and expiry in the query authorize the download.
+func (h *Handler) DownloadConfigLink(c *gin.Context) {
+	linkID, err := uuid.Parse(c.Param("linkID"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "config link not found"})
+		return
+	}
+	expires, err := strconv.ParseInt(c.Query("expires"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "config link not found"})
+		return
 	}
 
-	switch v := value.(type) {
-	case uuid.UUID:
-		return v, true
-	case string:
-		uid, err := uuid.Parse(v)
-		if err != nil {
-			return uuid.UUID{}, false
+	exported, err := h.service.ExportConfigByLink(c.Request.Context(), linkID, expires, c.Query("sig"), c.Query("format"))
+	if err != nil {
+		switch {
+		case errors.Is(err, clientconfig.ErrUnknownFormat):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "formats": h.service.ConfigFormats()})
+		case errors.Is(err, peers.ErrFormatUnavailable):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		case errors.Is(err, peers.ErrConfigLinksDisabled), errors.Is(err, peers.ErrConfigLinkInvalid):
+			c.JSON(http.StatusNotFound, gin.H{"error": "config link not found"})
+		case errors.Is(err, peers.ErrConfigTokenUsed), errors.Is(err, peers.ErrConfigTokenExpired), errors.Is(err, peers.ErrConfigTokenStale):
+			c.JSON(http.StatusGone, gin.H{"error": err.Error()})
+		default:
+			h.logger.Error("download config link", zap.Error(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to download config"})
 		}
-		return uid, true
-	default:
-		return uuid.UUID{}, false
+		return
 	}
+
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", exported.Filename))
+	c.Header("Cache-Control", "no-store")
+	c.Data(http.StatusOK, exported.ContentType, exported.Data)
+}
+
+func (h *Handler) ListConfigLinks(c *gin.Context) {
+	userID, ok := middleware.UserID(c)
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+
+	links, err := h.service.ListConfigLinks(c.Request.Context(), userID)
+	if err != nil {
+		h.logger.Error("list config links", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to list config links"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"config_links": links})
+}
+
+func (h *Handler) RevokeConfigLink(c *gin.Context) {
+	userID, ok := middleware.UserID(c)
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+	linkID, err := uuid.Parse(c.Param("linkID"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid link id"})
+		return
+	}
+
+	if err := h.service.RevokeConfigLink(c.Request.Context(), userID, linkID); err != nil {
+		if errors.Is(err, peers.ErrConfigLinkNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		h.logger.Error("revoke config link", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to revoke config link"})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
 }
@@ -1,22 +1,26 @@
 package regionshandler
 
 import (
+	"errors"
 	"net/http"
 
 	"github.com/gin-gonic/gin"
 	"go.uber.org/zap"
 
+	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/entitlements"
 	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/regions"
+	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/server/middleware"
 )
 
 // Handler provides HTTP endpoints for regions.
 type Handler struct {
-	service *regions.Service
-	logger  *zap.Logger
+	service      *regions.Service
+	entitlements *entitlements.Service
+	logger       *zap.Logger
 }
 
-func New(service *regions.Service, logger *zap.Logger) *Handler {
-	return &Handler{service: service, logger: logger}
+func New(service *regions.Service, entitlements *entitlements.Service, logger *zap.Logger) *Handler {
+	return &Handler{service: service, entitlements: entitlements, logger: logger}
 }
 
 func (h *Handler) List(c *gin.Context) {
@@ -29,3 +33,33 @@ func (h *Handler) List(c *gin.Context) {
 
 	c.JSON(http.StatusOK, gin.H{"regions": regions})
 }
+
+// ListForAccount returns regions marked with whether the user's plan allows them.
+func (h *Handler) ListForAccount(c *gin.Context) {
+	userID, ok := middleware.UserID(c)
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+
+	ent, err := h.entitlements.Resolve(c.Request.Context(), userID)
+	if err != nil {
+		switch {
+		case errors.Is(err, entitlements.ErrNoActiveSubscription):
+			c.JSON(http.StatusPaymentRequired, gin.H{"error": err.Error()})
+		default:
+			h.logger.Error("resolve entitlements failed", zap.Error(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to list regions"})
+		}
+		return
+	}
+
+	regions, err := h.service.ListForPlan(c.Request.Context(), ent)
+	if err != nil {
+		h.logger.Error("list regions failed", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to list regions"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"regions": regions})
+}
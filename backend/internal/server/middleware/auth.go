@@ -56,6 +56,27 @@ func Auth(manager *jwt.Manager, security config.AdminSecurityConfig, logger *zap
 	}
 }
 
+// UserID returns the authenticated user set by Auth.
+func UserID(c *gin.Context) (uuid.UUID, bool) {
+	value, exists := c.Get("user_id")
+	if !exists {
+		return uuid.UUID{}, false
+	}
+
+	switch v := value.(type) {
+	case uuid.UUID:
+		return v, true
+	case string:
+		uid, err := uuid.Parse(v)
+		if err != nil {
+			return uuid.UUID{}, false
+		}
+		return uid, true
+	default:
+		return uuid.UUID{}, false
+	}
+}
+
 func clientIPFromContext(c *gin.Context) string {
 	if ip := c.GetHeader("X-Forwarded-For"); ip != "" {
 		parts := strings.Split(ip, ",")
@@ -2,6 +2,7 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
 	"net/http"
 
 	"github.com/gin-gonic/gin"
@@ -9,6 +10,7 @@ import (
 
 	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/config"
 	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/metrics"
+	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/nodes"
 	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/server/middleware"
 	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/server/setup"
 )
@@ -64,10 +66,24 @@ func New(cfg config.Config, logger *zap.Logger, deps setup.Dependencies, collect
 
 // Run starts the HTTP server and blocks until the context is cancelled.
 func (s *Server) Run(ctx context.Context) error {
+	if s.cfg.HTTP.TLSCertFile != "" {
+		tlsConfig, err := s.tlsConfig()
+		if err != nil {
+			return err
+		}
+		s.http.TLSConfig = tlsConfig
+	}
+
 	errCh := make(chan error, 1)
 
 	go func() {
-		if err := s.http.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		var err error
+		if s.cfg.HTTP.TLSCertFile != "" {
+			err = s.http.ListenAndServeTLS(s.cfg.HTTP.TLSCertFile, s.cfg.HTTP.TLSKeyFile)
+		} else {
+			err = s.http.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
 			errCh <- err
 		}
 	}()
@@ -82,6 +98,23 @@ func (s *Server) Run(ctx context.Context) error {
 	}
 }
 
+// tlsConfig asks for client certificates when node identities are verified
+// on the connection. They stay optional so users reach the API without one;
+// node endpoints reject requests lacking the node's certificate.
+func (s *Server) tlsConfig() (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	identity := s.cfg.Node.Identity
+	if identity.ClientCAFile != "" && identity.CertHeader == "" {
+		roots, err := nodes.LoadCertPool(identity.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.ClientCAs = roots
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return cfg, nil
+}
+
 // Engine exposes the underlying gin engine. Useful for tests.
 func (s *Server) Engine() *gin.Engine {
 	return s.engine
@@ -30,21 +30,34 @@ type Dependencies struct {
 		CreateCheckoutSession(*gin.Context)
 		StripeWebhook(*gin.Context)
 		ListPayments(*gin.Context)
+		Entitlements(*gin.Context)
 	}
 	RegionsHandler interface {
 		List(*gin.Context)
+		ListForAccount(*gin.Context)
 	}
 	NodesHandler interface {
 		Register(*gin.Context)
 		ReportHealth(*gin.Context)
+		DesiredPeers(*gin.Context)
+		PeerStats(*gin.Context)
+		Stream(*gin.Context)
 	}
 	PeersHandler interface {
 		List(*gin.Context)
 		Usage(*gin.Context)
 		Create(*gin.Context)
 		Rename(*gin.Context)
+		Rotate(*gin.Context)
+		Migrate(*gin.Context)
+		SetRouting(*gin.Context)
+		DeviceMesh(*gin.Context)
+		SetDeviceMesh(*gin.Context)
 		Delete(*gin.Context)
 		DownloadConfig(*gin.Context)
+		DownloadConfigLink(*gin.Context)
+		ListConfigLinks(*gin.Context)
+		RevokeConfigLink(*gin.Context)
 	}
 }
 
@@ -97,21 +110,40 @@ func Register(engine *gin.Engine, cfg config.Config, deps Dependencies, logger *
 		checkoutGroup.POST("/checkout", deps.BillingHandler.CreateCheckoutSession)
 
 		protected.GET("/account/payments", deps.BillingHandler.ListPayments)
+		protected.GET("/account/entitlements", deps.BillingHandler.Entitlements)
 		engine.POST("/api/v1/webhooks/stripe", deps.BillingHandler.StripeWebhook)
 	}
+	if deps.RegionsHandler != nil {
+		protected.GET("/account/regions", deps.RegionsHandler.ListForAccount)
+	}
 	if deps.NodesHandler != nil {
 		engine.POST("/api/v1/nodes/register", deps.NodesHandler.Register)
 		engine.POST("/api/v1/nodes/health", deps.NodesHandler.ReportHealth)
+		engine.GET("/api/v1/nodes/peers", deps.NodesHandler.DesiredPeers)
+		engine.POST("/api/v1/nodes/peers/stats", deps.NodesHandler.PeerStats)
+		engine.GET("/api/v1/nodes/stream", deps.NodesHandler.Stream)
 	}
 	if deps.PeersHandler != nil {
 		peersGroup := protected.Group("/peers")
 		peersGroup.Use(middleware.RateLimit(cfg.RateLimit.Peers))
 		peersGroup.GET("", deps.PeersHandler.List)
 		peersGroup.GET("/usage", deps.PeersHandler.Usage)
+		peersGroup.GET("/mesh", deps.PeersHandler.DeviceMesh)
+		peersGroup.PUT("/mesh", deps.PeersHandler.SetDeviceMesh)
 		peersGroup.POST("", deps.PeersHandler.Create)
 		peersGroup.PATCH("/:peerID", deps.PeersHandler.Rename)
+		peersGroup.POST("/:peerID/rotate", deps.PeersHandler.Rotate)
+		peersGroup.POST("/:peerID/migrate", deps.PeersHandler.Migrate)
+		peersGroup.PUT("/:peerID/routing", deps.PeersHandler.SetRouting)
 		peersGroup.DELETE("/:peerID", deps.PeersHandler.Delete)
 		protected.GET("/peers/config/:token", deps.PeersHandler.DownloadConfig)
+		peersGroup.GET("/config-links", deps.PeersHandler.ListConfigLinks)
+		peersGroup.DELETE("/config-links/:linkID", deps.PeersHandler.RevokeConfigLink)
+
+		// Signed links are opened by devices without a session.
+		configLinks := api.Group("/config-links")
+		configLinks.Use(middleware.RateLimit(cfg.RateLimit.Peers))
+		configLinks.GET("/:linkID", deps.PeersHandler.DownloadConfigLink)
 	}
 
 	authProtected := protected.Group("/auth")
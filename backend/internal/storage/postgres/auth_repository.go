@@ -13,11 +13,13 @@ import (
 	"github.com/jackc/pgx/v5/pgxpool"
 
 	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/entities"
+	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/platform/fieldcrypt"
 )
 
 // AuthRepository provides persistence helpers for authentication flows.
 type AuthRepository struct {
-	pool *pgxpool.Pool
+	pool  *pgxpool.Pool
+	crypt *fieldcrypt.Keyring
 }
 
 var ErrDuplicate = errors.New("duplicate record")
@@ -26,6 +28,11 @@ func NewAuthRepository(pool *pgxpool.Pool) *AuthRepository {
 	return &AuthRepository{pool: pool}
 }
 
+// UseKeyring encrypts TOTP secrets and token metadata at rest.
+func (r *AuthRepository) UseKeyring(keyring *fieldcrypt.Keyring) {
+	r.crypt = keyring
+}
+
 func (r *AuthRepository) withTx(ctx context.Context, fn func(pgx.Tx) error) error {
 	tx, err := r.pool.BeginTx(ctx, pgx.TxOptions{})
 	if err != nil {
@@ -55,7 +62,7 @@ func (r *AuthRepository) CreateUser(ctx context.Context, email, passwordHash str
 	RETURNING id, email, password_hash, status, email_verified_at, last_login_at, totp_secret, totp_enabled_at, created_at, updated_at`
 
 	row := r.pool.QueryRow(ctx, query, email, passwordHash)
-	return scanUser(row)
+	return r.scanUser(row)
 }
 
 func (r *AuthRepository) GetUserByEmail(ctx context.Context, email string) (entities.User, error) {
@@ -65,7 +72,7 @@ func (r *AuthRepository) GetUserByEmail(ctx context.Context, email string) (enti
     WHERE email = $1`
 
 	row := r.pool.QueryRow(ctx, query, email)
-	return scanUser(row)
+	return r.scanUser(row)
 }
 
 func (r *AuthRepository) GetUserByID(ctx context.Context, id uuid.UUID) (entities.User, error) {
@@ -75,7 +82,7 @@ func (r *AuthRepository) GetUserByID(ctx context.Context, id uuid.UUID) (entitie
     WHERE id = $1`
 
 	row := r.pool.QueryRow(ctx, query, id)
-	return scanUser(row)
+	return r.scanUser(row)
 }
 
 func (r *AuthRepository) MarkEmailVerified(ctx context.Context, userID uuid.UUID, verifiedAt time.Time) error {
@@ -126,7 +133,11 @@ func (r *AuthRepository) UpsertTOTPSecret(ctx context.Context, userID uuid.UUID,
 	const query = `
 	UPDATE users SET totp_secret = $2, totp_enabled_at = NULL, updated_at = NOW() WHERE id = $1`
 
-	cmd, err := r.pool.Exec(ctx, query, userID, secret)
+	sealed, err := r.crypt.Seal(fieldTOTPSecret, secret)
+	if err != nil {
+		return fmt.Errorf("encrypt totp secret: %w", err)
+	}
+	cmd, err := r.pool.Exec(ctx, query, userID, sealed)
 	if err != nil {
 		return fmt.Errorf("upsert totp secret: %w", err)
 	}
@@ -230,8 +241,12 @@ INSERT INTO user_tokens (user_id, token_hash, token_type, expires_at, metadata)
 VALUES ($1, $2, $3, $4, $5)
 RETURNING id, user_id, token_hash, token_type, expires_at, consumed_at, created_at, metadata`
 
-	row := r.pool.QueryRow(ctx, query, token.UserID, token.TokenHash, token.TokenType, token.ExpiresAt, token.Metadata)
-	return scanUserToken(row)
+	metadata, err := r.crypt.SealPtr(fieldTokenMetadata, token.Metadata)
+	if err != nil {
+		return entities.UserToken{}, fmt.Errorf("encrypt token metadata: %w", err)
+	}
+	row := r.pool.QueryRow(ctx, query, token.UserID, token.TokenHash, token.TokenType, token.ExpiresAt, metadata)
+	return r.scanUserToken(row)
 }
 
 func (r *AuthRepository) ConsumeUserToken(ctx context.Context, tokenID uuid.UUID) error {
@@ -257,10 +272,83 @@ FROM user_tokens
 WHERE token_type = $1 AND token_hash = $2`
 
 	row := r.pool.QueryRow(ctx, query, tokenType, tokenHash)
-	return scanUserToken(row)
+	return r.scanUserToken(row)
+}
+
+func (r *AuthRepository) GetUserTokenByID(ctx context.Context, tokenID uuid.UUID) (entities.UserToken, error) {
+	const query = `
+SELECT id, user_id, token_hash, token_type, expires_at, consumed_at, created_at, metadata
+FROM user_tokens
+WHERE id = $1`
+
+	row := r.pool.QueryRow(ctx, query, tokenID)
+	return r.scanUserToken(row)
+}
+
+// ListActiveUserTokens returns the user's unconsumed, unexpired tokens of a
+// type, newest first.
+func (r *AuthRepository) ListActiveUserTokens(ctx context.Context, userID uuid.UUID, tokenType string) ([]entities.UserToken, error) {
+	const query = `
+SELECT id, user_id, token_hash, token_type, expires_at, consumed_at, created_at, metadata
+FROM user_tokens
+WHERE user_id = $1 AND token_type = $2 AND consumed_at IS NULL AND expires_at > NOW()
+ORDER BY created_at DESC`
+
+	rows, err := r.pool.Query(ctx, query, userID, tokenType)
+	if err != nil {
+		return nil, fmt.Errorf("list user tokens: %w", err)
+	}
+	defer rows.Close()
+
+	var tokens []entities.UserToken
+	for rows.Next() {
+		token, err := r.scanUserToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterate user tokens: %w", err)
+	}
+	return tokens, nil
 }
 
-func scanUser(row pgx.Row) (entities.User, error) {
+// ConsumeAndWipeUserToken consumes the token and drops its metadata, for
+// tokens whose metadata must not outlive them.
+func (r *AuthRepository) ConsumeAndWipeUserToken(ctx context.Context, tokenID uuid.UUID) error {
+	const query = `
+	UPDATE user_tokens
+	SET consumed_at = NOW(), metadata = NULL
+	WHERE id = $1 AND consumed_at IS NULL`
+
+	cmd, err := r.pool.Exec(ctx, query, tokenID)
+	if err != nil {
+		return fmt.Errorf("consume user token: %w", err)
+	}
+	if cmd.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
+
+// WipeUserTokenMetadata drops the metadata of consumed tokens of a type and
+// of those that expired before the given time.
+func (r *AuthRepository) WipeUserTokenMetadata(ctx context.Context, tokenType string, expiredBefore time.Time) (int64, error) {
+	const query = `
+	UPDATE user_tokens
+	SET metadata = NULL
+	WHERE token_type = $1 AND metadata IS NOT NULL
+	  AND (consumed_at IS NOT NULL OR expires_at < $2)`
+
+	cmd, err := r.pool.Exec(ctx, query, tokenType, expiredBefore)
+	if err != nil {
+		return 0, fmt.Errorf("wipe user token metadata: %w", err)
+	}
+	return cmd.RowsAffected(), nil
+}
+
+func (r *AuthRepository) scanUser(row pgx.Row) (entities.User, error) {
 	var (
 		u      entities.User
 		secret sql.NullString
@@ -269,7 +357,10 @@ func scanUser(row pgx.Row) (entities.User, error) {
 		return entities.User{}, translateError(err)
 	}
 	if secret.Valid {
-		value := secret.String
+		value, err := r.crypt.Open(fieldTOTPSecret, secret.String)
+		if err != nil {
+			return entities.User{}, fmt.Errorf("decrypt totp secret: %w", err)
+		}
 		u.TOTPSecret = &value
 	}
 	return u, nil
@@ -283,7 +374,7 @@ func scanSession(row pgx.Row) (entities.Session, error) {
 	return s, nil
 }
 
-func scanUserToken(row pgx.Row) (entities.UserToken, error) {
+func (r *AuthRepository) scanUserToken(row pgx.Row) (entities.UserToken, error) {
 	var (
 		t        entities.UserToken
 		metadata sql.NullString
@@ -292,7 +383,10 @@ func scanUserToken(row pgx.Row) (entities.UserToken, error) {
 		return entities.UserToken{}, translateError(err)
 	}
 	if metadata.Valid {
-		value := metadata.String
+		value, err := r.crypt.Open(fieldTokenMetadata, metadata.String)
+		if err != nil {
+			return entities.UserToken{}, fmt.Errorf("decrypt token metadata: %w", err)
+		}
 		t.Metadata = &value
 	}
 	return t, nil
@@ -24,8 +24,8 @@ func NewBillingRepository(pool *pgxpool.Pool) *BillingRepository {
 
 func (r *BillingRepository) UpsertPlan(ctx context.Context, plan entities.Plan) (entities.Plan, error) {
 	const query = `
-	INSERT INTO plans (code, name, description, price_cents, currency, billing_period, interval_count, device_limit, is_active)
-	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+	INSERT INTO plans (code, name, description, price_cents, currency, billing_period, interval_count, device_limit, is_active, allowed_regions, add_ons)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
 	ON CONFLICT (code)
 	DO UPDATE SET
 		name = EXCLUDED.name,
@@ -36,8 +36,10 @@ func (r *BillingRepository) UpsertPlan(ctx context.Context, plan entities.Plan)
 		interval_count = EXCLUDED.interval_count,
 		device_limit = EXCLUDED.device_limit,
 		is_active = EXCLUDED.is_active,
+		allowed_regions = EXCLUDED.allowed_regions,
+		add_ons = EXCLUDED.add_ons,
 		updated_at = NOW()
-	RETURNING id, code, name, description, price_cents, currency, billing_period, interval_count, device_limit, is_active, created_at, updated_at`
+	RETURNING id, code, name, description, price_cents, currency, billing_period, interval_count, device_limit, allowed_regions, add_ons, is_active, created_at, updated_at`
 
 	row := r.pool.QueryRow(ctx, query,
 		plan.Code,
@@ -49,6 +51,8 @@ func (r *BillingRepository) UpsertPlan(ctx context.Context, plan entities.Plan)
 		plan.IntervalCount,
 		plan.DeviceLimit,
 		plan.IsActive,
+		pgStringArray(plan.AllowedRegions),
+		pgStringArray(plan.AddOns),
 	)
 
 	return scanPlan(row)
@@ -56,7 +60,7 @@ func (r *BillingRepository) UpsertPlan(ctx context.Context, plan entities.Plan)
 
 func (r *BillingRepository) ListActivePlans(ctx context.Context) ([]entities.Plan, error) {
 	const query = `
-	SELECT id, code, name, description, price_cents, currency, billing_period, interval_count, device_limit, is_active, created_at, updated_at
+	SELECT id, code, name, description, price_cents, currency, billing_period, interval_count, device_limit, allowed_regions, add_ons, is_active, created_at, updated_at
 	FROM plans
 	WHERE is_active = true
 	ORDER BY price_cents ASC`
@@ -81,7 +85,7 @@ func (r *BillingRepository) ListActivePlans(ctx context.Context) ([]entities.Pla
 
 func (r *BillingRepository) GetPlanByCode(ctx context.Context, code string) (entities.Plan, error) {
 	const query = `
-	SELECT id, code, name, description, price_cents, currency, billing_period, interval_count, device_limit, is_active, created_at, updated_at
+	SELECT id, code, name, description, price_cents, currency, billing_period, interval_count, device_limit, allowed_regions, add_ons, is_active, created_at, updated_at
 	FROM plans
 	WHERE code = $1`
 
@@ -98,6 +102,7 @@ func (r *BillingRepository) UpsertSubscription(ctx context.Context, sub entities
 	ON CONFLICT (provider, provider_subscription_id)
 	DO UPDATE SET
 		status = EXCLUDED.status,
+		status_changed_at = CASE WHEN subscriptions.status IS DISTINCT FROM EXCLUDED.status THEN NOW() ELSE subscriptions.status_changed_at END,
 		current_period_start = EXCLUDED.current_period_start,
 		current_period_end = EXCLUDED.current_period_end,
 		cancel_at_period_end = EXCLUDED.cancel_at_period_end,
@@ -132,6 +137,35 @@ func (r *BillingRepository) GetSubscriptionByProviderID(ctx context.Context, pro
 	return scanSubscription(row)
 }
 
+// GetActiveSubscription returns the user's trialing or active subscription
+// together with its plan. At most one exists per user.
+func (r *BillingRepository) GetActiveSubscription(ctx context.Context, userID uuid.UUID) (entities.Subscription, entities.Plan, error) {
+	const query = `
+	SELECT s.id, s.user_id, s.plan_id, s.status, s.current_period_start, s.current_period_end, s.cancel_at_period_end, s.canceled_at, s.provider, s.provider_customer_id, s.provider_subscription_id, s.created_at, s.updated_at,
+	       p.id, p.code, p.name, p.description, p.price_cents, p.currency, p.billing_period, p.interval_count, p.device_limit, p.allowed_regions, p.add_ons, p.is_active, p.created_at, p.updated_at
+	FROM subscriptions s
+	JOIN plans p ON p.id = s.plan_id
+	WHERE s.user_id = $1 AND s.status IN ('trialing', 'active')
+	ORDER BY s.current_period_end DESC
+	LIMIT 1`
+
+	var (
+		sub  entities.Subscription
+		plan entities.Plan
+	)
+	err := r.pool.QueryRow(ctx, query, userID).Scan(
+		&sub.ID, &sub.UserID, &sub.PlanID, &sub.Status, &sub.CurrentPeriodStart, &sub.CurrentPeriodEnd,
+		&sub.CancelAtPeriodEnd, &sub.CanceledAt, &sub.Provider, &sub.ProviderCustomerID, &sub.ProviderSubscriptionID,
+		&sub.CreatedAt, &sub.UpdatedAt,
+		&plan.ID, &plan.Code, &plan.Name, &plan.Description, &plan.PriceCents, &plan.Currency, &plan.BillingPeriod,
+		&plan.IntervalCount, &plan.DeviceLimit, &plan.AllowedRegions, &plan.AddOns, &plan.IsActive, &plan.CreatedAt, &plan.UpdatedAt,
+	)
+	if err != nil {
+		return entities.Subscription{}, entities.Plan{}, translateError(err)
+	}
+	return sub, plan, nil
+}
+
 func (r *BillingRepository) RecordPayment(ctx context.Context, payment entities.Payment) (entities.Payment, error) {
 	const query = `
 	INSERT INTO payments (subscription_id, provider, provider_payment_id, status, amount_cents, currency, paid_at, refunded_at, metadata, created_at, updated_at)
@@ -199,7 +233,7 @@ func (r *BillingRepository) ListPaymentsByUser(ctx context.Context, userID uuid.
 
 func scanPlan(row pgx.Row) (entities.Plan, error) {
 	var p entities.Plan
-	if err := row.Scan(&p.ID, &p.Code, &p.Name, &p.Description, &p.PriceCents, &p.Currency, &p.BillingPeriod, &p.IntervalCount, &p.DeviceLimit, &p.IsActive, &p.CreatedAt, &p.UpdatedAt); err != nil {
+	if err := row.Scan(&p.ID, &p.Code, &p.Name, &p.Description, &p.PriceCents, &p.Currency, &p.BillingPeriod, &p.IntervalCount, &p.DeviceLimit, &p.AllowedRegions, &p.AddOns, &p.IsActive, &p.CreatedAt, &p.UpdatedAt); err != nil {
 		return entities.Plan{}, translateError(err)
 	}
 	return p, nil
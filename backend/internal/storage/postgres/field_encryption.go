@@ -0,0 +1,156 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/platform/fieldcrypt"
+)
+
+// Names of the encrypted columns. They are bound to the ciphertext, so a
+// value copied into another column does not decrypt.
+const (
+	fieldPresharedKey  = "peers.preshared_key"
+	fieldTOTPSecret    = "users.totp_secret"
+	fieldTokenMetadata = "user_tokens.metadata"
+)
+
+// encryptedColumn locates an encrypted column; every table is keyed by a
+// UUID id.
+type encryptedColumn struct {
+	field  string
+	table  string
+	column string
+}
+
+// sealedValue is a stored value of an encrypted column.
+type sealedValue struct {
+	id    uuid.UUID
+	value string
+}
+
+var encryptedColumns = []encryptedColumn{
+	{field: fieldPresharedKey, table: "peers", column: "preshared_key"},
+	{field: fieldTOTPSecret, table: "users", column: "totp_secret"},
+	{field: fieldTokenMetadata, table: "user_tokens", column: "metadata"},
+}
+
+// FieldsRepository maintains the encrypted columns as a whole.
+type FieldsRepository struct {
+	pool  *pgxpool.Pool
+	crypt *fieldcrypt.Keyring
+}
+
+func NewFieldsRepository(pool *pgxpool.Pool, keyring *fieldcrypt.Keyring) *FieldsRepository {
+	return &FieldsRepository{pool: pool, crypt: keyring}
+}
+
+// ReencryptFields seals every value that is still plaintext or sealed with a
+// key other than the primary, batchSize rows at a time. Values that cannot be
+// decrypted (e.g. their key was removed) are skipped and counted as failed.
+// Each row is only updated if it did not change in the meantime, so it never
+// overwrites a concurrent write.
+func (r *FieldsRepository) ReencryptFields(ctx context.Context, batchSize int) (updated, failed int64, err error) {
+	if r.crypt == nil {
+		return 0, 0, nil
+	}
+	current := likeEscape(fieldcrypt.SealedPrefix(r.crypt.Primary())) + "%"
+	for _, col := range encryptedColumns {
+		u, f, err := r.reencryptColumn(ctx, col, current, batchSize)
+		updated += u
+		failed += f
+		if err != nil {
+			return updated, failed, fmt.Errorf("reencrypt %s: %w", col.field, err)
+		}
+	}
+	return updated, failed, nil
+}
+
+func (r *FieldsRepository) reencryptColumn(ctx context.Context, col encryptedColumn, current string, batchSize int) (updated, failed int64, err error) {
+	selectBatch := fmt.Sprintf(`
+	SELECT id, %[2]s FROM %[1]s
+	WHERE %[2]s IS NOT NULL AND %[2]s NOT LIKE $1 AND id > $2
+	ORDER BY id
+	LIMIT $3`, col.table, col.column)
+	update := fmt.Sprintf(`UPDATE %[1]s SET %[2]s = $2 WHERE id = $1 AND %[2]s = $3`, col.table, col.column)
+
+	var after uuid.UUID
+	for {
+		rows, err := r.pool.Query(ctx, selectBatch, current, after, batchSize)
+		if err != nil {
+			return updated, failed, err
+		}
+		var batch []sealedValue
+		for rows.Next() {
+			var p sealedValue
+			if err := rows.Scan(&p.id, &p.value); err != nil {
+				rows.Close()
+				return updated, failed, err
+			}
+			batch = append(batch, p)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return updated, failed, err
+		}
+
+		u, f, err := r.reseal(ctx, col.field, update, batch)
+		updated += u
+		failed += f
+		if err != nil {
+			return updated, failed, err
+		}
+		if len(batch) < batchSize {
+			return updated, failed, nil
+		}
+		after = batch[len(batch)-1].id
+	}
+}
+
+// reseal seals a batch with the primary key in one transaction. Only the
+// ciphertext changes, so the transaction tells the peer revision trigger to
+// let it pass: nodes need not be sent the same keys again (see 0016).
+func (r *FieldsRepository) reseal(ctx context.Context, field, update string, batch []sealedValue) (updated, failed int64, err error) {
+	if len(batch) == 0 {
+		return 0, 0, nil
+	}
+	tx, err := r.pool.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return 0, 0, fmt.Errorf("begin tx: %w", err)
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	if _, err := tx.Exec(ctx, `SELECT set_config('tridot.reencrypting', 'on', true)`); err != nil {
+		return 0, 0, err
+	}
+	for _, p := range batch {
+		plain, err := r.crypt.Open(field, p.value)
+		if err != nil {
+			failed++
+			continue
+		}
+		sealed, err := r.crypt.Seal(field, plain)
+		if err != nil {
+			return 0, failed, err
+		}
+		cmd, err := tx.Exec(ctx, update, p.id, sealed, p.value)
+		if err != nil {
+			return 0, failed, err
+		}
+		updated += cmd.RowsAffected()
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return 0, failed, err
+	}
+	return updated, failed, nil
+}
+
+// likeEscape escapes the LIKE wildcards in s.
+func likeEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
@@ -0,0 +1,95 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE nodes ADD COLUMN peer_revision BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE peers ADD COLUMN revision BIGINT NOT NULL DEFAULT 0;
+
+-- Tombstones are keyed by node without a foreign key so that cascading node
+-- deletes do not fail while the trigger below is recording removals.
+CREATE TABLE peer_tombstones (
+    node_id         UUID NOT NULL,
+    public_key      TEXT NOT NULL,
+    revision        BIGINT NOT NULL,
+    created_at      TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX idx_peers_node_revision ON peers (node_id, revision);
+CREATE INDEX idx_peer_tombstones_node_revision ON peer_tombstones (node_id, revision);
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+-- bump_node_peer_revision increments the per-node revision counter. The row
+-- lock taken by the UPDATE serialises writers per node, so revisions become
+-- visible to readers in commit order and incremental fetches never skip one.
+CREATE FUNCTION bump_node_peer_revision(target UUID) RETURNS BIGINT AS $$
+DECLARE
+    rev BIGINT;
+BEGIN
+    UPDATE nodes
+    SET peer_revision = peer_revision + 1
+    WHERE id = target
+    RETURNING peer_revision INTO rev;
+    RETURN rev;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE FUNCTION peers_track_revision() RETURNS trigger AS $$
+DECLARE
+    rev BIGINT;
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        rev := bump_node_peer_revision(OLD.node_id);
+        IF rev IS NOT NULL THEN
+            INSERT INTO peer_tombstones (node_id, public_key, revision)
+            VALUES (OLD.node_id, OLD.public_key, rev);
+        END IF;
+        RETURN OLD;
+    END IF;
+
+    IF TG_OP = 'UPDATE' THEN
+        IF (NEW.node_id, NEW.public_key, NEW.preshared_key, NEW.allowed_ips, NEW.keepalive, NEW.status)
+            IS NOT DISTINCT FROM
+           (OLD.node_id, OLD.public_key, OLD.preshared_key, OLD.allowed_ips, OLD.keepalive, OLD.status) THEN
+            RETURN NEW;
+        END IF;
+        IF NEW.node_id <> OLD.node_id OR NEW.public_key <> OLD.public_key THEN
+            rev := bump_node_peer_revision(OLD.node_id);
+            IF rev IS NOT NULL THEN
+                INSERT INTO peer_tombstones (node_id, public_key, revision)
+                VALUES (OLD.node_id, OLD.public_key, rev);
+            END IF;
+        END IF;
+    END IF;
+
+    NEW.revision := COALESCE(bump_node_peer_revision(NEW.node_id), 0);
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER trg_peers_revision
+    BEFORE INSERT OR UPDATE OR DELETE ON peers
+    FOR EACH ROW EXECUTE FUNCTION peers_track_revision();
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+UPDATE nodes n
+SET peer_revision = sub.cnt
+FROM (SELECT node_id, COUNT(*) AS cnt FROM peers GROUP BY node_id) sub
+WHERE n.id = sub.node_id;
+
+UPDATE peers p
+SET revision = n.peer_revision
+FROM nodes n
+WHERE n.id = p.node_id;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TRIGGER IF EXISTS trg_peers_revision ON peers;
+DROP FUNCTION IF EXISTS peers_track_revision();
+DROP FUNCTION IF EXISTS bump_node_peer_revision(UUID);
+DROP INDEX IF EXISTS idx_peer_tombstones_node_revision;
+DROP INDEX IF EXISTS idx_peers_node_revision;
+DROP TABLE IF EXISTS peer_tombstones;
+ALTER TABLE peers DROP COLUMN IF EXISTS revision;
+ALTER TABLE nodes DROP COLUMN IF EXISTS peer_revision;
+-- +goose StatementEnd
@@ -0,0 +1,34 @@
+-- +goose Up
+-- +goose StatementBegin
+-- rx_counter/tx_counter hold the last raw WireGuard counters reported by the
+-- node. bytes_rx/bytes_tx accumulate the deltas between reports so totals
+-- survive counter resets when the interface or peer is recreated.
+ALTER TABLE peers ADD COLUMN rx_counter BIGINT NOT NULL DEFAULT 0 CHECK (rx_counter >= 0);
+ALTER TABLE peers ADD COLUMN tx_counter BIGINT NOT NULL DEFAULT 0 CHECK (tx_counter >= 0);
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+-- A peer that moves to another node or gets a new key starts with fresh
+-- counters on the device, so the stored baseline must start over as well.
+CREATE FUNCTION peers_reset_counters() RETURNS trigger AS $$
+BEGIN
+    IF NEW.node_id <> OLD.node_id OR NEW.public_key <> OLD.public_key THEN
+        NEW.rx_counter := 0;
+        NEW.tx_counter := 0;
+    END IF;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER trg_peers_reset_counters
+    BEFORE UPDATE OF node_id, public_key ON peers
+    FOR EACH ROW EXECUTE FUNCTION peers_reset_counters();
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TRIGGER IF EXISTS trg_peers_reset_counters ON peers;
+DROP FUNCTION IF EXISTS peers_reset_counters();
+ALTER TABLE peers DROP COLUMN IF EXISTS tx_counter;
+ALTER TABLE peers DROP COLUMN IF EXISTS rx_counter;
+-- +goose StatementEnd
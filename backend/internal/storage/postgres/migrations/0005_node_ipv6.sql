@@ -0,0 +1,17 @@
+-- +goose Up
+-- +goose StatementBegin
+-- tunnel_ipv6_prefix is the ULA prefix a node routes for its peers.
+-- ipv6_enabled is only set when the node announced working IPv6 egress, and
+-- gates whether client configs send ::/0 through the tunnel.
+ALTER TABLE nodes ADD COLUMN tunnel_ipv6_prefix CIDR CHECK (family(tunnel_ipv6_prefix) = 6);
+ALTER TABLE nodes ADD COLUMN ipv6_enabled BOOLEAN NOT NULL DEFAULT false;
+ALTER TABLE nodes ADD CONSTRAINT nodes_ipv6_requires_prefix
+    CHECK (NOT ipv6_enabled OR tunnel_ipv6_prefix IS NOT NULL);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE nodes DROP CONSTRAINT IF EXISTS nodes_ipv6_requires_prefix;
+ALTER TABLE nodes DROP COLUMN IF EXISTS ipv6_enabled;
+ALTER TABLE nodes DROP COLUMN IF EXISTS tunnel_ipv6_prefix;
+-- +goose StatementEnd
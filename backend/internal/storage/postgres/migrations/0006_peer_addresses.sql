@@ -0,0 +1,36 @@
+-- +goose Up
+-- +goose StatementBegin
+-- tunnel_address is the node's own interface address; its network is the pool
+-- peer addresses are assigned from.
+ALTER TABLE nodes ADD COLUMN tunnel_address INET NOT NULL DEFAULT '10.8.0.1/24'
+    CHECK (family(tunnel_address) = 4 AND masklen(tunnel_address) <= 30);
+
+-- One row per assigned tunnel address. The primary key makes an address
+-- unique per node, and rows go away with their peer so deleting a peer
+-- releases its addresses.
+CREATE TABLE peer_addresses (
+    node_id         UUID NOT NULL REFERENCES nodes(id) ON DELETE CASCADE,
+    address         INET NOT NULL,
+    peer_id         UUID NOT NULL REFERENCES peers(id) ON DELETE CASCADE,
+    created_at      TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (node_id, address)
+);
+
+CREATE INDEX idx_peer_addresses_peer ON peer_addresses (peer_id);
+
+-- Existing peers keep their addresses; only those inside the pool and not
+-- already claimed by an earlier peer are tracked.
+INSERT INTO peer_addresses (node_id, address, peer_id)
+SELECT p.node_id, split_part(p.allowed_ips, '/', 1)::inet, p.id
+FROM peers p
+JOIN nodes n ON n.id = p.node_id
+WHERE split_part(p.allowed_ips, '/', 1)::inet << network(n.tunnel_address)
+ORDER BY p.created_at
+ON CONFLICT DO NOTHING;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS peer_addresses;
+ALTER TABLE nodes DROP COLUMN IF EXISTS tunnel_address;
+-- +goose StatementEnd
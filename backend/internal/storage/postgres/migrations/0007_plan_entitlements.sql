@@ -0,0 +1,13 @@
+-- +goose Up
+-- +goose StatementBegin
+-- allowed_regions restricts a plan to the listed region codes; empty means
+-- every active region. add_ons lists extra features the plan unlocks.
+ALTER TABLE plans ADD COLUMN allowed_regions TEXT[] NOT NULL DEFAULT ARRAY[]::TEXT[];
+ALTER TABLE plans ADD COLUMN add_ons TEXT[] NOT NULL DEFAULT ARRAY[]::TEXT[];
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE plans DROP COLUMN IF EXISTS add_ons;
+ALTER TABLE plans DROP COLUMN IF EXISTS allowed_regions;
+-- +goose StatementEnd
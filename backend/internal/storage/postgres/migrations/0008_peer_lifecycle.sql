@@ -0,0 +1,34 @@
+-- +goose Up
+-- +goose StatementBegin
+-- status_changed_at anchors the grace period of a lapsed subscription.
+-- Existing rows start counting from the migration.
+ALTER TABLE subscriptions ADD COLUMN status_changed_at TIMESTAMPTZ NOT NULL DEFAULT NOW();
+
+-- suspended_at marks peers revoked because their subscription lapsed; only
+-- those are restored when the subscription becomes active again.
+ALTER TABLE peers ADD COLUMN suspended_at TIMESTAMPTZ;
+
+CREATE TABLE peer_lifecycle_events (
+    id              BIGSERIAL PRIMARY KEY,
+    peer_id         UUID NOT NULL REFERENCES peers(id) ON DELETE CASCADE,
+    user_id         UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    node_id         UUID NOT NULL,
+    subscription_id UUID REFERENCES subscriptions(id) ON DELETE SET NULL,
+    from_status     peer_status NOT NULL,
+    to_status       peer_status NOT NULL,
+    reason          TEXT NOT NULL,
+    created_at      TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX idx_peer_lifecycle_events_peer ON peer_lifecycle_events (peer_id, created_at);
+CREATE INDEX idx_peer_lifecycle_events_user ON peer_lifecycle_events (user_id, created_at);
+CREATE INDEX idx_peers_suspended ON peers (user_id) WHERE suspended_at IS NOT NULL;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX IF EXISTS idx_peers_suspended;
+DROP TABLE IF EXISTS peer_lifecycle_events;
+ALTER TABLE peers DROP COLUMN IF EXISTS suspended_at;
+ALTER TABLE subscriptions DROP COLUMN IF EXISTS status_changed_at;
+-- +goose StatementEnd
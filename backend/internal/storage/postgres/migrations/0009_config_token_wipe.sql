@@ -0,0 +1,18 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Peer config tokens carry the client config, private key included, in
+-- metadata until it is wiped after use or expiry. The index keeps the
+-- periodic wipe to the tokens that still hold data.
+CREATE INDEX IF NOT EXISTS idx_user_tokens_unwiped
+    ON user_tokens (token_type, expires_at)
+    WHERE metadata IS NOT NULL;
+
+-- Configs of tokens consumed before wiping existed.
+UPDATE user_tokens SET metadata = NULL
+WHERE token_type = 'peer_config' AND consumed_at IS NOT NULL;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX IF EXISTS idx_user_tokens_unwiped;
+-- +goose StatementEnd
@@ -0,0 +1,16 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Split-tunnel preset of the client config. The backend derives the client's
+-- AllowedIPs from it; the node-side peer entry is unaffected.
+ALTER TABLE peers ADD COLUMN routing_preset TEXT NOT NULL DEFAULT 'full'
+    CHECK (routing_preset IN ('full', 'exclude_lan', 'exclude_country', 'custom'));
+ALTER TABLE peers ADD COLUMN routing_country TEXT;
+ALTER TABLE peers ADD COLUMN routing_excludes TEXT[] NOT NULL DEFAULT '{}';
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE peers DROP COLUMN IF EXISTS routing_excludes;
+ALTER TABLE peers DROP COLUMN IF EXISTS routing_country;
+ALTER TABLE peers DROP COLUMN IF EXISTS routing_preset;
+-- +goose StatementEnd
@@ -0,0 +1,84 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Nodes isolate peers from each other. Users can opt in to a mesh of their own
+-- devices; their peers then carry a shared group marker that nodes use to
+-- allow traffic within the group.
+ALTER TABLE users ADD COLUMN device_mesh BOOLEAN NOT NULL DEFAULT false;
+ALTER TABLE peers ADD COLUMN mesh_group TEXT;
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+-- Same as in 0003, with mesh_group added to the node-facing columns so a
+-- regrouped peer is sent to its node again.
+CREATE OR REPLACE FUNCTION peers_track_revision() RETURNS trigger AS $$
+DECLARE
+    rev BIGINT;
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        rev := bump_node_peer_revision(OLD.node_id);
+        IF rev IS NOT NULL THEN
+            INSERT INTO peer_tombstones (node_id, public_key, revision)
+            VALUES (OLD.node_id, OLD.public_key, rev);
+        END IF;
+        RETURN OLD;
+    END IF;
+
+    IF TG_OP = 'UPDATE' THEN
+        IF (NEW.node_id, NEW.public_key, NEW.preshared_key, NEW.allowed_ips, NEW.keepalive, NEW.status, NEW.mesh_group)
+            IS NOT DISTINCT FROM
+           (OLD.node_id, OLD.public_key, OLD.preshared_key, OLD.allowed_ips, OLD.keepalive, OLD.status, OLD.mesh_group) THEN
+            RETURN NEW;
+        END IF;
+        IF NEW.node_id <> OLD.node_id OR NEW.public_key <> OLD.public_key THEN
+            rev := bump_node_peer_revision(OLD.node_id);
+            IF rev IS NOT NULL THEN
+                INSERT INTO peer_tombstones (node_id, public_key, revision)
+                VALUES (OLD.node_id, OLD.public_key, rev);
+            END IF;
+        END IF;
+    END IF;
+
+    NEW.revision := COALESCE(bump_node_peer_revision(NEW.node_id), 0);
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+CREATE OR REPLACE FUNCTION peers_track_revision() RETURNS trigger AS $$
+DECLARE
+    rev BIGINT;
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        rev := bump_node_peer_revision(OLD.node_id);
+        IF rev IS NOT NULL THEN
+            INSERT INTO peer_tombstones (node_id, public_key, revision)
+            VALUES (OLD.node_id, OLD.public_key, rev);
+        END IF;
+        RETURN OLD;
+    END IF;
+
+    IF TG_OP = 'UPDATE' THEN
+        IF (NEW.node_id, NEW.public_key, NEW.preshared_key, NEW.allowed_ips, NEW.keepalive, NEW.status)
+            IS NOT DISTINCT FROM
+           (OLD.node_id, OLD.public_key, OLD.preshared_key, OLD.allowed_ips, OLD.keepalive, OLD.status) THEN
+            RETURN NEW;
+        END IF;
+        IF NEW.node_id <> OLD.node_id OR NEW.public_key <> OLD.public_key THEN
+            rev := bump_node_peer_revision(OLD.node_id);
+            IF rev IS NOT NULL THEN
+                INSERT INTO peer_tombstones (node_id, public_key, revision)
+                VALUES (OLD.node_id, OLD.public_key, rev);
+            END IF;
+        END IF;
+    END IF;
+
+    NEW.revision := COALESCE(bump_node_peer_revision(NEW.node_id), 0);
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+ALTER TABLE peers DROP COLUMN IF EXISTS mesh_group;
+ALTER TABLE users DROP COLUMN IF EXISTS device_mesh;
+-- +goose StatementEnd
@@ -0,0 +1,15 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Token metadata may hold an encrypted value ("enc:v1:..."), which is not
+-- JSON. Existing plaintext stays as its JSON text and is sealed by the
+-- background re-encryption job.
+ALTER TABLE user_tokens ALTER COLUMN metadata TYPE TEXT USING metadata::text;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+-- Encrypted metadata cannot be turned back into JSON; it only belongs to
+-- short-lived tokens, so it is dropped.
+ALTER TABLE user_tokens ALTER COLUMN metadata TYPE JSONB
+    USING CASE WHEN metadata LIKE 'enc:%' THEN NULL ELSE metadata::jsonb END;
+-- +goose StatementEnd
@@ -0,0 +1,35 @@
+-- +goose Up
+-- +goose StatementBegin
+-- nodes_notify_event publishes peer revision bumps and status changes on the
+-- node_events channel. Notifications are delivered on commit, so every API
+-- replica listening on the channel can push them to the node's stream.
+CREATE FUNCTION nodes_notify_event() RETURNS trigger AS $$
+BEGIN
+    IF NEW.peer_revision IS DISTINCT FROM OLD.peer_revision THEN
+        PERFORM pg_notify('node_events', json_build_object(
+            'node_id', NEW.id,
+            'type', 'peers',
+            'revision', NEW.peer_revision
+        )::text);
+    END IF;
+    IF NEW.status IS DISTINCT FROM OLD.status THEN
+        PERFORM pg_notify('node_events', json_build_object(
+            'node_id', NEW.id,
+            'type', 'drain',
+            'drain', NEW.status <> 'active'
+        )::text);
+    END IF;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER trg_nodes_notify_event
+    AFTER UPDATE OF peer_revision, status ON nodes
+    FOR EACH ROW EXECUTE FUNCTION nodes_notify_event();
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TRIGGER IF EXISTS trg_nodes_notify_event ON nodes;
+DROP FUNCTION IF EXISTS nodes_notify_event();
+-- +goose StatementEnd
@@ -0,0 +1,13 @@
+-- +goose Up
+-- +goose StatementBegin
+-- cert_identity binds a node to its client certificate: a SPIFFE ID or
+-- "sha256:<fingerprint>". It is set on the first registration over mTLS.
+ALTER TABLE nodes ADD COLUMN cert_identity TEXT;
+CREATE UNIQUE INDEX idx_nodes_cert_identity ON nodes (cert_identity) WHERE cert_identity IS NOT NULL;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX IF EXISTS idx_nodes_cert_identity;
+ALTER TABLE nodes DROP COLUMN IF EXISTS cert_identity;
+-- +goose StatementEnd
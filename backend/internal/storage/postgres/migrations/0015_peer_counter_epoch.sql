@@ -0,0 +1,47 @@
+-- +goose Up
+-- +goose StatementBegin
+-- counter_epoch is the device epoch the node reported with rx_counter and
+-- tx_counter. A different epoch means the interface was recreated and the
+-- counters restarted from zero, even once they have grown past the baseline.
+ALTER TABLE peers ADD COLUMN counter_epoch TEXT;
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+-- Same as in 0004, and a revoked peer that becomes active again is added to
+-- its node's device afresh, so its counters restart as well.
+CREATE OR REPLACE FUNCTION peers_reset_counters() RETURNS trigger AS $$
+BEGIN
+    IF NEW.node_id <> OLD.node_id OR NEW.public_key <> OLD.public_key
+        OR (NEW.status = 'active' AND OLD.status <> 'active') THEN
+        NEW.rx_counter := 0;
+        NEW.tx_counter := 0;
+    END IF;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS trg_peers_reset_counters ON peers;
+CREATE TRIGGER trg_peers_reset_counters
+    BEFORE UPDATE OF node_id, public_key, status ON peers
+    FOR EACH ROW EXECUTE FUNCTION peers_reset_counters();
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+CREATE OR REPLACE FUNCTION peers_reset_counters() RETURNS trigger AS $$
+BEGIN
+    IF NEW.node_id <> OLD.node_id OR NEW.public_key <> OLD.public_key THEN
+        NEW.rx_counter := 0;
+        NEW.tx_counter := 0;
+    END IF;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS trg_peers_reset_counters ON peers;
+CREATE TRIGGER trg_peers_reset_counters
+    BEFORE UPDATE OF node_id, public_key ON peers
+    FOR EACH ROW EXECUTE FUNCTION peers_reset_counters();
+
+ALTER TABLE peers DROP COLUMN IF EXISTS counter_epoch;
+-- +goose StatementEnd
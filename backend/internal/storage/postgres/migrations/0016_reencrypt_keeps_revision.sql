@@ -0,0 +1,77 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Same as in 0011, except that a preshared_key change is ignored while
+-- tridot.reencrypting is set. The field re-encryption job sets it for its own
+-- transactions: re-sealing yields new ciphertext for the same key, which
+-- nodes do not need to hear about.
+CREATE OR REPLACE FUNCTION peers_track_revision() RETURNS trigger AS $$
+DECLARE
+    rev BIGINT;
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        rev := bump_node_peer_revision(OLD.node_id);
+        IF rev IS NOT NULL THEN
+            INSERT INTO peer_tombstones (node_id, public_key, revision)
+            VALUES (OLD.node_id, OLD.public_key, rev);
+        END IF;
+        RETURN OLD;
+    END IF;
+
+    IF TG_OP = 'UPDATE' THEN
+        IF (NEW.node_id, NEW.public_key, NEW.allowed_ips, NEW.keepalive, NEW.status, NEW.mesh_group)
+            IS NOT DISTINCT FROM
+           (OLD.node_id, OLD.public_key, OLD.allowed_ips, OLD.keepalive, OLD.status, OLD.mesh_group)
+           AND (NEW.preshared_key IS NOT DISTINCT FROM OLD.preshared_key
+                OR current_setting('tridot.reencrypting', true) = 'on') THEN
+            RETURN NEW;
+        END IF;
+        IF NEW.node_id <> OLD.node_id OR NEW.public_key <> OLD.public_key THEN
+            rev := bump_node_peer_revision(OLD.node_id);
+            IF rev IS NOT NULL THEN
+                INSERT INTO peer_tombstones (node_id, public_key, revision)
+                VALUES (OLD.node_id, OLD.public_key, rev);
+            END IF;
+        END IF;
+    END IF;
+
+    NEW.revision := COALESCE(bump_node_peer_revision(NEW.node_id), 0);
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+CREATE OR REPLACE FUNCTION peers_track_revision() RETURNS trigger AS $$
+DECLARE
+    rev BIGINT;
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        rev := bump_node_peer_revision(OLD.node_id);
+        IF rev IS NOT NULL THEN
+            INSERT INTO peer_tombstones (node_id, public_key, revision)
+            VALUES (OLD.node_id, OLD.public_key, rev);
+        END IF;
+        RETURN OLD;
+    END IF;
+
+    IF TG_OP = 'UPDATE' THEN
+        IF (NEW.node_id, NEW.public_key, NEW.preshared_key, NEW.allowed_ips, NEW.keepalive, NEW.status, NEW.mesh_group)
+            IS NOT DISTINCT FROM
+           (OLD.node_id, OLD.public_key, OLD.preshared_key, OLD.allowed_ips, OLD.keepalive, OLD.status, OLD.mesh_group) THEN
+            RETURN NEW;
+        END IF;
+        IF NEW.node_id <> OLD.node_id OR NEW.public_key <> OLD.public_key THEN
+            rev := bump_node_peer_revision(OLD.node_id);
+            IF rev IS NOT NULL THEN
+                INSERT INTO peer_tombstones (node_id, public_key, revision)
+                VALUES (OLD.node_id, OLD.public_key, rev);
+            END IF;
+        END IF;
+    END IF;
+
+    NEW.revision := COALESCE(bump_node_peer_revision(NEW.node_id), 0);
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
@@ -0,0 +1,12 @@
+-- +goose Up
+-- +goose StatementBegin
+-- agent_drain is the drain state the node agent last reported. Health reports
+-- only move a node between active and draining when the agent's state
+-- changed, so they do not undo a status set by an operator in the meantime.
+ALTER TABLE nodes ADD COLUMN agent_drain BOOLEAN NOT NULL DEFAULT false;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE nodes DROP COLUMN IF EXISTS agent_drain;
+-- +goose StatementEnd
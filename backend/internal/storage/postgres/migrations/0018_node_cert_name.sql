@@ -0,0 +1,12 @@
+-- +goose Up
+-- +goose StatementBegin
+-- cert_name is the subject and SANs of the certificate a node is bound to.
+-- A renewed certificate carrying the same name re-binds the node when it
+-- registers its hostname again.
+ALTER TABLE nodes ADD COLUMN cert_name TEXT;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE nodes DROP COLUMN IF EXISTS cert_name;
+-- +goose StatementEnd
@@ -0,0 +1,64 @@
+package postgres
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/entities"
+)
+
+// nodeEventsChannel is notified by the nodes_notify_event trigger.
+const nodeEventsChannel = "node_events"
+
+// NodeEventsListener receives node events published by any replica.
+type NodeEventsListener struct {
+	pool *pgxpool.Pool
+}
+
+func NewNodeEventsListener(pool *pgxpool.Pool) *NodeEventsListener {
+	return &NodeEventsListener{pool: pool}
+}
+
+// Listen takes a connection out of the pool, subscribes to node events,
+// calls ready and then handle for each event until ctx is done or the
+// connection fails. Events committed while no listener is connected are not
+// replayed.
+func (l *NodeEventsListener) Listen(ctx context.Context, ready func(), handle func(entities.NodeEvent)) error {
+	pooled, err := l.pool.Acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("acquire listen connection: %w", err)
+	}
+	// A connection in LISTEN state must not go back to the pool.
+	conn := pooled.Hijack()
+	defer conn.Close(context.Background())
+
+	if _, err := conn.Exec(ctx, "LISTEN "+nodeEventsChannel); err != nil {
+		return fmt.Errorf("listen %s: %w", nodeEventsChannel, err)
+	}
+	ready()
+	for {
+		notification, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+		var payload struct {
+			NodeID   uuid.UUID `json:"node_id"`
+			Type     string    `json:"type"`
+			Revision int64     `json:"revision"`
+			Drain    bool      `json:"drain"`
+		}
+		if err := json.Unmarshal([]byte(notification.Payload), &payload); err != nil {
+			continue
+		}
+		handle(entities.NodeEvent{
+			NodeID:   payload.NodeID,
+			Type:     payload.Type,
+			Revision: payload.Revision,
+			Drain:    payload.Drain,
+		})
+	}
+}
@@ -5,28 +5,41 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"net/netip"
+	"strings"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
 
 	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/entities"
+	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/ipam"
+	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/platform/fieldcrypt"
 )
 
 // PeersRepository handles CRUD for WireGuard peers.
 type PeersRepository struct {
-	pool *pgxpool.Pool
+	pool  *pgxpool.Pool
+	crypt *fieldcrypt.Keyring
 }
 
 func NewPeersRepository(pool *pgxpool.Pool) *PeersRepository {
 	return &PeersRepository{pool: pool}
 }
 
+// UseKeyring encrypts preshared keys at rest. Without a keyring they are
+// stored in plaintext; encrypted values then fail to load.
+func (r *PeersRepository) UseKeyring(keyring *fieldcrypt.Keyring) {
+	r.crypt = keyring
+}
+
 func (r *PeersRepository) ListByUser(ctx context.Context, userID uuid.UUID) ([]entities.Peer, error) {
 	const query = `
 	SELECT id, user_id, node_id, region_id, device_name, public_key, preshared_key,
 	       allowed_ips, dns_servers, keepalive, mtu, status, created_at, updated_at,
-	       last_handshake_at, bytes_tx, bytes_rx
+	       last_handshake_at, bytes_tx, bytes_rx, routing_preset, routing_country, routing_excludes
 	FROM peers
 	WHERE user_id = $1
 	ORDER BY created_at`
@@ -39,7 +52,7 @@ func (r *PeersRepository) ListByUser(ctx context.Context, userID uuid.UUID) ([]e
 
 	var peers []entities.Peer
 	for rows.Next() {
-		peer, err := scanPeer(rows)
+		peer, err := r.scanPeer(rows)
 		if err != nil {
 			return nil, err
 		}
@@ -58,47 +71,254 @@ func (r *PeersRepository) CountByUser(ctx context.Context, userID uuid.UUID) (in
 	return count, nil
 }
 
-func (r *PeersRepository) Create(ctx context.Context, peer entities.Peer) (entities.Peer, error) {
-	const query = `
+// Create places the peer, assigns its addresses and inserts it in one
+// transaction. The chosen node row stays locked until commit: concurrent
+// creates skip it and spread over the next best nodes, and address
+// assignment on a node is serialised. An address already held by another
+// peer on the node yields ipam.ErrAddressInUse.
+func (r *PeersRepository) Create(ctx context.Context, peer entities.Peer, placement entities.PeerPlacement, assign func(entities.Node, []netip.Addr) (string, error)) (entities.Peer, entities.Node, error) {
+	const insertPeer = `
 	INSERT INTO peers (
 		user_id, node_id, region_id, device_name, public_key, preshared_key,
-		allowed_ips, dns_servers, keepalive, mtu, status, bytes_tx, bytes_rx
+		allowed_ips, dns_servers, keepalive, mtu, status, bytes_tx, bytes_rx,
+		routing_preset, routing_country, routing_excludes, mesh_group
 	)
-	VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13)
+	VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13,$14,$15,$16,
+		(SELECT CASE WHEN device_mesh THEN md5(id::text) END FROM users WHERE id = $1))
 	RETURNING id, user_id, node_id, region_id, device_name, public_key, preshared_key,
 	          allowed_ips, dns_servers, keepalive, mtu, status, created_at, updated_at,
-	          last_handshake_at, bytes_tx, bytes_rx`
-
-	dns := pgStringArray(peer.DNSServers)
-	row := r.pool.QueryRow(ctx, query,
-		peer.UserID,
-		peer.NodeID,
-		peer.RegionID,
-		peer.DeviceName,
-		peer.PublicKey,
-		peer.PresharedKey,
-		peer.AllowedIPs,
-		dns,
-		peer.Keepalive,
-		peer.MTU,
-		peer.Status,
-		peer.BytesTX,
-		peer.BytesRX,
+	          last_handshake_at, bytes_tx, bytes_rx, routing_preset, routing_country, routing_excludes`
+	const insertAddress = `INSERT INTO peer_addresses (node_id, address, peer_id) VALUES ($1, $2, $3)`
+
+	var (
+		created entities.Peer
+		node    entities.Node
 	)
+	err := r.withTx(ctx, func(tx pgx.Tx) error {
+		var err error
+		if node, err = lockPlacementNode(ctx, tx, placement); err != nil {
+			return err
+		}
+		used, err := nodeAddresses(ctx, tx, node.ID)
+		if err != nil {
+			return err
+		}
+		if peer.AllowedIPs, err = assign(node, used); err != nil {
+			return poolError(node, err)
+		}
+		addrs, err := peerAddresses(peer.AllowedIPs)
+		if err != nil {
+			return err
+		}
 
-	return scanPeer(row)
+		peer.NodeID = node.ID
+		peer.RegionID = node.RegionID
+		preshared, err := r.crypt.SealPtr(fieldPresharedKey, peer.PresharedKey)
+		if err != nil {
+			return fmt.Errorf("encrypt preshared key: %w", err)
+		}
+		dns := pgStringArray(peer.DNSServers)
+		row := tx.QueryRow(ctx, insertPeer,
+			peer.UserID,
+			peer.NodeID,
+			peer.RegionID,
+			peer.DeviceName,
+			peer.PublicKey,
+			preshared,
+			peer.AllowedIPs,
+			dns,
+			peer.Keepalive,
+			peer.MTU,
+			peer.Status,
+			peer.BytesTX,
+			peer.BytesRX,
+			routingPreset(peer.Routing),
+			nullableString(peer.Routing.Country),
+			routingExcludes(peer.Routing),
+		)
+		if created, err = r.scanPeer(row); err != nil {
+			return err
+		}
+		for _, addr := range addrs {
+			if _, err := tx.Exec(ctx, insertAddress, peer.NodeID, addr, created.ID); err != nil {
+				if isUniqueViolation(err, "peer_addresses_pkey") {
+					return fmt.Errorf("%w: %s", ipam.ErrAddressInUse, addr)
+				}
+				return fmt.Errorf("record peer address: %w", err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return entities.Peer{}, entities.Node{}, err
+	}
+	return created, node, nil
+}
+
+// Migrate moves an active peer to a new node in one transaction: the peer
+// row is locked, the target node is chosen and locked like in Create, the old
+// addresses are released and new ones assigned, and node, region, addresses
+// and keys are updated together. The revision trigger tombstones the peer on
+// the old node and adds it on the new one.
+func (r *PeersRepository) Migrate(ctx context.Context, peer entities.Peer, placement entities.PeerPlacement, assign func(entities.Node, []netip.Addr) (string, error)) (entities.Peer, entities.Node, error) {
+	const lockPeer = `SELECT status = 'active' FROM peers WHERE id = $1 AND user_id = $2 FOR UPDATE`
+	const releaseAddresses = `DELETE FROM peer_addresses WHERE peer_id = $1`
+	const updatePeer = `
+	UPDATE peers
+	SET node_id = $3, region_id = $4, allowed_ips = $5, public_key = $6, preshared_key = $7, updated_at = NOW()
+	WHERE id = $1 AND user_id = $2
+	RETURNING id, user_id, node_id, region_id, device_name, public_key, preshared_key,
+	          allowed_ips, dns_servers, keepalive, mtu, status, created_at, updated_at,
+	          last_handshake_at, bytes_tx, bytes_rx, routing_preset, routing_country, routing_excludes`
+	const insertAddress = `INSERT INTO peer_addresses (node_id, address, peer_id) VALUES ($1, $2, $3)`
+
+	var (
+		moved entities.Peer
+		node  entities.Node
+	)
+	err := r.withTx(ctx, func(tx pgx.Tx) error {
+		var active bool
+		err := tx.QueryRow(ctx, lockPeer, peer.ID, peer.UserID).Scan(&active)
+		if errors.Is(err, pgx.ErrNoRows) || (err == nil && !active) {
+			return ErrPeerNotActive
+		}
+		if err != nil {
+			return fmt.Errorf("lock peer: %w", err)
+		}
+
+		if node, err = lockPlacementNode(ctx, tx, placement); err != nil {
+			return err
+		}
+		used, err := nodeAddresses(ctx, tx, node.ID)
+		if err != nil {
+			return err
+		}
+		allowed, err := assign(node, used)
+		if err != nil {
+			return poolError(node, err)
+		}
+		addrs, err := peerAddresses(allowed)
+		if err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec(ctx, releaseAddresses, peer.ID); err != nil {
+			return fmt.Errorf("release peer addresses: %w", err)
+		}
+		preshared, err := r.crypt.SealPtr(fieldPresharedKey, peer.PresharedKey)
+		if err != nil {
+			return fmt.Errorf("encrypt preshared key: %w", err)
+		}
+		row := tx.QueryRow(ctx, updatePeer, peer.ID, peer.UserID, node.ID, node.RegionID, allowed, peer.PublicKey, preshared)
+		if moved, err = r.scanPeer(row); err != nil {
+			if isUniqueViolation(err, "peers_public_key_key") {
+				return ErrDuplicatePeer
+			}
+			return err
+		}
+		for _, addr := range addrs {
+			if _, err := tx.Exec(ctx, insertAddress, node.ID, addr, moved.ID); err != nil {
+				if isUniqueViolation(err, "peer_addresses_pkey") {
+					return fmt.Errorf("%w: %s", ipam.ErrAddressInUse, addr)
+				}
+				return fmt.Errorf("record peer address: %w", err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return entities.Peer{}, entities.Node{}, err
+	}
+	return moved, node, nil
+}
+
+// lockPlacementNode locks the node a new peer goes to: the active node in an
+// active region with the best capacity score, then the fewest peers, then the
+// most free addresses, skipping nodes whose pool is full. A pinned node must
+// meet the same conditions. Nodes locked by a concurrent create are skipped
+// first; only when every candidate is locked does it wait for one. The
+// placement's region codes are honoured either way.
+func lockPlacementNode(ctx context.Context, tx pgx.Tx, placement entities.PeerPlacement) (entities.Node, error) {
+	const best = `
+	SELECT n.id, n.region_id, n.hostname, n.public_ipv4, n.public_ipv6, n.public_key, n.endpoint, n.status, n.capacity_score, n.tunnel_port, n.tunnel_address, n.tunnel_ipv6_prefix, n.ipv6_enabled, n.last_seen_at, n.created_at, n.updated_at, n.cert_identity, n.cert_name
+	FROM nodes n
+	JOIN regions r ON r.id = n.region_id
+	CROSS JOIN LATERAL (
+		SELECT (SELECT COUNT(*) FROM peers p WHERE p.node_id = n.id) AS peer_count,
+		       (2 ^ (32 - masklen(n.tunnel_address)))::bigint - 3
+		       - (SELECT COUNT(*) FROM peer_addresses a WHERE a.node_id = n.id AND family(a.address) = 4) AS free_addresses
+	) load
+	WHERE n.status = 'active' AND r.is_active
+	  AND ($1::uuid IS NULL OR n.region_id = $1)
+	  AND (cardinality($2::text[]) = 0 OR r.code = ANY($2))
+	  AND ($3::uuid IS NULL OR n.id <> $3)
+	  AND ($4::uuid IS NULL OR n.id = $4)
+	  AND load.free_addresses > 0
+	ORDER BY n.capacity_score DESC, load.peer_count ASC, load.free_addresses DESC, n.id
+	LIMIT 1
+	FOR UPDATE OF n`
+
+	region := nullUUID(placement.RegionID)
+	codes := pgStringArray(placement.RegionCodes)
+	exclude := nullUUID(placement.ExcludeNodeID)
+	pinned := nullUUID(placement.NodeID)
+	node, err := scanNode(tx.QueryRow(ctx, best+" SKIP LOCKED", region, codes, exclude, pinned))
+	if errors.Is(err, pgx.ErrNoRows) {
+		node, err = scanNode(tx.QueryRow(ctx, best, region, codes, exclude, pinned))
+	}
+	return node, err
+}
+
+func nodeAddresses(ctx context.Context, tx pgx.Tx, nodeID uuid.UUID) ([]netip.Addr, error) {
+	const query = `SELECT host(address) FROM peer_addresses WHERE node_id = $1`
+
+	rows, err := tx.Query(ctx, query, nodeID)
+	if err != nil {
+		return nil, fmt.Errorf("list node addresses: %w", err)
+	}
+	defer rows.Close()
+
+	var addrs []netip.Addr
+	for rows.Next() {
+		var raw string
+		if err := rows.Scan(&raw); err != nil {
+			return nil, err
+		}
+		addr, err := netip.ParseAddr(raw)
+		if err != nil {
+			return nil, fmt.Errorf("parse node address %q: %w", raw, err)
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs, rows.Err()
+}
+
+// poolError names the node whose address pool ran out, which the caller
+// cannot tell for automatically placed peers.
+func poolError(node entities.Node, err error) error {
+	if errors.Is(err, ipam.ErrPoolExhausted) {
+		return fmt.Errorf("%w on node %s", err, node.ID)
+	}
+	return err
+}
+
+func nullUUID(id uuid.UUID) *uuid.UUID {
+	if id == uuid.Nil {
+		return nil
+	}
+	return &id
 }
 
 func (r *PeersRepository) GetByID(ctx context.Context, id uuid.UUID, userID uuid.UUID) (entities.Peer, error) {
 	const query = `
 	SELECT id, user_id, node_id, region_id, device_name, public_key, preshared_key,
 	       allowed_ips, dns_servers, keepalive, mtu, status, created_at, updated_at,
-	       last_handshake_at, bytes_tx, bytes_rx
+	       last_handshake_at, bytes_tx, bytes_rx, routing_preset, routing_country, routing_excludes
 	FROM peers
 	WHERE id = $1 AND user_id = $2`
 
 	row := r.pool.QueryRow(ctx, query, id, userID)
-	return scanPeer(row)
+	return r.scanPeer(row)
 }
 
 func (r *PeersRepository) Rename(ctx context.Context, id uuid.UUID, userID uuid.UUID, name string) (entities.Peer, error) {
@@ -108,10 +328,84 @@ func (r *PeersRepository) Rename(ctx context.Context, id uuid.UUID, userID uuid.
 	WHERE id = $1 AND user_id = $2
 	RETURNING id, user_id, node_id, region_id, device_name, public_key, preshared_key,
 	          allowed_ips, dns_servers, keepalive, mtu, status, created_at, updated_at,
-	          last_handshake_at, bytes_tx, bytes_rx`
+	          last_handshake_at, bytes_tx, bytes_rx, routing_preset, routing_country, routing_excludes`
 
 	row := r.pool.QueryRow(ctx, query, id, userID, name)
-	return scanPeer(row)
+	return r.scanPeer(row)
+}
+
+// Rotate replaces the peer's public and preshared keys. Only active peers
+// rotate; the revision trigger tombstones the old key so nodes drop it. A key
+// held by another peer yields ErrDuplicatePeer.
+func (r *PeersRepository) Rotate(ctx context.Context, id uuid.UUID, userID uuid.UUID, publicKey string, presharedKey *string) (entities.Peer, error) {
+	const query = `
+	UPDATE peers
+	SET public_key = $3, preshared_key = $4, updated_at = NOW()
+	WHERE id = $1 AND user_id = $2 AND status = 'active'
+	RETURNING id, user_id, node_id, region_id, device_name, public_key, preshared_key,
+	          allowed_ips, dns_servers, keepalive, mtu, status, created_at, updated_at,
+	          last_handshake_at, bytes_tx, bytes_rx, routing_preset, routing_country, routing_excludes`
+
+	sealed, err := r.crypt.SealPtr(fieldPresharedKey, presharedKey)
+	if err != nil {
+		return entities.Peer{}, fmt.Errorf("encrypt preshared key: %w", err)
+	}
+	peer, err := r.scanPeer(r.pool.QueryRow(ctx, query, id, userID, publicKey, sealed))
+	if isUniqueViolation(err, "peers_public_key_key") {
+		return entities.Peer{}, ErrDuplicatePeer
+	}
+	return peer, err
+}
+
+// SetRouting stores the split-tunnel preset of an active peer.
+func (r *PeersRepository) SetRouting(ctx context.Context, id uuid.UUID, userID uuid.UUID, routing entities.PeerRouting) (entities.Peer, error) {
+	const query = `
+	UPDATE peers
+	SET routing_preset = $3, routing_country = $4, routing_excludes = $5, updated_at = NOW()
+	WHERE id = $1 AND user_id = $2 AND status = 'active'
+	RETURNING id, user_id, node_id, region_id, device_name, public_key, preshared_key,
+	          allowed_ips, dns_servers, keepalive, mtu, status, created_at, updated_at,
+	          last_handshake_at, bytes_tx, bytes_rx, routing_preset, routing_country, routing_excludes`
+
+	row := r.pool.QueryRow(ctx, query, id, userID, routingPreset(routing), nullableString(routing.Country), routingExcludes(routing))
+	return r.scanPeer(row)
+}
+
+// DeviceMesh reports whether the user lets their own devices reach each
+// other.
+func (r *PeersRepository) DeviceMesh(ctx context.Context, userID uuid.UUID) (bool, error) {
+	const query = `SELECT device_mesh FROM users WHERE id = $1`
+
+	var enabled bool
+	if err := r.pool.QueryRow(ctx, query, userID).Scan(&enabled); err != nil {
+		return false, err
+	}
+	return enabled, nil
+}
+
+// SetDeviceMesh stores the user's mesh setting and regroups their peers in
+// the same transaction. The revision trigger picks up every peer whose group
+// changed, so nodes update their isolation rules on the next sync.
+func (r *PeersRepository) SetDeviceMesh(ctx context.Context, userID uuid.UUID, enabled bool) error {
+	const updateUser = `UPDATE users SET device_mesh = $2, updated_at = NOW() WHERE id = $1`
+	const updatePeers = `
+	UPDATE peers
+	SET mesh_group = CASE WHEN $2 THEN md5(user_id::text) END
+	WHERE user_id = $1 AND mesh_group IS DISTINCT FROM CASE WHEN $2 THEN md5(user_id::text) END`
+
+	return r.withTx(ctx, func(tx pgx.Tx) error {
+		cmd, err := tx.Exec(ctx, updateUser, userID, enabled)
+		if err != nil {
+			return fmt.Errorf("update device mesh: %w", err)
+		}
+		if cmd.RowsAffected() == 0 {
+			return pgx.ErrNoRows
+		}
+		if _, err := tx.Exec(ctx, updatePeers, userID, enabled); err != nil {
+			return fmt.Errorf("regroup peers: %w", err)
+		}
+		return nil
+	})
 }
 
 func (r *PeersRepository) Delete(ctx context.Context, id uuid.UUID, userID uuid.UUID) error {
@@ -165,7 +459,198 @@ func (r *PeersRepository) UsageSummaryByUser(ctx context.Context, userID uuid.UU
 	return summary, nil
 }
 
-func scanPeer(row pgx.Row) (entities.Peer, error) {
+func (r *PeersRepository) NodePeerRevision(ctx context.Context, nodeID uuid.UUID) (int64, error) {
+	const query = `SELECT peer_revision FROM nodes WHERE id = $1`
+
+	var revision int64
+	if err := r.pool.QueryRow(ctx, query, nodeID).Scan(&revision); err != nil {
+		return 0, err
+	}
+	return revision, nil
+}
+
+func (r *PeersRepository) ListActiveByNode(ctx context.Context, nodeID uuid.UUID) ([]entities.PeerChange, error) {
+	const query = `
+	SELECT public_key, preshared_key, allowed_ips, keepalive, COALESCE(mesh_group, ''), false AS removed, revision
+	FROM peers
+	WHERE node_id = $1 AND status = 'active'
+	ORDER BY public_key`
+
+	rows, err := r.pool.Query(ctx, query, nodeID)
+	if err != nil {
+		return nil, fmt.Errorf("list node peers: %w", err)
+	}
+	defer rows.Close()
+
+	return r.collectPeerChanges(rows)
+}
+
+func (r *PeersRepository) ListChangesByNode(ctx context.Context, nodeID uuid.UUID, since int64) ([]entities.PeerChange, error) {
+	const query = `
+	SELECT public_key, preshared_key, allowed_ips, keepalive, COALESCE(mesh_group, ''), status <> 'active' AS removed, revision
+	FROM peers
+	WHERE node_id = $1 AND revision > $2
+	UNION ALL
+	SELECT public_key, NULL, '', NULL, '', true, revision
+	FROM peer_tombstones
+	WHERE node_id = $1 AND revision > $2
+	ORDER BY revision`
+
+	rows, err := r.pool.Query(ctx, query, nodeID, since)
+	if err != nil {
+		return nil, fmt.Errorf("list node peer changes: %w", err)
+	}
+	defer rows.Close()
+
+	return r.collectPeerChanges(rows)
+}
+
+// ApplyPeerStats folds a batch of raw node counters into the peers' totals.
+// The device counters restarted when the node reports a different epoch than
+// the stored baseline's, or a counter lower than the baseline; the whole new
+// value then counts as fresh traffic. Baselines without an epoch, from nodes
+// that do not report one, only detect the latter.
+func (r *PeersRepository) ApplyPeerStats(ctx context.Context, nodeID uuid.UUID, stats []entities.PeerStat) (int, error) {
+	if len(stats) == 0 {
+		return 0, nil
+	}
+
+	const query = `
+	UPDATE peers p
+	SET bytes_rx = p.bytes_rx + CASE WHEN s.rx >= p.rx_counter AND (s.epoch = '' OR p.counter_epoch IS NULL OR s.epoch = p.counter_epoch) THEN s.rx - p.rx_counter ELSE s.rx END,
+	    bytes_tx = p.bytes_tx + CASE WHEN s.tx >= p.tx_counter AND (s.epoch = '' OR p.counter_epoch IS NULL OR s.epoch = p.counter_epoch) THEN s.tx - p.tx_counter ELSE s.tx END,
+	    rx_counter = s.rx,
+	    tx_counter = s.tx,
+	    counter_epoch = COALESCE(NULLIF(s.epoch, ''), p.counter_epoch),
+	    last_handshake_at = GREATEST(p.last_handshake_at, s.handshake)
+	FROM unnest($2::text[], $3::bigint[], $4::bigint[], $5::timestamptz[], $6::text[]) AS s(public_key, rx, tx, handshake, epoch)
+	WHERE p.node_id = $1 AND p.public_key = s.public_key`
+
+	keys := make([]string, len(stats))
+	rx := make([]int64, len(stats))
+	tx := make([]int64, len(stats))
+	handshakes := make([]*time.Time, len(stats))
+	epochs := make([]string, len(stats))
+	for i, stat := range stats {
+		keys[i] = stat.PublicKey
+		rx[i] = stat.RxBytes
+		tx[i] = stat.TxBytes
+		handshakes[i] = stat.LastHandshakeAt
+		epochs[i] = stat.Epoch
+	}
+
+	cmd, err := r.pool.Exec(ctx, query, nodeID, keys, rx, tx, handshakes, epochs)
+	if err != nil {
+		return 0, fmt.Errorf("apply peer stats: %w", err)
+	}
+	return int(cmd.RowsAffected()), nil
+}
+
+// Lifecycle reasons recorded in peer_lifecycle_events.
+const (
+	reasonSubscriptionLapsed = "subscription_lapsed"
+	reasonSubscriptionActive = "subscription_active"
+)
+
+// RevokeLapsedPeers revokes the active peers of users without a trialing or
+// active subscription whose latest subscription changed status at or before
+// lapsedBefore. Users who never subscribed are left alone. Each revocation is
+// recorded in the same statement.
+func (r *PeersRepository) RevokeLapsedPeers(ctx context.Context, lapsedBefore time.Time) ([]entities.PeerTransition, error) {
+	const query = `
+	WITH lapsed AS (
+		SELECT DISTINCT ON (s.user_id) s.user_id, s.id AS subscription_id, s.status_changed_at
+		FROM subscriptions s
+		WHERE NOT EXISTS (
+			SELECT 1 FROM subscriptions a
+			WHERE a.user_id = s.user_id AND a.status IN ('trialing', 'active')
+		)
+		ORDER BY s.user_id, s.status_changed_at DESC
+	), revoked AS (
+		UPDATE peers p
+		SET status = 'revoked', suspended_at = NOW(), updated_at = NOW()
+		FROM lapsed l
+		WHERE p.user_id = l.user_id AND p.status = 'active' AND l.status_changed_at <= $1
+		RETURNING p.id, p.user_id, p.node_id, l.subscription_id
+	)
+	INSERT INTO peer_lifecycle_events (peer_id, user_id, node_id, subscription_id, from_status, to_status, reason)
+	SELECT id, user_id, node_id, subscription_id, 'active'::peer_status, 'revoked'::peer_status, $2
+	FROM revoked
+	RETURNING peer_id, user_id, node_id, subscription_id, from_status::text, to_status::text, reason, created_at`
+
+	rows, err := r.pool.Query(ctx, query, lapsedBefore, reasonSubscriptionLapsed)
+	if err != nil {
+		return nil, fmt.Errorf("revoke lapsed peers: %w", err)
+	}
+	defer rows.Close()
+	return collectPeerTransitions(rows)
+}
+
+// RestoreEntitledPeers reactivates peers revoked for a lapsed subscription
+// once their user has a trialing or active subscription again.
+func (r *PeersRepository) RestoreEntitledPeers(ctx context.Context) ([]entities.PeerTransition, error) {
+	const query = `
+	WITH restored AS (
+		UPDATE peers p
+		SET status = 'active', suspended_at = NULL, updated_at = NOW()
+		FROM subscriptions s
+		WHERE s.user_id = p.user_id AND s.status IN ('trialing', 'active')
+		  AND p.status = 'revoked' AND p.suspended_at IS NOT NULL
+		RETURNING p.id, p.user_id, p.node_id, s.id AS subscription_id
+	)
+	INSERT INTO peer_lifecycle_events (peer_id, user_id, node_id, subscription_id, from_status, to_status, reason)
+	SELECT id, user_id, node_id, subscription_id, 'revoked'::peer_status, 'active'::peer_status, $1
+	FROM restored
+	RETURNING peer_id, user_id, node_id, subscription_id, from_status::text, to_status::text, reason, created_at`
+
+	rows, err := r.pool.Query(ctx, query, reasonSubscriptionActive)
+	if err != nil {
+		return nil, fmt.Errorf("restore entitled peers: %w", err)
+	}
+	defer rows.Close()
+	return collectPeerTransitions(rows)
+}
+
+func collectPeerTransitions(rows pgx.Rows) ([]entities.PeerTransition, error) {
+	var transitions []entities.PeerTransition
+	for rows.Next() {
+		var t entities.PeerTransition
+		if err := rows.Scan(&t.PeerID, &t.UserID, &t.NodeID, &t.SubscriptionID, &t.FromStatus, &t.ToStatus, &t.Reason, &t.CreatedAt); err != nil {
+			return nil, err
+		}
+		transitions = append(transitions, t)
+	}
+	return transitions, rows.Err()
+}
+
+func (r *PeersRepository) collectPeerChanges(rows pgx.Rows) ([]entities.PeerChange, error) {
+	var changes []entities.PeerChange
+	for rows.Next() {
+		var (
+			change    entities.PeerChange
+			preshared sql.NullString
+			keepalive sql.NullInt32
+		)
+		if err := rows.Scan(&change.PublicKey, &preshared, &change.AllowedIPs, &keepalive, &change.MeshGroup, &change.Removed, &change.Revision); err != nil {
+			return nil, err
+		}
+		if preshared.Valid {
+			val, err := r.crypt.Open(fieldPresharedKey, preshared.String)
+			if err != nil {
+				return nil, fmt.Errorf("decrypt preshared key: %w", err)
+			}
+			change.PresharedKey = &val
+		}
+		if keepalive.Valid {
+			val := int(keepalive.Int32)
+			change.Keepalive = &val
+		}
+		changes = append(changes, change)
+	}
+	return changes, rows.Err()
+}
+
+func (r *PeersRepository) scanPeer(row pgx.Row) (entities.Peer, error) {
 	var (
 		peer       entities.Peer
 		preshared  sql.NullString
@@ -173,6 +658,7 @@ func scanPeer(row pgx.Row) (entities.Peer, error) {
 		keepalive  sql.NullInt32
 		mtu        sql.NullInt32
 		lastSeen   sql.NullTime
+		country    sql.NullString
 	)
 
 	if err := row.Scan(
@@ -193,12 +679,18 @@ func scanPeer(row pgx.Row) (entities.Peer, error) {
 		&lastSeen,
 		&peer.BytesTX,
 		&peer.BytesRX,
+		&peer.Routing.Preset,
+		&country,
+		&peer.Routing.Exclude,
 	); err != nil {
 		return entities.Peer{}, err
 	}
 
 	if preshared.Valid {
-		val := preshared.String
+		val, err := r.crypt.Open(fieldPresharedKey, preshared.String)
+		if err != nil {
+			return entities.Peer{}, fmt.Errorf("decrypt preshared key: %w", err)
+		}
 		peer.PresharedKey = &val
 	}
 	peer.DNSServers = dnsServers
@@ -214,10 +706,77 @@ func scanPeer(row pgx.Row) (entities.Peer, error) {
 		val := lastSeen.Time
 		peer.LastHandshakeAt = &val
 	}
+	peer.Routing.Country = country.String
+	if len(peer.Routing.Exclude) == 0 {
+		peer.Routing.Exclude = nil
+	}
 
 	return peer, nil
 }
 
+func routingPreset(routing entities.PeerRouting) string {
+	if routing.Preset == "" {
+		return "full"
+	}
+	return routing.Preset
+}
+
+func routingExcludes(routing entities.PeerRouting) []string {
+	if routing.Exclude == nil {
+		return []string{}
+	}
+	return routing.Exclude
+}
+
+func nullableString(value string) *string {
+	if value == "" {
+		return nil
+	}
+	return &value
+}
+
+func (r *PeersRepository) withTx(ctx context.Context, fn func(pgx.Tx) error) error {
+	tx, err := r.pool.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return fmt.Errorf("begin tx: %w", err)
+	}
+	defer func() {
+		if tx != nil {
+			_ = tx.Rollback(ctx)
+		}
+	}()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("commit tx: %w", err)
+	}
+	tx = nil
+	return nil
+}
+
+// peerAddresses extracts the single-host entries of an AllowedIPs list.
+func peerAddresses(allowed string) ([]string, error) {
+	var addrs []string
+	for _, part := range strings.Split(allowed, ",") {
+		prefix, err := netip.ParsePrefix(strings.TrimSpace(part))
+		if err != nil {
+			return nil, fmt.Errorf("invalid allowed ip %q: %w", part, err)
+		}
+		if prefix.Bits() == prefix.Addr().BitLen() {
+			addrs = append(addrs, prefix.Addr().String())
+		}
+	}
+	return addrs, nil
+}
+
+func isUniqueViolation(err error, constraint string) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23505" && pgErr.ConstraintName == constraint
+}
+
 func pgStringArray(values []string) interface{} {
 	if len(values) == 0 {
 		return []string{}
@@ -225,4 +784,7 @@ func pgStringArray(values []string) interface{} {
 	return values
 }
 
-var ErrDuplicatePeer = errors.New("peer already exists")
+var (
+	ErrDuplicatePeer = errors.New("peer already exists")
+	ErrPeerNotActive = errors.New("peer not active")
+)
@@ -0,0 +1,219 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/entities"
+)
+
+// testPool connects to TEST_POSTGRES_DSN and migrates a schema of its own,
+// which is dropped when the test ends. Without the variable the test is
+// skipped.
+func testPool(t *testing.T) *pgxpool.Pool {
+	t.Helper()
+	dsn := os.Getenv("TEST_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("TEST_POSTGRES_DSN not set")
+	}
+	ctx := context.Background()
+
+	schema := "test_" + strings.ReplaceAll(uuid.NewString(), "-", "")
+	admin, err := pgx.Connect(ctx, dsn)
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	if _, err := admin.Exec(ctx, "CREATE SCHEMA "+schema); err != nil {
+		t.Fatalf("create schema: %v", err)
+	}
+	t.Cleanup(func() {
+		_, _ = admin.Exec(context.Background(), "DROP SCHEMA "+schema+" CASCADE")
+		_ = admin.Close(context.Background())
+	})
+
+	cfg, err := pgxpool.ParseConfig(dsn)
+	if err != nil {
+		t.Fatalf("parse dsn: %v", err)
+	}
+	cfg.ConnConfig.RuntimeParams["search_path"] = schema + ",public"
+	pool, err := pgxpool.NewWithConfig(ctx, cfg)
+	if err != nil {
+		t.Fatalf("create pool: %v", err)
+	}
+	t.Cleanup(pool.Close)
+
+	files, err := filepath.Glob("migrations/*.sql")
+	if err != nil {
+		t.Fatalf("list migrations: %v", err)
+	}
+	sort.Strings(files)
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatalf("read %s: %v", file, err)
+		}
+		// goose annotations are comments; everything above Down is Up.
+		up, _, _ := strings.Cut(string(data), "-- +goose Down")
+		if _, err := pool.Exec(ctx, up); err != nil {
+			t.Fatalf("migrate %s: %v", filepath.Base(file), err)
+		}
+	}
+	return pool
+}
+
+func TestHealthReportDrainTakesNodeOutOfPlacement(t *testing.T) {
+	pool := testPool(t)
+	ctx := context.Background()
+	regions := NewRegionsRepository(pool)
+
+	var regionID, nodeID uuid.UUID
+	if err := pool.QueryRow(ctx, `INSERT INTO regions (code, name, country_code) VALUES ('TR-IST', 'Istanbul', 'TR') RETURNING id`).Scan(&regionID); err != nil {
+		t.Fatalf("insert region: %v", err)
+	}
+	if err := pool.QueryRow(ctx, `
+		INSERT INTO nodes (region_id, hostname, public_key, endpoint, tunnel_port)
+		VALUES ($1, 'ist-1', 'server-pub', 'vpn.example.com:51820', 51820) RETURNING id`, regionID).Scan(&nodeID); err != nil {
+		t.Fatalf("insert node: %v", err)
+	}
+
+	place := func() error {
+		tx, err := pool.Begin(ctx)
+		if err != nil {
+			t.Fatalf("begin: %v", err)
+		}
+		defer func() { _ = tx.Rollback(ctx) }()
+		_, err = lockPlacementNode(ctx, tx, entities.PeerPlacement{})
+		return err
+	}
+	health := func(drain bool) string {
+		node, err := regions.UpdateNodeHealth(ctx, nodeID, 80, drain)
+		if err != nil {
+			t.Fatalf("update health: %v", err)
+		}
+		return node.Status
+	}
+
+	if err := place(); err != nil {
+		t.Fatalf("active node must be placeable: %v", err)
+	}
+
+	if status := health(true); status != "draining" {
+		t.Fatalf("agent drain: expected draining, got %s", status)
+	}
+	if err := place(); !errors.Is(err, pgx.ErrNoRows) {
+		t.Fatalf("drained node must be skipped, got %v", err)
+	}
+
+	// An operator's status stands until the agent's drain state changes.
+	if _, err := pool.Exec(ctx, `UPDATE nodes SET status = 'active' WHERE id = $1`, nodeID); err != nil {
+		t.Fatalf("reactivate: %v", err)
+	}
+	if status := health(true); status != "active" {
+		t.Fatalf("unchanged drain: expected active, got %s", status)
+	}
+
+	if status := health(false); status != "active" {
+		t.Fatalf("agent undrain: expected active, got %s", status)
+	}
+	if err := place(); err != nil {
+		t.Fatalf("undrained node must be placeable: %v", err)
+	}
+}
+
+func TestPinnedPlacementNeedsAnAvailableNode(t *testing.T) {
+	pool := testPool(t)
+	ctx := context.Background()
+
+	var regionID, nodeID uuid.UUID
+	if err := pool.QueryRow(ctx, `INSERT INTO regions (code, name, country_code) VALUES ('TR-IST', 'Istanbul', 'TR') RETURNING id`).Scan(&regionID); err != nil {
+		t.Fatalf("insert region: %v", err)
+	}
+	if err := pool.QueryRow(ctx, `
+		INSERT INTO nodes (region_id, hostname, public_key, endpoint, tunnel_port)
+		VALUES ($1, 'ist-1', 'server-pub', 'vpn.example.com:51820', 51820) RETURNING id`, regionID).Scan(&nodeID); err != nil {
+		t.Fatalf("insert node: %v", err)
+	}
+
+	place := func() error {
+		tx, err := pool.Begin(ctx)
+		if err != nil {
+			t.Fatalf("begin: %v", err)
+		}
+		defer func() { _ = tx.Rollback(ctx) }()
+		_, err = lockPlacementNode(ctx, tx, entities.PeerPlacement{NodeID: nodeID})
+		return err
+	}
+	exec := func(query string, args ...any) {
+		if _, err := pool.Exec(ctx, query, args...); err != nil {
+			t.Fatalf("%s: %v", query, err)
+		}
+	}
+
+	if err := place(); err != nil {
+		t.Fatalf("active node must be placeable: %v", err)
+	}
+
+	exec(`UPDATE nodes SET status = 'draining' WHERE id = $1`, nodeID)
+	if err := place(); !errors.Is(err, pgx.ErrNoRows) {
+		t.Fatalf("draining node must not be pinned, got %v", err)
+	}
+	exec(`UPDATE nodes SET status = 'active' WHERE id = $1`, nodeID)
+
+	exec(`UPDATE regions SET is_active = false WHERE id = $1`, regionID)
+	if err := place(); !errors.Is(err, pgx.ErrNoRows) {
+		t.Fatalf("node in an inactive region must not be pinned, got %v", err)
+	}
+}
+
+func TestRestartWhileDrainedKeepsNodeDraining(t *testing.T) {
+	pool := testPool(t)
+	ctx := context.Background()
+	regions := NewRegionsRepository(pool)
+
+	var regionID uuid.UUID
+	if err := pool.QueryRow(ctx, `INSERT INTO regions (code, name, country_code) VALUES ('TR-IST', 'Istanbul', 'TR') RETURNING id`).Scan(&regionID); err != nil {
+		t.Fatalf("insert region: %v", err)
+	}
+	register := func() entities.Node {
+		node, err := regions.RegisterOrUpdateNode(ctx, entities.Node{
+			RegionID:      regionID,
+			Hostname:      "ist-1",
+			PublicKey:     "server-pub",
+			Endpoint:      "vpn.example.com:51820",
+			Status:        "active",
+			TunnelPort:    51820,
+			CapacityScore: 100,
+			TunnelAddress: "10.8.0.1/24",
+		})
+		if err != nil {
+			t.Fatalf("register: %v", err)
+		}
+		return node
+	}
+
+	node := register()
+	if _, err := regions.UpdateNodeHealth(ctx, node.ID, 80, true); err != nil {
+		t.Fatalf("update health: %v", err)
+	}
+
+	// The agent restarts with its drain marker still in place.
+	if restarted := register(); restarted.Status != "draining" {
+		t.Fatalf("re-registration must keep the node draining, got %s", restarted.Status)
+	}
+	updated, err := regions.UpdateNodeHealth(ctx, node.ID, 80, true)
+	if err != nil {
+		t.Fatalf("update health: %v", err)
+	}
+	if updated.Status != "draining" {
+		t.Fatalf("first report after restart: expected draining, got %s", updated.Status)
+	}
+}
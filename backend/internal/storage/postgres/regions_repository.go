@@ -3,6 +3,7 @@ package postgres
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"time"
 
@@ -98,10 +99,20 @@ func (r *RegionsRepository) ListRegionsWithCapacity(ctx context.Context) ([]enti
 	return result, rows.Err()
 }
 
+// ErrNodeIdentityConflict is returned when a node registers with a
+// certificate identity other than the one its record is bound to, or with
+// one already bound to another node.
+var ErrNodeIdentityConflict = errors.New("node identity conflict")
+
+// RegisterOrUpdateNode upserts a node by hostname. A registering node keeps
+// its status, so an agent restarting while drained, or a node an operator
+// disabled, does not come back as active. A certificate identity binds the
+// record on first use, and a certificate with the bound one's name re-binds
+// it; an unbound registration keeps the existing binding.
 func (r *RegionsRepository) RegisterOrUpdateNode(ctx context.Context, node entities.Node) (entities.Node, error) {
 	const query = `
-	INSERT INTO nodes (region_id, hostname, public_ipv4, public_ipv6, public_key, endpoint, status, tunnel_port, capacity_score, last_seen_at)
-	VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10)
+	INSERT INTO nodes (region_id, hostname, public_ipv4, public_ipv6, public_key, endpoint, status, tunnel_port, capacity_score, last_seen_at, tunnel_ipv6_prefix, ipv6_enabled, tunnel_address, cert_identity, cert_name)
+	VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13,$14,$15)
 	ON CONFLICT (hostname)
 	DO UPDATE SET
 		region_id = EXCLUDED.region_id,
@@ -109,12 +120,20 @@ func (r *RegionsRepository) RegisterOrUpdateNode(ctx context.Context, node entit
 		public_ipv6 = EXCLUDED.public_ipv6,
 		public_key = EXCLUDED.public_key,
 		endpoint = EXCLUDED.endpoint,
-		status = EXCLUDED.status,
 		tunnel_port = EXCLUDED.tunnel_port,
 		capacity_score = EXCLUDED.capacity_score,
 		last_seen_at = EXCLUDED.last_seen_at,
+		tunnel_ipv6_prefix = EXCLUDED.tunnel_ipv6_prefix,
+		ipv6_enabled = EXCLUDED.ipv6_enabled,
+		tunnel_address = EXCLUDED.tunnel_address,
+		cert_identity = COALESCE(EXCLUDED.cert_identity, nodes.cert_identity),
+		cert_name = CASE WHEN EXCLUDED.cert_identity IS NULL THEN nodes.cert_name ELSE EXCLUDED.cert_name END,
 		updated_at = NOW()
-	RETURNING id, region_id, hostname, public_ipv4, public_ipv6, public_key, endpoint, status, capacity_score, tunnel_port, last_seen_at, created_at, updated_at`
+	WHERE nodes.cert_identity IS NULL
+	   OR EXCLUDED.cert_identity IS NULL
+	   OR nodes.cert_identity = EXCLUDED.cert_identity
+	   OR nodes.cert_name = EXCLUDED.cert_name
+	RETURNING id, region_id, hostname, public_ipv4, public_ipv6, public_key, endpoint, status, capacity_score, tunnel_port, tunnel_address, tunnel_ipv6_prefix, ipv6_enabled, last_seen_at, created_at, updated_at, cert_identity, cert_name`
 
 	row := r.pool.QueryRow(ctx, query,
 		node.RegionID,
@@ -127,21 +146,39 @@ func (r *RegionsRepository) RegisterOrUpdateNode(ctx context.Context, node entit
 		node.TunnelPort,
 		node.CapacityScore,
 		time.Now().UTC(),
+		node.TunnelIPv6Prefix,
+		node.IPv6Enabled,
+		node.TunnelAddress,
+		node.CertIdentity,
+		node.CertName,
 	)
 
-	return scanNode(row)
+	registered, err := scanNode(row)
+	if errors.Is(err, pgx.ErrNoRows) || isUniqueViolation(err, "idx_nodes_cert_identity") {
+		return entities.Node{}, ErrNodeIdentityConflict
+	}
+	return registered, err
 }
 
-func (r *RegionsRepository) UpdateNodeHealth(ctx context.Context, nodeID uuid.UUID, capacityScore int) (entities.Node, error) {
+// UpdateNodeHealth records a health report. When the agent's drain state
+// changed since its last report, the node is moved to draining or back to
+// active; disabled nodes stay disabled.
+func (r *RegionsRepository) UpdateNodeHealth(ctx context.Context, nodeID uuid.UUID, capacityScore int, drain bool) (entities.Node, error) {
 	const query = `
 	UPDATE nodes
 	SET capacity_score = $2,
+	    status = CASE
+	        WHEN $3 = agent_drain OR status = 'disabled' THEN status
+	        WHEN $3 THEN 'draining'::node_status
+	        ELSE 'active'::node_status
+	    END,
+	    agent_drain = $3,
 	    last_seen_at = NOW(),
 	    updated_at = NOW()
 	WHERE id = $1
-	RETURNING id, region_id, hostname, public_ipv4, public_ipv6, public_key, endpoint, status, capacity_score, tunnel_port, last_seen_at, created_at, updated_at`
+	RETURNING id, region_id, hostname, public_ipv4, public_ipv6, public_key, endpoint, status, capacity_score, tunnel_port, tunnel_address, tunnel_ipv6_prefix, ipv6_enabled, last_seen_at, created_at, updated_at, cert_identity, cert_name`
 
-	row := r.pool.QueryRow(ctx, query, nodeID, capacityScore)
+	row := r.pool.QueryRow(ctx, query, nodeID, capacityScore, drain)
 	return scanNode(row)
 }
 
@@ -157,7 +194,7 @@ func (r *RegionsRepository) GetRegionByCode(ctx context.Context, code string) (e
 
 func (r *RegionsRepository) GetNodeByID(ctx context.Context, id uuid.UUID) (entities.Node, error) {
 	const query = `
-	SELECT id, region_id, hostname, public_ipv4, public_ipv6, public_key, endpoint, status, capacity_score, tunnel_port, last_seen_at, created_at, updated_at
+	SELECT id, region_id, hostname, public_ipv4, public_ipv6, public_key, endpoint, status, capacity_score, tunnel_port, tunnel_address, tunnel_ipv6_prefix, ipv6_enabled, last_seen_at, created_at, updated_at, cert_identity, cert_name
 	FROM nodes
 	WHERE id = $1`
 
@@ -177,6 +214,8 @@ func scanNode(row pgx.Row) (entities.Node, error) {
 	var (
 		node       entities.Node
 		ipv4, ipv6 sql.NullString
+		tunnelAddr sql.NullString
+		tunnel6    sql.NullString
 		lastSeen   sql.NullTime
 	)
 
@@ -191,9 +230,14 @@ func scanNode(row pgx.Row) (entities.Node, error) {
 		&node.Status,
 		&node.CapacityScore,
 		&node.TunnelPort,
+		&tunnelAddr,
+		&tunnel6,
+		&node.IPv6Enabled,
 		&lastSeen,
 		&node.CreatedAt,
 		&node.UpdatedAt,
+		&node.CertIdentity,
+		&node.CertName,
 	); err != nil {
 		return entities.Node{}, err
 	}
@@ -206,6 +250,11 @@ func scanNode(row pgx.Row) (entities.Node, error) {
 		value := ipv6.String
 		node.PublicIPv6 = &value
 	}
+	node.TunnelAddress = tunnelAddr.String
+	if tunnel6.Valid {
+		value := tunnel6.String
+		node.TunnelIPv6Prefix = &value
+	}
 	if lastSeen.Valid {
 		value := lastSeen.Time
 		node.LastSeenAt = &value
@@ -0,0 +1,51 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/google/uuid"
+
+	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/entities"
+)
+
+func TestRegisterRebindsRenewedCertificate(t *testing.T) {
+	pool := testPool(t)
+	ctx := context.Background()
+	regions := NewRegionsRepository(pool)
+
+	var regionID uuid.UUID
+	if err := pool.QueryRow(ctx, `INSERT INTO regions (code, name, country_code) VALUES ('TR-IST', 'Istanbul', 'TR') RETURNING id`).Scan(&regionID); err != nil {
+		t.Fatalf("insert region: %v", err)
+	}
+	register := func(fingerprint, name string) (entities.Node, error) {
+		return regions.RegisterOrUpdateNode(ctx, entities.Node{
+			RegionID:      regionID,
+			Hostname:      "ist-1",
+			PublicKey:     "server-pub",
+			Endpoint:      "vpn.example.com:51820",
+			Status:        "active",
+			TunnelPort:    51820,
+			CapacityScore: 100,
+			TunnelAddress: "10.8.0.1/24",
+			CertIdentity:  &fingerprint,
+			CertName:      &name,
+		})
+	}
+
+	if _, err := register("sha256:aa", "CN=ist-1"); err != nil {
+		t.Fatalf("first registration: %v", err)
+	}
+	if _, err := register("sha256:bb", "CN=ams-1"); !errors.Is(err, ErrNodeIdentityConflict) {
+		t.Fatalf("certificate with another name must not re-bind, got %v", err)
+	}
+
+	node, err := register("sha256:cc", "CN=ist-1")
+	if err != nil {
+		t.Fatalf("renewed certificate: %v", err)
+	}
+	if node.CertIdentity == nil || *node.CertIdentity != "sha256:cc" {
+		t.Fatalf("expected binding to move to the renewed certificate, got %v", node.CertIdentity)
+	}
+}
@@ -3,16 +3,19 @@ package e2e
 import (
 	"context"
 	"errors"
+	"net/netip"
 	"testing"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
 	"github.com/stretchr/testify/require"
 
 	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/auth"
 	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/billing"
 	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/config"
 	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/entities"
+	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/entitlements"
 	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/peers"
 	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/platform/hash"
 	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/platform/jwt"
@@ -145,6 +148,19 @@ func (r *e2eBillingRepo) GetSubscriptionByProviderID(ctx context.Context, provid
 	}
 	return sub, nil
 }
+func (r *e2eBillingRepo) GetActiveSubscription(ctx context.Context, userID uuid.UUID) (entities.Subscription, entities.Plan, error) {
+	for _, sub := range r.subscriptions {
+		if sub.UserID != userID || (sub.Status != "active" && sub.Status != "trialing") {
+			continue
+		}
+		for _, plan := range r.plans {
+			if plan.ID == sub.PlanID {
+				return sub, plan, nil
+			}
+		}
+	}
+	return entities.Subscription{}, entities.Plan{}, pgx.ErrNoRows
+}
 func (r *e2eBillingRepo) RecordPayment(ctx context.Context, payment entities.Payment) (entities.Payment, error) {
 	return payment, nil
 }
@@ -171,9 +187,11 @@ func (p *e2eBillingProvider) ParseWebhook(payload []byte, signature string) (*bi
 
 // Peers stubs reused
 
+// e2ePeerRepo places every peer on its single node.
 type e2ePeerRepo struct {
 	peers map[uuid.UUID]entities.Peer
 	count int
+	node  entities.Node
 }
 
 func newE2EPeerRepo() *e2ePeerRepo {
@@ -186,11 +204,18 @@ func (r *e2ePeerRepo) ListByUser(ctx context.Context, userID uuid.UUID) ([]entit
 func (r *e2ePeerRepo) CountByUser(ctx context.Context, userID uuid.UUID) (int, error) {
 	return r.count, nil
 }
-func (r *e2ePeerRepo) Create(ctx context.Context, peer entities.Peer) (entities.Peer, error) {
+func (r *e2ePeerRepo) Create(ctx context.Context, peer entities.Peer, placement entities.PeerPlacement, assign func(entities.Node, []netip.Addr) (string, error)) (entities.Peer, entities.Node, error) {
+	allowed, err := assign(r.node, nil)
+	if err != nil {
+		return entities.Peer{}, entities.Node{}, err
+	}
 	peer.ID = uuid.New()
+	peer.NodeID = r.node.ID
+	peer.RegionID = r.node.RegionID
+	peer.AllowedIPs = allowed
 	r.peers[peer.ID] = peer
 	r.count++
-	return peer, nil
+	return peer, r.node, nil
 }
 func (r *e2ePeerRepo) GetByID(ctx context.Context, id uuid.UUID, userID uuid.UUID) (entities.Peer, error) {
 	peer, ok := r.peers[id]
@@ -202,11 +227,52 @@ func (r *e2ePeerRepo) GetByID(ctx context.Context, id uuid.UUID, userID uuid.UUI
 func (r *e2ePeerRepo) Rename(ctx context.Context, id uuid.UUID, userID uuid.UUID, name string) (entities.Peer, error) {
 	return entities.Peer{}, nil
 }
+func (r *e2ePeerRepo) Migrate(ctx context.Context, peer entities.Peer, placement entities.PeerPlacement, assign func(entities.Node, []netip.Addr) (string, error)) (entities.Peer, entities.Node, error) {
+	return entities.Peer{}, entities.Node{}, pgx.ErrNoRows
+}
+func (r *e2ePeerRepo) Rotate(ctx context.Context, id uuid.UUID, userID uuid.UUID, publicKey string, presharedKey *string) (entities.Peer, error) {
+	peer, ok := r.peers[id]
+	if !ok {
+		return entities.Peer{}, errors.New("not found")
+	}
+	peer.PublicKey = publicKey
+	peer.PresharedKey = presharedKey
+	r.peers[id] = peer
+	return peer, nil
+}
+func (r *e2ePeerRepo) SetRouting(ctx context.Context, id uuid.UUID, userID uuid.UUID, routing entities.PeerRouting) (entities.Peer, error) {
+	peer, ok := r.peers[id]
+	if !ok {
+		return entities.Peer{}, pgx.ErrNoRows
+	}
+	peer.Routing = routing
+	r.peers[id] = peer
+	return peer, nil
+}
 func (r *e2ePeerRepo) Delete(ctx context.Context, id uuid.UUID, userID uuid.UUID) error { return nil }
+func (r *e2ePeerRepo) DeviceMesh(ctx context.Context, userID uuid.UUID) (bool, error) {
+	return false, nil
+}
+func (r *e2ePeerRepo) SetDeviceMesh(ctx context.Context, userID uuid.UUID, enabled bool) error {
+	return nil
+}
 func (r *e2ePeerRepo) UsageSummaryByUser(ctx context.Context, userID uuid.UUID) (entities.UsageSummary, error) {
 	return entities.UsageSummary{PeerCount: r.count}, nil
 }
 
+func (r *e2ePeerRepo) NodePeerRevision(ctx context.Context, nodeID uuid.UUID) (int64, error) {
+	return 0, nil
+}
+func (r *e2ePeerRepo) ListActiveByNode(ctx context.Context, nodeID uuid.UUID) ([]entities.PeerChange, error) {
+	return nil, nil
+}
+func (r *e2ePeerRepo) ListChangesByNode(ctx context.Context, nodeID uuid.UUID, since int64) ([]entities.PeerChange, error) {
+	return nil, nil
+}
+func (r *e2ePeerRepo) ApplyPeerStats(ctx context.Context, nodeID uuid.UUID, stats []entities.PeerStat) (int, error) {
+	return len(stats), nil
+}
+
 type e2eNodeStore struct {
 	node entities.Node
 }
@@ -218,6 +284,10 @@ func (n *e2eNodeStore) GetNodeByID(ctx context.Context, id uuid.UUID) (entities.
 	return n.node, nil
 }
 
+func (n *e2eNodeStore) GetRegionByCode(ctx context.Context, code string) (entities.Region, error) {
+	return entities.Region{ID: n.node.RegionID, Code: code, IsActive: true}, nil
+}
+
 type e2eTokenStore struct {
 	tokens map[string]entities.UserToken
 }
@@ -242,14 +312,31 @@ func (t *e2eTokenStore) GetUserToken(ctx context.Context, tokenType, tokenHash s
 	return token, nil
 }
 
-func (t *e2eTokenStore) ConsumeUserToken(ctx context.Context, tokenID uuid.UUID) error {
+func (t *e2eTokenStore) GetUserTokenByID(ctx context.Context, tokenID uuid.UUID) (entities.UserToken, error) {
+	for _, token := range t.tokens {
+		if token.ID == tokenID {
+			return token, nil
+		}
+	}
+	return entities.UserToken{}, pgx.ErrNoRows
+}
+
+func (t *e2eTokenStore) ListActiveUserTokens(ctx context.Context, userID uuid.UUID, tokenType string) ([]entities.UserToken, error) {
+	return nil, nil
+}
+
+func (t *e2eTokenStore) ConsumeAndWipeUserToken(ctx context.Context, tokenID uuid.UUID) error {
 	for hash, token := range t.tokens {
 		if token.ID == tokenID {
 			delete(t.tokens, hash)
-			break
+			return nil
 		}
 	}
-	return nil
+	return pgx.ErrNoRows
+}
+
+func (t *e2eTokenStore) WipeUserTokenMetadata(ctx context.Context, tokenType string, expiredBefore time.Time) (int64, error) {
+	return 0, nil
 }
 
 func TestEndToEndPeerProvisioningFlow(t *testing.T) {
@@ -297,19 +384,21 @@ func TestEndToEndPeerProvisioningFlow(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, "active", sub.Status)
 
-	node := &e2eNodeStore{node: entities.Node{PublicKey: "serverpk", Endpoint: "vpn.example.com:51820"}}
+	node := &e2eNodeStore{node: entities.Node{ID: uuid.New(), RegionID: uuid.New(), PublicKey: "serverpk", Endpoint: "vpn.example.com:51820"}}
 	peerRepo := newE2EPeerRepo()
+	peerRepo.node = node.node
 	tokens := newE2ETokenStore()
-	peerService := peers.NewService(peerRepo, node, tokens)
+	peerService, err := peers.NewService(peerRepo, node, tokens, entitlements.NewService(billingRepo), config.PeersConfig{ConfigTTL: 24 * time.Hour})
+	require.NoError(t, err)
 
 	peerOut, err := peerService.CreatePeer(ctx, peers.CreatePeerInput{
 		UserID:     user.ID,
-		NodeID:     uuid.New(),
-		RegionID:   uuid.New(),
+		RegionCode: peers.RegionRecommended,
 		DeviceName: "Laptop",
 	})
 	require.NoError(t, err)
 	require.NotEmpty(t, peerOut.ConfigToken)
+	require.Equal(t, node.node.ID, peerOut.Peer.NodeID)
 
 	cfgText, err := peerService.GetConfigByToken(ctx, user.ID, peerOut.ConfigToken)
 	require.NoError(t, err)
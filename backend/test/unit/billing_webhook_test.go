@@ -180,3 +180,22 @@ func TestBillingHandleWebhookUnsupportedProvider(t *testing.T) {
 	err := service.HandleWebhook(context.Background(), "unknown", nil, "")
 	require.ErrorIs(t, err, billing.ErrUnsupportedProvider)
 }
+
+func TestBillingWebhookNotifiesSubscriptionChange(t *testing.T) {
+	service, repo, provider, userID := setupBillingService()
+	var changed []entities.Subscription
+	service.OnSubscriptionChange(func(sub entities.Subscription) { changed = append(changed, sub) })
+
+	subID := "sub_789"
+	repo.subscriptions[subID] = entities.Subscription{ID: uuid.New(), UserID: userID, Provider: "stripe", ProviderSubscriptionID: subID, Status: "active"}
+	provider.events = []*billing.WebhookEvent{{
+		Type:           billing.WebhookTypeSubscriptionCanceled,
+		SubscriptionID: subID,
+		OccurredAt:     time.Now(),
+	}}
+
+	require.NoError(t, service.HandleWebhook(context.Background(), "stripe", []byte("payload"), "sig"))
+	require.Len(t, changed, 1)
+	require.Equal(t, "canceled", changed[0].Status)
+	require.Equal(t, userID, changed[0].UserID)
+}
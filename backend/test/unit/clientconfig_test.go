@@ -0,0 +1,144 @@
+package unit
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/clientconfig"
+)
+
+func sampleClientConfig() clientconfig.Config {
+	mtu := 1420
+	return clientconfig.Config{
+		PeerID:          "7b0c3c52-64a4-4c1f-9a8e-2f3d5e1b9c10",
+		Name:            "Office Router",
+		PrivateKey:      "clientprivate=",
+		Addresses:       []string{"10.8.0.2/32", "fd00::2/128"},
+		DNS:             []string{"1.1.1.1", "2606:4700:4700::1111"},
+		MTU:             &mtu,
+		Keepalive:       25,
+		ServerPublicKey: "serverpublic=",
+		PresharedKey:    "preshared=",
+		Endpoint:        "vpn.example.com:51820",
+		AllowedIPs:      []string{"0.0.0.0/0", "::/0"},
+	}
+}
+
+func exportConfig(t *testing.T, format string, cfg clientconfig.Config) string {
+	t.Helper()
+	exporter, err := clientconfig.DefaultRegistry().Get(format)
+	require.NoError(t, err)
+	data, err := exporter.Export(cfg)
+	require.NoError(t, err)
+	return string(data)
+}
+
+func TestClientConfigRegistry(t *testing.T) {
+	registry := clientconfig.DefaultRegistry()
+	require.Equal(t, []string{"conf", "json", "mikrotik", "mobileconfig", "networkmanager", "openwrt", "qr-svg"}, registry.Formats())
+
+	exporter, err := registry.Get("")
+	require.NoError(t, err)
+	require.Equal(t, clientconfig.DefaultFormat, exporter.Format())
+
+	_, err = registry.Get("ovpn")
+	require.ErrorIs(t, err, clientconfig.ErrUnknownFormat)
+}
+
+func TestClientConfigWGQuick(t *testing.T) {
+	cfg := sampleClientConfig()
+	cfg.PrivateKey = ""
+	out := exportConfig(t, "conf", cfg)
+
+	require.NotContains(t, out, "PrivateKey")
+	require.Contains(t, out, "Address = 10.8.0.2/32, fd00::2/128\n")
+	require.Contains(t, out, "PresharedKey = preshared=\n")
+	require.Contains(t, out, "AllowedIPs = 0.0.0.0/0, ::/0\n")
+}
+
+func TestClientConfigMobileJSON(t *testing.T) {
+	var doc struct {
+		Version    int    `json:"version"`
+		PrivateKey string `json:"privateKey"`
+		Tunnel     struct {
+			Address         []string `json:"address"`
+			ServerPublicKey string   `json:"serverPublicKey"`
+			PresharedKey    string   `json:"presharedKey"`
+			AllowedIPs      []string `json:"allowedIPs"`
+			MTU             int      `json:"mtu"`
+		} `json:"tunnel"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(exportConfig(t, "json", sampleClientConfig())), &doc))
+	require.Equal(t, 1, doc.Version)
+	require.Equal(t, "clientprivate=", doc.PrivateKey)
+	require.Equal(t, []string{"10.8.0.2/32", "fd00::2/128"}, doc.Tunnel.Address)
+	require.Equal(t, "serverpublic=", doc.Tunnel.ServerPublicKey)
+	require.Equal(t, "preshared=", doc.Tunnel.PresharedKey)
+	require.Equal(t, 1420, doc.Tunnel.MTU)
+}
+
+func TestClientConfigRouterFormats(t *testing.T) {
+	cfg := sampleClientConfig()
+	cfg.Name = "Bob's router"
+
+	openwrt := exportConfig(t, "openwrt", cfg)
+	require.Contains(t, openwrt, "set network.wg_tridot.proto='wireguard'\n")
+	require.Contains(t, openwrt, "add_list network.wg_tridot.addresses='fd00::2/128'\n")
+	require.Contains(t, openwrt, `set network.wg_tridot_server.description='Bob'\''s router'`)
+	require.Contains(t, openwrt, "set network.wg_tridot_server.endpoint_port='51820'\n")
+
+	mikrotik := exportConfig(t, "mikrotik", cfg)
+	require.Contains(t, mikrotik, `/interface wireguard add name=wg-tridot private-key="clientprivate=" mtu=1420`)
+	require.Contains(t, mikrotik, `endpoint-address="vpn.example.com" endpoint-port=51820 allowed-address=0.0.0.0/0,::/0 persistent-keepalive=25s`)
+	require.Contains(t, mikrotik, "/ip address add address=10.8.0.2/32 interface=wg-tridot\n")
+	require.Contains(t, mikrotik, "/ipv6 address add address=fd00::2/128 interface=wg-tridot advertise=no\n")
+
+	cfg.Endpoint = "vpn.example.com"
+	exporter, err := clientconfig.DefaultRegistry().Get("mikrotik")
+	require.NoError(t, err)
+	_, err = exporter.Export(cfg)
+	require.Error(t, err)
+}
+
+func TestClientConfigNetworkManager(t *testing.T) {
+	cfg := sampleClientConfig()
+	out := exportConfig(t, "networkmanager", cfg)
+
+	require.Contains(t, out, "[wireguard-peer.serverpublic=]\n")
+	require.Contains(t, out, "allowed-ips=0.0.0.0/0;::/0;\n")
+	require.Contains(t, out, "[ipv4]\nmethod=manual\naddress1=10.8.0.2/32\ndns=1.1.1.1;\n")
+	require.Contains(t, out, "[ipv6]\nmethod=manual\naddress1=fd00::2/128\ndns=2606:4700:4700::1111;\n")
+
+	cfg.Addresses = []string{"10.8.0.2/32"}
+	require.Contains(t, exportConfig(t, "networkmanager", cfg), "[ipv6]\nmethod=disabled\n")
+}
+
+func TestClientConfigMobileConfig(t *testing.T) {
+	cfg := sampleClientConfig()
+	cfg.Name = "Phone & Tablet"
+	out := exportConfig(t, "mobileconfig", cfg)
+
+	require.True(t, strings.HasPrefix(out, "<?xml"))
+	require.Contains(t, out, "<string>com.wireguard.ios</string>")
+	require.Contains(t, out, "<string>Phone &amp; Tablet</string>")
+	require.Contains(t, out, "<key>WgQuickConfig</key>\n<string>[Interface]\nPrivateKey = clientprivate=\n")
+	// Identifiers are stable so a newer profile replaces the installed one.
+	require.Equal(t, out, exportConfig(t, "mobileconfig", cfg))
+
+	cfg.PeerID = ""
+	exporter, err := clientconfig.DefaultRegistry().Get("mobileconfig")
+	require.NoError(t, err)
+	_, err = exporter.Export(cfg)
+	require.Error(t, err)
+}
+
+func TestClientConfigQRSVG(t *testing.T) {
+	out := exportConfig(t, "qr-svg", sampleClientConfig())
+
+	require.True(t, strings.HasPrefix(out, `<svg xmlns="http://www.w3.org/2000/svg"`))
+	require.Contains(t, out, `<path fill="#000000" d="M4 4h1v1h-1z`)
+	require.True(t, strings.HasSuffix(out, "</svg>\n"))
+}
@@ -0,0 +1,63 @@
+package unit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/stretchr/testify/require"
+
+	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/entities"
+	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/entitlements"
+)
+
+type subscriptionRepoStub struct {
+	sub  entities.Subscription
+	plan entities.Plan
+	err  error
+}
+
+func (r *subscriptionRepoStub) GetActiveSubscription(ctx context.Context, userID uuid.UUID) (entities.Subscription, entities.Plan, error) {
+	if r.err != nil {
+		return entities.Subscription{}, entities.Plan{}, r.err
+	}
+	return r.sub, r.plan, nil
+}
+
+func TestEntitlementsResolveFromPlan(t *testing.T) {
+	periodEnd := time.Now().Add(30 * 24 * time.Hour).UTC()
+	repo := &subscriptionRepoStub{
+		sub:  entities.Subscription{Status: "active", CurrentPeriodEnd: periodEnd},
+		plan: entities.Plan{Code: "vpn-monthly", DeviceLimit: 3, AllowedRegions: []string{"tr-ist"}, AddOns: []string{"static-ip"}},
+	}
+	service := entitlements.NewService(repo)
+	userID := uuid.New()
+
+	ent, err := service.Resolve(context.Background(), userID)
+	require.NoError(t, err)
+	require.Equal(t, userID, ent.UserID)
+	require.Equal(t, "vpn-monthly", ent.PlanCode)
+	require.Equal(t, "active", ent.SubscriptionStatus)
+	require.Equal(t, periodEnd, ent.PeriodEnd)
+	require.Equal(t, 3, ent.DeviceLimit)
+	require.Equal(t, []string{"TR-IST"}, ent.Regions)
+	require.True(t, ent.AllowsRegion("tr-ist"))
+	require.False(t, ent.AllowsRegion("EU-FRA"))
+	require.True(t, ent.HasAddOn("Static-IP"))
+	require.False(t, ent.HasAddOn("dedicated-node"))
+
+	// Plans without a region list allow every region.
+	repo.plan.AllowedRegions = nil
+	ent, err = service.Resolve(context.Background(), userID)
+	require.NoError(t, err)
+	require.True(t, ent.AllowsRegion("EU-FRA"))
+}
+
+func TestEntitlementsWithoutSubscription(t *testing.T) {
+	service := entitlements.NewService(&subscriptionRepoStub{err: pgx.ErrNoRows})
+
+	_, err := service.Resolve(context.Background(), uuid.New())
+	require.ErrorIs(t, err, entitlements.ErrNoActiveSubscription)
+}
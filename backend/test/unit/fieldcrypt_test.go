@@ -0,0 +1,105 @@
+package unit
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/config"
+	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/platform/fieldcrypt"
+	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/platform/secrets"
+)
+
+func fieldKey(b byte) []byte {
+	return bytes.Repeat([]byte{b}, fieldcrypt.KeySize)
+}
+
+func TestFieldKeyringSealOpen(t *testing.T) {
+	keyring, err := fieldcrypt.NewKeyring("k1", map[string][]byte{"k1": fieldKey(1)})
+	require.NoError(t, err)
+
+	sealed, err := keyring.Seal("peers.preshared_key", "psk-secret")
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(sealed, fieldcrypt.SealedPrefix("k1")))
+	require.NotContains(t, sealed, "psk-secret")
+
+	plain, err := keyring.Open("peers.preshared_key", sealed)
+	require.NoError(t, err)
+	require.Equal(t, "psk-secret", plain)
+
+	// The column name is bound to the ciphertext.
+	_, err = keyring.Open("users.totp_secret", sealed)
+	require.ErrorIs(t, err, fieldcrypt.ErrDecrypt)
+
+	// Legacy plaintext passes through and needs sealing.
+	plain, err = keyring.Open("users.totp_secret", "JBSWY3DPEHPK3PXP")
+	require.NoError(t, err)
+	require.Equal(t, "JBSWY3DPEHPK3PXP", plain)
+	require.True(t, keyring.NeedsRotation("JBSWY3DPEHPK3PXP"))
+	require.False(t, keyring.NeedsRotation(sealed))
+}
+
+func TestFieldKeyringRotation(t *testing.T) {
+	old, err := fieldcrypt.NewKeyring("k1", map[string][]byte{"k1": fieldKey(1)})
+	require.NoError(t, err)
+	sealed, err := old.Seal("users.totp_secret", "secret")
+	require.NoError(t, err)
+
+	rotated, err := fieldcrypt.NewKeyring("k2", map[string][]byte{"k1": fieldKey(1), "k2": fieldKey(2)})
+	require.NoError(t, err)
+	require.Equal(t, []string{"k1", "k2"}, rotated.KeyIDs())
+	require.True(t, rotated.NeedsRotation(sealed))
+
+	plain, err := rotated.Open("users.totp_secret", sealed)
+	require.NoError(t, err)
+	require.Equal(t, "secret", plain)
+	resealed, err := rotated.Seal("users.totp_secret", plain)
+	require.NoError(t, err)
+	require.False(t, rotated.NeedsRotation(resealed))
+
+	// Once k1 is retired its values no longer open.
+	retired, err := fieldcrypt.NewKeyring("k2", map[string][]byte{"k2": fieldKey(2)})
+	require.NoError(t, err)
+	_, err = retired.Open("users.totp_secret", sealed)
+	require.ErrorIs(t, err, fieldcrypt.ErrUnknownKey)
+
+	// Without a keyring nothing is sealed and sealed values are refused.
+	var none *fieldcrypt.Keyring
+	plain, err = none.Seal("users.totp_secret", "secret")
+	require.NoError(t, err)
+	require.Equal(t, "secret", plain)
+	_, err = none.Open("users.totp_secret", resealed)
+	require.ErrorIs(t, err, fieldcrypt.ErrNoKeyring)
+}
+
+func TestFieldKeyringFromConfig(t *testing.T) {
+	manager := secrets.NewManager(config.SecretsConfig{})
+	ctx := context.Background()
+
+	keyring, err := manager.FieldKeyring(ctx, config.FieldEncryptionConfig{})
+	require.NoError(t, err)
+	require.Nil(t, keyring)
+
+	k1 := base64.StdEncoding.EncodeToString(fieldKey(1))
+	k2 := base64.StdEncoding.EncodeToString(fieldKey(2))
+
+	keyring, err = manager.FieldKeyring(ctx, config.FieldEncryptionConfig{Keys: "k1:" + k1})
+	require.NoError(t, err)
+	require.Equal(t, "k1", keyring.Primary())
+
+	_, err = manager.FieldKeyring(ctx, config.FieldEncryptionConfig{Keys: "k1:" + k1 + ",k2:" + k2})
+	require.ErrorContains(t, err, "primary key is required")
+
+	keyring, err = manager.FieldKeyring(ctx, config.FieldEncryptionConfig{Keys: "k1:" + k1 + ", k2:" + k2, PrimaryKey: "k2"})
+	require.NoError(t, err)
+	require.Equal(t, "k2", keyring.Primary())
+
+	_, err = manager.FieldKeyring(ctx, config.FieldEncryptionConfig{Keys: "k1:" + base64.StdEncoding.EncodeToString([]byte("short"))})
+	require.Error(t, err)
+	_, err = manager.FieldKeyring(ctx, config.FieldEncryptionConfig{Keys: "k1:" + k1, PrimaryKey: "k9"})
+	require.Error(t, err)
+}
@@ -0,0 +1,38 @@
+package unit
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/ipam"
+)
+
+func TestIPAMPoolExhaustion(t *testing.T) {
+	// A /30 has two usable hosts, one of which is the node.
+	pool, err := ipam.NewPool("10.8.0.1/30", "")
+	require.NoError(t, err)
+
+	assignment, err := pool.Assign("", nil)
+	require.NoError(t, err)
+	require.Equal(t, "10.8.0.2/32", assignment.String())
+
+	_, err = pool.Assign("", assignment.Addrs())
+	require.ErrorIs(t, err, ipam.ErrPoolExhausted)
+
+	_, err = ipam.NewPool("10.8.0.1/32", "")
+	require.Error(t, err)
+}
+
+func TestIPAMPoolPairsIPv6WithIPv4(t *testing.T) {
+	pool, err := ipam.NewPool("10.8.0.1/24", "fd12:3456:789a::/64")
+	require.NoError(t, err)
+
+	assignment, err := pool.Assign("", []netip.Addr{netip.MustParseAddr("10.8.0.2")})
+	require.NoError(t, err)
+	require.Equal(t, "10.8.0.3/32, fd12:3456:789a::a08:3/128", assignment.String())
+
+	_, err = pool.Assign("10.8.0.9/32, fd00::9/128", nil)
+	require.ErrorIs(t, err, ipam.ErrOutOfPool)
+}
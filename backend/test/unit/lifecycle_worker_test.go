@@ -0,0 +1,92 @@
+package unit
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/config"
+	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/entities"
+	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/lifecycle"
+)
+
+type lifecycleRepoStub struct {
+	calls        []string
+	lapsedBefore time.Time
+	revoked      []entities.PeerTransition
+	restored     []entities.PeerTransition
+	restoreErr   error
+	passes       chan struct{}
+}
+
+func (r *lifecycleRepoStub) RevokeLapsedPeers(ctx context.Context, lapsedBefore time.Time) ([]entities.PeerTransition, error) {
+	r.calls = append(r.calls, "revoke")
+	r.lapsedBefore = lapsedBefore
+	return r.revoked, nil
+}
+
+func (r *lifecycleRepoStub) RestoreEntitledPeers(ctx context.Context) ([]entities.PeerTransition, error) {
+	r.calls = append(r.calls, "restore")
+	if r.passes != nil {
+		r.passes <- struct{}{}
+	}
+	return r.restored, r.restoreErr
+}
+
+func TestLifecycleWorkerAppliesGracePeriod(t *testing.T) {
+	repo := &lifecycleRepoStub{
+		revoked:  []entities.PeerTransition{{PeerID: uuid.New(), FromStatus: "active", ToStatus: "revoked", Reason: "subscription_lapsed"}},
+		restored: []entities.PeerTransition{{PeerID: uuid.New(), FromStatus: "revoked", ToStatus: "active", Reason: "subscription_active"}},
+	}
+	worker := lifecycle.NewWorker(repo, config.BillingConfig{GracePeriod: 72 * time.Hour, LifecycleInterval: time.Minute}, zap.NewNop())
+
+	before := time.Now()
+	result, err := worker.Reconcile(context.Background())
+	after := time.Now()
+	require.NoError(t, err)
+	require.Equal(t, []string{"restore", "revoke"}, repo.calls)
+	require.Equal(t, repo.revoked, result.Revoked)
+	require.Equal(t, repo.restored, result.Restored)
+	require.False(t, repo.lapsedBefore.Before(before.Add(-72*time.Hour)))
+	require.False(t, repo.lapsedBefore.After(after.Add(-72*time.Hour)))
+}
+
+func TestLifecycleWorkerStopsOnRepositoryError(t *testing.T) {
+	repo := &lifecycleRepoStub{restoreErr: errors.New("db down")}
+	worker := lifecycle.NewWorker(repo, config.BillingConfig{LifecycleInterval: time.Minute}, zap.NewNop())
+
+	_, err := worker.Reconcile(context.Background())
+	require.Error(t, err)
+	require.Equal(t, []string{"restore"}, repo.calls)
+}
+
+func TestLifecycleWorkerRunsOnTrigger(t *testing.T) {
+	repo := &lifecycleRepoStub{passes: make(chan struct{})}
+	worker := lifecycle.NewWorker(repo, config.BillingConfig{LifecycleInterval: time.Hour}, zap.NewNop())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		worker.Run(ctx)
+		close(done)
+	}()
+
+	wait := func() {
+		select {
+		case <-repo.passes:
+		case <-time.After(time.Second):
+			t.Fatal("no reconcile pass")
+		}
+	}
+	wait() // initial pass
+	worker.Trigger()
+	wait()
+
+	cancel()
+	<-done
+}
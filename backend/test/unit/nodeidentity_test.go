@@ -0,0 +1,206 @@
+package unit
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/config"
+	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/nodes"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	file string
+}
+
+func newTestCA(t *testing.T) testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "node-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	file := filepath.Join(t.TempDir(), "ca.pem")
+	require.NoError(t, os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	return testCA{cert: cert, key: key, file: file}
+}
+
+func (ca testCA) issue(t *testing.T, serial int64, spiffeID string) *x509.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "node"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if spiffeID != "" {
+		uri, err := url.Parse(spiffeID)
+		require.NoError(t, err)
+		tmpl.URIs = []*url.URL{uri}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return cert
+}
+
+func TestNodeVerifierDisabledWithoutCA(t *testing.T) {
+	verifier, err := nodes.NewVerifier(config.NodeIdentityConfig{})
+	require.NoError(t, err)
+	require.Nil(t, verifier)
+}
+
+func TestNodeVerifierBindsFingerprint(t *testing.T) {
+	ca := newTestCA(t)
+	verifier, err := nodes.NewVerifier(config.NodeIdentityConfig{ClientCAFile: ca.file})
+	require.NoError(t, err)
+
+	req := httptest.NewRequest("GET", "/api/v1/nodes/peers", nil)
+	_, err = verifier.Identify(req)
+	require.ErrorIs(t, err, nodes.ErrNoCertificate)
+
+	cert := ca.issue(t, 2, "")
+	req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+	identity, err := verifier.Identify(req)
+	require.NoError(t, err)
+	require.Regexp(t, `^sha256:[0-9a-f]{64}$`, identity.Fingerprint)
+
+	binding, err := verifier.Binding(identity, "ist-1")
+	require.NoError(t, err)
+	require.Equal(t, identity.Fingerprint, binding)
+	require.True(t, verifier.Matches(identity, &binding))
+	require.False(t, verifier.Matches(identity, nil), "unbound nodes match no certificate")
+
+	other := ca.issue(t, 3, "")
+	req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{other}}
+	otherIdentity, err := verifier.Identify(req)
+	require.NoError(t, err)
+	require.False(t, verifier.Matches(otherIdentity, &binding), "another node's certificate must not match")
+}
+
+func TestNodeIdentityNameSurvivesRenewal(t *testing.T) {
+	ca := newTestCA(t)
+	verifier, err := nodes.NewVerifier(config.NodeIdentityConfig{ClientCAFile: ca.file})
+	require.NoError(t, err)
+
+	identify := func(cert *x509.Certificate) nodes.Identity {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+		identity, err := verifier.Identify(req)
+		require.NoError(t, err)
+		return identity
+	}
+
+	first := identify(ca.issue(t, 2, ""))
+	renewed := identify(ca.issue(t, 3, ""))
+	require.NotEqual(t, first.Fingerprint, renewed.Fingerprint)
+	require.Equal(t, "CN=node", first.Name)
+	require.Equal(t, first.Name, renewed.Name)
+
+	other := identify(ca.issue(t, 4, "spiffe://tridot.example/node/ams-1"))
+	require.Equal(t, "CN=node;uri:spiffe://tridot.example/node/ams-1", other.Name)
+}
+
+func TestNodeVerifierRejectsForeignCertificate(t *testing.T) {
+	ca := newTestCA(t)
+	verifier, err := nodes.NewVerifier(config.NodeIdentityConfig{ClientCAFile: ca.file})
+	require.NoError(t, err)
+
+	foreign := newTestCA(t).issue(t, 2, "")
+	req := httptest.NewRequest("GET", "/", nil)
+	req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{foreign}}
+	_, err = verifier.Identify(req)
+	require.ErrorIs(t, err, nodes.ErrUntrustedCertificate)
+}
+
+func TestNodeVerifierBindsSPIFFEIDFromProxyHeader(t *testing.T) {
+	ca := newTestCA(t)
+	verifier, err := nodes.NewVerifier(config.NodeIdentityConfig{
+		ClientCAFile:   ca.file,
+		CertHeader:     "X-Client-Cert",
+		TrustedProxies: []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")},
+		TrustDomain:    "tridot.example",
+	})
+	require.NoError(t, err)
+
+	header := func(cert *x509.Certificate) string {
+		return url.PathEscape(string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})))
+	}
+	identify := func(cert *x509.Certificate) nodes.Identity {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-Client-Cert", header(cert))
+		identity, err := verifier.Identify(req)
+		require.NoError(t, err)
+		return identity
+	}
+
+	first := identify(ca.issue(t, 2, "spiffe://tridot.example/node/ist-1"))
+	require.Equal(t, "spiffe://tridot.example/node/ist-1", first.SPIFFEID)
+
+	binding, err := verifier.Binding(first, "ist-1")
+	require.NoError(t, err)
+	require.Equal(t, nodes.SPIFFEID("tridot.example", "ist-1"), binding)
+
+	_, err = verifier.Binding(first, "ams-1")
+	require.ErrorIs(t, err, nodes.ErrIdentityMismatch, "a certificate only registers its own hostname")
+
+	// A rotated certificate keeps the SPIFFE ID and still matches.
+	rotated := identify(ca.issue(t, 3, "spiffe://tridot.example/node/ist-1"))
+	require.NotEqual(t, first.Fingerprint, rotated.Fingerprint)
+	require.True(t, verifier.Matches(rotated, &binding))
+
+	other := identify(ca.issue(t, 4, "spiffe://tridot.example/node/ams-1"))
+	require.False(t, verifier.Matches(other, &binding))
+}
+
+func TestNodeVerifierRejectsHeaderFromUntrustedAddress(t *testing.T) {
+	ca := newTestCA(t)
+	verifier, err := nodes.NewVerifier(config.NodeIdentityConfig{
+		ClientCAFile:   ca.file,
+		CertHeader:     "X-Client-Cert",
+		TrustedProxies: []netip.Prefix{netip.MustParsePrefix("10.0.0.5/32")},
+	})
+	require.NoError(t, err)
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Client-Cert", url.PathEscape(string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.issue(t, 2, "").Raw}))))
+
+	req.RemoteAddr = "203.0.113.7:40000"
+	_, err = verifier.Identify(req)
+	require.ErrorIs(t, err, nodes.ErrUntrustedProxy, "only the proxy may forward certificates")
+
+	req.RemoteAddr = "[::ffff:10.0.0.5]:40000"
+	_, err = verifier.Identify(req)
+	require.NoError(t, err)
+}
@@ -0,0 +1,101 @@
+package unit
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/entities"
+	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/nodestream"
+	"github.com/emrecetinkayadev/vpn-tridot/nodeproto"
+)
+
+// nodeEventSource becomes ready when Listen is called and fails when fail is
+// closed.
+type nodeEventSource struct {
+	listening chan struct{}
+	fail      chan struct{}
+}
+
+func (s *nodeEventSource) Listen(ctx context.Context, ready func(), _ func(entities.NodeEvent)) error {
+	ready()
+	s.listening <- struct{}{}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-s.fail:
+		return errors.New("connection lost")
+	}
+}
+
+func startNodeHub(t *testing.T) (*nodestream.Hub, *nodeEventSource) {
+	t.Helper()
+	hub := nodestream.NewHub(zap.NewNop())
+	source := &nodeEventSource{listening: make(chan struct{}, 1), fail: make(chan struct{})}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go hub.Run(ctx, source)
+	<-source.listening
+	return hub, source
+}
+
+func waitReady(t *testing.T, sub *nodestream.Subscription) {
+	t.Helper()
+	select {
+	case <-sub.Ready():
+	case <-time.After(time.Second):
+		t.Fatal("subscription not signalled")
+	}
+}
+
+func TestNodeHubRefusesSubscriptionsUntilListening(t *testing.T) {
+	hub := nodestream.NewHub(zap.NewNop())
+	_, err := hub.Subscribe(uuid.New())
+	require.ErrorIs(t, err, nodestream.ErrUnavailable)
+}
+
+func TestNodeHubCoalescesEventsPerNode(t *testing.T) {
+	hub, _ := startNodeHub(t)
+	nodeID, otherID := uuid.New(), uuid.New()
+
+	sub, err := hub.Subscribe(nodeID)
+	require.NoError(t, err)
+	defer sub.Close()
+	other, err := hub.Subscribe(otherID)
+	require.NoError(t, err)
+	defer other.Close()
+
+	hub.Publish(entities.NodeEvent{NodeID: nodeID, Type: entities.NodeEventPeers, Revision: 4})
+	hub.Publish(entities.NodeEvent{NodeID: nodeID, Type: entities.NodeEventPeers, Revision: 6})
+	hub.Publish(entities.NodeEvent{NodeID: nodeID, Type: entities.NodeEventPeers, Revision: 5})
+	hub.Publish(entities.NodeEvent{NodeID: nodeID, Type: entities.NodeEventDrain, Drain: true})
+
+	waitReady(t, sub)
+	drain := true
+	require.Equal(t, []nodeproto.StreamMessage{
+		{Type: nodeproto.StreamDrain, Drain: &drain},
+		{Type: nodeproto.StreamPeers, Revision: 6},
+	}, sub.Pending())
+	require.Empty(t, sub.Pending())
+	require.Empty(t, other.Pending())
+}
+
+func TestNodeHubClosesSubscriptionsWhenSourceFails(t *testing.T) {
+	hub, source := startNodeHub(t)
+
+	sub, err := hub.Subscribe(uuid.New())
+	require.NoError(t, err)
+	close(source.fail)
+
+	select {
+	case <-sub.Done():
+	case <-time.After(time.Second):
+		t.Fatal("subscription not closed")
+	}
+	sub.Close()
+}
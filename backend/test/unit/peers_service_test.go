@@ -3,25 +3,62 @@ package unit
 import (
 	"context"
 	"errors"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
 	"github.com/stretchr/testify/require"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 
+	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/clientconfig"
+	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/config"
 	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/entities"
+	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/entitlements"
+	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/ipam"
 	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/peers"
+	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/routing"
+	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/storage/postgres"
 )
 
 type peerRepoStub struct {
-	peers     map[uuid.UUID]entities.Peer
-	count     int
-	createErr error
+	peers        map[uuid.UUID]entities.Peer
+	count        int
+	createErr    error
+	nodeRevision int64
+	nodeMissing  bool
+	nodeActive   []entities.PeerChange
+	nodeChanges  []entities.PeerChange
+	appliedStats []entities.PeerStat
+	// nodes are the placement candidates, best first. addresses maps
+	// assigned tunnel addresses to their peer, like peer_addresses.
+	nodes     []entities.Node
+	addresses map[netip.Addr]uuid.UUID
+	placement entities.PeerPlacement
+	mesh      map[uuid.UUID]bool
+}
+
+// addNode registers node as a placement candidate.
+func (r *peerRepoStub) addNode(node entities.Node) entities.Node {
+	if node.ID == uuid.Nil {
+		node.ID = uuid.New()
+	}
+	if node.RegionID == uuid.Nil {
+		node.RegionID = uuid.New()
+	}
+	if node.Status == "" {
+		node.Status = "active"
+	}
+	r.nodes = append(r.nodes, node)
+	return node
 }
 
 func newPeerRepoStub() *peerRepoStub {
-	return &peerRepoStub{peers: make(map[uuid.UUID]entities.Peer)}
+	return &peerRepoStub{peers: make(map[uuid.UUID]entities.Peer), addresses: make(map[netip.Addr]uuid.UUID)}
 }
 
 func (r *peerRepoStub) ListByUser(ctx context.Context, userID uuid.UUID) ([]entities.Peer, error) {
@@ -38,26 +75,126 @@ func (r *peerRepoStub) CountByUser(ctx context.Context, userID uuid.UUID) (int,
 	return r.count, nil
 }
 
-func (r *peerRepoStub) Create(ctx context.Context, peer entities.Peer) (entities.Peer, error) {
+func (r *peerRepoStub) Create(ctx context.Context, peer entities.Peer, placement entities.PeerPlacement, assign func(entities.Node, []netip.Addr) (string, error)) (entities.Peer, entities.Node, error) {
+	r.placement = placement
 	if r.createErr != nil {
-		return entities.Peer{}, r.createErr
+		return entities.Peer{}, entities.Node{}, r.createErr
+	}
+	node, ok := r.pickNode(placement)
+	if !ok {
+		return entities.Peer{}, entities.Node{}, pgx.ErrNoRows
+	}
+
+	allowed, err := assign(node, r.usedAddresses())
+	if err != nil {
+		return entities.Peer{}, entities.Node{}, err
 	}
 	peer.ID = uuid.New()
+	peer.NodeID = node.ID
+	peer.RegionID = node.RegionID
+	peer.AllowedIPs = allowed
+	r.claim(peer.ID, allowed)
 	peer.CreatedAt = time.Now()
 	peer.UpdatedAt = time.Now()
 	r.peers[peer.ID] = peer
 	r.count++
-	return peer, nil
+	return peer, node, nil
+}
+
+func (r *peerRepoStub) Migrate(ctx context.Context, peer entities.Peer, placement entities.PeerPlacement, assign func(entities.Node, []netip.Addr) (string, error)) (entities.Peer, entities.Node, error) {
+	r.placement = placement
+	current, ok := r.peers[peer.ID]
+	if !ok || current.UserID != peer.UserID || !current.IsActive() {
+		return entities.Peer{}, entities.Node{}, postgres.ErrPeerNotActive
+	}
+	node, ok := r.pickNode(placement)
+	if !ok {
+		return entities.Peer{}, entities.Node{}, pgx.ErrNoRows
+	}
+
+	for addr, owner := range r.addresses {
+		if owner == peer.ID {
+			delete(r.addresses, addr)
+		}
+	}
+	allowed, err := assign(node, r.usedAddresses())
+	if err != nil {
+		return entities.Peer{}, entities.Node{}, err
+	}
+	current.NodeID = node.ID
+	current.RegionID = node.RegionID
+	current.AllowedIPs = allowed
+	current.PublicKey = peer.PublicKey
+	current.PresharedKey = peer.PresharedKey
+	r.claim(current.ID, allowed)
+	r.peers[current.ID] = current
+	return current, node, nil
+}
+
+// pickNode returns the first candidate matching placement, like the
+// placement query with nodes listed best first.
+func (r *peerRepoStub) pickNode(placement entities.PeerPlacement) (entities.Node, bool) {
+	for _, candidate := range r.nodes {
+		switch {
+		case placement.NodeID != uuid.Nil && candidate.ID != placement.NodeID:
+		case placement.RegionID != uuid.Nil && candidate.RegionID != placement.RegionID:
+		case candidate.Status != "active":
+		case candidate.ID == placement.ExcludeNodeID:
+		default:
+			return candidate, true
+		}
+	}
+	return entities.Node{}, false
+}
+
+func (r *peerRepoStub) usedAddresses() []netip.Addr {
+	used := make([]netip.Addr, 0, len(r.addresses))
+	for addr := range r.addresses {
+		used = append(used, addr)
+	}
+	return used
+}
+
+func (r *peerRepoStub) claim(peerID uuid.UUID, allowed string) {
+	for _, part := range strings.Split(allowed, ",") {
+		r.addresses[netip.MustParsePrefix(strings.TrimSpace(part)).Addr()] = peerID
+	}
 }
 
 func (r *peerRepoStub) GetByID(ctx context.Context, id uuid.UUID, userID uuid.UUID) (entities.Peer, error) {
 	peer, ok := r.peers[id]
-	if !ok {
-		return entities.Peer{}, errors.New("not found")
+	if !ok || peer.UserID != userID {
+		return entities.Peer{}, pgx.ErrNoRows
 	}
 	return peer, nil
 }
 
+func (r *peerRepoStub) Rotate(ctx context.Context, id uuid.UUID, userID uuid.UUID, publicKey string, presharedKey *string) (entities.Peer, error) {
+	peer, ok := r.peers[id]
+	if !ok || peer.UserID != userID || !peer.IsActive() {
+		return entities.Peer{}, pgx.ErrNoRows
+	}
+	for otherID, other := range r.peers {
+		if otherID != id && other.PublicKey == publicKey {
+			return entities.Peer{}, postgres.ErrDuplicatePeer
+		}
+	}
+	peer.PublicKey = publicKey
+	peer.PresharedKey = presharedKey
+	r.peers[id] = peer
+	return peer, nil
+}
+
+func (r *peerRepoStub) SetRouting(ctx context.Context, id uuid.UUID, userID uuid.UUID, routing entities.PeerRouting) (entities.Peer, error) {
+	peer, ok := r.peers[id]
+	if !ok || peer.UserID != userID || !peer.IsActive() {
+		return entities.Peer{}, pgx.ErrNoRows
+	}
+	peer.Routing = routing
+	r.peers[id] = peer
+	return peer, nil
+}
+
 func (r *peerRepoStub) Rename(ctx context.Context, id uuid.UUID, userID uuid.UUID, name string) (entities.Peer, error) {
 	peer, ok := r.peers[id]
 	if !ok {
@@ -69,17 +206,61 @@ func (r *peerRepoStub) Rename(ctx context.Context, id uuid.UUID, userID uuid.UUI
 }
 
 func (r *peerRepoStub) Delete(ctx context.Context, id uuid.UUID, userID uuid.UUID) error {
+	for addr, owner := range r.addresses {
+		if owner == id {
+			delete(r.addresses, addr)
+		}
+	}
 	delete(r.peers, id)
 	r.count--
 	return nil
 }
 
+func (r *peerRepoStub) DeviceMesh(ctx context.Context, userID uuid.UUID) (bool, error) {
+	return r.mesh[userID], nil
+}
+
+func (r *peerRepoStub) SetDeviceMesh(ctx context.Context, userID uuid.UUID, enabled bool) error {
+	if r.mesh == nil {
+		r.mesh = make(map[uuid.UUID]bool)
+	}
+	r.mesh[userID] = enabled
+	return nil
+}
+
 func (r *peerRepoStub) UsageSummaryByUser(ctx context.Context, userID uuid.UUID) (entities.UsageSummary, error) {
 	return entities.UsageSummary{PeerCount: r.count}, nil
 }
 
+func (r *peerRepoStub) NodePeerRevision(ctx context.Context, nodeID uuid.UUID) (int64, error) {
+	if r.nodeMissing {
+		return 0, pgx.ErrNoRows
+	}
+	return r.nodeRevision, nil
+}
+
+func (r *peerRepoStub) ListActiveByNode(ctx context.Context, nodeID uuid.UUID) ([]entities.PeerChange, error) {
+	return r.nodeActive, nil
+}
+
+func (r *peerRepoStub) ListChangesByNode(ctx context.Context, nodeID uuid.UUID, since int64) ([]entities.PeerChange, error) {
+	var out []entities.PeerChange
+	for _, change := range r.nodeChanges {
+		if change.Revision > since {
+			out = append(out, change)
+		}
+	}
+	return out, nil
+}
+
+func (r *peerRepoStub) ApplyPeerStats(ctx context.Context, nodeID uuid.UUID, stats []entities.PeerStat) (int, error) {
+	r.appliedStats = append(r.appliedStats, stats...)
+	return len(stats), nil
+}
+
 type nodeStoreStub struct {
-	node entities.Node
+	node    entities.Node
+	regions []entities.Region
 }
 
 func (n *nodeStoreStub) GetNodeByID(ctx context.Context, id uuid.UUID) (entities.Node, error) {
@@ -89,6 +270,15 @@ func (n *nodeStoreStub) GetNodeByID(ctx context.Context, id uuid.UUID) (entities
 	return n.node, nil
 }
 
+func (n *nodeStoreStub) GetRegionByCode(ctx context.Context, code string) (entities.Region, error) {
+	for _, region := range n.regions {
+		if region.Code == code {
+			return region, nil
+		}
+	}
+	return entities.Region{}, pgx.ErrNoRows
+}
+
 type tokenStoreStub struct {
 	tokens map[uuid.UUID]entities.UserToken
 }
@@ -114,21 +304,86 @@ func (s *tokenStoreStub) GetUserToken(ctx context.Context, tokenType, tokenHash
 	return entities.UserToken{}, errors.New("token not found")
 }
 
-func (s *tokenStoreStub) ConsumeUserToken(ctx context.Context, tokenID uuid.UUID) error {
-	delete(s.tokens, tokenID)
+func (s *tokenStoreStub) GetUserTokenByID(ctx context.Context, tokenID uuid.UUID) (entities.UserToken, error) {
+	token, ok := s.tokens[tokenID]
+	if !ok {
+		return entities.UserToken{}, pgx.ErrNoRows
+	}
+	return token, nil
+}
+
+func (s *tokenStoreStub) ListActiveUserTokens(ctx context.Context, userID uuid.UUID, tokenType string) ([]entities.UserToken, error) {
+	var tokens []entities.UserToken
+	for _, token := range s.tokens {
+		if token.UserID == userID && token.TokenType == tokenType && token.ConsumedAt == nil && token.ExpiresAt.After(time.Now()) {
+			tokens = append(tokens, token)
+		}
+	}
+	return tokens, nil
+}
+
+func (s *tokenStoreStub) ConsumeAndWipeUserToken(ctx context.Context, tokenID uuid.UUID) error {
+	token, ok := s.tokens[tokenID]
+	if !ok || token.ConsumedAt != nil {
+		return pgx.ErrNoRows
+	}
+	now := time.Now()
+	token.ConsumedAt = &now
+	token.Metadata = nil
+	s.tokens[tokenID] = token
 	return nil
 }
 
+func (s *tokenStoreStub) WipeUserTokenMetadata(ctx context.Context, tokenType string, expiredBefore time.Time) (int64, error) {
+	var wiped int64
+	for id, token := range s.tokens {
+		if token.TokenType != tokenType || token.Metadata == nil {
+			continue
+		}
+		if token.ConsumedAt != nil || token.ExpiresAt.Before(expiredBefore) {
+			token.Metadata = nil
+			s.tokens[id] = token
+			wiped++
+		}
+	}
+	return wiped, nil
+}
+
+type entitlementsStub struct {
+	ent entitlements.Entitlements
+	err error
+}
+
+var peersConfig = config.PeersConfig{
+	ConfigTTL:        24 * time.Hour,
+	ConfigLinkSecret: "unit-test-config-link-secret-0123456789",
+	PublicBaseURL:    "https://api.example.com",
+	DeepLinkScheme:   "tridot",
+}
+
+// subscribed returns entitlements for an active plan with the given limit.
+func subscribed(deviceLimit int) *entitlementsStub {
+	return &entitlementsStub{ent: entitlements.Entitlements{PlanCode: "vpn-monthly", SubscriptionStatus: "active", DeviceLimit: deviceLimit}}
+}
+
+func (e *entitlementsStub) Resolve(ctx context.Context, userID uuid.UUID) (entitlements.Entitlements, error) {
+	if e.err != nil {
+		return entitlements.Entitlements{}, e.err
+	}
+	ent := e.ent
+	ent.UserID = userID
+	return ent, nil
+}
+
 func TestPeersServiceCreateGeneratesServerKeys(t *testing.T) {
 	repo := newPeerRepoStub()
-	node := nodeStoreStub{node: entities.Node{PublicKey: wgtypes.Key{}.String(), Endpoint: "vpn.example.com:51820"}}
+	node := repo.addNode(entities.Node{PublicKey: wgtypes.Key{}.String(), Endpoint: "vpn.example.com:51820"})
 	tokens := newTokenStoreStub()
-	service := peers.NewService(repo, &node, tokens)
+	service := newPeersService(t, repo, &nodeStoreStub{}, tokens, subscribed(5), peersConfig)
 
 	input := peers.CreatePeerInput{
 		UserID:     uuid.New(),
-		NodeID:     uuid.New(),
-		RegionID:   uuid.New(),
+		NodeID:     node.ID,
 		DeviceName: "Laptop",
 	}
 
@@ -142,33 +397,81 @@ func TestPeersServiceCreateGeneratesServerKeys(t *testing.T) {
 
 func TestPeersServiceDeviceLimit(t *testing.T) {
 	repo := newPeerRepoStub()
-	repo.count = 5
-	node := nodeStoreStub{node: entities.Node{PublicKey: wgtypes.Key{}.String(), Endpoint: "vpn.example.com:51820"}}
+	repo.count = 2
+	node := repo.addNode(entities.Node{PublicKey: wgtypes.Key{}.String(), Endpoint: "vpn.example.com:51820"})
 	tokens := newTokenStoreStub()
-	service := peers.NewService(repo, &node, tokens)
+	plan := subscribed(2)
+	service := newPeersService(t, repo, &nodeStoreStub{}, tokens, plan, peersConfig)
 
 	input := peers.CreatePeerInput{
 		UserID:     uuid.New(),
-		NodeID:     uuid.New(),
-		RegionID:   uuid.New(),
+		NodeID:     node.ID,
 		DeviceName: "Tablet",
 	}
 
 	_, err := service.CreatePeer(context.Background(), input)
 	require.ErrorIs(t, err, peers.ErrDeviceLimitReached)
+
+	// An upgrade applies to the very next request.
+	plan.ent.DeviceLimit = 10
+	_, err = service.CreatePeer(context.Background(), input)
+	require.NoError(t, err)
+}
+
+func TestPeersServiceRequiresActiveSubscription(t *testing.T) {
+	repo := newPeerRepoStub()
+	node := repo.addNode(entities.Node{PublicKey: wgtypes.Key{}.String(), Endpoint: "vpn.example.com:51820"})
+	service := newPeersService(t, repo, &nodeStoreStub{}, newTokenStoreStub(), &entitlementsStub{err: entitlements.ErrNoActiveSubscription}, peersConfig)
+
+	_, err := service.CreatePeer(context.Background(), peers.CreatePeerInput{
+		UserID:     uuid.New(),
+		NodeID:     node.ID,
+		DeviceName: "Laptop",
+	})
+	require.ErrorIs(t, err, entitlements.ErrNoActiveSubscription)
+	require.Empty(t, repo.peers)
+}
+
+func TestPeersServiceRestrictsRegionsToPlan(t *testing.T) {
+	repo := newPeerRepoStub()
+	ist := repo.addNode(entities.Node{PublicKey: wgtypes.Key{}.String(), Endpoint: "ist.example.com:51820"})
+	fra := uuid.New()
+	regions := &nodeStoreStub{regions: []entities.Region{
+		{ID: ist.RegionID, Code: "TR-IST", IsActive: true},
+		{ID: fra, Code: "EU-FRA", IsActive: true},
+	}}
+	plan := subscribed(5)
+	plan.ent.Regions = []string{"TR-IST"}
+	service := newPeersService(t, repo, regions, newTokenStoreStub(), plan, peersConfig)
+	create := func(code string) error {
+		_, err := service.CreatePeer(context.Background(), peers.CreatePeerInput{
+			UserID:     uuid.New(),
+			RegionCode: code,
+			DeviceName: "Laptop",
+		})
+		return err
+	}
+
+	require.ErrorIs(t, create("EU-FRA"), entitlements.ErrRegionNotAllowed)
+
+	require.NoError(t, create("TR-IST"))
+	require.Equal(t, entities.PeerPlacement{RegionID: ist.RegionID, RegionCodes: []string{"TR-IST"}}, repo.placement)
+
+	// Automatic placement is limited to the plan's regions by the repository.
+	require.NoError(t, create(peers.RegionRecommended))
+	require.Equal(t, []string{"TR-IST"}, repo.placement.RegionCodes)
 }
 
 func TestPeersServiceConfigTokenFlow(t *testing.T) {
 	repo := newPeerRepoStub()
-	node := nodeStoreStub{node: entities.Node{PublicKey: "serverpk", Endpoint: "vpn.example.com:51820"}}
+	node := repo.addNode(entities.Node{PublicKey: "serverpk", Endpoint: "vpn.example.com:51820"})
 	tokens := newTokenStoreStub()
-	service := peers.NewService(repo, &node, tokens)
+	service := newPeersService(t, repo, &nodeStoreStub{}, tokens, subscribed(5), peersConfig)
 
 	userID := uuid.New()
 	out, err := service.CreatePeer(context.Background(), peers.CreatePeerInput{
 		UserID:     userID,
-		NodeID:     uuid.New(),
-		RegionID:   uuid.New(),
+		NodeID:     node.ID,
 		DeviceName: "Phone",
 	})
 	require.NoError(t, err)
@@ -180,3 +483,571 @@ func TestPeersServiceConfigTokenFlow(t *testing.T) {
 	_, err = service.GetConfigByToken(context.Background(), userID, out.ConfigToken)
 	require.Error(t, err)
 }
+
+func TestPeersServiceExportConfigByToken(t *testing.T) {
+	repo := newPeerRepoStub()
+	node := repo.addNode(entities.Node{PublicKey: "serverpk", Endpoint: "vpn.example.com:51820"})
+	service := newPeersService(t, repo, &nodeStoreStub{}, newTokenStoreStub(), subscribed(5), peersConfig)
+
+	userID := uuid.New()
+	out, err := service.CreatePeer(context.Background(), peers.CreatePeerInput{
+		UserID:     userID,
+		NodeID:     node.ID,
+		DeviceName: "Home Router",
+	})
+	require.NoError(t, err)
+
+	// An unknown format is rejected before the token is consumed.
+	_, err = service.ExportConfigByToken(context.Background(), userID, out.ConfigToken, "pdf")
+	require.ErrorIs(t, err, clientconfig.ErrUnknownFormat)
+
+	exported, err := service.ExportConfigByToken(context.Background(), userID, out.ConfigToken, "openwrt")
+	require.NoError(t, err)
+	require.Equal(t, "openwrt", exported.Format)
+	require.Equal(t, "Home-Router.uci", exported.Filename)
+	require.Contains(t, string(exported.Data), "set network.wg_tridot.private_key='"+out.ClientPrivateKey+"'")
+	require.Contains(t, string(exported.Data), "set network.wg_tridot_server.endpoint_host='vpn.example.com'")
+
+	_, err = service.ExportConfigByToken(context.Background(), userID, out.ConfigToken, "conf")
+	require.Error(t, err)
+}
+
+func TestPeersServiceConfigLink(t *testing.T) {
+	repo := newPeerRepoStub()
+	node := repo.addNode(entities.Node{PublicKey: "serverpk", Endpoint: "vpn.example.com:51820"})
+	tokens := newTokenStoreStub()
+	service := newPeersService(t, repo, &nodeStoreStub{}, tokens, subscribed(5), peersConfig)
+
+	userID := uuid.New()
+	out, err := service.CreatePeer(context.Background(), peers.CreatePeerInput{UserID: userID, NodeID: node.ID, DeviceName: "Phone"})
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(out.ConfigURL, "https://api.example.com/api/v1/config-links/"))
+
+	deepLink, err := url.Parse(out.ConfigDeepLink)
+	require.NoError(t, err)
+	require.Equal(t, "tridot", deepLink.Scheme)
+	jsonLink, err := url.Parse(deepLink.Query().Get("url"))
+	require.NoError(t, err)
+	require.Equal(t, "json", jsonLink.Query().Get("format"))
+
+	link, err := url.Parse(out.ConfigURL)
+	require.NoError(t, err)
+	linkID := uuid.MustParse(strings.TrimPrefix(link.Path, "/api/v1/config-links/"))
+	expires, err := strconv.ParseInt(link.Query().Get("expires"), 10, 64)
+	require.NoError(t, err)
+	sig := link.Query().Get("sig")
+
+	_, err = service.ExportConfigByLink(context.Background(), linkID, expires+3600, sig, "")
+	require.ErrorIs(t, err, peers.ErrConfigLinkInvalid)
+	_, err = service.ExportConfigByLink(context.Background(), uuid.New(), expires, sig, "")
+	require.ErrorIs(t, err, peers.ErrConfigLinkInvalid)
+
+	exported, err := service.ExportConfigByLink(context.Background(), linkID, expires, sig, "")
+	require.NoError(t, err)
+	require.Equal(t, out.Config, string(exported.Data))
+	// The stored config is gone once the link is used.
+	require.Nil(t, tokens.tokens[linkID].Metadata)
+
+	_, err = service.ExportConfigByLink(context.Background(), linkID, expires, sig, "")
+	require.ErrorIs(t, err, peers.ErrConfigTokenUsed)
+	_, err = service.GetConfigByToken(context.Background(), userID, out.ConfigToken)
+	require.ErrorIs(t, err, peers.ErrConfigTokenUsed)
+}
+
+func TestPeersServiceConfigLinksDisabled(t *testing.T) {
+	repo := newPeerRepoStub()
+	node := repo.addNode(entities.Node{PublicKey: "serverpk", Endpoint: "vpn.example.com:51820"})
+	service := newPeersService(t, repo, &nodeStoreStub{}, newTokenStoreStub(), subscribed(5), config.PeersConfig{ConfigTTL: time.Hour})
+
+	out, err := service.CreatePeer(context.Background(), peers.CreatePeerInput{UserID: uuid.New(), NodeID: node.ID, DeviceName: "Phone"})
+	require.NoError(t, err)
+	require.Empty(t, out.ConfigURL)
+	require.Empty(t, out.ConfigDeepLink)
+
+	_, err = service.ExportConfigByLink(context.Background(), uuid.New(), time.Now().Add(time.Hour).Unix(), "sig", "")
+	require.ErrorIs(t, err, peers.ErrConfigLinksDisabled)
+}
+
+func TestPeersServiceRejectsShortConfigLinkSecret(t *testing.T) {
+	_, err := peers.NewService(newPeerRepoStub(), &nodeStoreStub{}, newTokenStoreStub(), subscribed(5), config.PeersConfig{ConfigTTL: time.Hour, ConfigLinkSecret: "short"})
+	require.Error(t, err, "links must not be silently disabled by a bad secret")
+}
+
+func TestPeersServiceListAndRevokeConfigLinks(t *testing.T) {
+	repo := newPeerRepoStub()
+	node := repo.addNode(entities.Node{PublicKey: "serverpk", Endpoint: "vpn.example.com:51820"})
+	tokens := newTokenStoreStub()
+	service := newPeersService(t, repo, &nodeStoreStub{}, tokens, subscribed(5), peersConfig)
+
+	userID := uuid.New()
+	out, err := service.CreatePeer(context.Background(), peers.CreatePeerInput{UserID: userID, NodeID: node.ID, DeviceName: "Tablet"})
+	require.NoError(t, err)
+
+	links, err := service.ListConfigLinks(context.Background(), userID)
+	require.NoError(t, err)
+	require.Len(t, links, 1)
+	require.Equal(t, out.Peer.ID, links[0].PeerID)
+	require.Equal(t, "Tablet", links[0].DeviceName)
+
+	require.ErrorIs(t, service.RevokeConfigLink(context.Background(), uuid.New(), links[0].ID), peers.ErrConfigLinkNotFound)
+	require.NoError(t, service.RevokeConfigLink(context.Background(), userID, links[0].ID))
+	require.Nil(t, tokens.tokens[links[0].ID].Metadata)
+	require.ErrorIs(t, service.RevokeConfigLink(context.Background(), userID, links[0].ID), peers.ErrConfigLinkNotFound)
+
+	links, err = service.ListConfigLinks(context.Background(), userID)
+	require.NoError(t, err)
+	require.Empty(t, links)
+	_, err = service.GetConfigByToken(context.Background(), userID, out.ConfigToken)
+	require.ErrorIs(t, err, peers.ErrConfigTokenUsed)
+}
+
+func TestPeersServicePurgeConfigTokensWipesExpired(t *testing.T) {
+	repo := newPeerRepoStub()
+	node := repo.addNode(entities.Node{PublicKey: "serverpk", Endpoint: "vpn.example.com:51820"})
+	tokens := newTokenStoreStub()
+	service := newPeersService(t, repo, &nodeStoreStub{}, tokens, subscribed(5), peersConfig)
+
+	userID := uuid.New()
+	expired, err := service.CreatePeer(context.Background(), peers.CreatePeerInput{UserID: userID, NodeID: node.ID, DeviceName: "Old"})
+	require.NoError(t, err)
+	_, err = service.CreatePeer(context.Background(), peers.CreatePeerInput{UserID: userID, NodeID: node.ID, DeviceName: "New"})
+	require.NoError(t, err)
+	for id, token := range tokens.tokens {
+		if strings.Contains(*token.Metadata, expired.Peer.ID.String()) {
+			token.ExpiresAt = time.Now().Add(-time.Minute)
+			tokens.tokens[id] = token
+		}
+	}
+
+	wiped, err := service.PurgeConfigTokens(context.Background())
+	require.NoError(t, err)
+	require.EqualValues(t, 1, wiped)
+
+	_, err = service.GetConfigByToken(context.Background(), userID, expired.ConfigToken)
+	require.ErrorIs(t, err, peers.ErrConfigTokenExpired)
+}
+
+func TestPeersServiceRotatePeer(t *testing.T) {
+	repo := newPeerRepoStub()
+	node := repo.addNode(entities.Node{PublicKey: "serverpk", Endpoint: "vpn.example.com:51820"})
+	service := newPeersService(t, repo, &nodeStoreStub{node: node}, newTokenStoreStub(), subscribed(5), peersConfig)
+
+	userID := uuid.New()
+	created, err := service.CreatePeer(context.Background(), peers.CreatePeerInput{
+		UserID:     userID,
+		NodeID:     node.ID,
+		DeviceName: "Phone",
+	})
+	require.NoError(t, err)
+
+	rotated, err := service.RotatePeer(context.Background(), userID, created.Peer.ID, "")
+	require.NoError(t, err)
+	require.Equal(t, created.Peer.ID, rotated.Peer.ID)
+	require.Equal(t, created.Peer.AllowedIPs, rotated.Peer.AllowedIPs)
+	require.NotEqual(t, created.Peer.PublicKey, rotated.Peer.PublicKey)
+	require.NotEqual(t, *created.Peer.PresharedKey, *rotated.Peer.PresharedKey)
+	require.NotEmpty(t, rotated.ClientPrivateKey)
+	require.NotEmpty(t, rotated.ConfigQR)
+	require.Contains(t, rotated.Config, "PrivateKey = "+rotated.ClientPrivateKey)
+	require.Contains(t, rotated.Config, "PresharedKey = "+*rotated.Peer.PresharedKey)
+
+	// The token issued at creation carries the old key and no longer works.
+	_, err = service.GetConfigByToken(context.Background(), userID, created.ConfigToken)
+	require.ErrorIs(t, err, peers.ErrConfigTokenStale)
+	config, err := service.GetConfigByToken(context.Background(), userID, rotated.ConfigToken)
+	require.NoError(t, err)
+	require.Equal(t, rotated.Config, config)
+
+	// A client-supplied key is used as is and no private key is returned.
+	clientKey, err := wgtypes.GeneratePrivateKey()
+	require.NoError(t, err)
+	rotated, err = service.RotatePeer(context.Background(), userID, created.Peer.ID, clientKey.PublicKey().String())
+	require.NoError(t, err)
+	require.Equal(t, clientKey.PublicKey().String(), rotated.Peer.PublicKey)
+	require.Empty(t, rotated.ClientPrivateKey)
+	require.NotContains(t, rotated.Config, "PrivateKey")
+}
+
+func TestPeersServiceRotatePeerErrors(t *testing.T) {
+	repo := newPeerRepoStub()
+	node := repo.addNode(entities.Node{PublicKey: "serverpk", Endpoint: "vpn.example.com:51820"})
+	service := newPeersService(t, repo, &nodeStoreStub{node: node}, newTokenStoreStub(), subscribed(5), peersConfig)
+
+	userID := uuid.New()
+	first, err := service.CreatePeer(context.Background(), peers.CreatePeerInput{UserID: userID, NodeID: node.ID, DeviceName: "Phone"})
+	require.NoError(t, err)
+	second, err := service.CreatePeer(context.Background(), peers.CreatePeerInput{UserID: userID, NodeID: node.ID, DeviceName: "Laptop"})
+	require.NoError(t, err)
+
+	_, err = service.RotatePeer(context.Background(), userID, uuid.New(), "")
+	require.ErrorIs(t, err, peers.ErrPeerNotFound)
+	_, err = service.RotatePeer(context.Background(), uuid.New(), first.Peer.ID, "")
+	require.ErrorIs(t, err, peers.ErrPeerNotFound)
+	_, err = service.RotatePeer(context.Background(), userID, first.Peer.ID, second.Peer.PublicKey)
+	require.ErrorIs(t, err, peers.ErrPublicKeyInUse)
+	_, err = service.RotatePeer(context.Background(), userID, first.Peer.ID, "not-a-key")
+	require.Error(t, err)
+
+	revoked := repo.peers[first.Peer.ID]
+	revoked.Status = "revoked"
+	repo.peers[first.Peer.ID] = revoked
+	_, err = service.RotatePeer(context.Background(), userID, first.Peer.ID, "")
+	require.ErrorIs(t, err, peers.ErrPeerInactive)
+}
+
+func TestPeersServiceMigratePeer(t *testing.T) {
+	repo := newPeerRepoStub()
+	ist := repo.addNode(entities.Node{PublicKey: "istpk", Endpoint: "ist.example.com:51820"})
+	fra := repo.addNode(entities.Node{PublicKey: "frapk", Endpoint: "fra.example.com:51820", TunnelAddress: "10.9.0.1/24"})
+	regions := &nodeStoreStub{regions: []entities.Region{{ID: fra.RegionID, Code: "EU-FRA", IsActive: true}}}
+	service := newPeersService(t, repo, regions, newTokenStoreStub(), subscribed(5), peersConfig)
+
+	userID := uuid.New()
+	clientKey, err := wgtypes.GeneratePrivateKey()
+	require.NoError(t, err)
+	created, err := service.CreatePeer(context.Background(), peers.CreatePeerInput{
+		UserID:       userID,
+		NodeID:       ist.ID,
+		DeviceName:   "Laptop",
+		ClientPubKey: clientKey.PublicKey().String(),
+	})
+	require.NoError(t, err)
+	require.Equal(t, "10.8.0.2/32", created.Peer.AllowedIPs)
+
+	moved, err := service.MigratePeer(context.Background(), peers.MigratePeerInput{
+		UserID:       userID,
+		PeerID:       created.Peer.ID,
+		RegionCode:   "eu-fra",
+		ClientPubKey: created.Peer.PublicKey,
+	})
+	require.NoError(t, err)
+	require.Equal(t, created.Peer.ID, moved.Peer.ID)
+	require.Equal(t, "Laptop", moved.Peer.DeviceName)
+	require.Equal(t, fra.ID, moved.Peer.NodeID)
+	require.Equal(t, fra.RegionID, moved.Peer.RegionID)
+	require.Equal(t, ist.ID, repo.placement.ExcludeNodeID)
+	require.Equal(t, "10.9.0.2/32", moved.Peer.AllowedIPs)
+	require.Equal(t, created.Peer.PublicKey, moved.Peer.PublicKey)
+	require.Equal(t, *created.Peer.PresharedKey, *moved.Peer.PresharedKey)
+	require.Empty(t, moved.ClientPrivateKey)
+	require.Contains(t, moved.Config, "Endpoint = fra.example.com:51820")
+	require.Contains(t, moved.Config, "Address = 10.9.0.2/32")
+	require.NotContains(t, repo.addresses, netip.MustParseAddr("10.8.0.2"))
+
+	// The config handed out before the move points at the old node.
+	_, err = service.GetConfigByToken(context.Background(), userID, created.ConfigToken)
+	require.ErrorIs(t, err, peers.ErrConfigTokenStale)
+
+	// Without a client key the move comes with a fresh server-side keypair.
+	moved, err = service.MigratePeer(context.Background(), peers.MigratePeerInput{
+		UserID: userID,
+		PeerID: created.Peer.ID,
+		NodeID: ist.ID,
+	})
+	require.NoError(t, err)
+	require.Equal(t, ist.ID, moved.Peer.NodeID)
+	require.NotEmpty(t, moved.ClientPrivateKey)
+	require.NotEqual(t, created.Peer.PublicKey, moved.Peer.PublicKey)
+	require.NotEqual(t, *created.Peer.PresharedKey, *moved.Peer.PresharedKey)
+}
+
+func TestPeersServiceMigratePeerErrors(t *testing.T) {
+	repo := newPeerRepoStub()
+	only := repo.addNode(entities.Node{PublicKey: "istpk", Endpoint: "ist.example.com:51820"})
+	service := newPeersService(t, repo, &nodeStoreStub{}, newTokenStoreStub(), subscribed(5), peersConfig)
+
+	userID := uuid.New()
+	created, err := service.CreatePeer(context.Background(), peers.CreatePeerInput{UserID: userID, NodeID: only.ID, DeviceName: "Laptop"})
+	require.NoError(t, err)
+	migrate := func(input peers.MigratePeerInput) error {
+		input.UserID = userID
+		if input.PeerID == uuid.Nil {
+			input.PeerID = created.Peer.ID
+		}
+		_, err := service.MigratePeer(context.Background(), input)
+		return err
+	}
+
+	require.ErrorIs(t, migrate(peers.MigratePeerInput{PeerID: uuid.New()}), peers.ErrPeerNotFound)
+	require.ErrorIs(t, migrate(peers.MigratePeerInput{NodeID: only.ID}), peers.ErrSameNode)
+	require.ErrorIs(t, migrate(peers.MigratePeerInput{}), peers.ErrNoNodeAvailable)
+	require.ErrorIs(t, migrate(peers.MigratePeerInput{NodeID: uuid.New()}), peers.ErrNoNodeAvailable)
+	drained := repo.addNode(entities.Node{Status: "draining"})
+	require.ErrorIs(t, migrate(peers.MigratePeerInput{NodeID: drained.ID}), peers.ErrNoNodeAvailable, "peers cannot move onto a drained node")
+
+	revoked := repo.peers[created.Peer.ID]
+	revoked.Status = "revoked"
+	repo.peers[created.Peer.ID] = revoked
+	require.ErrorIs(t, migrate(peers.MigratePeerInput{}), peers.ErrPeerInactive)
+}
+
+func TestPeersServiceSplitTunnelRouting(t *testing.T) {
+	repo := newPeerRepoStub()
+	node := repo.addNode(entities.Node{PublicKey: "serverpk", Endpoint: "vpn.example.com:51820"})
+	service := newPeersService(t, repo, &nodeStoreStub{node: node}, newTokenStoreStub(), subscribed(5), peersConfig)
+
+	userID := uuid.New()
+	created, err := service.CreatePeer(context.Background(), peers.CreatePeerInput{
+		UserID:     userID,
+		NodeID:     node.ID,
+		DeviceName: "Laptop",
+		Routing:    entities.PeerRouting{Preset: routing.PresetCustom, Exclude: []string{"128.0.0.0/1"}},
+	})
+	require.NoError(t, err)
+	require.Equal(t, routing.PresetCustom, created.Peer.Routing.Preset)
+	require.Contains(t, created.Config, "AllowedIPs = 0.0.0.0/1\n")
+
+	updated, err := service.SetPeerRouting(context.Background(), userID, created.Peer.ID, entities.PeerRouting{Preset: routing.PresetExcludeLAN})
+	require.NoError(t, err)
+	require.Equal(t, routing.PresetExcludeLAN, updated.Peer.Routing.Preset)
+	require.NotContains(t, updated.Config, "0.0.0.0/0")
+	require.NotContains(t, updated.Config, "PrivateKey")
+	require.NotEmpty(t, updated.ConfigToken)
+
+	_, err = service.SetPeerRouting(context.Background(), userID, created.Peer.ID, entities.PeerRouting{Preset: routing.PresetExcludeCountry, Country: "TR"})
+	require.ErrorIs(t, err, routing.ErrCountryUnavailable)
+	_, err = service.SetPeerRouting(context.Background(), userID, uuid.New(), entities.PeerRouting{})
+	require.ErrorIs(t, err, peers.ErrPeerNotFound)
+	_, err = service.CreatePeer(context.Background(), peers.CreatePeerInput{
+		UserID:     userID,
+		NodeID:     node.ID,
+		DeviceName: "Phone",
+		Routing:    entities.PeerRouting{Preset: "split"},
+	})
+	require.ErrorIs(t, err, routing.ErrUnknownPreset)
+
+	revoked := repo.peers[created.Peer.ID]
+	revoked.Status = "revoked"
+	repo.peers[created.Peer.ID] = revoked
+	_, err = service.SetPeerRouting(context.Background(), userID, created.Peer.ID, entities.PeerRouting{})
+	require.ErrorIs(t, err, peers.ErrPeerInactive)
+}
+
+func TestPeersServiceDesiredPeersFull(t *testing.T) {
+	repo := newPeerRepoStub()
+	repo.nodeRevision = 7
+	repo.nodeActive = []entities.PeerChange{{PublicKey: "a", AllowedIPs: "10.0.0.2/32", Revision: 3}}
+	service := newPeersService(t, repo, &nodeStoreStub{}, newTokenStoreStub(), subscribed(5), peersConfig)
+
+	desired, err := service.DesiredPeers(context.Background(), uuid.New(), 0)
+	require.NoError(t, err)
+	require.True(t, desired.Full)
+	require.Equal(t, int64(7), desired.Revision)
+	require.Len(t, desired.Peers, 1)
+
+	// A revision ahead of the node (e.g. after a database restore) forces a full resync.
+	desired, err = service.DesiredPeers(context.Background(), uuid.New(), 42)
+	require.NoError(t, err)
+	require.True(t, desired.Full)
+}
+
+func TestPeersServiceDesiredPeersIncremental(t *testing.T) {
+	repo := newPeerRepoStub()
+	repo.nodeRevision = 6
+	repo.nodeChanges = []entities.PeerChange{
+		{PublicKey: "old", Removed: true, Revision: 3},
+		{PublicKey: "new", AllowedIPs: "10.0.0.3/32", Revision: 4},
+		{PublicKey: "flap", Removed: true, Revision: 5},
+		{PublicKey: "flap", AllowedIPs: "10.0.0.4/32", Revision: 6},
+	}
+	service := newPeersService(t, repo, &nodeStoreStub{}, newTokenStoreStub(), subscribed(5), peersConfig)
+
+	desired, err := service.DesiredPeers(context.Background(), uuid.New(), 2)
+	require.NoError(t, err)
+	require.False(t, desired.Full)
+	require.Equal(t, []string{"old"}, desired.Removed)
+	require.Len(t, desired.Peers, 2)
+	require.Equal(t, "flap", desired.Peers[0].PublicKey)
+	require.Equal(t, "new", desired.Peers[1].PublicKey)
+
+	desired, err = service.DesiredPeers(context.Background(), uuid.New(), 6)
+	require.NoError(t, err)
+	require.False(t, desired.Full)
+	require.Empty(t, desired.Peers)
+	require.Empty(t, desired.Removed)
+}
+
+func TestPeersServiceDesiredPeersUnknownNode(t *testing.T) {
+	repo := newPeerRepoStub()
+	repo.nodeMissing = true
+	service := newPeersService(t, repo, &nodeStoreStub{}, newTokenStoreStub(), subscribed(5), peersConfig)
+
+	_, err := service.DesiredPeers(context.Background(), uuid.New(), 0)
+	require.ErrorIs(t, err, peers.ErrNodeNotFound)
+}
+
+func TestPeersServiceIngestStatsKeepsLastSamplePerKey(t *testing.T) {
+	repo := newPeerRepoStub()
+	service := newPeersService(t, repo, &nodeStoreStub{}, newTokenStoreStub(), subscribed(5), peersConfig)
+
+	updated, err := service.IngestStats(context.Background(), uuid.New(), []entities.PeerStat{
+		{PublicKey: "a", RxBytes: 10, TxBytes: 20},
+		{PublicKey: "b", RxBytes: 1, TxBytes: 2},
+		{PublicKey: "a", RxBytes: 15, TxBytes: 25},
+	})
+	require.NoError(t, err)
+	require.Equal(t, 2, updated)
+	require.Equal(t, []entities.PeerStat{
+		{PublicKey: "a", RxBytes: 15, TxBytes: 25},
+		{PublicKey: "b", RxBytes: 1, TxBytes: 2},
+	}, repo.appliedStats)
+}
+
+func TestPeersServiceIngestStatsValidates(t *testing.T) {
+	service := newPeersService(t, newPeerRepoStub(), &nodeStoreStub{}, newTokenStoreStub(), subscribed(5), peersConfig)
+
+	_, err := service.IngestStats(context.Background(), uuid.Nil, nil)
+	require.Error(t, err)
+
+	_, err = service.IngestStats(context.Background(), uuid.New(), []entities.PeerStat{{PublicKey: "a", RxBytes: -1}})
+	require.Error(t, err)
+}
+
+func TestPeersServiceCreateDualStackPeer(t *testing.T) {
+	repo := newPeerRepoStub()
+	prefix := "fd12:3456:789a::/64"
+	node := repo.addNode(entities.Node{
+		PublicKey:        wgtypes.Key{}.String(),
+		Endpoint:         "vpn.example.com:51820",
+		TunnelIPv6Prefix: &prefix,
+		IPv6Enabled:      true,
+	})
+	service := newPeersService(t, repo, &nodeStoreStub{}, newTokenStoreStub(), subscribed(5), peersConfig)
+
+	out, err := service.CreatePeer(context.Background(), peers.CreatePeerInput{
+		UserID:     uuid.New(),
+		NodeID:     node.ID,
+		DeviceName: "Laptop",
+		AllowedIPs: "10.8.0.7/32",
+	})
+	require.NoError(t, err)
+	require.Equal(t, "10.8.0.7/32, fd12:3456:789a::a08:7/128", out.Peer.AllowedIPs)
+	require.Contains(t, out.Config, "Address = 10.8.0.7/32, fd12:3456:789a::a08:7/128")
+	require.Contains(t, out.Config, "AllowedIPs = 0.0.0.0/0, ::/0")
+}
+
+func TestPeersServiceCreateIPv4OnlyNodeOmitsIPv6Route(t *testing.T) {
+	repo := newPeerRepoStub()
+	node := repo.addNode(entities.Node{PublicKey: wgtypes.Key{}.String(), Endpoint: "vpn.example.com:51820"})
+	service := newPeersService(t, repo, &nodeStoreStub{}, newTokenStoreStub(), subscribed(5), peersConfig)
+
+	out, err := service.CreatePeer(context.Background(), peers.CreatePeerInput{
+		UserID:     uuid.New(),
+		NodeID:     node.ID,
+		DeviceName: "Phone",
+	})
+	require.NoError(t, err)
+	require.NotContains(t, out.Config, "::/0")
+	require.Contains(t, out.Config, "AllowedIPs = 0.0.0.0/0\n")
+}
+
+func TestPeersServiceAllocatesUniqueAddresses(t *testing.T) {
+	repo := newPeerRepoStub()
+	node := repo.addNode(entities.Node{PublicKey: wgtypes.Key{}.String(), Endpoint: "vpn.example.com:51820", TunnelAddress: "10.8.0.1/24"})
+	service := newPeersService(t, repo, &nodeStoreStub{}, newTokenStoreStub(), subscribed(5), peersConfig)
+	create := func(name, allowed string) (peers.CreatePeerOutput, error) {
+		return service.CreatePeer(context.Background(), peers.CreatePeerInput{
+			UserID:     uuid.New(),
+			NodeID:     node.ID,
+			DeviceName: name,
+			AllowedIPs: allowed,
+		})
+	}
+
+	// The node's own address (.1) is skipped.
+	first, err := create("a", "")
+	require.NoError(t, err)
+	require.Equal(t, "10.8.0.2/32", first.Peer.AllowedIPs)
+	require.Contains(t, first.Config, "Address = 10.8.0.2/32\n")
+
+	second, err := create("b", "")
+	require.NoError(t, err)
+	require.Equal(t, "10.8.0.3/32", second.Peer.AllowedIPs)
+
+	// Deleting a peer releases its address for the next one.
+	require.NoError(t, service.DeletePeer(context.Background(), first.Peer.UserID, first.Peer.ID))
+	third, err := create("c", "")
+	require.NoError(t, err)
+	require.Equal(t, "10.8.0.2/32", third.Peer.AllowedIPs)
+}
+
+func TestPeersServiceRejectsRequestedAddresses(t *testing.T) {
+	repo := newPeerRepoStub()
+	node := repo.addNode(entities.Node{PublicKey: wgtypes.Key{}.String(), Endpoint: "vpn.example.com:51820", TunnelAddress: "10.8.0.1/24"})
+	service := newPeersService(t, repo, &nodeStoreStub{}, newTokenStoreStub(), subscribed(5), peersConfig)
+	create := func(allowed string) error {
+		_, err := service.CreatePeer(context.Background(), peers.CreatePeerInput{
+			UserID:     uuid.New(),
+			NodeID:     node.ID,
+			DeviceName: uuid.NewString(),
+			AllowedIPs: allowed,
+		})
+		return err
+	}
+
+	require.ErrorIs(t, create("10.9.0.5/32"), ipam.ErrOutOfPool)
+	require.ErrorIs(t, create("10.8.0.1/32"), ipam.ErrReserved)
+	require.ErrorIs(t, create("10.8.0.255/32"), ipam.ErrReserved)
+	require.Error(t, create("10.8.0.0/24"))
+
+	require.NoError(t, create("10.8.0.50/32"))
+	require.ErrorIs(t, create("10.8.0.50/32"), ipam.ErrAddressInUse)
+}
+
+func TestPeersServicePlacesPeerByRegionCode(t *testing.T) {
+	repo := newPeerRepoStub()
+	fra := repo.addNode(entities.Node{PublicKey: wgtypes.Key{}.String(), Endpoint: "fra.example.com:51820"})
+	ist := repo.addNode(entities.Node{PublicKey: wgtypes.Key{}.String(), Endpoint: "ist.example.com:51820"})
+	regions := &nodeStoreStub{regions: []entities.Region{{ID: ist.RegionID, Code: "TR-IST", IsActive: true}}}
+	service := newPeersService(t, repo, regions, newTokenStoreStub(), subscribed(5), peersConfig)
+
+	out, err := service.CreatePeer(context.Background(), peers.CreatePeerInput{
+		UserID:     uuid.New(),
+		RegionCode: "tr-ist",
+		DeviceName: "Laptop",
+	})
+	require.NoError(t, err)
+	require.Equal(t, entities.PeerPlacement{RegionID: ist.RegionID}, repo.placement)
+	require.Equal(t, ist.ID, out.Peer.NodeID)
+	require.Equal(t, ist.RegionID, out.Peer.RegionID)
+	require.Contains(t, out.Config, "Endpoint = ist.example.com:51820")
+
+	// "recommended" leaves both region and node to the placement query.
+	out, err = service.CreatePeer(context.Background(), peers.CreatePeerInput{
+		UserID:     uuid.New(),
+		RegionCode: peers.RegionRecommended,
+		DeviceName: "Phone",
+	})
+	require.NoError(t, err)
+	require.Equal(t, entities.PeerPlacement{}, repo.placement)
+	require.Equal(t, fra.ID, out.Peer.NodeID)
+}
+
+func TestPeersServicePlacementErrors(t *testing.T) {
+	repo := newPeerRepoStub()
+	draining := repo.addNode(entities.Node{Status: "draining"})
+	regions := &nodeStoreStub{regions: []entities.Region{
+		{ID: draining.RegionID, Code: "EU-FRA", IsActive: true},
+		{ID: uuid.New(), Code: "EU-NL", IsActive: false},
+	}}
+	service := newPeersService(t, repo, regions, newTokenStoreStub(), subscribed(5), peersConfig)
+	create := func(input peers.CreatePeerInput) error {
+		input.UserID = uuid.New()
+		input.DeviceName = "Laptop"
+		_, err := service.CreatePeer(context.Background(), input)
+		return err
+	}
+
+	require.ErrorIs(t, create(peers.CreatePeerInput{RegionCode: "XX-NOPE"}), peers.ErrRegionNotFound)
+	require.ErrorIs(t, create(peers.CreatePeerInput{RegionCode: "EU-NL"}), peers.ErrRegionNotFound)
+	require.ErrorIs(t, create(peers.CreatePeerInput{RegionCode: "EU-FRA"}), peers.ErrNoNodeAvailable)
+	require.ErrorIs(t, create(peers.CreatePeerInput{NodeID: uuid.New()}), peers.ErrNoNodeAvailable)
+	require.ErrorIs(t, create(peers.CreatePeerInput{NodeID: draining.ID}), peers.ErrNoNodeAvailable, "a pinned node must be active")
+}
+
+func newPeersService(t *testing.T, repo peers.Repository, nodes peers.NodeStore, tokens peers.TokenStore, ent peers.Entitlements, cfg config.PeersConfig) *peers.Service {
+	t.Helper()
+	service, err := peers.NewService(repo, nodes, tokens, ent, cfg)
+	require.NoError(t, err)
+	return service
+}
@@ -0,0 +1,86 @@
+package unit
+
+import (
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/entities"
+	"github.com/emrecetinkayadev/vpn-tridot/backend/internal/routing"
+)
+
+func prefixes(values ...string) []netip.Prefix {
+	out := make([]netip.Prefix, 0, len(values))
+	for _, value := range values {
+		out = append(out, netip.MustParsePrefix(value))
+	}
+	return out
+}
+
+func TestRoutingSubtract(t *testing.T) {
+	got := routing.Subtract(prefixes("0.0.0.0/0"), prefixes("10.0.0.0/8"))
+	require.Equal(t, prefixes(
+		"0.0.0.0/5", "8.0.0.0/7", "11.0.0.0/8", "12.0.0.0/6", "16.0.0.0/4",
+		"32.0.0.0/3", "64.0.0.0/2", "128.0.0.0/1",
+	), got)
+
+	// Overlapping excludes merge and families stay independent.
+	got = routing.Subtract(prefixes("10.0.0.0/8", "fd00::/8"), prefixes("10.0.0.0/9", "10.64.0.0/10", "10.128.0.0/9"))
+	require.Equal(t, prefixes("fd00::/8"), got)
+
+	// Excluding everything leaves nothing; excluding nothing is a no-op.
+	require.Empty(t, routing.Subtract(prefixes("192.168.1.0/24"), prefixes("0.0.0.0/0")))
+	require.Equal(t, prefixes("::/0"), routing.Subtract(prefixes("::/0"), nil))
+}
+
+func TestRoutingExcludeLANKeepsTunnelSubnet(t *testing.T) {
+	planner := routing.NewPlanner(nil)
+
+	allowed, err := planner.AllowedIPs(entities.PeerRouting{Preset: routing.PresetExcludeLAN}, false, prefixes("10.8.0.0/24"))
+	require.NoError(t, err)
+	require.Contains(t, allowed, "10.8.0.0/24")
+	require.NotContains(t, allowed, "0.0.0.0/0")
+	for _, value := range allowed {
+		prefix := netip.MustParsePrefix(value)
+		require.False(t, prefix.Overlaps(netip.MustParsePrefix("192.168.0.0/16")), value)
+		require.True(t, prefix.Addr().Is4(), value)
+	}
+
+	allowed, err = planner.AllowedIPs(entities.PeerRouting{}, true, nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{"0.0.0.0/0", "::/0"}, allowed)
+}
+
+func TestRoutingNormalizeCustom(t *testing.T) {
+	planner := routing.NewPlanner(nil)
+
+	r, err := planner.Normalize(entities.PeerRouting{Preset: "CUSTOM", Country: "TR", Exclude: []string{"203.0.113.7", "198.51.100.9/24"}})
+	require.NoError(t, err)
+	require.Equal(t, entities.PeerRouting{Preset: routing.PresetCustom, Exclude: []string{"203.0.113.7/32", "198.51.100.0/24"}}, r)
+
+	_, err = planner.Normalize(entities.PeerRouting{Preset: routing.PresetCustom})
+	require.ErrorIs(t, err, routing.ErrInvalidExclude)
+	_, err = planner.Normalize(entities.PeerRouting{Preset: routing.PresetCustom, Exclude: []string{"not-a-cidr"}})
+	require.ErrorIs(t, err, routing.ErrInvalidExclude)
+	_, err = planner.Normalize(entities.PeerRouting{Preset: "split"})
+	require.ErrorIs(t, err, routing.ErrUnknownPreset)
+	_, err = planner.Normalize(entities.PeerRouting{Preset: routing.PresetExcludeCountry, Country: "TR"})
+	require.ErrorIs(t, err, routing.ErrCountryUnavailable)
+}
+
+func TestRoutingExcludeCountry(t *testing.T) {
+	geo, err := routing.ParseGeoIP(strings.NewReader("# test ranges\n\n128.0.0.0/1,tr\n2a02::/16,TR\n8.8.8.0/24,US\n"))
+	require.NoError(t, err)
+	planner := routing.NewPlanner(geo)
+
+	allowed, err := planner.AllowedIPs(entities.PeerRouting{Preset: routing.PresetExcludeCountry, Country: "tr"}, false, nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{"0.0.0.0/1"}, allowed)
+
+	_, err = routing.ParseGeoIP(strings.NewReader("10.0.0.0/8\n"))
+	require.Error(t, err)
+	_, err = routing.ParseGeoIP(strings.NewReader("10.0.0.0/8,TUR\n"))
+	require.Error(t, err)
+}
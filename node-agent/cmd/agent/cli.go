@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/emrecetinkayadev/vpn-tridot/node-agent/internal/agent"
+	"github.com/emrecetinkayadev/vpn-tridot/node-agent/internal/config"
+	"github.com/emrecetinkayadev/vpn-tridot/node-agent/internal/doctor"
+	"github.com/emrecetinkayadev/vpn-tridot/node-agent/internal/rpc"
+)
+
+const usage = `usage: node-agent [command [-socket path] [-json] [args]]
+
+Without a command the agent runs. Commands talk to a running agent:
+
+  status          show registration, sync and drain state
+  drain on|off    stop or resume placing new peers on this node
+  peers           list the peers applied on this node
+  resync          fetch and apply the complete peer set now
+  doctor          check kernel module, ip_forward, port binding and mTLS
+`
+
+// runCommand executes an admin subcommand against the agent's admin socket
+// and returns the process exit code.
+func runCommand(ctx context.Context, args []string, stdout, stderr io.Writer) int {
+	name := args[0]
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() { fmt.Fprint(stderr, usage) }
+	socket := fs.String("socket", defaultAdminSocket(), "admin socket path")
+	asJSON := fs.Bool("json", false, "print raw JSON")
+	if name == "help" || name == "-h" || name == "--help" {
+		fmt.Fprint(stdout, usage)
+		return 0
+	}
+	if err := fs.Parse(args[1:]); err != nil {
+		return 2
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	client := rpc.NewClient(*socket)
+	out := printer{w: stdout, json: *asJSON}
+
+	var err error
+	switch name {
+	case "status":
+		err = out.status(client.Status(ctx))
+	case "drain":
+		var enabled bool
+		switch strings.Join(fs.Args(), " ") {
+		case "on":
+			enabled = true
+		case "off":
+		default:
+			fmt.Fprintln(stderr, "usage: node-agent drain on|off")
+			return 2
+		}
+		err = out.status(client.SetDrain(ctx, enabled))
+	case "peers":
+		err = out.peers(client.Peers(ctx))
+	case "resync":
+		if err = client.Resync(ctx); err == nil {
+			fmt.Fprintln(stdout, "resync requested")
+		}
+	case "doctor":
+		report, derr := client.Doctor(ctx)
+		if derr != nil {
+			// The checks matter most when the agent does not come up, so
+			// run them here instead.
+			fmt.Fprintf(stderr, "agent not reachable (%v), checking locally\n", derr)
+			cfg, cerr := config.Load()
+			if cerr != nil {
+				fmt.Fprintf(stderr, "load config: %v\n", cerr)
+				return 1
+			}
+			checks := doctor.Run(cfg)
+			report = rpc.DoctorReport{Healthy: doctor.Healthy(checks), Checks: checks}
+		}
+		if err = out.doctor(report); err == nil && !report.Healthy {
+			return 1
+		}
+	default:
+		fmt.Fprintf(stderr, "unknown command %q\n\n%s", name, usage)
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// defaultAdminSocket resolves the socket the daemon listens on. A config
+// that does not load, e.g. a missing token on a host that only runs the
+// CLI, falls back to AGENT_ADMIN_SOCKET and then the built-in path.
+func defaultAdminSocket() string {
+	if cfg, err := config.Load(); err == nil && cfg.Agent.AdminSocket != "" {
+		return cfg.Agent.AdminSocket
+	}
+	if v := os.Getenv("AGENT_ADMIN_SOCKET"); v != "" {
+		return v
+	}
+	return config.DefaultAdminSocket
+}
+
+type printer struct {
+	w    io.Writer
+	json bool
+}
+
+func (p printer) raw(v any) error {
+	enc := json.NewEncoder(p.w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func (p printer) status(status agent.Status, err error) error {
+	if err != nil {
+		return err
+	}
+	if p.json {
+		return p.raw(status)
+	}
+	tw := tabwriter.NewWriter(p.w, 0, 4, 2, ' ', 0)
+	nodeID := status.NodeID
+	if !status.Registered {
+		nodeID = "(not registered)"
+	}
+	fmt.Fprintf(tw, "node id:\t%s\n", nodeID)
+	fmt.Fprintf(tw, "interface:\t%s (udp %d)\n", status.Interface, status.ListenPort)
+	fmt.Fprintf(tw, "peers:\t%d applied, %d active\n", status.PeerCount, status.ActivePeers)
+	fmt.Fprintf(tw, "peer revision:\t%d\n", status.PeerRevision)
+	fmt.Fprintf(tw, "drain:\t%s\n", onOff(status.Drain))
+	lastSync := "never"
+	if status.LastSync != nil {
+		lastSync = status.LastSync.Local().Format(time.RFC3339)
+	}
+	if status.LastSyncError != "" {
+		lastSync += " (failed: " + status.LastSyncError + ")"
+	}
+	fmt.Fprintf(tw, "last sync:\t%s\n", lastSync)
+	return tw.Flush()
+}
+
+func (p printer) peers(peers []agent.PeerStatus, err error) error {
+	if err != nil {
+		return err
+	}
+	if p.json {
+		return p.raw(peers)
+	}
+	tw := tabwriter.NewWriter(p.w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "PUBLIC KEY\tALLOWED IPS\tGROUP\tLAST HANDSHAKE\tRX\tTX")
+	for _, peer := range peers {
+		handshake := "-"
+		if peer.LastHandshake != nil {
+			handshake = time.Since(*peer.LastHandshake).Round(time.Second).String() + " ago"
+		}
+		group := peer.Group
+		if group == "" {
+			group = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%d\n", peer.PublicKey, strings.Join(peer.AllowedIPs, ","), group, handshake, peer.RxBytes, peer.TxBytes)
+	}
+	return tw.Flush()
+}
+
+func (p printer) doctor(report rpc.DoctorReport) error {
+	if p.json {
+		return p.raw(report)
+	}
+	tw := tabwriter.NewWriter(p.w, 0, 4, 2, ' ', 0)
+	for _, check := range report.Checks {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", check.Result, check.Name, check.Detail)
+	}
+	return tw.Flush()
+}
+
+func onOff(b bool) string {
+	if b {
+		return "on"
+	}
+	return "off"
+}
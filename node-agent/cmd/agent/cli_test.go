@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/emrecetinkayadev/vpn-tridot/node-agent/internal/agent"
+	"github.com/emrecetinkayadev/vpn-tridot/node-agent/internal/doctor"
+	"github.com/emrecetinkayadev/vpn-tridot/node-agent/internal/rpc"
+)
+
+type cliAgentStub struct{ drain bool }
+
+func (a *cliAgentStub) Status() agent.Status {
+	return agent.Status{NodeID: "node-1", Registered: true, Interface: "wg0", ListenPort: 51820, Drain: a.drain}
+}
+
+func (a *cliAgentStub) Peers() []agent.PeerStatus {
+	return []agent.PeerStatus{{PublicKey: "pk", AllowedIPs: []string{"10.8.0.2/32"}}}
+}
+
+func (a *cliAgentStub) SetDrain(enabled bool) error {
+	a.drain = enabled
+	return nil
+}
+
+func (a *cliAgentStub) Resync() {}
+
+func TestRunCommand(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "admin.sock")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	checks := []doctor.Check{{Name: "ip_forward", Result: doctor.Fail, Detail: "disabled"}}
+	go func() {
+		_ = rpc.NewServer(socket, &cliAgentStub{}, func() []doctor.Check { return checks }).Serve(ctx)
+	}()
+	require.Eventually(t, func() bool {
+		conn, err := net.Dial("unix", socket)
+		if err == nil {
+			conn.Close()
+		}
+		return err == nil
+	}, 2*time.Second, 10*time.Millisecond)
+
+	run := func(name string, args ...string) (int, string, string) {
+		var stdout, stderr bytes.Buffer
+		args = append([]string{name, "-socket", socket}, args...)
+		code := runCommand(context.Background(), args, &stdout, &stderr)
+		return code, stdout.String(), stderr.String()
+	}
+
+	code, out, _ := run("status")
+	require.Equal(t, 0, code)
+	require.Contains(t, out, "node-1")
+	require.Contains(t, out, "drain:")
+
+	code, out, _ = run("drain", "on")
+	require.Equal(t, 0, code)
+	require.Regexp(t, `drain:\s+on`, out)
+
+	code, _, errOut := run("drain", "maybe")
+	require.Equal(t, 2, code)
+	require.Contains(t, errOut, "drain on|off")
+
+	code, out, _ = run("peers")
+	require.Equal(t, 0, code)
+	require.Contains(t, out, "10.8.0.2/32")
+
+	code, out, _ = run("resync")
+	require.Equal(t, 0, code)
+	require.Contains(t, out, "resync requested")
+
+	code, out, _ = run("doctor")
+	require.Equal(t, 1, code, "failed checks exit non-zero")
+	require.Contains(t, out, "ip_forward")
+
+	code, _, _ = run("bogus")
+	require.Equal(t, 2, code)
+}
+
+func TestDefaultAdminSocketFollowsConfig(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "agent.yaml")
+	require.NoError(t, os.WriteFile(file, []byte(`controlPlane:
+  url: https://control.example.com
+provision:
+  token: token
+mtls:
+  caPEM: ca
+  certPEM: cert
+  keyPEM: key
+agent:
+  adminSocket: /srv/agent/admin.sock
+node:
+  regionCode: TR-IST
+  hostname: ist-1
+`), 0o600))
+	t.Setenv("AGENT_ADMIN_SOCKET", "")
+	t.Setenv("NODE_AGENT_CONFIG_FILE", file)
+	require.Equal(t, "/srv/agent/admin.sock", defaultAdminSocket())
+
+	t.Setenv("NODE_AGENT_CONFIG_FILE", filepath.Join(dir, "missing.yaml"))
+	require.Equal(t, "/run/vpn-agent/admin.sock", defaultAdminSocket(), "load errors fall back to the default")
+}
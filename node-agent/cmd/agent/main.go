@@ -5,14 +5,21 @@ import (
 	"errors"
 	"log"
 	"net/http"
+	"os"
 	"os/signal"
 	"syscall"
 	"time"
 
 	"github.com/emrecetinkayadev/vpn-tridot/node-agent/internal/config"
+	"github.com/emrecetinkayadev/vpn-tridot/node-agent/internal/doctor"
+	"github.com/emrecetinkayadev/vpn-tridot/node-agent/internal/rpc"
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(context.Background(), os.Args[1:], os.Stdout, os.Stderr))
+	}
+
 	cfg, err := config.Load()
 	if err != nil {
 		log.Fatalf("load config: %v", err)
@@ -46,6 +53,15 @@ func main() {
 		}()
 	}
 
+	if cfg.Agent.AdminSocket != "" {
+		admin := rpc.NewServer(cfg.Agent.AdminSocket, agent, func() []doctor.Check { return doctor.Run(cfg) })
+		go func() {
+			if err := admin.Serve(ctx); err != nil {
+				log.Printf("admin socket error: %v", err)
+			}
+		}()
+	}
+
 	if err := agent.Run(ctx); err != nil {
 		log.Fatalf("agent error: %v", err)
 	}
@@ -2,10 +2,14 @@ package main
 
 import (
 	"fmt"
+	"log"
+	"net/netip"
+	"path/filepath"
 	"time"
 
 	"github.com/emrecetinkayadev/vpn-tridot/node-agent/internal/agent"
 	"github.com/emrecetinkayadev/vpn-tridot/node-agent/internal/config"
+	"github.com/emrecetinkayadev/vpn-tridot/node-agent/internal/health"
 	"github.com/emrecetinkayadev/vpn-tridot/node-agent/internal/metrics"
 	"github.com/emrecetinkayadev/vpn-tridot/node-agent/internal/netutil"
 	"github.com/emrecetinkayadev/vpn-tridot/node-agent/internal/state"
@@ -23,43 +27,102 @@ func newAgent(cfg config.Config) (*agent.Agent, *metrics.Exporter, error) {
 		cfg.Agent.PollInterval = 30 * time.Second
 	}
 
-	wgManager := wg.NewManager(cfg.WireGuard)
-	configPath, err := wgManager.EnsureBaseConfig()
+	keys, err := wg.LoadOrCreateKey(wg.NewManager(cfg.WireGuard).PrivateKeyPath())
 	if err != nil {
-		return nil, nil, fmt.Errorf("write wireguard config: %w", err)
-	}
-	if cfg.WireGuard.EnableNAT {
-		if err := netutil.ApplyNATRules(cfg.WireGuard.InterfaceName); err != nil {
-			return nil, nil, fmt.Errorf("apply nat rules: %w", err)
-		}
+		return nil, nil, fmt.Errorf("load wireguard key: %w", err)
 	}
-	if cfg.WireGuard.EnableKillSwitch {
-		if err := netutil.EnableKillSwitch(cfg.WireGuard.InterfaceName); err != nil {
-			return nil, nil, fmt.Errorf("enable kill switch: %w", err)
-		}
+	// Without an explicit address6 the node derives a stable ULA /64 from its
+	// key, so the prefix survives restarts without being stored anywhere.
+	if cfg.WireGuard.EnableIPv6 && cfg.WireGuard.AddressCIDR6 == "" {
+		cfg.WireGuard.AddressCIDR6 = wg.ULAAddress(keys.PublicKey).String()
 	}
+	wgManager := wg.NewManager(cfg.WireGuard)
+	wgManager.WithPrivateKey(keys.PrivateKey)
+	uplink := uplinkInterface(cfg.Node)
 
 	ag, err := agent.New(cfg, client)
 	if err != nil {
 		return nil, nil, err
 	}
-	stateStore, err := state.New(cfg.Agent.StateDirectory)
+	stateStore, err := newStateStore(cfg.Agent)
 	if err != nil {
 		return nil, nil, fmt.Errorf("init state store: %w", err)
 	}
 	ag.WithState(stateStore)
-	ag.WithWireGuard(wgManager, configPath, wg.SetupInterface, func(path string) error {
-		return wg.SyncPeers(cfg.WireGuard.InterfaceName, path)
-	})
+	ag.WithPublicKey(keys.PublicKey)
+	ag.WithWireGuard(wgManager, wg.NewLink(cfg.WireGuard))
+	if fw := newFirewall(cfg.WireGuard, uplink); fw != nil {
+		ag.WithFirewall(fw)
+	}
 	exporter := metrics.New()
 	ag.WithMetrics(exporter)
-	if peers, err := stateStore.LoadPeers(); err != nil {
-		return nil, nil, fmt.Errorf("load persisted peers: %w", err)
-	} else if len(peers) > 0 {
-		if err := ag.ApplyPeers(peers); err != nil {
-			return nil, nil, fmt.Errorf("restore peers: %w", err)
+	ag.WithHostCollector(health.NewCollector(uplink))
+
+	return ag, exporter, nil
+}
+
+// newStateStore opens the encrypted state store, or an in-memory one when
+// the node must not keep anything on disk.
+func newStateStore(agentCfg config.AgentConfig) (*state.Store, error) {
+	if agentCfg.StateMemoryOnly {
+		return state.NewMemory(), nil
+	}
+	var (
+		key []byte
+		err error
+	)
+	if agentCfg.StateKey != "" {
+		key, err = state.ParseKey(agentCfg.StateKey)
+	} else {
+		path := agentCfg.StateKeyFile
+		if path == "" {
+			path = filepath.Join(agentCfg.StateDirectory, "state.key")
 		}
+		key, err = state.LoadOrCreateKey(path)
+	}
+	if err != nil {
+		return nil, err
 	}
+	return state.New(agentCfg.StateDirectory, key)
+}
 
-	return ag, exporter, nil
+// uplinkInterface returns the configured uplink or the default-route
+// interface. NIC sampling is skipped when neither is available.
+func uplinkInterface(node config.NodeConfig) string {
+	if node.UplinkInterface != "" {
+		return node.UplinkInterface
+	}
+	iface, err := netutil.DefaultRouteInterface()
+	if err != nil {
+		log.Printf("agent: uplink detection failed, NIC stats disabled: %v", err)
+		return ""
+	}
+	return iface
+}
+
+// newFirewall builds the forwarding/NAT policy for the tunnel, or nil when
+// there is nothing to enforce: no NAT, no kill switch and client-to-client
+// traffic allowed.
+func newFirewall(wgCfg config.WireGuardConfig, uplink string) *netutil.Firewall {
+	if !wgCfg.EnableNAT && !wgCfg.EnableKillSwitch && wgCfg.AllowClientToClient {
+		return nil
+	}
+	fwCfg := netutil.FirewallConfig{
+		Backend:            wgCfg.FirewallBackend,
+		WireGuardInterface: wgCfg.InterfaceName,
+		UplinkInterface:    uplink,
+		EnableNAT:          wgCfg.EnableNAT,
+		EnableKillSwitch:   wgCfg.EnableKillSwitch,
+		IsolateClients:     !wgCfg.AllowClientToClient,
+	}
+	if prefix, err := netip.ParsePrefix(wgCfg.AddressCIDR); err == nil && prefix.Bits() < prefix.Addr().BitLen() {
+		fwCfg.SourceCIDR = prefix.Masked().String()
+	}
+	if wgCfg.EnableIPv6 {
+		if prefix, err := netip.ParsePrefix(wgCfg.AddressCIDR6); err == nil {
+			fwCfg.EnableIPv6 = true
+			fwCfg.SourceCIDR6 = prefix.Masked().String()
+		}
+	}
+	return netutil.NewFirewall(fwCfg)
 }
@@ -7,6 +7,7 @@ import (
 	"crypto/x509/pkix"
 	"encoding/pem"
 	"math/big"
+	"os"
 	"testing"
 	"time"
 
@@ -16,7 +17,7 @@ import (
 	"github.com/emrecetinkayadev/vpn-tridot/node-agent/internal/netutil"
 )
 
-func TestNewAgentAppliesNATAndKillSwitch(t *testing.T) {
+func TestNewAgentDefersFirewallToRun(t *testing.T) {
 	caPEM, certPEM, keyPEM := generateCertBundle(t)
 	tempDir := t.TempDir()
 	cfg := config.Config{
@@ -56,7 +57,53 @@ func TestNewAgentAppliesNATAndKillSwitch(t *testing.T) {
 	require.NoError(t, err)
 	require.NotNil(t, a)
 	require.NotNil(t, exp)
-	require.True(t, len(calls) >= 2)
+	require.Empty(t, calls, "firewall rules are installed by Run once the interface is up")
+}
+
+func TestNewFirewallMasqueradesTunnelSubnetOutOfUplink(t *testing.T) {
+	require.Nil(t, newFirewall(config.WireGuardConfig{InterfaceName: "wg0", AllowClientToClient: true}, "eth0"))
+
+	var ruleset string
+	restore := netutil.WithCommandRunner(func(name string, args ...string) ([]byte, error) {
+		if name == "iptables-restore" || name == "nft" && args[0] == "-f" {
+			raw, err := os.ReadFile(args[len(args)-1])
+			require.NoError(t, err)
+			ruleset = string(raw)
+		}
+		return nil, nil
+	})
+	t.Cleanup(restore)
+
+	fw := newFirewall(config.WireGuardConfig{InterfaceName: "wg0", AddressCIDR: "10.8.0.1/24", EnableNAT: true, FirewallBackend: "iptables"}, "eth0")
+	require.NotNil(t, fw)
+	require.NoError(t, fw.Apply())
+	require.Contains(t, ruleset, "-A VPN-NAT -s 10.8.0.0/24 -o eth0 -j MASQUERADE")
+
+	fw = newFirewall(config.WireGuardConfig{InterfaceName: "wg0", AddressCIDR: "10.8.0.1/24", EnableNAT: true, FirewallBackend: "nftables"}, "eth0")
+	require.NoError(t, fw.Apply())
+	require.Contains(t, ruleset, `ip saddr 10.8.0.0/24 oifname "eth0" masquerade`)
+}
+
+func TestNewFirewallIsolatesClientsByDefault(t *testing.T) {
+	var ruleset string
+	restore := netutil.WithCommandRunner(func(name string, args ...string) ([]byte, error) {
+		if name == "nft" && args[0] == "-f" {
+			raw, err := os.ReadFile(args[len(args)-1])
+			require.NoError(t, err)
+			ruleset = string(raw)
+		}
+		return nil, nil
+	})
+	t.Cleanup(restore)
+
+	fw := newFirewall(config.WireGuardConfig{InterfaceName: "wg0", FirewallBackend: "nftables"}, "eth0")
+	require.NotNil(t, fw)
+	require.NoError(t, fw.Apply())
+	require.Contains(t, ruleset, `iifname "wg0" oifname "wg0" drop`)
+
+	fw = newFirewall(config.WireGuardConfig{InterfaceName: "wg0", EnableNAT: true, AllowClientToClient: true, FirewallBackend: "nftables"}, "eth0")
+	require.NoError(t, fw.Apply())
+	require.NotContains(t, ruleset, `oifname "wg0" drop`)
 }
 
 func generateCertBundle(t *testing.T) (string, string, string) {
@@ -0,0 +1,115 @@
+package agent
+
+import (
+	"errors"
+	"time"
+)
+
+// Status is the agent's view of itself as reported on the admin socket.
+type Status struct {
+	NodeID        string     `json:"node_id,omitempty"`
+	Registered    bool       `json:"registered"`
+	Interface     string     `json:"interface"`
+	ListenPort    int        `json:"listen_port"`
+	PeerRevision  int64      `json:"peer_revision"`
+	PeerCount     int        `json:"peer_count"`
+	ActivePeers   int        `json:"active_peers"`
+	Drain         bool       `json:"drain"`
+	LastSync      *time.Time `json:"last_sync,omitempty"`
+	LastSyncError string     `json:"last_sync_error,omitempty"`
+}
+
+// PeerStatus describes an applied peer. Preshared keys are never exposed.
+type PeerStatus struct {
+	PublicKey     string     `json:"public_key"`
+	AllowedIPs    []string   `json:"allowed_ips"`
+	Group         string     `json:"group,omitempty"`
+	LastHandshake *time.Time `json:"last_handshake,omitempty"`
+	RxBytes       uint64     `json:"rx_bytes"`
+	TxBytes       uint64     `json:"tx_bytes"`
+}
+
+// ErrNoState is returned by SetDrain when the agent has no state store.
+var ErrNoState = errors.New("state store not configured")
+
+// Status returns a snapshot of registration, sync and device state.
+func (a *Agent) Status() Status {
+	a.mu.RLock()
+	status := Status{
+		NodeID:        a.nodeID,
+		Registered:    a.nodeID != "",
+		Interface:     a.cfg.WireGuard.InterfaceName,
+		ListenPort:    a.cfg.WireGuard.ListenPort,
+		PeerRevision:  a.peerRevision,
+		PeerCount:     len(a.applied),
+		LastSyncError: a.lastSyncErr,
+	}
+	if !a.lastSync.IsZero() {
+		last := a.lastSync
+		status.LastSync = &last
+	}
+	a.mu.RUnlock()
+
+	if a.wgManager != nil {
+		if stats, err := a.wgManager.Stats(); err == nil {
+			status.ActivePeers = stats.ActivePeers
+		}
+	}
+	if a.state != nil {
+		if drain, err := a.state.DrainEnabled(); err == nil {
+			status.Drain = drain
+		}
+	}
+	return status
+}
+
+// Peers lists the applied peers, sorted by public key, with their device
+// counters when the device can be read.
+func (a *Agent) Peers() []PeerStatus {
+	a.mu.RLock()
+	applied := sortedPeers(a.applied)
+	a.mu.RUnlock()
+
+	counters := make(map[string]PeerStatus)
+	if a.wgManager != nil {
+		if stats, err := a.wgManager.Stats(); err == nil {
+			for _, peer := range stats.Peers {
+				status := PeerStatus{RxBytes: peer.ReceiveBytes, TxBytes: peer.TransmitBytes}
+				if !peer.LastHandshake.IsZero() {
+					last := peer.LastHandshake
+					status.LastHandshake = &last
+				}
+				counters[peer.PublicKey] = status
+			}
+		}
+	}
+
+	peers := make([]PeerStatus, 0, len(applied))
+	for _, peer := range applied {
+		status := counters[peer.PublicKey]
+		status.PublicKey = peer.PublicKey
+		status.AllowedIPs = peer.AllowedIPs
+		status.Group = peer.Group
+		peers = append(peers, status)
+	}
+	return peers
+}
+
+// SetDrain toggles drain mode and reports it to the control plane right
+// away, so no new peers are placed on the node.
+func (a *Agent) SetDrain(enabled bool) error {
+	if a.state == nil {
+		return ErrNoState
+	}
+	if err := a.state.SetDrain(enabled); err != nil {
+		return err
+	}
+	a.Wake()
+	return nil
+}
+
+// Resync makes the agent fetch and apply the complete peer set now.
+func (a *Agent) Resync() {
+	a.fullResync.Store(true)
+	a.Wake()
+}
@@ -0,0 +1,79 @@
+package agent
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/emrecetinkayadev/vpn-tridot/node-agent/internal/config"
+	"github.com/emrecetinkayadev/vpn-tridot/node-agent/internal/wg"
+)
+
+func TestResyncFetchesAndAppliesFullSet(t *testing.T) {
+	var queries []string
+	tr := roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		queries = append(queries, r.URL.RawQuery)
+		return protoResponse(http.StatusOK, `{"revision":3,"full":true,"peers":[{"public_key":"a","preshared_key":"psk","allowed_ips":["10.0.0.2/32"]}]}`), nil
+	})
+	cfg := config.Config{ControlPlane: config.ControlPlaneConfig{URL: "https://cp", PeersPath: "/peers"}}
+	a, err := New(cfg, &http.Client{Transport: tr})
+	require.NoError(t, err)
+	mgr := &wgManagerStub{}
+	a.WithWireGuard(mgr, nil)
+	a.nodeID = "node-1"
+
+	ctx := context.Background()
+	require.NoError(t, a.syncPeers(ctx))
+	require.NoError(t, a.syncPeers(ctx))
+	require.Len(t, mgr.configs, 1, "unchanged peer set must not be reapplied")
+
+	a.Resync()
+	select {
+	case <-a.wake:
+	default:
+		t.Fatal("resync must wake the agent loop")
+	}
+	require.NoError(t, a.syncPeers(ctx))
+	require.Len(t, mgr.configs, 2, "resync reapplies the full set")
+	require.Equal(t, []string{"node_id=node-1", "node_id=node-1&since=3", "node_id=node-1"}, queries)
+
+	status := a.Status()
+	require.Equal(t, "node-1", status.NodeID)
+	require.True(t, status.Registered)
+	require.Equal(t, int64(3), status.PeerRevision)
+	require.Equal(t, 1, status.PeerCount)
+	require.NotNil(t, status.LastSync)
+	require.Empty(t, status.LastSyncError)
+}
+
+func TestAdminPeersAndDrain(t *testing.T) {
+	a, err := New(config.Config{}, &http.Client{})
+	require.NoError(t, err)
+	handshake := time.Now().Add(-time.Minute)
+	mgr := &wgManagerStub{stats: wg.DeviceStats{
+		ActivePeers: 1,
+		Peers:       []wg.PeerStats{{PublicKey: "b", ReceiveBytes: 10, TransmitBytes: 20, LastHandshake: handshake}},
+	}}
+	a.WithWireGuard(mgr, nil)
+	require.NoError(t, a.ApplyPeers([]wg.Peer{
+		{PublicKey: "b", PresharedKey: "secret", AllowedIPs: []string{"10.0.0.3/32"}, Group: "g1"},
+		{PublicKey: "a", AllowedIPs: []string{"10.0.0.2/32"}},
+	}))
+
+	require.Equal(t, []PeerStatus{
+		{PublicKey: "a", AllowedIPs: []string{"10.0.0.2/32"}},
+		{PublicKey: "b", AllowedIPs: []string{"10.0.0.3/32"}, Group: "g1", LastHandshake: &handshake, RxBytes: 10, TxBytes: 20},
+	}, a.Peers())
+
+	require.ErrorIs(t, a.SetDrain(true), ErrNoState)
+
+	store := &stateStub{}
+	a.WithState(store)
+	require.NoError(t, a.SetDrain(true))
+	require.True(t, store.drain)
+	require.True(t, a.Status().Drain)
+	require.Equal(t, 1, a.Status().ActivePeers)
+}
@@ -4,51 +4,98 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"math/rand"
+	"net"
 	"net/http"
+	"net/netip"
 	"net/url"
-	"strings"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/emrecetinkayadev/vpn-tridot/node-agent/internal/config"
+	"github.com/emrecetinkayadev/vpn-tridot/node-agent/internal/health"
+	"github.com/emrecetinkayadev/vpn-tridot/node-agent/internal/netutil"
 	"github.com/emrecetinkayadev/vpn-tridot/node-agent/internal/wg"
+	"github.com/emrecetinkayadev/vpn-tridot/nodeproto"
 )
 
 // Agent represents the node agent runtime.
 type Agent struct {
-	cfg          config.Config
-	client       *http.Client
-	wgManager    wireGuardManager
-	wgConfigPath string
-	wgUp         func(string) error
-	wgSync       func(string) error
-	metrics      metricsExporter
-	prevStats    wg.DeviceStats
-	prevStatsAt  time.Time
-	state        stateStore
-	maxRetry     time.Duration
-	retryBase    time.Duration
+	cfg         config.Config
+	client      *http.Client
+	wgManager   wireGuardManager
+	wgLink      interfaceLink
+	metrics     metricsExporter
+	host        hostCollector
+	firewall    firewall
+	prevStats   wg.DeviceStats
+	prevStatsAt time.Time
+	state       stateStore
+	maxRetry    time.Duration
+	retryBase   time.Duration
+	publicKey   string
+
+	// mu guards the fields below. They are only written by the agent loop,
+	// which reads them without locking; admin requests read them under mu.
+	mu           sync.RWMutex
+	nodeID       string
+	peerRevision int64
+	applied      map[string]wg.Peer
+	lastSync     time.Time
+	lastSyncErr  string
+
+	// wake runs the periodic work right away; fullResync makes the next
+	// peer sync fetch and apply the complete peer set.
+	wake       chan struct{}
+	fullResync atomic.Bool
+	// pollOverride is the peer sync interval set by the control plane while
+	// the stream is connected; zero means the configured poll interval.
+	pollOverride atomic.Int64
 }
 
 type wireGuardManager interface {
-	WritePeers([]wg.Peer) (string, error)
+	ApplyPeers([]wg.Peer) error
 	Stats() (wg.DeviceStats, error)
 }
 
+type interfaceLink interface {
+	Up() error
+	Down() error
+}
+
 type metricsExporter interface {
 	Update(wg.DeviceStats)
+	UpdateHost(health.Snapshot)
 	Handler() http.Handler
 }
 
+type firewall interface {
+	Apply() error
+	Teardown() error
+	SetMeshGroups([][]string) error
+}
+
+type hostCollector interface {
+	Collect() (health.Snapshot, error)
+}
+
 type stateStore interface {
 	SavePeers([]wg.Peer) error
 	LoadPeers() ([]wg.Peer, error)
 	DrainEnabled() (bool, error)
+	SetDrain(bool) error
+	SaveNodeID(string) error
+	LoadNodeID() (string, error)
 }
 
+var detectPublicIPs = netutil.DetectPublicIPs
+
 // New creates a node agent with the provided configuration and HTTP client.
 func New(cfg config.Config, client *http.Client) (*Agent, error) {
 	if client == nil {
@@ -58,15 +105,20 @@ func New(cfg config.Config, client *http.Client) (*Agent, error) {
 	if maxRetry <= 0 {
 		maxRetry = 30 * time.Second
 	}
-	return &Agent{cfg: cfg, client: client, maxRetry: maxRetry, retryBase: time.Second}, nil
+	return &Agent{
+		cfg:       cfg,
+		client:    client,
+		maxRetry:  maxRetry,
+		retryBase: time.Second,
+		wake:      make(chan struct{}, 1),
+	}, nil
 }
 
-// WithWireGuard configures WireGuard helpers for the agent.
-func (a *Agent) WithWireGuard(manager wireGuardManager, configPath string, upFn, syncFn func(string) error) {
+// WithWireGuard configures WireGuard helpers for the agent. link owns the
+// network interface; peers are applied to the running device by the manager.
+func (a *Agent) WithWireGuard(manager wireGuardManager, link interfaceLink) {
 	a.wgManager = manager
-	a.wgConfigPath = configPath
-	a.wgUp = upFn
-	a.wgSync = syncFn
+	a.wgLink = link
 }
 
 // WithMetrics sets the metrics exporter for Prometheus reporting.
@@ -74,25 +126,53 @@ func (a *Agent) WithMetrics(exporter metricsExporter) {
 	a.metrics = exporter
 }
 
+// WithFirewall makes the agent install its forwarding/NAT rules once the
+// interface is up and remove them again on shutdown.
+func (a *Agent) WithFirewall(fw firewall) {
+	a.firewall = fw
+}
+
+// WithHostCollector enables host CPU, memory and uplink sampling for health reports.
+func (a *Agent) WithHostCollector(collector hostCollector) {
+	a.host = collector
+}
+
 // WithState configures persistent state handling for crash-safe recovery.
+// A node identity saved by a previous run is restored immediately.
 func (a *Agent) WithState(store stateStore) {
 	a.state = store
+	if store == nil {
+		return
+	}
+	if id, err := store.LoadNodeID(); err != nil {
+		log.Printf("agent: load node id failed: %v", err)
+	} else if id != "" {
+		a.nodeID = id
+	}
 }
 
-// ApplyPeers writes new peer configuration and triggers sync command if configured.
+// WithPublicKey sets the WireGuard interface public key announced on registration.
+func (a *Agent) WithPublicKey(key string) {
+	a.publicKey = key
+}
+
+// ApplyPeers reconciles the WireGuard device with peers, updates the mesh
+// groups exempt from client isolation and persists the peers.
 func (a *Agent) ApplyPeers(peers []wg.Peer) error {
 	if a.wgManager == nil {
 		return fmt.Errorf("wireguard manager not configured")
 	}
-	path, err := a.wgManager.WritePeers(peers)
-	if err != nil {
+	if err := a.wgManager.ApplyPeers(peers); err != nil {
 		return err
 	}
-	if a.wgSync != nil {
-		if err := a.wgSync(path); err != nil {
-			return err
+	if a.firewall != nil {
+		if err := a.firewall.SetMeshGroups(meshGroups(peers)); err != nil {
+			return fmt.Errorf("update mesh groups: %w", err)
 		}
 	}
+	a.mu.Lock()
+	a.applied = indexPeers(peers)
+	a.mu.Unlock()
 	if a.state != nil {
 		if err := a.state.SavePeers(peers); err != nil {
 			log.Printf("agent: persist peers failed: %v", err)
@@ -103,39 +183,125 @@ func (a *Agent) ApplyPeers(peers []wg.Peer) error {
 
 // Run starts the agent loop until the context is cancelled.
 func (a *Agent) Run(ctx context.Context) error {
-	if a.wgUp != nil && a.wgConfigPath != "" {
-		if err := a.wgUp(a.wgConfigPath); err != nil {
-			log.Printf("agent: wireguard setup failed: %v", err)
+	if a.wgLink != nil {
+		if err := a.wgLink.Up(); err != nil {
+			return fmt.Errorf("wireguard interface setup: %w", err)
 		}
+		defer a.teardown()
 	}
+	if a.firewall != nil {
+		if err := a.firewall.Apply(); err != nil {
+			return fmt.Errorf("firewall setup: %w", err)
+		}
+		defer func() {
+			if err := a.firewall.Teardown(); err != nil {
+				log.Printf("agent: firewall teardown failed: %v", err)
+			}
+		}()
+	}
+	a.restorePeers()
 	if err := a.registerWithRetry(ctx); err != nil {
 		return err
 	}
-	if err := a.reportHealthWithRetry(ctx); err != nil {
+	// Health reports are attempted once per tick, so a failing health
+	// endpoint never holds up peer sync; the next tick tries again.
+	if err := a.reportHealth(ctx); err != nil {
 		log.Printf("agent: initial health report failed: %v", err)
 	}
+	if err := a.syncPeers(ctx); err != nil {
+		log.Printf("agent: initial peer sync failed: %v", err)
+	}
 
+	if a.cfg.ControlPlane.StreamPath != "" && !a.cfg.Agent.DisableStream {
+		go a.runStream(ctx)
+	}
+
+	// Health and stats keep the configured interval; only peer sync follows
+	// the interval the control plane pushes over the stream.
 	ticker := time.NewTicker(a.cfg.Agent.PollInterval)
 	defer ticker.Stop()
+	peerTimer := time.NewTimer(a.peerSyncInterval())
+	defer peerTimer.Stop()
 
 	for {
+		var report, sync bool
 		select {
 		case <-ctx.Done():
 			return nil
 		case <-ticker.C:
-			if err := a.reportHealthWithRetry(ctx); err != nil {
+			report = true
+		case <-peerTimer.C:
+			sync = true
+		case <-a.wake:
+			report, sync = true, true
+		}
+		if report {
+			if err := a.reportHealth(ctx); err != nil {
 				log.Printf("agent: health report failed: %v", err)
 			}
 		}
+		if sync {
+			if err := a.syncPeers(ctx); err != nil {
+				log.Printf("agent: peer sync failed: %v", err)
+			}
+			peerTimer.Reset(a.peerSyncInterval())
+		}
+		if report {
+			if err := a.reportPeerStats(ctx); err != nil {
+				log.Printf("agent: peer stats report failed: %v", err)
+			}
+		}
 	}
 }
 
-func (a *Agent) registerWithRetry(ctx context.Context) error {
-	return a.withRetry(ctx, "register", a.doRegister)
+// peerSyncInterval is the interval pushed by the control plane while the
+// stream is connected, or the configured poll interval.
+func (a *Agent) peerSyncInterval() time.Duration {
+	if d := time.Duration(a.pollOverride.Load()); d > 0 {
+		return d
+	}
+	return a.cfg.Agent.PollInterval
+}
+
+// Wake runs the periodic health report and peer sync without waiting for
+// the next tick. It never blocks; requests made while one is pending are
+// coalesced.
+func (a *Agent) Wake() {
+	select {
+	case a.wake <- struct{}{}:
+	default:
+	}
+}
+
+// teardown removes the WireGuard interface on shutdown when configured to.
+func (a *Agent) teardown() {
+	if !a.cfg.WireGuard.TeardownOnExit {
+		return
+	}
+	if err := a.wgLink.Down(); err != nil {
+		log.Printf("agent: wireguard teardown failed: %v", err)
+	}
+}
+
+// restorePeers re-applies the last persisted peer set so clients reconnect
+// before the control plane is reachable again. It also runs with an empty set
+// so a freshly created device receives its private key and listen port.
+func (a *Agent) restorePeers() {
+	if a.state == nil || a.wgManager == nil {
+		return
+	}
+	peers, err := a.state.LoadPeers()
+	if err != nil {
+		log.Printf("agent: load persisted peers failed: %v", err)
+		return
+	}
+	if err := a.ApplyPeers(peers); err != nil {
+		log.Printf("agent: restore peers failed: %v", err)
+	}
 }
 
-func (a *Agent) reportHealthWithRetry(ctx context.Context) error {
-	return a.withRetry(ctx, "health", func(ctx context.Context) error { return a.reportHealth(ctx) })
+func (a *Agent) registerWithRetry(ctx context.Context) error {
+	return a.withRetry(ctx, "register", a.doRegister)
 }
 
 func (a *Agent) doRegister(ctx context.Context) error {
@@ -144,11 +310,21 @@ func (a *Agent) doRegister(ctx context.Context) error {
 		return err
 	}
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, registerURL, nil)
+	register := a.registrationPayload()
+	if err := register.Validate(); err != nil {
+		return fmt.Errorf("invalid registration: %w", err)
+	}
+	payload, err := json.Marshal(register)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, registerURL, bytes.NewReader(payload))
 	if err != nil {
 		return err
 	}
-	addAuthHeaders(req, a.cfg.Provision.Token)
+	req.Header.Set("Content-Type", "application/json")
+	addAuthHeaders(req.Header, a.cfg.Provision.Token)
 
 	resp, err := a.client.Do(req)
 	if err != nil {
@@ -156,34 +332,101 @@ func (a *Agent) doRegister(ctx context.Context) error {
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode >= 400 {
-		return fmt.Errorf("register failed with status %d", resp.StatusCode)
+	if err := checkResponse(resp, "register"); err != nil {
+		return err
 	}
 
-	if a.wgSync != nil && a.wgConfigPath != "" {
-		if err := a.wgSync(a.wgConfigPath); err != nil {
-			log.Printf("agent: wireguard sync failed: %v", err)
+	var registered nodeproto.RegisterResponse
+	if err := json.NewDecoder(resp.Body).Decode(&registered); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("decode register response: %w", err)
+	}
+	if registered.NodeID != "" && registered.NodeID != a.nodeID {
+		a.mu.Lock()
+		a.nodeID = registered.NodeID
+		a.peerRevision = 0
+		a.mu.Unlock()
+		if a.state != nil {
+			if err := a.state.SaveNodeID(registered.NodeID); err != nil {
+				log.Printf("agent: persist node id failed: %v", err)
+			}
 		}
 	}
 
 	return nil
 }
 
-func (a *Agent) reportHealth(ctx context.Context) error {
-	healthURL, err := JoinURL(a.cfg.ControlPlane.URL, a.cfg.ControlPlane.HealthPath)
-	if err != nil {
-		return err
+// registrationPayload builds the register request from configuration, the
+// interface public key and, for anything not configured, detected addresses.
+func (a *Agent) registrationPayload() nodeproto.RegisterRequest {
+	node := a.cfg.Node
+	ipv4, ipv6 := node.PublicIPv4, node.PublicIPv6
+	if ipv4 == "" || ipv6 == "" {
+		detected4, detected6, err := detectPublicIPs()
+		if err != nil {
+			log.Printf("agent: public ip detection failed: %v", err)
+		}
+		if ipv4 == "" {
+			ipv4 = detected4
+		}
+		if ipv6 == "" {
+			ipv6 = detected6
+		}
+	}
+
+	endpoint := node.Endpoint
+	if endpoint == "" {
+		host := ipv4
+		if host == "" {
+			host = ipv6
+		}
+		if host != "" {
+			endpoint = net.JoinHostPort(host, strconv.Itoa(a.cfg.WireGuard.ListenPort))
+		}
 	}
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, healthURL, strings.NewReader("{}"))
+	req := nodeproto.RegisterRequest{
+		RegionCode: node.RegionCode,
+		Hostname:   node.Hostname,
+		PublicKey:  a.publicKey,
+		Endpoint:   endpoint,
+		TunnelPort: a.cfg.WireGuard.ListenPort,
+	}
+	if ipv4 != "" {
+		req.PublicIPv4 = &ipv4
+	}
+	if ipv6 != "" {
+		req.PublicIPv6 = &ipv6
+	}
+	// A host-only address (/32) tells the control plane nothing about the
+	// pool, so it falls back to its default subnet.
+	if prefix, err := netip.ParsePrefix(a.cfg.WireGuard.AddressCIDR); err == nil && prefix.Addr().Is4() && prefix.Bits() <= 30 {
+		req.TunnelAddress = prefix.String()
+	}
+	// IPv6 is only advertised when the tunnel has a prefix and the node can
+	// actually route IPv6 out; otherwise clients stay on an IPv4-only config.
+	if a.cfg.WireGuard.EnableIPv6 {
+		if prefix, err := netip.ParsePrefix(a.cfg.WireGuard.AddressCIDR6); err == nil {
+			req.TunnelIPv6Prefix = prefix.Masked().String()
+			if ipv6 != "" {
+				req.Capabilities = append(req.Capabilities, nodeproto.CapabilityIPv6)
+			}
+		}
+	}
+	return req
+}
+
+func (a *Agent) reportHealth(ctx context.Context) error {
+	if a.nodeID == "" {
+		return errors.New("node not registered")
+	}
+	healthURL, err := JoinURL(a.cfg.ControlPlane.URL, a.cfg.ControlPlane.HealthPath)
 	if err != nil {
 		return err
 	}
-	req.Header.Set("Content-Type", "application/json")
-	addAuthHeaders(req, a.cfg.Provision.Token)
 
-	body := map[string]any{
-		"timestamp": time.Now().UTC(),
+	report := nodeproto.HealthReport{
+		NodeID:    a.nodeID,
+		Timestamp: time.Now().UTC(),
 	}
 
 	if a.wgManager != nil {
@@ -193,45 +436,62 @@ func (a *Agent) reportHealth(ctx context.Context) error {
 			if a.metrics != nil {
 				a.metrics.Update(stats)
 			}
-			ratio := 0.0
+			report.PeerCount = stats.PeerCount
+			report.ActivePeers = stats.ActivePeers
 			if stats.PeerCount > 0 {
-				ratio = float64(stats.ActivePeers) / float64(stats.PeerCount)
+				report.HandshakeRatio = float64(stats.ActivePeers) / float64(stats.PeerCount)
 			}
-			wgState := map[string]any{
-				"peer_count":        stats.PeerCount,
-				"active_peer_count": stats.ActivePeers,
-				"handshake_ratio":   ratio,
-				"last_handshake":    stats.LastHandshake,
-				"rx_bytes":          stats.ReceiveBytes,
-				"tx_bytes":          stats.TransmitBytes,
-				"rx_bps":            rxBps,
-				"tx_bps":            txBps,
+			if !stats.LastHandshake.IsZero() {
+				last := stats.LastHandshake.UTC()
+				report.LastHandshake = &last
 			}
-			if a.state != nil {
-				if drain, err := a.state.DrainEnabled(); err == nil {
-					wgState["drain"] = drain
-				} else {
-					log.Printf("agent: drain state read failed: %v", err)
-				}
-			}
-			body["wireguard"] = wgState
+			report.RxBytes = stats.ReceiveBytes
+			report.TxBytes = stats.TransmitBytes
+			report.RxBps = rxBps
+			report.TxBps = txBps
+			report.ThroughputMbps = (rxBps + txBps) / 1e6
 		}
 	}
+	if a.host != nil {
+		snap, err := a.host.Collect()
+		if err != nil {
+			log.Printf("agent: host sample incomplete: %v", err)
+		}
+		report.CPUPercent = snap.CPUPercent
+		report.SoftirqPercent = snap.SoftirqPercent
+		report.MemoryPercent = snap.MemoryPercent
+		report.PacketLoss = snap.PacketLoss
+		if a.metrics != nil {
+			a.metrics.UpdateHost(snap)
+		}
+	}
+	if a.state != nil {
+		if drain, err := a.state.DrainEnabled(); err == nil {
+			report.Drain = drain
+		} else {
+			log.Printf("agent: drain state read failed: %v", err)
+		}
+	}
+
+	payload, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
 
-	payload, err := json.Marshal(body)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, healthURL, bytes.NewReader(payload))
 	if err != nil {
 		return err
 	}
-	req.Body = io.NopCloser(bytes.NewReader(payload))
-	req.ContentLength = int64(len(payload))
+	req.Header.Set("Content-Type", "application/json")
+	addAuthHeaders(req.Header, a.cfg.Provision.Token)
 
 	resp, err := a.client.Do(req)
 	if err != nil {
 		return err
 	}
-	resp.Body.Close()
+	defer resp.Body.Close()
 
-	return nil
+	return checkResponse(resp, "health")
 }
 
 func (a *Agent) computeThroughput(now time.Time, stats wg.DeviceStats) (float64, float64) {
@@ -253,11 +513,37 @@ func (a *Agent) computeThroughput(now time.Time, stats wg.DeviceStats) (float64,
 	return float64(rxDelta) * 8 / elapsed, float64(txDelta) * 8 / elapsed
 }
 
-func addAuthHeaders(req *http.Request, token string) {
+func addAuthHeaders(h http.Header, token string) {
 	if token != "" {
-		req.Header.Set("Authorization", "Bearer "+token)
+		h.Set(nodeproto.HeaderProvisionToken, token)
 	}
-	req.Header.Set("User-Agent", "vpn-node-agent/1.0")
+	nodeproto.SetHeader(h)
+	h.Set("User-Agent", "vpn-node-agent/1.0")
+}
+
+// checkResponse rejects responses from a control plane speaking an
+// incompatible protocol version and turns error statuses into errors. Only
+// successful responses must carry the version header: errors from proxies
+// and load balancers in front of the control plane lack it and are retried
+// like any other failure.
+func checkResponse(resp *http.Response, label string) error {
+	if resp.StatusCode == http.StatusUpgradeRequired {
+		var body nodeproto.ErrorResponse
+		_ = json.NewDecoder(resp.Body).Decode(&body)
+		return fmt.Errorf("%s: %w: control plane supports %s, agent speaks %d",
+			label, nodeproto.ErrIncompatibleVersion, body.SupportedVersion, nodeproto.Version)
+	}
+	if resp.StatusCode >= 400 {
+		var body nodeproto.ErrorResponse
+		if err := json.NewDecoder(resp.Body).Decode(&body); err == nil && body.Error != "" {
+			return fmt.Errorf("%s failed with status %d: %s", label, resp.StatusCode, body.Error)
+		}
+		return fmt.Errorf("%s failed with status %d", label, resp.StatusCode)
+	}
+	if err := nodeproto.CheckHeader(resp.Header); err != nil {
+		return fmt.Errorf("%s: control plane: %w", label, err)
+	}
+	return nil
 }
 
 // JoinURL joins control plane base URL with a relative path.
@@ -307,6 +593,9 @@ func (a *Agent) withRetry(ctx context.Context, label string, fn func(context.Con
 		if ctx.Err() != nil {
 			return ctx.Err()
 		}
+		if errors.Is(err, nodeproto.ErrIncompatibleVersion) {
+			return err
+		}
 		log.Printf("agent: %s attempt failed: %v", label, err)
 		wait := backoff
 		if backoff < a.maxRetry {
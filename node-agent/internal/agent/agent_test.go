@@ -3,16 +3,21 @@ package agent
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/require"
 
 	"github.com/emrecetinkayadev/vpn-tridot/node-agent/internal/config"
+	"github.com/emrecetinkayadev/vpn-tridot/node-agent/internal/health"
 	"github.com/emrecetinkayadev/vpn-tridot/node-agent/internal/wg"
+	"github.com/emrecetinkayadev/vpn-tridot/nodeproto"
 )
 
 type roundTripperFunc func(*http.Request) (*http.Response, error)
@@ -21,7 +26,10 @@ func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) { r
 
 func TestAgentRun(t *testing.T) {
 	tr := roundTripperFunc(func(r *http.Request) (*http.Response, error) {
-		return &http.Response{StatusCode: http.StatusNoContent, Body: http.NoBody}, nil
+		if r.URL.Path == "/register" {
+			return protoResponse(http.StatusCreated, `{"node_id":"node-1"}`), nil
+		}
+		return protoResponse(http.StatusNoContent, ""), nil
 	})
 
 	client := &http.Client{Transport: tr}
@@ -35,15 +43,284 @@ func TestAgentRun(t *testing.T) {
 		Provision: config.ProvisionConfig{Token: "test"},
 		MTLS:      config.MTLSConfig{CACert: "ca", Cert: "cert", Key: "key"},
 		Agent:     config.AgentConfig{PollInterval: 10 * time.Millisecond},
+		WireGuard: config.WireGuardConfig{ListenPort: 51820},
+		Node:      config.NodeConfig{RegionCode: "TR-IST", Hostname: "ist-1", Endpoint: "vpn.example.com:51820"},
 	}
 
 	a, err := New(cfg, client)
 	require.NoError(t, err)
+	a.WithPublicKey("server-pub")
 
 	ctx, cancel := context.WithTimeout(context.Background(), 35*time.Millisecond)
 	defer cancel()
 
 	require.NoError(t, a.Run(ctx))
+	require.Equal(t, "node-1", a.nodeID)
+}
+
+func TestStreamPollIntervalOnlySlowsPeerSync(t *testing.T) {
+	var mu sync.Mutex
+	calls := map[string]int{}
+	tr := roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		mu.Lock()
+		calls[r.URL.Path]++
+		mu.Unlock()
+		switch r.URL.Path {
+		case "/register":
+			return protoResponse(http.StatusCreated, `{"node_id":"node-1"}`), nil
+		case "/peers":
+			return protoResponse(http.StatusOK, `{"revision":1,"peers":[]}`), nil
+		}
+		return protoResponse(http.StatusNoContent, ""), nil
+	})
+	cfg := config.Config{
+		ControlPlane: config.ControlPlaneConfig{URL: "https://cp", RegisterPath: "/register", HealthPath: "/health", PeersPath: "/peers"},
+		Agent:        config.AgentConfig{PollInterval: 10 * time.Millisecond},
+		WireGuard:    config.WireGuardConfig{ListenPort: 51820},
+		Node:         config.NodeConfig{RegionCode: "TR-IST", Hostname: "ist-1", Endpoint: "vpn.example.com:51820"},
+	}
+	a, err := New(cfg, &http.Client{Transport: tr})
+	require.NoError(t, err)
+	a.WithPublicKey("server-pub")
+	a.pollOverride.Store(int64(time.Hour))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	require.NoError(t, a.Run(ctx))
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Equal(t, 1, calls["/peers"], "peer sync waits for the pushed interval")
+	require.GreaterOrEqual(t, calls["/health"], 3, "health keeps the configured interval")
+}
+
+func TestFailingHealthDoesNotStopPeerSync(t *testing.T) {
+	var mu sync.Mutex
+	calls := map[string]int{}
+	tr := roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		mu.Lock()
+		calls[r.URL.Path]++
+		mu.Unlock()
+		switch r.URL.Path {
+		case "/register":
+			return protoResponse(http.StatusCreated, `{"node_id":"node-1"}`), nil
+		case "/health":
+			return protoResponse(http.StatusInternalServerError, `{"error":"down"}`), nil
+		}
+		return protoResponse(http.StatusOK, `{"revision":1,"peers":[]}`), nil
+	})
+	cfg := config.Config{
+		ControlPlane: config.ControlPlaneConfig{URL: "https://cp", RegisterPath: "/register", HealthPath: "/health", PeersPath: "/peers"},
+		Agent:        config.AgentConfig{PollInterval: 10 * time.Millisecond},
+		WireGuard:    config.WireGuardConfig{ListenPort: 51820},
+		Node:         config.NodeConfig{RegionCode: "TR-IST", Hostname: "ist-1", Endpoint: "vpn.example.com:51820"},
+	}
+	a, err := New(cfg, &http.Client{Transport: tr})
+	require.NoError(t, err)
+	a.WithPublicKey("server-pub")
+	a.retryBase = time.Hour
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	require.NoError(t, a.Run(ctx))
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.GreaterOrEqual(t, calls["/peers"], 3, "peer sync keeps running while health fails")
+	require.GreaterOrEqual(t, calls["/health"], 3, "each tick tries health once")
+}
+
+func TestRegisterSendsPayloadAndPersistsNodeID(t *testing.T) {
+	origDetect := detectPublicIPs
+	detectPublicIPs = func() (string, string, error) { return "203.0.113.10", "", nil }
+	defer func() { detectPublicIPs = origDetect }()
+
+	var payload nodeproto.RegisterRequest
+	tr := roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&payload))
+		return protoResponse(http.StatusCreated, `{"node_id":"node-1"}`), nil
+	})
+	cfg := config.Config{
+		ControlPlane: config.ControlPlaneConfig{URL: "https://cp", RegisterPath: "/register"},
+		Provision:    config.ProvisionConfig{Token: "tok"},
+		WireGuard:    config.WireGuardConfig{ListenPort: 51820},
+		Node:         config.NodeConfig{RegionCode: "TR-IST", Hostname: "ist-1"},
+	}
+	a, err := New(cfg, &http.Client{Transport: tr})
+	require.NoError(t, err)
+	state := &stateStub{}
+	a.WithState(state)
+	a.WithPublicKey("server-pub")
+
+	require.NoError(t, a.doRegister(context.Background()))
+	require.Equal(t, "TR-IST", payload.RegionCode)
+	require.Equal(t, "ist-1", payload.Hostname)
+	require.Equal(t, "server-pub", payload.PublicKey)
+	require.Equal(t, "203.0.113.10:51820", payload.Endpoint)
+	require.Equal(t, 51820, payload.TunnelPort)
+	require.NotNil(t, payload.PublicIPv4)
+	require.Nil(t, payload.PublicIPv6)
+	require.Empty(t, payload.TunnelAddress)
+	require.Equal(t, "node-1", a.nodeID)
+	require.Equal(t, "node-1", state.nodeID)
+}
+
+func TestRegistrationPayloadAdvertisesIPv6(t *testing.T) {
+	origDetect := detectPublicIPs
+	detectPublicIPs = func() (string, string, error) { return "203.0.113.10", "", nil }
+	defer func() { detectPublicIPs = origDetect }()
+
+	cfg := config.Config{
+		WireGuard: config.WireGuardConfig{ListenPort: 51820, AddressCIDR: "10.8.0.1/24", EnableIPv6: true, AddressCIDR6: "fd12:3456:789a::1/64"},
+		Node:      config.NodeConfig{RegionCode: "TR-IST", Hostname: "ist-1"},
+	}
+	a, err := New(cfg, &http.Client{})
+	require.NoError(t, err)
+	a.WithPublicKey("server-pub")
+
+	// No public IPv6: the prefix is reported but clients are not routed over it.
+	payload := a.registrationPayload()
+	require.Equal(t, "10.8.0.1/24", payload.TunnelAddress)
+	require.Equal(t, "fd12:3456:789a::/64", payload.TunnelIPv6Prefix)
+	require.Empty(t, payload.Capabilities)
+
+	a.cfg.Node.PublicIPv6 = "2001:db8::10"
+	payload = a.registrationPayload()
+	require.True(t, payload.HasCapability(nodeproto.CapabilityIPv6))
+	require.NoError(t, payload.Validate())
+}
+
+func TestWithStateRestoresNodeID(t *testing.T) {
+	a := &Agent{}
+	a.WithState(&stateStub{nodeID: "node-9"})
+	require.Equal(t, "node-9", a.nodeID)
+}
+
+func TestRegisterStopsOnIncompatibleVersion(t *testing.T) {
+	origDetect := detectPublicIPs
+	detectPublicIPs = func() (string, string, error) { return "203.0.113.10", "", nil }
+	defer func() { detectPublicIPs = origDetect }()
+
+	attempts := 0
+	tr := roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		attempts++
+		require.Equal(t, "tok", r.Header.Get(nodeproto.HeaderProvisionToken))
+		require.Empty(t, r.Header.Get("Authorization"))
+		resp := protoResponse(http.StatusUpgradeRequired, `{"error":"incompatible","supported_version":"2"}`)
+		resp.Header.Set(nodeproto.HeaderVersion, "2")
+		return resp, nil
+	})
+	cfg := config.Config{
+		ControlPlane: config.ControlPlaneConfig{URL: "https://cp", RegisterPath: "/register"},
+		Provision:    config.ProvisionConfig{Token: "tok"},
+		WireGuard:    config.WireGuardConfig{ListenPort: 51820},
+		Node:         config.NodeConfig{RegionCode: "TR-IST", Hostname: "ist-1"},
+	}
+	a, err := New(cfg, &http.Client{Transport: tr})
+	require.NoError(t, err)
+	a.WithPublicKey("server-pub")
+
+	err = a.registerWithRetry(context.Background())
+	require.ErrorIs(t, err, nodeproto.ErrIncompatibleVersion)
+	require.Equal(t, 1, attempts)
+}
+
+func TestCheckResponseRequiresVersionHeader(t *testing.T) {
+	resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: http.NoBody}
+	require.ErrorIs(t, checkResponse(resp, "test"), nodeproto.ErrIncompatibleVersion)
+}
+
+func TestRegisterRetriesProxyErrorsWithoutVersionHeader(t *testing.T) {
+	origDetect := detectPublicIPs
+	detectPublicIPs = func() (string, string, error) { return "203.0.113.10", "", nil }
+	defer func() { detectPublicIPs = origDetect }()
+	originalSleep := sleepDelay
+	sleepDelay = func(context.Context, time.Duration) error { return nil }
+	defer func() { sleepDelay = originalSleep }()
+
+	attempts := 0
+	tr := roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		attempts++
+		if attempts < 3 {
+			// A load balancer answering while the control plane is down.
+			return &http.Response{StatusCode: http.StatusBadGateway, Header: http.Header{}, Body: io.NopCloser(strings.NewReader("bad gateway"))}, nil
+		}
+		return protoResponse(http.StatusCreated, `{"node_id":"node-1"}`), nil
+	})
+	cfg := config.Config{
+		ControlPlane: config.ControlPlaneConfig{URL: "https://cp", RegisterPath: "/register"},
+		Provision:    config.ProvisionConfig{Token: "tok"},
+		WireGuard:    config.WireGuardConfig{ListenPort: 51820},
+		Node:         config.NodeConfig{RegionCode: "TR-IST", Hostname: "ist-1"},
+	}
+	a, err := New(cfg, &http.Client{Transport: tr})
+	require.NoError(t, err)
+	a.WithPublicKey("server-pub")
+
+	require.NoError(t, a.registerWithRetry(context.Background()))
+	require.Equal(t, 3, attempts)
+	require.Equal(t, "node-1", a.nodeID)
+}
+
+func TestRunTearsDownInterfaceOnExit(t *testing.T) {
+	tr := roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		return protoResponse(http.StatusCreated, `{"node_id":"node-1"}`), nil
+	})
+	cfg := config.Config{
+		ControlPlane: config.ControlPlaneConfig{URL: "https://cp", RegisterPath: "/register", HealthPath: "/health"},
+		Provision:    config.ProvisionConfig{Token: "tok"},
+		Agent:        config.AgentConfig{PollInterval: time.Hour},
+		WireGuard:    config.WireGuardConfig{ListenPort: 51820, TeardownOnExit: true},
+		Node:         config.NodeConfig{RegionCode: "TR-IST", Hostname: "ist-1", Endpoint: "vpn.example.com:51820"},
+	}
+	a, err := New(cfg, &http.Client{Transport: tr})
+	require.NoError(t, err)
+	a.WithPublicKey("server-pub")
+	link := &linkStub{}
+	a.WithWireGuard(&wgManagerStub{}, link)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_ = a.Run(ctx)
+	require.Equal(t, 1, link.ups)
+	require.Equal(t, 1, link.downs)
+}
+
+func TestRunAppliesAndRemovesFirewall(t *testing.T) {
+	tr := roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		return protoResponse(http.StatusCreated, `{"node_id":"node-1"}`), nil
+	})
+	cfg := config.Config{
+		ControlPlane: config.ControlPlaneConfig{URL: "https://cp", RegisterPath: "/register", HealthPath: "/health"},
+		Agent:        config.AgentConfig{PollInterval: time.Hour},
+		WireGuard:    config.WireGuardConfig{ListenPort: 51820},
+		Node:         config.NodeConfig{RegionCode: "TR-IST", Hostname: "ist-1", Endpoint: "vpn.example.com:51820"},
+	}
+	a, err := New(cfg, &http.Client{Transport: tr})
+	require.NoError(t, err)
+	a.WithPublicKey("server-pub")
+	a.WithWireGuard(&wgManagerStub{}, &linkStub{})
+	fw := &firewallStub{}
+	a.WithFirewall(fw)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_ = a.Run(ctx)
+	require.Equal(t, 1, fw.applies)
+	require.Equal(t, 1, fw.teardowns)
+}
+
+func TestRunFailsWhenFirewallSetupFails(t *testing.T) {
+	a := &Agent{}
+	a.WithWireGuard(&wgManagerStub{}, &linkStub{})
+	a.WithFirewall(&firewallStub{applyErr: fmt.Errorf("iptables-restore missing")})
+	require.ErrorContains(t, a.Run(context.Background()), "iptables-restore missing")
+}
+
+func TestRunFailsWhenInterfaceSetupFails(t *testing.T) {
+	a := &Agent{}
+	a.WithWireGuard(&wgManagerStub{}, &linkStub{upErr: fmt.Errorf("no module")})
+	require.ErrorContains(t, a.Run(context.Background()), "no module")
 }
 
 func TestJoinURL(t *testing.T) {
@@ -57,18 +334,25 @@ func TestApplyPeers(t *testing.T) {
 	a := &Agent{}
 	state := &stateStub{}
 	a.WithState(state)
-	a.WithWireGuard(mgr, "/etc/wireguard/wg0.conf", nil, func(path string) error {
-		mgr.synced = append(mgr.synced, path)
-		return nil
-	})
+	a.WithWireGuard(mgr, nil)
 
 	err := a.ApplyPeers([]wg.Peer{{PublicKey: "pk", AllowedIPs: []string{"0.0.0.0/0"}}})
 	require.NoError(t, err)
 	require.Len(t, mgr.configs, 1)
-	require.Equal(t, "/etc/wireguard/wg0.conf", mgr.synced[0])
 	require.Len(t, state.savedPeers, 1)
 }
 
+func TestRestorePeersAppliesPersistedSet(t *testing.T) {
+	mgr := &wgManagerStub{}
+	a := &Agent{}
+	a.WithState(&stateStub{loadPeers: []wg.Peer{{PublicKey: "pk", AllowedIPs: []string{"10.0.0.2/32"}}}})
+	a.WithWireGuard(mgr, nil)
+
+	a.restorePeers()
+	require.Len(t, mgr.configs, 1)
+	require.Contains(t, a.applied, "pk")
+}
+
 func TestReportHealthIncludesDrain(t *testing.T) {
 	stats := wg.DeviceStats{PeerCount: 2, ActivePeers: 1, ReceiveBytes: 10, TransmitBytes: 20, LastHandshake: time.Unix(100, 0)}
 	mgr := &wgManagerStub{stats: stats}
@@ -78,7 +362,7 @@ func TestReportHealthIncludesDrain(t *testing.T) {
 		body, err := io.ReadAll(r.Body)
 		require.NoError(t, err)
 		reqBody <- body
-		return &http.Response{StatusCode: http.StatusNoContent, Body: http.NoBody}, nil
+		return protoResponse(http.StatusNoContent, ""), nil
 	})
 	client := &http.Client{Transport: tr}
 	cfg := config.Config{
@@ -88,21 +372,53 @@ func TestReportHealthIncludesDrain(t *testing.T) {
 	}
 	a, err := New(cfg, client)
 	require.NoError(t, err)
-	a.WithWireGuard(mgr, "", nil, nil)
+	a.WithWireGuard(mgr, nil)
 	a.WithState(state)
+	a.nodeID = "node-1"
 	require.NoError(t, a.reportHealth(context.Background()))
 	select {
 	case body := <-reqBody:
-		var payload map[string]any
+		var payload nodeproto.HealthReport
 		require.NoError(t, json.Unmarshal(body, &payload))
-		wgPayload, ok := payload["wireguard"].(map[string]any)
-		require.True(t, ok)
-		require.Equal(t, true, wgPayload["drain"])
+		require.Equal(t, "node-1", payload.NodeID)
+		require.Equal(t, 1, payload.ActivePeers)
+		require.Equal(t, 2, payload.PeerCount)
+		require.True(t, payload.Drain)
 	case <-time.After(time.Second):
 		t.Fatal("expected health request")
 	}
 }
 
+type hostStub struct {
+	snap health.Snapshot
+	err  error
+}
+
+func (h hostStub) Collect() (health.Snapshot, error) { return h.snap, h.err }
+
+func TestReportHealthIncludesHostLoad(t *testing.T) {
+	var payload nodeproto.HealthReport
+	tr := roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&payload))
+		return protoResponse(http.StatusOK, `{"capacity_score":50}`), nil
+	})
+	cfg := config.Config{ControlPlane: config.ControlPlaneConfig{URL: "https://cp", HealthPath: "/health"}}
+	a, err := New(cfg, &http.Client{Transport: tr})
+	require.NoError(t, err)
+	// A partial sample (e.g. missing uplink) still reports what was read.
+	a.WithHostCollector(hostStub{
+		snap: health.Snapshot{CPUPercent: 63, SoftirqPercent: 12, MemoryPercent: 40, PacketLoss: 0.02},
+		err:  errors.New("uplink missing"),
+	})
+	a.nodeID = "node-1"
+
+	require.NoError(t, a.reportHealth(context.Background()))
+	require.Equal(t, 63.0, payload.CPUPercent)
+	require.Equal(t, 12.0, payload.SoftirqPercent)
+	require.Equal(t, 40.0, payload.MemoryPercent)
+	require.Equal(t, 0.02, payload.PacketLoss)
+}
+
 func TestWithRetryRetriesUntilSuccess(t *testing.T) {
 	originalSleep := sleepDelay
 	sleepDelay = func(context.Context, time.Duration) error { return nil }
@@ -124,25 +440,67 @@ func TestWithRetryRetriesUntilSuccess(t *testing.T) {
 	require.Equal(t, 3, attempts)
 }
 
+func protoResponse(status int, body string) *http.Response {
+	header := http.Header{}
+	nodeproto.SetHeader(header)
+	return &http.Response{StatusCode: status, Header: header, Body: io.NopCloser(strings.NewReader(body))}
+}
+
 type wgManagerStub struct {
 	configs []wg.Peer
-	synced  []string
 	stats   wg.DeviceStats
 }
 
-func (m *wgManagerStub) WritePeers(peers []wg.Peer) (string, error) {
-	path := "/etc/wireguard/wg0.conf"
+func (m *wgManagerStub) ApplyPeers(peers []wg.Peer) error {
 	m.configs = append(m.configs, peers...)
-	return path, nil
+	return nil
 }
 
 func (m *wgManagerStub) Stats() (wg.DeviceStats, error) {
 	return m.stats, nil
 }
 
+type linkStub struct {
+	ups, downs int
+	upErr      error
+}
+
+func (l *linkStub) Up() error {
+	l.ups++
+	return l.upErr
+}
+
+func (l *linkStub) Down() error {
+	l.downs++
+	return nil
+}
+
+type firewallStub struct {
+	applies, teardowns int
+	applyErr           error
+	meshGroups         [][]string
+}
+
+func (f *firewallStub) Apply() error {
+	f.applies++
+	return f.applyErr
+}
+
+func (f *firewallStub) Teardown() error {
+	f.teardowns++
+	return nil
+}
+
+func (f *firewallStub) SetMeshGroups(groups [][]string) error {
+	f.meshGroups = groups
+	return nil
+}
+
 type stateStub struct {
 	savedPeers [][]wg.Peer
+	loadPeers  []wg.Peer
 	drain      bool
+	nodeID     string
 }
 
 func (s *stateStub) SavePeers(peers []wg.Peer) error {
@@ -150,6 +508,18 @@ func (s *stateStub) SavePeers(peers []wg.Peer) error {
 	return nil
 }
 
-func (s *stateStub) LoadPeers() ([]wg.Peer, error) { return nil, nil }
+func (s *stateStub) LoadPeers() ([]wg.Peer, error) { return s.loadPeers, nil }
 
 func (s *stateStub) DrainEnabled() (bool, error) { return s.drain, nil }
+
+func (s *stateStub) SetDrain(enabled bool) error {
+	s.drain = enabled
+	return nil
+}
+
+func (s *stateStub) SaveNodeID(id string) error {
+	s.nodeID = id
+	return nil
+}
+
+func (s *stateStub) LoadNodeID() (string, error) { return s.nodeID, nil }
@@ -0,0 +1,180 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/emrecetinkayadev/vpn-tridot/node-agent/internal/wg"
+	"github.com/emrecetinkayadev/vpn-tridot/nodeproto"
+)
+
+// syncPeers fetches the desired peer set from the control plane and applies it
+// when it differs from what is currently configured. After the first full
+// fetch only changes since the last seen revision are requested, unless a
+// full resync was requested; that set is applied even when it looks
+// unchanged, to undo changes made to the device behind the agent's back.
+func (a *Agent) syncPeers(ctx context.Context) error {
+	if a.nodeID == "" || a.cfg.ControlPlane.PeersPath == "" {
+		return nil
+	}
+	err := a.doSyncPeers(ctx, a.fullResync.Swap(false))
+
+	a.mu.Lock()
+	a.lastSync = time.Now()
+	a.lastSyncErr = ""
+	if err != nil {
+		a.lastSyncErr = err.Error()
+	}
+	a.mu.Unlock()
+	return err
+}
+
+func (a *Agent) doSyncPeers(ctx context.Context, full bool) error {
+	since := a.peerRevision
+	if full {
+		since = 0
+	}
+	desired, err := a.fetchDesiredPeers(ctx, since)
+	if err != nil {
+		return err
+	}
+
+	var target map[string]wg.Peer
+	if desired.Full {
+		target = make(map[string]wg.Peer, len(desired.Peers))
+		for _, peer := range desired.Peers {
+			target[peer.PublicKey] = fromProtoPeer(peer)
+		}
+	} else {
+		target = make(map[string]wg.Peer, len(a.applied))
+		for key, peer := range a.applied {
+			target[key] = peer
+		}
+		for _, key := range desired.Removed {
+			delete(target, key)
+		}
+		for _, peer := range desired.Peers {
+			target[peer.PublicKey] = fromProtoPeer(peer)
+		}
+	}
+
+	if full || !peerSetsEqual(a.applied, target) {
+		if err := a.ApplyPeers(sortedPeers(target)); err != nil {
+			return fmt.Errorf("apply desired peers: %w", err)
+		}
+	}
+	a.mu.Lock()
+	a.peerRevision = desired.Revision
+	a.mu.Unlock()
+	return nil
+}
+
+func (a *Agent) fetchDesiredPeers(ctx context.Context, since int64) (nodeproto.DesiredPeersResponse, error) {
+	peersURL, err := JoinURL(a.cfg.ControlPlane.URL, a.cfg.ControlPlane.PeersPath)
+	if err != nil {
+		return nodeproto.DesiredPeersResponse{}, err
+	}
+	u, err := url.Parse(peersURL)
+	if err != nil {
+		return nodeproto.DesiredPeersResponse{}, err
+	}
+	q := u.Query()
+	q.Set("node_id", a.nodeID)
+	if since > 0 {
+		q.Set("since", strconv.FormatInt(since, 10))
+	}
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nodeproto.DesiredPeersResponse{}, err
+	}
+	addAuthHeaders(req.Header, a.cfg.Provision.Token)
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nodeproto.DesiredPeersResponse{}, err
+	}
+	defer resp.Body.Close()
+
+	if err := checkResponse(resp, "desired peers"); err != nil {
+		return nodeproto.DesiredPeersResponse{}, err
+	}
+
+	var desired nodeproto.DesiredPeersResponse
+	if err := json.NewDecoder(resp.Body).Decode(&desired); err != nil {
+		return nodeproto.DesiredPeersResponse{}, fmt.Errorf("decode desired peers: %w", err)
+	}
+	return desired, nil
+}
+
+func fromProtoPeer(peer nodeproto.Peer) wg.Peer {
+	return wg.Peer{
+		PublicKey:      peer.PublicKey,
+		PresharedKey:   peer.PresharedKey,
+		AllowedIPs:     peer.AllowedIPs,
+		PersistentKeep: peer.PersistentKeepalive,
+		Group:          peer.Group,
+	}
+}
+
+// meshGroups collects the addresses of grouped peers, one entry per group.
+func meshGroups(peers []wg.Peer) [][]string {
+	index := make(map[string][]string)
+	for _, peer := range peers {
+		if peer.Group != "" {
+			index[peer.Group] = append(index[peer.Group], peer.AllowedIPs...)
+		}
+	}
+	groups := make([][]string, 0, len(index))
+	for _, addrs := range index {
+		groups = append(groups, addrs)
+	}
+	return groups
+}
+
+func indexPeers(peers []wg.Peer) map[string]wg.Peer {
+	index := make(map[string]wg.Peer, len(peers))
+	for _, peer := range peers {
+		index[peer.PublicKey] = peer
+	}
+	return index
+}
+
+func sortedPeers(index map[string]wg.Peer) []wg.Peer {
+	peers := make([]wg.Peer, 0, len(index))
+	for _, peer := range index {
+		peers = append(peers, peer)
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].PublicKey < peers[j].PublicKey })
+	return peers
+}
+
+func peerSetsEqual(a, b map[string]wg.Peer) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for key, pa := range a {
+		pb, ok := b[key]
+		if !ok || !peersEqual(pa, pb) {
+			return false
+		}
+	}
+	return true
+}
+
+func peersEqual(a, b wg.Peer) bool {
+	return a.PublicKey == b.PublicKey &&
+		a.PresharedKey == b.PresharedKey &&
+		a.Endpoint == b.Endpoint &&
+		a.PersistentKeep == b.PersistentKeep &&
+		a.Group == b.Group &&
+		slices.Equal(a.AllowedIPs, b.AllowedIPs)
+}
@@ -0,0 +1,99 @@
+package agent
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/emrecetinkayadev/vpn-tridot/node-agent/internal/config"
+	"github.com/emrecetinkayadev/vpn-tridot/node-agent/internal/wg"
+)
+
+func TestSyncPeersAppliesFullThenIncremental(t *testing.T) {
+	responses := []string{
+		`{"revision":2,"full":true,"peers":[{"public_key":"a","allowed_ips":["10.0.0.2/32"]},{"public_key":"b","allowed_ips":["10.0.0.3/32"]}]}`,
+		`{"revision":2,"full":false,"peers":[],"removed":[]}`,
+		`{"revision":4,"full":false,"peers":[{"public_key":"c","allowed_ips":["10.0.0.4/32"]}],"removed":["a"]}`,
+	}
+	var queries []string
+	tr := roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		queries = append(queries, r.URL.RawQuery)
+		body := responses[0]
+		responses = responses[1:]
+		return protoResponse(http.StatusOK, body), nil
+	})
+
+	cfg := config.Config{
+		ControlPlane: config.ControlPlaneConfig{URL: "https://cp", PeersPath: "/peers"},
+		Provision:    config.ProvisionConfig{Token: "tok"},
+	}
+	a, err := New(cfg, &http.Client{Transport: tr})
+	require.NoError(t, err)
+	mgr := &wgManagerStub{}
+	a.WithWireGuard(mgr, nil)
+	a.nodeID = "node-1"
+
+	ctx := context.Background()
+	require.NoError(t, a.syncPeers(ctx))
+	require.Len(t, mgr.configs, 2)
+	require.Equal(t, int64(2), a.peerRevision)
+
+	require.NoError(t, a.syncPeers(ctx))
+	require.Len(t, mgr.configs, 2, "unchanged peer set must not be reapplied")
+
+	require.NoError(t, a.syncPeers(ctx))
+	require.Equal(t, int64(4), a.peerRevision)
+	require.Equal(t, []wg.Peer{
+		{PublicKey: "b", AllowedIPs: []string{"10.0.0.3/32"}},
+		{PublicKey: "c", AllowedIPs: []string{"10.0.0.4/32"}},
+	}, mgr.configs[2:])
+
+	require.Equal(t, "node_id=node-1", queries[0])
+	require.Equal(t, "node_id=node-1&since=2", queries[1])
+}
+
+func TestSyncPeersSkipsWithoutNodeID(t *testing.T) {
+	tr := roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		t.Fatal("unexpected request")
+		return nil, nil
+	})
+	cfg := config.Config{ControlPlane: config.ControlPlaneConfig{URL: "https://cp", PeersPath: "/peers"}}
+	a, err := New(cfg, &http.Client{Transport: tr})
+	require.NoError(t, err)
+	require.NoError(t, a.syncPeers(context.Background()))
+}
+
+func TestSyncPeersUpdatesMeshGroups(t *testing.T) {
+	responses := []string{
+		`{"revision":1,"full":true,"peers":[` +
+			`{"public_key":"a","allowed_ips":["10.0.0.2/32"],"group":"u1"},` +
+			`{"public_key":"b","allowed_ips":["10.0.0.3/32","fd00::3/128"],"group":"u1"},` +
+			`{"public_key":"c","allowed_ips":["10.0.0.4/32"]}]}`,
+		`{"revision":2,"full":false,"peers":[{"public_key":"b","allowed_ips":["10.0.0.3/32","fd00::3/128"]}],"removed":[]}`,
+	}
+	tr := roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		body := responses[0]
+		responses = responses[1:]
+		return protoResponse(http.StatusOK, body), nil
+	})
+
+	cfg := config.Config{ControlPlane: config.ControlPlaneConfig{URL: "https://cp", PeersPath: "/peers"}}
+	a, err := New(cfg, &http.Client{Transport: tr})
+	require.NoError(t, err)
+	mgr := &wgManagerStub{}
+	fw := &firewallStub{}
+	a.WithWireGuard(mgr, nil)
+	a.WithFirewall(fw)
+	a.nodeID = "node-1"
+
+	require.NoError(t, a.syncPeers(context.Background()))
+	require.Equal(t, [][]string{{"10.0.0.2/32", "10.0.0.3/32", "fd00::3/128"}}, fw.meshGroups)
+
+	// Leaving the group only changes the marker, which still triggers an
+	// update so the node isolates the peer again.
+	require.NoError(t, a.syncPeers(context.Background()))
+	require.Len(t, mgr.configs, 6)
+	require.Equal(t, [][]string{{"10.0.0.2/32"}}, fw.meshGroups)
+}
@@ -0,0 +1,88 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/emrecetinkayadev/vpn-tridot/node-agent/internal/wg"
+	"github.com/emrecetinkayadev/vpn-tridot/nodeproto"
+)
+
+// reportPeerStats sends the raw per-peer counters to the control plane in
+// batches. The control plane tracks the previous sample per peer and turns it
+// into traffic deltas, so a lost report only delays accounting. The device
+// epoch tells it when the counters restarted with a recreated interface.
+func (a *Agent) reportPeerStats(ctx context.Context) error {
+	if a.nodeID == "" || a.wgManager == nil || a.cfg.ControlPlane.PeerStatsPath == "" {
+		return nil
+	}
+	stats, err := a.wgManager.Stats()
+	if err != nil {
+		return fmt.Errorf("read device stats: %w", err)
+	}
+	if len(stats.Peers) == 0 {
+		return nil
+	}
+
+	collectedAt := time.Now().UTC()
+	for start := 0; start < len(stats.Peers); start += nodeproto.MaxPeerStatsBatch {
+		end := min(start+nodeproto.MaxPeerStatsBatch, len(stats.Peers))
+		report := nodeproto.PeerStatsReport{
+			NodeID:      a.nodeID,
+			CollectedAt: collectedAt,
+			Epoch:       stats.Epoch,
+			Peers:       toProtoPeerStats(stats.Peers[start:end]),
+		}
+		if err := a.sendPeerStats(ctx, report); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *Agent) sendPeerStats(ctx context.Context, report nodeproto.PeerStatsReport) error {
+	statsURL, err := JoinURL(a.cfg.ControlPlane.URL, a.cfg.ControlPlane.PeerStatsPath)
+	if err != nil {
+		return err
+	}
+	payload, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, statsURL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	addAuthHeaders(req.Header, a.cfg.Provision.Token)
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return checkResponse(resp, "peer stats")
+}
+
+func toProtoPeerStats(peers []wg.PeerStats) []nodeproto.PeerStat {
+	out := make([]nodeproto.PeerStat, 0, len(peers))
+	for _, peer := range peers {
+		stat := nodeproto.PeerStat{
+			PublicKey: peer.PublicKey,
+			RxBytes:   peer.ReceiveBytes,
+			TxBytes:   peer.TransmitBytes,
+		}
+		if !peer.LastHandshake.IsZero() {
+			handshake := peer.LastHandshake.UTC()
+			stat.LastHandshake = &handshake
+		}
+		out = append(out, stat)
+	}
+	return out
+}
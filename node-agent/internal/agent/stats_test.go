@@ -0,0 +1,72 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/emrecetinkayadev/vpn-tridot/node-agent/internal/config"
+	"github.com/emrecetinkayadev/vpn-tridot/node-agent/internal/wg"
+	"github.com/emrecetinkayadev/vpn-tridot/nodeproto"
+)
+
+func TestReportPeerStatsSendsPerPeerCounters(t *testing.T) {
+	handshake := time.Unix(1700000000, 0)
+	mgr := &wgManagerStub{stats: wg.DeviceStats{Epoch: "boot:7", Peers: []wg.PeerStats{
+		{PublicKey: "a", ReceiveBytes: 10, TransmitBytes: 20, LastHandshake: handshake},
+		{PublicKey: "b"},
+	}}}
+
+	var reports []nodeproto.PeerStatsReport
+	tr := roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		require.Equal(t, "/stats", r.URL.Path)
+		var report nodeproto.PeerStatsReport
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&report))
+		reports = append(reports, report)
+		return protoResponse(http.StatusOK, `{"updated":2}`), nil
+	})
+	cfg := config.Config{
+		ControlPlane: config.ControlPlaneConfig{URL: "https://cp", PeerStatsPath: "/stats"},
+		Provision:    config.ProvisionConfig{Token: "tok"},
+	}
+	a, err := New(cfg, &http.Client{Transport: tr})
+	require.NoError(t, err)
+	a.WithWireGuard(mgr, nil)
+	a.nodeID = "node-1"
+
+	require.NoError(t, a.reportPeerStats(context.Background()))
+	require.Len(t, reports, 1)
+	require.Equal(t, "node-1", reports[0].NodeID)
+	require.Equal(t, "boot:7", reports[0].Epoch)
+	require.Len(t, reports[0].Peers, 2)
+	require.Equal(t, uint64(10), reports[0].Peers[0].RxBytes)
+	require.Equal(t, uint64(20), reports[0].Peers[0].TxBytes)
+	require.True(t, handshake.Equal(*reports[0].Peers[0].LastHandshake))
+	require.Nil(t, reports[0].Peers[1].LastHandshake)
+}
+
+func TestReportPeerStatsBatches(t *testing.T) {
+	peers := make([]wg.PeerStats, nodeproto.MaxPeerStatsBatch+1)
+	for i := range peers {
+		peers[i].PublicKey = "pk"
+	}
+	mgr := &wgManagerStub{stats: wg.DeviceStats{Peers: peers}}
+
+	requests := 0
+	tr := roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		requests++
+		return protoResponse(http.StatusOK, `{}`), nil
+	})
+	cfg := config.Config{ControlPlane: config.ControlPlaneConfig{URL: "https://cp", PeerStatsPath: "/stats"}}
+	a, err := New(cfg, &http.Client{Transport: tr})
+	require.NoError(t, err)
+	a.WithWireGuard(mgr, nil)
+	a.nodeID = "node-1"
+
+	require.NoError(t, a.reportPeerStats(context.Background()))
+	require.Equal(t, 2, requests)
+}
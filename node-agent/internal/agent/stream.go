@@ -0,0 +1,174 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/websocket"
+
+	"github.com/emrecetinkayadev/vpn-tridot/nodeproto"
+)
+
+const (
+	// streamPingInterval is assumed until the control plane announces its own.
+	streamPingInterval = 30 * time.Second
+	// streamMissedPings is how many ping intervals the stream may stay silent
+	// before it is considered dead.
+	streamMissedPings = 3
+)
+
+// runStream keeps the control stream connected until ctx is done. Changes
+// pushed over it are picked up right away, and the control plane may relax
+// the peer sync interval meanwhile. Whenever the stream drops the agent
+// syncs peers at its configured interval again until it reconnects.
+func (a *Agent) runStream(ctx context.Context) {
+	backoff := a.retryBase
+	if backoff <= 0 {
+		backoff = time.Second
+	}
+	for {
+		received, err := a.stream(ctx)
+		if a.pollOverride.Swap(0) != 0 {
+			a.Wake()
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("agent: control stream closed: %v", err)
+		if received {
+			backoff = a.retryBase
+			if backoff <= 0 {
+				backoff = time.Second
+			}
+		}
+		if err := sleepDelay(ctx, nextBackoff(backoff)); err != nil {
+			return
+		}
+		backoff *= 2
+		if backoff > a.maxRetry {
+			backoff = a.maxRetry
+		}
+	}
+}
+
+// stream connects once and handles messages until the connection fails. It
+// reports whether any message was received.
+func (a *Agent) stream(ctx context.Context) (bool, error) {
+	a.mu.RLock()
+	nodeID := a.nodeID
+	a.mu.RUnlock()
+	if nodeID == "" {
+		return false, errors.New("node not registered")
+	}
+
+	cfg, err := a.streamConfig(nodeID)
+	if err != nil {
+		return false, err
+	}
+	dialCtx, cancel := context.WithTimeout(ctx, a.cfg.ControlPlane.Timeout)
+	ws, err := cfg.DialContext(dialCtx)
+	cancel()
+	if err != nil {
+		return false, err
+	}
+	defer ws.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			ws.Close()
+		case <-done:
+		}
+	}()
+
+	received := false
+	silence := streamMissedPings * streamPingInterval
+	for {
+		_ = ws.SetReadDeadline(time.Now().Add(silence))
+		var msg nodeproto.StreamMessage
+		if err := websocket.JSON.Receive(ws, &msg); err != nil {
+			return received, err
+		}
+		received = true
+		if msg.Type == nodeproto.StreamConfig && msg.Config != nil && msg.Config.PingInterval > 0 {
+			silence = streamMissedPings * time.Duration(msg.Config.PingInterval) * time.Second
+		}
+		a.handleStreamMessage(msg)
+	}
+}
+
+// handleStreamMessage acts on a pushed message. Peers are still applied by
+// the agent loop, which is only woken up here.
+func (a *Agent) handleStreamMessage(msg nodeproto.StreamMessage) {
+	switch msg.Type {
+	case nodeproto.StreamPeers:
+		a.mu.RLock()
+		current := a.peerRevision
+		a.mu.RUnlock()
+		if msg.Revision != current {
+			a.Wake()
+		}
+	case nodeproto.StreamDrain:
+		if msg.Drain == nil || a.state == nil {
+			return
+		}
+		if enabled, err := a.state.DrainEnabled(); err == nil && enabled == *msg.Drain {
+			return
+		}
+		if err := a.SetDrain(*msg.Drain); err != nil {
+			log.Printf("agent: drain from control plane failed: %v", err)
+			return
+		}
+		log.Printf("agent: drain set to %t by control plane", *msg.Drain)
+	case nodeproto.StreamConfig:
+		if msg.Config == nil {
+			return
+		}
+		a.pollOverride.Store(int64(time.Duration(msg.Config.PollInterval) * time.Second))
+	}
+}
+
+// streamConfig builds the WebSocket handshake for the node's stream, using
+// the same TLS settings and headers as the HTTP client.
+func (a *Agent) streamConfig(nodeID string) (*websocket.Config, error) {
+	raw, err := JoinURL(a.cfg.ControlPlane.URL, a.cfg.ControlPlane.StreamPath)
+	if err != nil {
+		return nil, err
+	}
+	location, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	origin := *location
+	origin.Path, origin.RawQuery = "", ""
+	switch location.Scheme {
+	case "https":
+		location.Scheme = "wss"
+	case "http":
+		location.Scheme = "ws"
+	default:
+		return nil, fmt.Errorf("unsupported control plane scheme %q", location.Scheme)
+	}
+	query := location.Query()
+	query.Set("node_id", nodeID)
+	location.RawQuery = query.Encode()
+
+	cfg, err := websocket.NewConfig(location.String(), origin.String())
+	if err != nil {
+		return nil, err
+	}
+	addAuthHeaders(cfg.Header, a.cfg.Provision.Token)
+	cfg.Dialer = &net.Dialer{Timeout: a.cfg.ControlPlane.Timeout}
+	if transport, ok := a.client.Transport.(*http.Transport); ok && transport.TLSClientConfig != nil {
+		cfg.TlsConfig = transport.TLSClientConfig.Clone()
+	}
+	return cfg, nil
+}
@@ -0,0 +1,88 @@
+package agent
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/websocket"
+
+	"github.com/emrecetinkayadev/vpn-tridot/node-agent/internal/config"
+	"github.com/emrecetinkayadev/vpn-tridot/nodeproto"
+)
+
+func TestStreamAppliesPushedMessages(t *testing.T) {
+	drain := true
+	pushed := []nodeproto.StreamMessage{
+		{Type: nodeproto.StreamConfig, Config: &nodeproto.AgentSettings{PingInterval: 1, PollInterval: 120}},
+		{Type: nodeproto.StreamPing},
+		{Type: nodeproto.StreamPeers, Revision: 5},
+		{Type: nodeproto.StreamDrain, Drain: &drain},
+	}
+	var query, token string
+	srv := httptest.NewServer(websocket.Server{Handler: func(ws *websocket.Conn) {
+		query = ws.Request().URL.RawQuery
+		token = ws.Request().Header.Get(nodeproto.HeaderProvisionToken)
+		for _, msg := range pushed {
+			require.NoError(t, websocket.JSON.Send(ws, msg))
+		}
+	}})
+	defer srv.Close()
+
+	cfg := config.Config{
+		ControlPlane: config.ControlPlaneConfig{URL: srv.URL, StreamPath: "/stream", Timeout: time.Second},
+		Provision:    config.ProvisionConfig{Token: "secret"},
+		Agent:        config.AgentConfig{PollInterval: 30 * time.Second},
+	}
+	a, err := New(cfg, &http.Client{})
+	require.NoError(t, err)
+	state := &stateStub{}
+	a.WithState(state)
+	a.nodeID = "node-1"
+	a.peerRevision = 3
+
+	received, err := a.stream(context.Background())
+	require.True(t, received)
+	require.Error(t, err, "stream ends when the server hangs up")
+	require.Equal(t, "node_id=node-1", query)
+	require.Equal(t, "secret", token)
+
+	require.Equal(t, 2*time.Minute, a.peerSyncInterval())
+	require.True(t, state.drain)
+	select {
+	case <-a.wake:
+	default:
+		t.Fatal("newer revision must wake the agent loop")
+	}
+}
+
+func TestStreamIgnoresCurrentRevision(t *testing.T) {
+	a, err := New(config.Config{Agent: config.AgentConfig{PollInterval: 30 * time.Second}}, &http.Client{})
+	require.NoError(t, err)
+	a.peerRevision = 5
+
+	a.handleStreamMessage(nodeproto.StreamMessage{Type: nodeproto.StreamPeers, Revision: 5})
+	select {
+	case <-a.wake:
+		t.Fatal("current revision must not wake the agent loop")
+	default:
+	}
+
+	a.handleStreamMessage(nodeproto.StreamMessage{Type: nodeproto.StreamConfig, Config: &nodeproto.AgentSettings{}})
+	require.Equal(t, 30*time.Second, a.peerSyncInterval(), "zero poll interval keeps the configured one")
+}
+
+func TestStreamConfigUsesSecureScheme(t *testing.T) {
+	cfg := config.Config{ControlPlane: config.ControlPlaneConfig{URL: "https://cp.example.com", StreamPath: nodeproto.PathStream}}
+	a, err := New(cfg, &http.Client{Transport: &http.Transport{}})
+	require.NoError(t, err)
+
+	ws, err := a.streamConfig("node-1")
+	require.NoError(t, err)
+	require.Equal(t, "wss://cp.example.com/api/v1/nodes/stream?node_id=node-1", ws.Location.String())
+	require.Equal(t, "https://cp.example.com", ws.Origin.String())
+	require.Equal(t, "1", ws.Header.Get(nodeproto.HeaderVersion))
+}
@@ -1,8 +1,10 @@
 package config
 
 import (
+	"encoding/base64"
 	"errors"
 	"fmt"
+	"net/netip"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -10,6 +12,8 @@ import (
 	"time"
 
 	"gopkg.in/yaml.v3"
+
+	"github.com/emrecetinkayadev/vpn-tridot/nodeproto"
 )
 
 // Config represents runtime configuration for the node agent.
@@ -19,14 +23,30 @@ type Config struct {
 	MTLS         MTLSConfig         `yaml:"mtls"`
 	Agent        AgentConfig        `yaml:"agent"`
 	WireGuard    WireGuardConfig    `yaml:"wireguard"`
+	Node         NodeConfig         `yaml:"node"`
 }
 
 type ControlPlaneConfig struct {
-	URL string `yaml:"url"
- json:"url"`
-	RegisterPath string        `yaml:"registerPath" json:"register_path"`
-	HealthPath   string        `yaml:"healthPath" json:"health_path"`
-	Timeout      time.Duration `yaml:"timeout" json:"timeout"`
+	URL           string        `yaml:"url" json:"url"`
+	RegisterPath  string        `yaml:"registerPath" json:"register_path"`
+	HealthPath    string        `yaml:"healthPath" json:"health_path"`
+	PeersPath     string        `yaml:"peersPath" json:"peers_path"`
+	PeerStatsPath string        `yaml:"peerStatsPath" json:"peer_stats_path"`
+	StreamPath    string        `yaml:"streamPath" json:"stream_path"`
+	Timeout       time.Duration `yaml:"timeout" json:"timeout"`
+}
+
+// NodeConfig describes how the node announces itself to the control plane.
+// Public addresses and endpoint are detected at runtime when left empty.
+type NodeConfig struct {
+	RegionCode string `yaml:"regionCode" json:"region_code"`
+	Hostname   string `yaml:"hostname" json:"hostname"`
+	Endpoint   string `yaml:"endpoint" json:"endpoint"`
+	PublicIPv4 string `yaml:"publicIPv4" json:"public_ipv4"`
+	PublicIPv6 string `yaml:"publicIPv6" json:"public_ipv6"`
+	// UplinkInterface is the NIC carrying client traffic to the internet.
+	// Detected from the default route when empty.
+	UplinkInterface string `yaml:"uplinkInterface" json:"uplink_interface"`
 }
 
 type ProvisionConfig struct {
@@ -47,8 +67,26 @@ type AgentConfig struct {
 	MetricsAddress   string        `yaml:"metricsAddr" json:"metrics_addr"`
 	StateDirectory   string        `yaml:"stateDir" json:"state_dir"`
 	MaxRetryInterval time.Duration `yaml:"maxRetryInterval" json:"max_retry_interval"`
+	// StateKey is the base64 AES-256 key the state store is encrypted with.
+	// Without it the key is read from StateKeyFile, which is created on
+	// first start and defaults to state.key in the state directory.
+	StateKey     string `yaml:"stateKey" json:"state_key"`
+	StateKeyFile string `yaml:"stateKeyFile" json:"state_key_file"`
+	// StateMemoryOnly keeps node identity and peers in memory only; nothing
+	// is written to the state directory.
+	StateMemoryOnly bool `yaml:"stateMemoryOnly" json:"state_memory_only"`
+	// AdminSocket is the Unix socket of the local admin API used by the
+	// node-agent subcommands.
+	AdminSocket string `yaml:"adminSocket" json:"admin_socket"`
+	// DisableStream turns off the control stream; changes are then only
+	// picked up by polling.
+	DisableStream bool `yaml:"disableStream" json:"disable_stream"`
 }
 
+// DefaultAdminSocket is where the agent serves its admin API unless
+// configured otherwise.
+const DefaultAdminSocket = "/run/vpn-agent/admin.sock"
+
 type WireGuardConfig struct {
 	InterfaceName       string   `yaml:"interfaceName" json:"interface_name"`
 	ListenPort          int      `yaml:"listenPort" json:"listen_port"`
@@ -57,8 +95,21 @@ type WireGuardConfig struct {
 	MTU                 int      `yaml:"mtu" json:"mtu"`
 	PersistentKeepalive int      `yaml:"persistentKeepalive" json:"persistent_keepalive"`
 	ConfigDirectory     string   `yaml:"configDir" json:"config_dir"`
+	PrivateKeyFile      string   `yaml:"privateKeyFile" json:"private_key_file"`
+	Routes              []string `yaml:"routes" json:"routes"`
+	TeardownOnExit      bool     `yaml:"teardownOnExit" json:"teardown_on_exit"`
 	EnableNAT           bool     `yaml:"enableNAT" json:"enable_nat"`
 	EnableKillSwitch    bool     `yaml:"enableKillSwitch" json:"enable_kill_switch"`
+	// AllowClientToClient turns off client isolation, letting any peer on
+	// the node reach any other. By default only peers in the same mesh
+	// group, as sent by the control plane, can reach each other.
+	AllowClientToClient bool `yaml:"allowClientToClient" json:"allow_client_to_client"`
+	// FirewallBackend is "iptables", "nftables" or "auto" (default).
+	FirewallBackend string `yaml:"firewallBackend" json:"firewall_backend"`
+	// AddressCIDR6 is the interface's IPv6 tunnel address inside the node's
+	// ULA /64. Derived from the interface key when IPv6 is enabled and empty.
+	AddressCIDR6 string `yaml:"address6" json:"address6"`
+	EnableIPv6   bool   `yaml:"enableIPv6" json:"enable_ipv6"`
 }
 
 // Load reads configuration from YAML file (optional) and environment variables.
@@ -68,9 +119,13 @@ func Load() (Config, error) {
 	cfg.Agent.MetricsAddress = ":9102"
 	cfg.Agent.StateDirectory = "/var/lib/vpn-agent"
 	cfg.Agent.MaxRetryInterval = 2 * time.Minute
+	cfg.Agent.AdminSocket = DefaultAdminSocket
 	cfg.ControlPlane.Timeout = 10 * time.Second
-	cfg.ControlPlane.RegisterPath = "/api/v1/nodes/register"
-	cfg.ControlPlane.HealthPath = "/api/v1/nodes/health"
+	cfg.ControlPlane.RegisterPath = nodeproto.PathRegister
+	cfg.ControlPlane.HealthPath = nodeproto.PathHealth
+	cfg.ControlPlane.PeersPath = nodeproto.PathPeers
+	cfg.ControlPlane.PeerStatsPath = nodeproto.PathPeerStats
+	cfg.ControlPlane.StreamPath = nodeproto.PathStream
 	cfg.WireGuard.InterfaceName = "wg0"
 	cfg.WireGuard.ListenPort = 51820
 	cfg.WireGuard.ConfigDirectory = "/etc/wireguard"
@@ -86,6 +141,12 @@ func Load() (Config, error) {
 
 	overlayEnv(&cfg)
 
+	if cfg.Node.Hostname == "" {
+		if hostname, err := os.Hostname(); err == nil {
+			cfg.Node.Hostname = hostname
+		}
+	}
+
 	if err := validate(cfg); err != nil {
 		return Config{}, err
 	}
@@ -115,9 +176,18 @@ func fromYAML(path string) (Config, error) {
 	if cfg.WireGuard.ConfigDirectory != "" && !filepath.IsAbs(cfg.WireGuard.ConfigDirectory) {
 		cfg.WireGuard.ConfigDirectory = filepath.Join(dir, cfg.WireGuard.ConfigDirectory)
 	}
+	if cfg.WireGuard.PrivateKeyFile != "" && !filepath.IsAbs(cfg.WireGuard.PrivateKeyFile) {
+		cfg.WireGuard.PrivateKeyFile = filepath.Join(dir, cfg.WireGuard.PrivateKeyFile)
+	}
 	if cfg.Agent.StateDirectory != "" && !filepath.IsAbs(cfg.Agent.StateDirectory) {
 		cfg.Agent.StateDirectory = filepath.Join(dir, cfg.Agent.StateDirectory)
 	}
+	if cfg.Agent.StateKeyFile != "" && !filepath.IsAbs(cfg.Agent.StateKeyFile) {
+		cfg.Agent.StateKeyFile = filepath.Join(dir, cfg.Agent.StateKeyFile)
+	}
+	if cfg.Agent.AdminSocket != "" && !filepath.IsAbs(cfg.Agent.AdminSocket) {
+		cfg.Agent.AdminSocket = filepath.Join(dir, cfg.Agent.AdminSocket)
+	}
 	return cfg, nil
 }
 
@@ -131,6 +201,15 @@ func overlayEnv(cfg *Config) {
 	if v := os.Getenv("CONTROL_PLANE_HEALTH_PATH"); v != "" {
 		cfg.ControlPlane.HealthPath = v
 	}
+	if v := os.Getenv("CONTROL_PLANE_PEERS_PATH"); v != "" {
+		cfg.ControlPlane.PeersPath = v
+	}
+	if v := os.Getenv("CONTROL_PLANE_PEER_STATS_PATH"); v != "" {
+		cfg.ControlPlane.PeerStatsPath = v
+	}
+	if v := os.Getenv("CONTROL_PLANE_STREAM_PATH"); v != "" {
+		cfg.ControlPlane.StreamPath = v
+	}
 	if v := os.Getenv("CONTROL_PLANE_TIMEOUT"); v != "" {
 		if dur, err := time.ParseDuration(v); err == nil {
 			cfg.ControlPlane.Timeout = dur
@@ -171,6 +250,25 @@ func overlayEnv(cfg *Config) {
 	if v := os.Getenv("AGENT_STATE_DIR"); v != "" {
 		cfg.Agent.StateDirectory = v
 	}
+	if v := os.Getenv("AGENT_STATE_KEY"); v != "" {
+		cfg.Agent.StateKey = v
+	}
+	if v := os.Getenv("AGENT_STATE_KEY_FILE"); v != "" {
+		cfg.Agent.StateKeyFile = v
+	}
+	if v := os.Getenv("AGENT_STATE_MEMORY_ONLY"); v != "" {
+		if b, err := strconv.ParseBool(v); err == nil {
+			cfg.Agent.StateMemoryOnly = b
+		}
+	}
+	if v := os.Getenv("AGENT_ADMIN_SOCKET"); v != "" {
+		cfg.Agent.AdminSocket = v
+	}
+	if v := os.Getenv("AGENT_DISABLE_STREAM"); v != "" {
+		if b, err := strconv.ParseBool(v); err == nil {
+			cfg.Agent.DisableStream = b
+		}
+	}
 	if v := os.Getenv("AGENT_MAX_RETRY_INTERVAL"); v != "" {
 		if dur, err := time.ParseDuration(v); err == nil {
 			cfg.Agent.MaxRetryInterval = dur
@@ -188,6 +286,14 @@ func overlayEnv(cfg *Config) {
 	if v := os.Getenv("WG_ADDRESS"); v != "" {
 		cfg.WireGuard.AddressCIDR = v
 	}
+	if v := os.Getenv("WG_ADDRESS6"); v != "" {
+		cfg.WireGuard.AddressCIDR6 = v
+	}
+	if v := os.Getenv("WG_ENABLE_IPV6"); v != "" {
+		if b, err := strconv.ParseBool(v); err == nil {
+			cfg.WireGuard.EnableIPv6 = b
+		}
+	}
 	if v := os.Getenv("WG_DNS"); v != "" {
 		cfg.WireGuard.DNS = strings.Split(v, ",")
 	}
@@ -204,6 +310,17 @@ func overlayEnv(cfg *Config) {
 	if v := os.Getenv("WG_CONFIG_DIR"); v != "" {
 		cfg.WireGuard.ConfigDirectory = v
 	}
+	if v := os.Getenv("WG_PRIVATE_KEY_FILE"); v != "" {
+		cfg.WireGuard.PrivateKeyFile = v
+	}
+	if v := os.Getenv("WG_ROUTES"); v != "" {
+		cfg.WireGuard.Routes = strings.Split(v, ",")
+	}
+	if v := os.Getenv("WG_TEARDOWN_ON_EXIT"); v != "" {
+		if b, err := strconv.ParseBool(v); err == nil {
+			cfg.WireGuard.TeardownOnExit = b
+		}
+	}
 	if v := os.Getenv("WG_ENABLE_NAT"); v != "" {
 		if b, err := strconv.ParseBool(v); err == nil {
 			cfg.WireGuard.EnableNAT = b
@@ -214,6 +331,33 @@ func overlayEnv(cfg *Config) {
 			cfg.WireGuard.EnableKillSwitch = b
 		}
 	}
+	if v := os.Getenv("WG_ALLOW_CLIENT_TO_CLIENT"); v != "" {
+		if b, err := strconv.ParseBool(v); err == nil {
+			cfg.WireGuard.AllowClientToClient = b
+		}
+	}
+	if v := os.Getenv("WG_FIREWALL_BACKEND"); v != "" {
+		cfg.WireGuard.FirewallBackend = v
+	}
+
+	if v := os.Getenv("NODE_REGION_CODE"); v != "" {
+		cfg.Node.RegionCode = v
+	}
+	if v := os.Getenv("NODE_HOSTNAME"); v != "" {
+		cfg.Node.Hostname = v
+	}
+	if v := os.Getenv("NODE_ENDPOINT"); v != "" {
+		cfg.Node.Endpoint = v
+	}
+	if v := os.Getenv("NODE_PUBLIC_IPV4"); v != "" {
+		cfg.Node.PublicIPv4 = v
+	}
+	if v := os.Getenv("NODE_PUBLIC_IPV6"); v != "" {
+		cfg.Node.PublicIPv6 = v
+	}
+	if v := os.Getenv("NODE_UPLINK_INTERFACE"); v != "" {
+		cfg.Node.UplinkInterface = v
+	}
 }
 
 func validate(cfg Config) error {
@@ -238,9 +382,14 @@ func validate(cfg Config) error {
 	if cfg.Agent.MetricsAddress == "" {
 		return errors.New("agent metrics address required")
 	}
-	if cfg.Agent.StateDirectory == "" {
+	if cfg.Agent.StateDirectory == "" && !cfg.Agent.StateMemoryOnly {
 		return errors.New("agent state directory required")
 	}
+	if cfg.Agent.StateKey != "" {
+		if key, err := base64.StdEncoding.DecodeString(cfg.Agent.StateKey); err != nil || len(key) != 32 {
+			return errors.New("agent state key must be 32 bytes, base64 encoded")
+		}
+	}
 	if cfg.Agent.MaxRetryInterval <= 0 {
 		return errors.New("agent max retry interval must be greater than zero")
 	}
@@ -250,6 +399,23 @@ func validate(cfg Config) error {
 	if cfg.WireGuard.ListenPort <= 0 || cfg.WireGuard.ListenPort > 65535 {
 		return errors.New("wireguard listen port invalid")
 	}
+	if cfg.WireGuard.AddressCIDR6 != "" {
+		prefix, err := netip.ParsePrefix(cfg.WireGuard.AddressCIDR6)
+		if err != nil || !prefix.Addr().Is6() || prefix.Bits() > 64 {
+			return errors.New("wireguard address6 must be an IPv6 address in a /64 or shorter prefix")
+		}
+	}
+	switch cfg.WireGuard.FirewallBackend {
+	case "", "auto", "iptables", "nftables":
+	default:
+		return fmt.Errorf("unknown firewall backend %q", cfg.WireGuard.FirewallBackend)
+	}
+	if cfg.Node.RegionCode == "" {
+		return errors.New("node region code required")
+	}
+	if cfg.Node.Hostname == "" {
+		return errors.New("node hostname required")
+	}
 	return nil
 }
 
@@ -264,6 +430,15 @@ func merge(base, override Config) Config {
 	if override.ControlPlane.HealthPath != "" {
 		cfg.ControlPlane.HealthPath = override.ControlPlane.HealthPath
 	}
+	if override.ControlPlane.PeersPath != "" {
+		cfg.ControlPlane.PeersPath = override.ControlPlane.PeersPath
+	}
+	if override.ControlPlane.PeerStatsPath != "" {
+		cfg.ControlPlane.PeerStatsPath = override.ControlPlane.PeerStatsPath
+	}
+	if override.ControlPlane.StreamPath != "" {
+		cfg.ControlPlane.StreamPath = override.ControlPlane.StreamPath
+	}
 	if override.ControlPlane.Timeout != 0 {
 		cfg.ControlPlane.Timeout = override.ControlPlane.Timeout
 	}
@@ -297,6 +472,21 @@ func merge(base, override Config) Config {
 	if override.Agent.StateDirectory != "" {
 		cfg.Agent.StateDirectory = override.Agent.StateDirectory
 	}
+	if override.Agent.StateKey != "" {
+		cfg.Agent.StateKey = override.Agent.StateKey
+	}
+	if override.Agent.StateKeyFile != "" {
+		cfg.Agent.StateKeyFile = override.Agent.StateKeyFile
+	}
+	if override.Agent.StateMemoryOnly {
+		cfg.Agent.StateMemoryOnly = true
+	}
+	if override.Agent.AdminSocket != "" {
+		cfg.Agent.AdminSocket = override.Agent.AdminSocket
+	}
+	if override.Agent.DisableStream {
+		cfg.Agent.DisableStream = true
+	}
 	if override.Agent.MaxRetryInterval != 0 {
 		cfg.Agent.MaxRetryInterval = override.Agent.MaxRetryInterval
 	}
@@ -309,6 +499,12 @@ func merge(base, override Config) Config {
 	if override.WireGuard.AddressCIDR != "" {
 		cfg.WireGuard.AddressCIDR = override.WireGuard.AddressCIDR
 	}
+	if override.WireGuard.AddressCIDR6 != "" {
+		cfg.WireGuard.AddressCIDR6 = override.WireGuard.AddressCIDR6
+	}
+	if override.WireGuard.EnableIPv6 {
+		cfg.WireGuard.EnableIPv6 = true
+	}
 	if len(override.WireGuard.DNS) > 0 {
 		cfg.WireGuard.DNS = override.WireGuard.DNS
 	}
@@ -321,11 +517,44 @@ func merge(base, override Config) Config {
 	if override.WireGuard.ConfigDirectory != "" {
 		cfg.WireGuard.ConfigDirectory = override.WireGuard.ConfigDirectory
 	}
+	if override.WireGuard.PrivateKeyFile != "" {
+		cfg.WireGuard.PrivateKeyFile = override.WireGuard.PrivateKeyFile
+	}
+	if len(override.WireGuard.Routes) > 0 {
+		cfg.WireGuard.Routes = override.WireGuard.Routes
+	}
+	if override.WireGuard.TeardownOnExit {
+		cfg.WireGuard.TeardownOnExit = true
+	}
 	if override.WireGuard.EnableNAT {
 		cfg.WireGuard.EnableNAT = true
 	}
 	if override.WireGuard.EnableKillSwitch {
 		cfg.WireGuard.EnableKillSwitch = true
 	}
+	if override.WireGuard.AllowClientToClient {
+		cfg.WireGuard.AllowClientToClient = true
+	}
+	if override.WireGuard.FirewallBackend != "" {
+		cfg.WireGuard.FirewallBackend = override.WireGuard.FirewallBackend
+	}
+	if override.Node.RegionCode != "" {
+		cfg.Node.RegionCode = override.Node.RegionCode
+	}
+	if override.Node.Hostname != "" {
+		cfg.Node.Hostname = override.Node.Hostname
+	}
+	if override.Node.Endpoint != "" {
+		cfg.Node.Endpoint = override.Node.Endpoint
+	}
+	if override.Node.PublicIPv4 != "" {
+		cfg.Node.PublicIPv4 = override.Node.PublicIPv4
+	}
+	if override.Node.PublicIPv6 != "" {
+		cfg.Node.PublicIPv6 = override.Node.PublicIPv6
+	}
+	if override.Node.UplinkInterface != "" {
+		cfg.Node.UplinkInterface = override.Node.UplinkInterface
+	}
 	return cfg
 }
@@ -8,6 +8,7 @@ import (
 	"github.com/stretchr/testify/require"
 
 	"github.com/emrecetinkayadev/vpn-tridot/node-agent/internal/config"
+	"github.com/emrecetinkayadev/vpn-tridot/nodeproto"
 )
 
 func TestLoadFromEnv(t *testing.T) {
@@ -29,10 +30,29 @@ func TestLoadFromEnv(t *testing.T) {
 	t.Setenv("AGENT_METRICS_ADDR", "127.0.0.1:9200")
 	t.Setenv("AGENT_STATE_DIR", "/tmp/vpn-agent-state")
 	t.Setenv("AGENT_MAX_RETRY_INTERVAL", "45s")
+	t.Setenv("AGENT_ADMIN_SOCKET", "/tmp/vpn-agent.sock")
+	t.Setenv("AGENT_DISABLE_STREAM", "true")
+	t.Setenv("WG_ROUTES", "10.99.0.0/16")
+	t.Setenv("WG_TEARDOWN_ON_EXIT", "true")
+	t.Setenv("NODE_REGION_CODE", "TR-IST")
+	t.Setenv("NODE_HOSTNAME", "ist-1")
+	t.Setenv("NODE_ENDPOINT", "vpn.example.com:51821")
+	t.Setenv("CONTROL_PLANE_PEER_STATS_PATH", "/stats")
+	t.Setenv("NODE_UPLINK_INTERFACE", "eth1")
+	t.Setenv("WG_FIREWALL_BACKEND", "nftables")
+	t.Setenv("WG_ENABLE_IPV6", "true")
+	t.Setenv("WG_ADDRESS6", "fd00:1::1/64")
 
 	cfg, err := config.Load()
 	require.NoError(t, err)
 	require.Equal(t, "https://api.example.com", cfg.ControlPlane.URL)
+	require.Equal(t, "/stats", cfg.ControlPlane.PeerStatsPath)
+	require.Equal(t, nodeproto.PathStream, cfg.ControlPlane.StreamPath)
+	require.True(t, cfg.Agent.DisableStream)
+	require.Equal(t, "eth1", cfg.Node.UplinkInterface)
+	require.Equal(t, "nftables", cfg.WireGuard.FirewallBackend)
+	require.True(t, cfg.WireGuard.EnableIPv6)
+	require.Equal(t, "fd00:1::1/64", cfg.WireGuard.AddressCIDR6)
 	require.Equal(t, "token-123", cfg.Provision.Token)
 	require.Equal(t, "ca-pem", cfg.MTLS.CACert)
 	require.Equal(t, "cert-pem", cfg.MTLS.Cert)
@@ -50,6 +70,12 @@ func TestLoadFromEnv(t *testing.T) {
 	require.Equal(t, "127.0.0.1:9200", cfg.Agent.MetricsAddress)
 	require.Equal(t, "/tmp/vpn-agent-state", cfg.Agent.StateDirectory)
 	require.Equal(t, "45s", cfg.Agent.MaxRetryInterval.String())
+	require.Equal(t, "/tmp/vpn-agent.sock", cfg.Agent.AdminSocket)
+	require.Equal(t, "TR-IST", cfg.Node.RegionCode)
+	require.Equal(t, "ist-1", cfg.Node.Hostname)
+	require.Equal(t, "vpn.example.com:51821", cfg.Node.Endpoint)
+	require.Equal(t, []string{"10.99.0.0/16"}, cfg.WireGuard.Routes)
+	require.True(t, cfg.WireGuard.TeardownOnExit)
 }
 
 func TestLoadFromFile(t *testing.T) {
@@ -78,6 +104,10 @@ wireguard:
   mtu: 1280
   persistentKeepalive: 33
   configDir: wgconf
+  privateKeyFile: wg1.key
+node:
+  regionCode: DE-FRA
+  publicIPv4: 198.51.100.7
 `)
 	dir := t.TempDir()
 	configPath := filepath.Join(dir, "agent.yaml")
@@ -110,9 +140,47 @@ wireguard:
 	require.Equal(t, filepath.Join(dir, "wgconf"), cfg.WireGuard.ConfigDirectory)
 	require.False(t, cfg.WireGuard.EnableNAT)
 	require.False(t, cfg.WireGuard.EnableKillSwitch)
+	require.Equal(t, filepath.Join(dir, "wg1.key"), cfg.WireGuard.PrivateKeyFile)
+	require.Equal(t, "DE-FRA", cfg.Node.RegionCode)
+	require.Equal(t, "198.51.100.7", cfg.Node.PublicIPv4)
+	require.NotEmpty(t, cfg.Node.Hostname)
 }
 
 func TestValidateMissingValues(t *testing.T) {
 	_, err := config.Load()
 	require.Error(t, err)
 }
+
+func TestValidateRejectsUnknownFirewallBackend(t *testing.T) {
+	t.Setenv("CONTROL_PLANE_URL", "https://api.example.com")
+	t.Setenv("NODE_PROVISION_TOKEN", "token-123")
+	t.Setenv("MTLS_CA_PEM", "ca-pem")
+	t.Setenv("MTLS_CLIENT_CERT", "cert-pem")
+	t.Setenv("MTLS_CLIENT_KEY", "key-pem")
+	t.Setenv("NODE_REGION_CODE", "TR-IST")
+	t.Setenv("WG_FIREWALL_BACKEND", "pf")
+
+	_, err := config.Load()
+	require.ErrorContains(t, err, "firewall backend")
+}
+
+func TestStateOptions(t *testing.T) {
+	t.Setenv("CONTROL_PLANE_URL", "https://api.example.com")
+	t.Setenv("NODE_PROVISION_TOKEN", "token-123")
+	t.Setenv("MTLS_CA_PEM", "ca-pem")
+	t.Setenv("MTLS_CLIENT_CERT", "cert-pem")
+	t.Setenv("MTLS_CLIENT_KEY", "key-pem")
+	t.Setenv("NODE_REGION_CODE", "TR-IST")
+	t.Setenv("AGENT_STATE_DIR", "")
+	t.Setenv("AGENT_STATE_MEMORY_ONLY", "true")
+	t.Setenv("AGENT_STATE_KEY_FILE", "/run/credentials/vpn-agent/state-key")
+
+	cfg, err := config.Load()
+	require.NoError(t, err)
+	require.True(t, cfg.Agent.StateMemoryOnly)
+	require.Equal(t, "/run/credentials/vpn-agent/state-key", cfg.Agent.StateKeyFile)
+
+	t.Setenv("AGENT_STATE_KEY", "c2hvcnQ=")
+	_, err = config.Load()
+	require.ErrorContains(t, err, "state key")
+}
@@ -0,0 +1,151 @@
+// Package doctor checks that the host is able to run the node agent.
+package doctor
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emrecetinkayadev/vpn-tridot/node-agent/internal/config"
+	"github.com/emrecetinkayadev/vpn-tridot/node-agent/internal/transport"
+)
+
+// Result is the outcome of a single check.
+type Result string
+
+const (
+	OK   Result = "ok"
+	Warn Result = "warn"
+	Fail Result = "fail"
+)
+
+// Check is one diagnosed aspect of the host.
+type Check struct {
+	Name   string `json:"name"`
+	Result Result `json:"result"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// certExpiryWarning is how long before expiry the client certificate is
+// reported as a warning.
+const certExpiryWarning = 14 * 24 * time.Hour
+
+// Run checks the WireGuard kernel module, IP forwarding, the tunnel port
+// binding and the mTLS client certificate.
+func Run(cfg config.Config) []Check {
+	return run(cfg, "/", time.Now())
+}
+
+// run resolves /proc and /sys below root so tests can provide their own.
+func run(cfg config.Config, root string, now time.Time) []Check {
+	checks := []Check{
+		kernelModule(root),
+		forwarding(root, "ip_forward", "proc/sys/net/ipv4/ip_forward"),
+	}
+	if cfg.WireGuard.EnableIPv6 {
+		checks = append(checks, forwarding(root, "ipv6_forwarding", "proc/sys/net/ipv6/conf/all/forwarding"))
+	}
+	return append(checks,
+		portBinding(root, cfg.WireGuard.ListenPort),
+		clientCertificate(cfg.MTLS, now),
+	)
+}
+
+func kernelModule(root string) Check {
+	check := Check{Name: "wireguard_module", Result: OK}
+	if _, err := os.Stat(filepath.Join(root, "sys/module/wireguard")); err != nil {
+		check.Result = Fail
+		check.Detail = "wireguard kernel module not loaded (modprobe wireguard)"
+	}
+	return check
+}
+
+func forwarding(root, name, path string) Check {
+	check := Check{Name: name, Result: OK}
+	content, err := os.ReadFile(filepath.Join(root, path))
+	switch {
+	case err != nil:
+		check.Result = Fail
+		check.Detail = err.Error()
+	case strings.TrimSpace(string(content)) != "1":
+		check.Result = Fail
+		check.Detail = fmt.Sprintf("disabled; set /%s to 1", path)
+	}
+	return check
+}
+
+// portBinding looks for the WireGuard listen port among the bound UDP
+// sockets. Kernel WireGuard sockets have no owning process, so the socket
+// tables are read instead of probing the port.
+func portBinding(root string, port int) Check {
+	check := Check{Name: "udp_port", Result: OK, Detail: strconv.Itoa(port)}
+	for _, table := range []string{"proc/net/udp", "proc/net/udp6"} {
+		bound, err := udpPortBound(filepath.Join(root, table), port)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			check.Result = Fail
+			check.Detail = err.Error()
+			return check
+		}
+		if bound {
+			return check
+		}
+	}
+	check.Result = Fail
+	check.Detail = fmt.Sprintf("udp port %d is not bound; is the wireguard interface up?", port)
+	return check
+}
+
+func udpPortBound(path string, port int) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	want := fmt.Sprintf(":%04X", port)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) > 1 && strings.HasSuffix(fields[1], want) {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
+
+func clientCertificate(cfg config.MTLSConfig, now time.Time) Check {
+	check := Check{Name: "mtls_certificate", Result: OK}
+	cert, err := transport.ClientCertificate(cfg)
+	switch {
+	case err != nil:
+		check.Result = Fail
+		check.Detail = err.Error()
+	case now.Before(cert.NotBefore):
+		check.Result = Fail
+		check.Detail = "not valid before " + cert.NotBefore.UTC().Format(time.RFC3339)
+	case now.After(cert.NotAfter):
+		check.Result = Fail
+		check.Detail = "expired " + cert.NotAfter.UTC().Format(time.RFC3339)
+	case cert.NotAfter.Sub(now) < certExpiryWarning:
+		check.Result = Warn
+		check.Detail = "expires " + cert.NotAfter.UTC().Format(time.RFC3339)
+	default:
+		check.Detail = "valid until " + cert.NotAfter.UTC().Format(time.RFC3339)
+	}
+	return check
+}
+
+// Healthy reports whether no check failed.
+func Healthy(checks []Check) bool {
+	for _, check := range checks {
+		if check.Result == Fail {
+			return false
+		}
+	}
+	return true
+}
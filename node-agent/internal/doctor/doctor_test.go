@@ -0,0 +1,100 @@
+package doctor
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/emrecetinkayadev/vpn-tridot/node-agent/internal/config"
+)
+
+func writeFile(t *testing.T, root, path, content string) {
+	t.Helper()
+	full := filepath.Join(root, path)
+	require.NoError(t, os.MkdirAll(filepath.Dir(full), 0o755))
+	require.NoError(t, os.WriteFile(full, []byte(content), 0o644))
+}
+
+func clientCert(t *testing.T, notAfter time.Time) config.MTLSConfig {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "node"},
+		NotBefore:    notAfter.Add(-90 * 24 * time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	return config.MTLSConfig{
+		Cert: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		Key:  string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})),
+	}
+}
+
+func results(checks []Check) map[string]Result {
+	out := make(map[string]Result, len(checks))
+	for _, check := range checks {
+		out[check.Name] = check.Result
+	}
+	return out
+}
+
+func TestRunHealthyHost(t *testing.T) {
+	root := t.TempDir()
+	now := time.Now()
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "sys/module/wireguard"), 0o755))
+	writeFile(t, root, "proc/sys/net/ipv4/ip_forward", "1\n")
+	writeFile(t, root, "proc/net/udp", "  sl  local_address rem_address   st\n   0: 00000000:CA6C 00000000:0000 07\n")
+
+	cfg := config.Config{
+		MTLS:      clientCert(t, now.Add(90*24*time.Hour)),
+		WireGuard: config.WireGuardConfig{ListenPort: 51820},
+	}
+	checks := run(cfg, root, now)
+	require.True(t, Healthy(checks))
+	require.Equal(t, map[string]Result{
+		"wireguard_module": OK,
+		"ip_forward":       OK,
+		"udp_port":         OK,
+		"mtls_certificate": OK,
+	}, results(checks))
+}
+
+func TestRunReportsProblems(t *testing.T) {
+	root := t.TempDir()
+	now := time.Now()
+	writeFile(t, root, "proc/sys/net/ipv4/ip_forward", "0\n")
+	writeFile(t, root, "proc/net/udp6", "  sl  local_address rem_address   st\n   0: 00000000000000000000000000000000:CA6D 00000000000000000000000000000000:0000 07\n")
+
+	cfg := config.Config{
+		MTLS:      clientCert(t, now.Add(3*24*time.Hour)),
+		WireGuard: config.WireGuardConfig{ListenPort: 51820, EnableIPv6: true},
+	}
+	checks := run(cfg, root, now)
+	require.False(t, Healthy(checks))
+	require.Equal(t, map[string]Result{
+		"wireguard_module": Fail,
+		"ip_forward":       Fail,
+		"ipv6_forwarding":  Fail,
+		"udp_port":         Fail,
+		"mtls_certificate": Warn,
+	}, results(checks))
+
+	expired := clientCertificate(clientCert(t, now.Add(-time.Hour)), now)
+	require.Equal(t, Fail, expired.Result)
+	require.Contains(t, expired.Detail, "expired")
+}
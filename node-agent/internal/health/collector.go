@@ -0,0 +1,252 @@
+// Package health samples host resource usage from procfs and sysfs so the
+// control plane can score nodes by their actual load.
+package health
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Snapshot is a single host sample. Percentages and rates are computed against
+// the previous sample and are zero on the first one.
+type Snapshot struct {
+	CPUPercent     float64
+	SoftirqPercent float64
+
+	MemoryTotalBytes     uint64
+	MemoryAvailableBytes uint64
+	MemoryPercent        float64
+
+	Interface  string
+	RxBytes    uint64
+	TxBytes    uint64
+	RxPackets  uint64
+	TxPackets  uint64
+	RxDropped  uint64
+	TxDropped  uint64
+	RxBps      float64
+	TxBps      float64
+	PacketLoss float64
+}
+
+// Collector reads CPU, memory and uplink NIC counters.
+type Collector struct {
+	procRoot string
+	sysRoot  string
+	iface    string
+	now      func() time.Time
+
+	mu      sync.Mutex
+	prevCPU *cpuTimes
+	prevNIC *nicCounters
+	// prevNICAt is when prevNIC was read; failed reads leave both alone.
+	prevNICAt time.Time
+}
+
+type cpuTimes struct {
+	total   uint64
+	idle    uint64
+	softirq uint64
+}
+
+type nicCounters struct {
+	rxBytes, txBytes     uint64
+	rxPackets, txPackets uint64
+	rxDropped, txDropped uint64
+}
+
+// NewCollector creates a collector for the given uplink interface. An empty
+// interface skips NIC sampling.
+func NewCollector(iface string) *Collector {
+	return &Collector{procRoot: "/proc", sysRoot: "/sys", iface: iface, now: time.Now}
+}
+
+// WithRoots points the collector at alternative procfs and sysfs mounts.
+func (c *Collector) WithRoots(procRoot, sysRoot string) *Collector {
+	c.procRoot = procRoot
+	c.sysRoot = sysRoot
+	return c
+}
+
+// Collect takes a sample. Sources that cannot be read are reported in the
+// returned error while the remaining fields are still filled in.
+func (c *Collector) Collect() (Snapshot, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	snap := Snapshot{Interface: c.iface}
+	var errs []error
+
+	if cpu, err := c.readCPU(); err != nil {
+		errs = append(errs, err)
+	} else {
+		if c.prevCPU != nil && cpu.total > c.prevCPU.total {
+			total := float64(cpu.total - c.prevCPU.total)
+			busy := total - float64(sub(cpu.idle, c.prevCPU.idle))
+			snap.CPUPercent = clampPercent(busy / total * 100)
+			snap.SoftirqPercent = clampPercent(float64(sub(cpu.softirq, c.prevCPU.softirq)) / total * 100)
+		}
+		c.prevCPU = &cpu
+	}
+
+	if total, available, err := c.readMemory(); err != nil {
+		errs = append(errs, err)
+	} else {
+		snap.MemoryTotalBytes = total
+		snap.MemoryAvailableBytes = available
+		if total > 0 {
+			snap.MemoryPercent = clampPercent(float64(sub(total, available)) / float64(total) * 100)
+		}
+	}
+
+	if c.iface != "" {
+		if nic, err := c.readNIC(); err != nil {
+			errs = append(errs, err)
+		} else {
+			snap.RxBytes, snap.TxBytes = nic.rxBytes, nic.txBytes
+			snap.RxPackets, snap.TxPackets = nic.rxPackets, nic.txPackets
+			snap.RxDropped, snap.TxDropped = nic.rxDropped, nic.txDropped
+			if prev := c.prevNIC; prev != nil {
+				if elapsed := now.Sub(c.prevNICAt).Seconds(); elapsed > 0 {
+					snap.RxBps = float64(sub(nic.rxBytes, prev.rxBytes)) * 8 / elapsed
+					snap.TxBps = float64(sub(nic.txBytes, prev.txBytes)) * 8 / elapsed
+				}
+				dropped := sub(nic.rxDropped, prev.rxDropped) + sub(nic.txDropped, prev.txDropped)
+				packets := sub(nic.rxPackets, prev.rxPackets) + sub(nic.txPackets, prev.txPackets)
+				if dropped+packets > 0 {
+					snap.PacketLoss = float64(dropped) / float64(dropped+packets)
+				}
+			}
+			c.prevNIC = &nic
+			c.prevNICAt = now
+		}
+	}
+
+	return snap, errors.Join(errs...)
+}
+
+// readCPU parses the aggregate "cpu" line of /proc/stat. Guest time is already
+// included in user time and is therefore not summed.
+func (c *Collector) readCPU() (cpuTimes, error) {
+	f, err := os.Open(filepath.Join(c.procRoot, "stat"))
+	if err != nil {
+		return cpuTimes{}, fmt.Errorf("read cpu stats: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 8 || fields[0] != "cpu" {
+			continue
+		}
+		// user nice system idle iowait irq softirq [steal]
+		var values [8]uint64
+		for i := 1; i < len(fields) && i <= len(values); i++ {
+			v, err := strconv.ParseUint(fields[i], 10, 64)
+			if err != nil {
+				return cpuTimes{}, fmt.Errorf("parse cpu stats: %w", err)
+			}
+			values[i-1] = v
+		}
+		var times cpuTimes
+		for _, v := range values {
+			times.total += v
+		}
+		times.idle = values[3] + values[4]
+		times.softirq = values[6]
+		return times, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return cpuTimes{}, fmt.Errorf("read cpu stats: %w", err)
+	}
+	return cpuTimes{}, errors.New("read cpu stats: aggregate cpu line not found")
+}
+
+func (c *Collector) readMemory() (total, available uint64, err error) {
+	f, err := os.Open(filepath.Join(c.procRoot, "meminfo"))
+	if err != nil {
+		return 0, 0, fmt.Errorf("read meminfo: %w", err)
+	}
+	defer f.Close()
+
+	var haveTotal, haveAvailable bool
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		var dst *uint64
+		switch fields[0] {
+		case "MemTotal:":
+			dst, haveTotal = &total, true
+		case "MemAvailable:":
+			dst, haveAvailable = &available, true
+		default:
+			continue
+		}
+		kb, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return 0, 0, fmt.Errorf("parse meminfo: %w", err)
+		}
+		*dst = kb * 1024
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, 0, fmt.Errorf("read meminfo: %w", err)
+	}
+	if !haveTotal || !haveAvailable {
+		return 0, 0, errors.New("read meminfo: MemTotal or MemAvailable missing")
+	}
+	return total, available, nil
+}
+
+func (c *Collector) readNIC() (nicCounters, error) {
+	dir := filepath.Join(c.sysRoot, "class", "net", c.iface, "statistics")
+	var nic nicCounters
+	for name, dst := range map[string]*uint64{
+		"rx_bytes":   &nic.rxBytes,
+		"tx_bytes":   &nic.txBytes,
+		"rx_packets": &nic.rxPackets,
+		"tx_packets": &nic.txPackets,
+		"rx_dropped": &nic.rxDropped,
+		"tx_dropped": &nic.txDropped,
+	} {
+		raw, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return nicCounters{}, fmt.Errorf("read %s %s: %w", c.iface, name, err)
+		}
+		v, err := strconv.ParseUint(strings.TrimSpace(string(raw)), 10, 64)
+		if err != nil {
+			return nicCounters{}, fmt.Errorf("parse %s %s: %w", c.iface, name, err)
+		}
+		*dst = v
+	}
+	return nic, nil
+}
+
+// sub returns cur-prev, treating a smaller current value as a counter reset.
+func sub(cur, prev uint64) uint64 {
+	if cur < prev {
+		return cur
+	}
+	return cur - prev
+}
+
+func clampPercent(v float64) float64 {
+	if v < 0 {
+		return 0
+	}
+	if v > 100 {
+		return 100
+	}
+	return v
+}
@@ -0,0 +1,113 @@
+package health
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type fakeHost struct {
+	proc, sys string
+}
+
+func newFakeHost(t *testing.T) fakeHost {
+	t.Helper()
+	root := t.TempDir()
+	h := fakeHost{proc: filepath.Join(root, "proc"), sys: filepath.Join(root, "sys")}
+	require.NoError(t, os.MkdirAll(h.proc, 0o755))
+	require.NoError(t, os.MkdirAll(filepath.Join(h.sys, "class", "net", "eth0", "statistics"), 0o755))
+	h.write(t, filepath.Join(h.proc, "meminfo"), "MemTotal:       4000 kB\nMemFree:         500 kB\nMemAvailable:   1000 kB\n")
+	return h
+}
+
+func (h fakeHost) write(t *testing.T, path, content string) {
+	t.Helper()
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+}
+
+func (h fakeHost) setCPU(t *testing.T, line string) {
+	h.write(t, filepath.Join(h.proc, "stat"), line+"\ncpu0 1 1 1 1 1 1 1 1 0 0\nintr 1\n")
+}
+
+func (h fakeHost) setNIC(t *testing.T, counters map[string]uint64) {
+	for name, v := range counters {
+		h.write(t, filepath.Join(h.sys, "class", "net", "eth0", "statistics", name), strconv.FormatUint(v, 10)+"\n")
+	}
+}
+
+func TestCollectorComputesDeltas(t *testing.T) {
+	host := newFakeHost(t)
+	host.setCPU(t, "cpu  100 0 100 700 100 0 0 0 0 0")
+	host.setNIC(t, map[string]uint64{
+		"rx_bytes": 1000, "tx_bytes": 2000, "rx_packets": 100, "tx_packets": 100, "rx_dropped": 0, "tx_dropped": 0,
+	})
+
+	c := NewCollector("eth0").WithRoots(host.proc, host.sys)
+	now := time.Unix(100, 0)
+	c.now = func() time.Time { return now }
+
+	first, err := c.Collect()
+	require.NoError(t, err)
+	require.Zero(t, first.CPUPercent)
+	require.Zero(t, first.RxBps)
+	require.Equal(t, uint64(4000*1024), first.MemoryTotalBytes)
+	require.InDelta(t, 75, first.MemoryPercent, 0.001)
+
+	// 1000 jiffies elapsed: 200 idle+iowait, 100 softirq.
+	host.setCPU(t, "cpu  600 0 300 850 150 0 100 0 0 0")
+	host.setNIC(t, map[string]uint64{
+		"rx_bytes": 11000, "tx_bytes": 7000, "rx_packets": 190, "tx_packets": 190, "rx_dropped": 15, "tx_dropped": 5,
+	})
+	now = now.Add(10 * time.Second)
+
+	second, err := c.Collect()
+	require.NoError(t, err)
+	require.InDelta(t, 80, second.CPUPercent, 0.001)
+	require.InDelta(t, 10, second.SoftirqPercent, 0.001)
+	require.InDelta(t, 8000, second.RxBps, 0.001)
+	require.InDelta(t, 4000, second.TxBps, 0.001)
+	require.InDelta(t, 0.1, second.PacketLoss, 0.001)
+	require.Equal(t, uint64(15), second.RxDropped)
+}
+
+func TestCollectorRateSpansFailedNICReads(t *testing.T) {
+	host := newFakeHost(t)
+	host.setCPU(t, "cpu  100 0 100 700 100 0 0 0 0 0")
+	host.setNIC(t, map[string]uint64{
+		"rx_bytes": 1000, "tx_bytes": 1000, "rx_packets": 10, "tx_packets": 10, "rx_dropped": 0, "tx_dropped": 0,
+	})
+
+	c := NewCollector("eth0").WithRoots(host.proc, host.sys)
+	now := time.Unix(100, 0)
+	c.now = func() time.Time { return now }
+	_, err := c.Collect()
+	require.NoError(t, err)
+
+	rxBytes := filepath.Join(host.sys, "class", "net", "eth0", "statistics", "rx_bytes")
+	require.NoError(t, os.Remove(rxBytes))
+	now = now.Add(10 * time.Second)
+	_, err = c.Collect()
+	require.Error(t, err)
+
+	host.setNIC(t, map[string]uint64{"rx_bytes": 21000, "tx_bytes": 21000})
+	now = now.Add(10 * time.Second)
+	snap, err := c.Collect()
+	require.NoError(t, err)
+	// 20000 bytes over the 20s since the last successful read.
+	require.InDelta(t, 8000, snap.RxBps, 0.001)
+	require.InDelta(t, 8000, snap.TxBps, 0.001)
+}
+
+func TestCollectorReportsMissingSourcesButKeepsOthers(t *testing.T) {
+	host := newFakeHost(t)
+	host.setCPU(t, "cpu  100 0 100 700 100 0 0 0 0 0")
+
+	snap, err := NewCollector("missing0").WithRoots(host.proc, host.sys).Collect()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "missing0")
+	require.NotZero(t, snap.MemoryTotalBytes)
+}
@@ -8,6 +8,7 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 
+	"github.com/emrecetinkayadev/vpn-tridot/node-agent/internal/health"
 	"github.com/emrecetinkayadev/vpn-tridot/node-agent/internal/wg"
 )
 
@@ -28,6 +29,15 @@ type Exporter struct {
 	txBpsGauge  prometheus.Gauge
 	handshake   prometheus.Gauge
 
+	cpuGauge        prometheus.Gauge
+	softirqGauge    prometheus.Gauge
+	memoryGauge     prometheus.Gauge
+	memAvailGauge   prometheus.Gauge
+	nicRxBpsGauge   prometheus.Gauge
+	nicTxBpsGauge   prometheus.Gauge
+	packetLossGauge prometheus.Gauge
+	host            health.Snapshot
+
 	lastRx     uint64
 	lastTx     uint64
 	lastSample time.Time
@@ -48,7 +58,26 @@ func New() *Exporter {
 		handshake:   prometheus.NewGauge(prometheus.GaugeOpts{Name: "node_agent_wireguard_last_handshake", Help: "Timestamp of the latest peer handshake"}),
 	}
 
+	exp.cpuGauge = prometheus.NewGauge(prometheus.GaugeOpts{Name: "node_agent_host_cpu_percent", Help: "Host CPU utilisation"})
+	exp.softirqGauge = prometheus.NewGauge(prometheus.GaugeOpts{Name: "node_agent_host_softirq_percent", Help: "Share of CPU time spent in softirq"})
+	exp.memoryGauge = prometheus.NewGauge(prometheus.GaugeOpts{Name: "node_agent_host_memory_used_percent", Help: "Host memory in use"})
+	exp.memAvailGauge = prometheus.NewGauge(prometheus.GaugeOpts{Name: "node_agent_host_memory_available_bytes", Help: "Host memory available for new allocations"})
+	exp.nicRxBpsGauge = prometheus.NewGauge(prometheus.GaugeOpts{Name: "node_agent_host_nic_rx_throughput_bps", Help: "Uplink receive throughput in bits per second"})
+	exp.nicTxBpsGauge = prometheus.NewGauge(prometheus.GaugeOpts{Name: "node_agent_host_nic_tx_throughput_bps", Help: "Uplink transmit throughput in bits per second"})
+	exp.packetLossGauge = prometheus.NewGauge(prometheus.GaugeOpts{Name: "node_agent_host_nic_packet_loss_ratio", Help: "Dropped / (dropped + delivered) uplink packets since the previous sample"})
+	nicRxDropped := prometheus.NewCounterFunc(prometheus.CounterOpts{Name: "node_agent_host_nic_rx_dropped_total", Help: "Packets dropped on uplink receive"}, func() float64 {
+		exp.mu.Lock()
+		defer exp.mu.Unlock()
+		return float64(exp.host.RxDropped)
+	})
+	nicTxDropped := prometheus.NewCounterFunc(prometheus.CounterOpts{Name: "node_agent_host_nic_tx_dropped_total", Help: "Packets dropped on uplink transmit"}, func() float64 {
+		exp.mu.Lock()
+		defer exp.mu.Unlock()
+		return float64(exp.host.TxDropped)
+	})
+
 	r.MustRegister(exp.peerGauge, exp.activeGauge, exp.ratioGauge, exp.rxCounter, exp.txCounter, exp.rxBpsGauge, exp.txBpsGauge, exp.handshake)
+	r.MustRegister(exp.cpuGauge, exp.softirqGauge, exp.memoryGauge, exp.memAvailGauge, exp.nicRxBpsGauge, exp.nicTxBpsGauge, exp.packetLossGauge, nicRxDropped, nicTxDropped)
 	exp.handler = promhttp.HandlerFor(r, promhttp.HandlerOpts{})
 	return exp
 }
@@ -78,6 +107,21 @@ func (e *Exporter) Update(stats wg.DeviceStats) {
 	e.lastSample = now
 }
 
+// UpdateHost records the latest host resource sample.
+func (e *Exporter) UpdateHost(snap health.Snapshot) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.host = snap
+	e.cpuGauge.Set(snap.CPUPercent)
+	e.softirqGauge.Set(snap.SoftirqPercent)
+	e.memoryGauge.Set(snap.MemoryPercent)
+	e.memAvailGauge.Set(float64(snap.MemoryAvailableBytes))
+	e.nicRxBpsGauge.Set(snap.RxBps)
+	e.nicTxBpsGauge.Set(snap.TxBps)
+	e.packetLossGauge.Set(snap.PacketLoss)
+}
+
 func (e *Exporter) updateByteSeries(now time.Time, current uint64, last *uint64, counter prometheus.Counter, throughput prometheus.Gauge) {
 	if *last == 0 {
 		counter.Add(float64(current))
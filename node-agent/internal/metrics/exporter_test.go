@@ -8,6 +8,7 @@ import (
 
 	"github.com/stretchr/testify/require"
 
+	"github.com/emrecetinkayadev/vpn-tridot/node-agent/internal/health"
 	"github.com/emrecetinkayadev/vpn-tridot/node-agent/internal/wg"
 )
 
@@ -37,3 +38,32 @@ func TestExporterUpdate(t *testing.T) {
 	require.Contains(t, body, "node_agent_wireguard_rx_throughput_bps 40")
 	require.Contains(t, body, "node_agent_wireguard_tx_throughput_bps 48")
 }
+
+func TestExporterUpdateHost(t *testing.T) {
+	exp := New()
+	exp.UpdateHost(health.Snapshot{
+		CPUPercent:           42,
+		SoftirqPercent:       7,
+		MemoryPercent:        60,
+		MemoryAvailableBytes: 2048,
+		RxBps:                1000,
+		TxBps:                2000,
+		RxDropped:            3,
+		TxDropped:            4,
+		PacketLoss:           0.25,
+	})
+
+	rec := httptest.NewRecorder()
+	exp.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	body := rec.Body.String()
+	require.Contains(t, body, "node_agent_host_cpu_percent 42")
+	require.Contains(t, body, "node_agent_host_softirq_percent 7")
+	require.Contains(t, body, "node_agent_host_memory_used_percent 60")
+	require.Contains(t, body, "node_agent_host_memory_available_bytes 2048")
+	require.Contains(t, body, "node_agent_host_nic_rx_throughput_bps 1000")
+	require.Contains(t, body, "node_agent_host_nic_tx_throughput_bps 2000")
+	require.Contains(t, body, "node_agent_host_nic_rx_dropped_total 3")
+	require.Contains(t, body, "node_agent_host_nic_tx_dropped_total 4")
+	require.Contains(t, body, "node_agent_host_nic_packet_loss_ratio 0.25")
+}
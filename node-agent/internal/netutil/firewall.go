@@ -0,0 +1,214 @@
+package netutil
+
+import (
+	"fmt"
+	"net/netip"
+	"os"
+	"os/exec"
+	"slices"
+	"sort"
+	"strings"
+)
+
+var runCommand = func(name string, args ...string) ([]byte, error) {
+	cmd := exec.Command(name, args...)
+	return cmd.CombinedOutput()
+}
+
+// WithCommandRunner overrides the command runner for testing.
+func WithCommandRunner(fn func(string, ...string) ([]byte, error)) (restore func()) {
+	prev := runCommand
+	runCommand = fn
+	return func() { runCommand = prev }
+}
+
+// Firewall backends accepted in FirewallConfig.Backend.
+const (
+	BackendAuto     = "auto"
+	BackendIPTables = "iptables"
+	BackendNFTables = "nftables"
+)
+
+// FirewallConfig describes the node's forwarding policy.
+type FirewallConfig struct {
+	// Backend selects iptables or nftables. Empty or "auto" detects it.
+	Backend string
+	// WireGuardInterface is the tunnel interface clients arrive on.
+	WireGuardInterface string
+	// UplinkInterface is the NIC client traffic leaves through and is
+	// masqueraded on.
+	UplinkInterface string
+	// SourceCIDR limits masquerading to the tunnel subnet. Empty masquerades
+	// everything forwarded out of the uplink.
+	SourceCIDR       string
+	EnableNAT        bool
+	EnableKillSwitch bool
+	// EnableIPv6 extends forwarding and NAT66 to IPv6, masquerading
+	// SourceCIDR6 (the tunnel's ULA prefix) out of the uplink.
+	EnableIPv6  bool
+	SourceCIDR6 string
+	// IsolateClients drops traffic between peers on the tunnel interface,
+	// except within one of MeshGroups.
+	IsolateClients bool
+	// MeshGroups lists the tunnel addresses of peers that may reach each
+	// other, one entry per group. Kept current through SetMeshGroups.
+	MeshGroups [][]string
+}
+
+// Firewall owns the agent's packet filter rules. Apply can be called any
+// number of times and always converges to the same rule set; Teardown removes
+// it again.
+type Firewall struct {
+	cfg         FirewallConfig
+	backend     firewallBackend
+	backendName string
+	applied     bool
+}
+
+type firewallBackend interface {
+	apply(cfg FirewallConfig) error
+	teardown() error
+}
+
+// NewFirewall creates a firewall manager for cfg.
+func NewFirewall(cfg FirewallConfig) *Firewall {
+	return &Firewall{cfg: cfg}
+}
+
+// Backend returns the backend in use, detecting it on first call.
+func (f *Firewall) Backend() (string, error) {
+	if f.backend == nil {
+		name := f.cfg.Backend
+		if name == "" || name == BackendAuto {
+			name = DetectFirewallBackend()
+		}
+		switch name {
+		case BackendIPTables:
+			f.backend = iptablesBackend{}
+		case BackendNFTables:
+			f.backend = nftablesBackend{}
+		default:
+			return "", fmt.Errorf("unknown firewall backend %q", name)
+		}
+		f.backendName = name
+	}
+	return f.backendName, nil
+}
+
+// Apply installs the policy atomically through the selected backend.
+func (f *Firewall) Apply() error {
+	if f.cfg.WireGuardInterface == "" {
+		return fmt.Errorf("wireguard interface required")
+	}
+	if f.cfg.EnableNAT && f.cfg.UplinkInterface == "" {
+		return fmt.Errorf("uplink interface required for nat")
+	}
+	if _, err := f.Backend(); err != nil {
+		return err
+	}
+	if err := f.backend.apply(f.cfg); err != nil {
+		return err
+	}
+	f.applied = true
+	return nil
+}
+
+// SetMeshGroups replaces the groups of peers exempt from client isolation
+// and re-applies the policy when it is installed and the groups changed.
+// Each group lists the AllowedIPs of its peers; groups with fewer than two
+// addresses are dropped. Without IsolateClients the groups are ignored.
+func (f *Firewall) SetMeshGroups(groups [][]string) error {
+	if !f.cfg.IsolateClients {
+		return nil
+	}
+	normalized := normalizeMeshGroups(groups)
+	if slices.EqualFunc(normalized, f.cfg.MeshGroups, slices.Equal[[]string]) {
+		return nil
+	}
+	prev := f.cfg.MeshGroups
+	f.cfg.MeshGroups = normalized
+	if !f.applied {
+		return nil
+	}
+	if err := f.Apply(); err != nil {
+		f.cfg.MeshGroups = prev
+		return err
+	}
+	return nil
+}
+
+// Teardown removes everything the manager installed. Missing rules are ignored.
+func (f *Firewall) Teardown() error {
+	if _, err := f.Backend(); err != nil {
+		return err
+	}
+	f.applied = false
+	return f.backend.teardown()
+}
+
+// normalizeMeshGroups sorts groups and their members so equal sets compare
+// equal and render identical rules.
+func normalizeMeshGroups(groups [][]string) [][]string {
+	var out [][]string
+	for _, group := range groups {
+		if len(group) < 2 {
+			continue
+		}
+		sorted := slices.Clone(group)
+		sort.Strings(sorted)
+		out = append(out, slices.Compact(sorted))
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i][0] < out[j][0] })
+	return out
+}
+
+// meshFamily returns the group's prefixes of one address family, or nil when
+// fewer than two remain.
+func meshFamily(group []string, v6 bool) []string {
+	var out []string
+	for _, cidr := range group {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil || prefix.Addr().Is6() != v6 {
+			continue
+		}
+		out = append(out, prefix.Masked().String())
+	}
+	if len(out) < 2 {
+		return nil
+	}
+	return out
+}
+
+// DetectFirewallBackend prefers nftables unless iptables runs in legacy mode,
+// where nftables rules would be evaluated separately from existing ones.
+func DetectFirewallBackend() string {
+	if out, err := runCommand("iptables", "-V"); err == nil && strings.Contains(string(out), "legacy") {
+		return BackendIPTables
+	}
+	if _, err := runCommand("nft", "--version"); err == nil {
+		return BackendNFTables
+	}
+	return BackendIPTables
+}
+
+// loadRulesFile writes rules to a temporary file and hands it to a loader
+// command (iptables-restore, nft -f) so the whole set is applied in one go.
+func loadRulesFile(rules string, name string, args ...string) error {
+	f, err := os.CreateTemp("", "vpn-agent-*.rules")
+	if err != nil {
+		return fmt.Errorf("write ruleset: %w", err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString(rules); err != nil {
+		f.Close()
+		return fmt.Errorf("write ruleset: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("write ruleset: %w", err)
+	}
+	args = append(args, f.Name())
+	if out, err := runCommand(name, args...); err != nil {
+		return fmt.Errorf("%s: %w: %s", name, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -1,56 +1,162 @@
 package netutil
 
 import (
+	"errors"
 	"fmt"
-	"os/exec"
+	"strings"
 )
 
-var runCommand = func(name string, args ...string) ([]byte, error) {
-	cmd := exec.Command(name, args...)
-	return cmd.CombinedOutput()
-}
+// Chains owned by the iptables backend. Built-in chains only ever receive a
+// single jump into these, everything else lives inside them.
+const (
+	ChainForward = "VPN-FWD"
+	ChainNAT     = "VPN-NAT"
+	ChainInput   = "VPN-IN"
+	ChainOutput  = "VPN-OUT"
+)
 
-// WithCommandRunner overrides the command runner for testing.
-func WithCommandRunner(fn func(string, ...string) ([]byte, error)) (restore func()) {
-	prev := runCommand
-	runCommand = fn
-	return func() { runCommand = prev }
+type iptablesBackend struct{}
+
+type chainJump struct {
+	table, from, to string
+}
 
+// ipFamily pairs the iptables binaries for one address family.
+type ipFamily struct {
+	bin, restore string
+	v6           bool
 }
 
-// ApplyNATRules configures basic NAT masquerade and forwarding rules for an interface.
-func ApplyNATRules(iface string) error {
-	if iface == "" {
-		return fmt.Errorf("iface required")
+var (
+	familyIPv4 = ipFamily{bin: "iptables", restore: "iptables-restore"}
+	familyIPv6 = ipFamily{bin: "ip6tables", restore: "ip6tables-restore", v6: true}
+)
+
+// apply loads the chain contents atomically with iptables-restore and makes
+// sure each built-in chain jumps to them exactly once. ip6tables gets the same
+// policy when IPv6 is enabled.
+func (iptablesBackend) apply(cfg FirewallConfig) error {
+	families := []ipFamily{familyIPv4}
+	if cfg.EnableIPv6 {
+		families = append(families, familyIPv6)
 	}
-	commands := [][]string{
-		{"iptables", "-t", "nat", "-A", "POSTROUTING", "-o", iface, "-j", "MASQUERADE"},
-		{"iptables", "-A", "FORWARD", "-i", iface, "-j", "ACCEPT"},
-		{"iptables", "-A", "FORWARD", "-o", iface, "-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "-j", "ACCEPT"},
+	for _, family := range families {
+		if err := loadRulesFile(iptablesRuleset(cfg, family), family.restore, "--noflush"); err != nil {
+			return err
+		}
+		for _, jump := range iptablesJumps(cfg) {
+			if jumpExists(family, jump) {
+				continue
+			}
+			if _, err := runCommand(family.bin, "-t", jump.table, "-I", jump.from, "1", "-j", jump.to); err != nil {
+				return fmt.Errorf("insert %s jump %s -> %s: %w", family.bin, jump.from, jump.to, err)
+			}
+		}
 	}
-	return runCommands(commands)
+	return nil
 }
 
-// EnableKillSwitch drops new outbound connections not using the WireGuard interface.
-func EnableKillSwitch(iface string) error {
-	if iface == "" {
-		return fmt.Errorf("iface required")
-	}
-	commands := [][]string{
-		{"iptables", "-A", "OUTPUT", "!", "-o", iface, "-m", "conntrack", "--ctstate", "NEW", "-j", "DROP"},
-		{"iptables", "-A", "INPUT", "!", "-i", iface, "-m", "conntrack", "--ctstate", "NEW", "-j", "DROP"},
+// teardown removes the jumps into the agent's chains, then flushes and
+// deletes the chains, for both families. Chains that do not exist are ignored.
+func (iptablesBackend) teardown() error {
+	var errs []error
+	for _, family := range []ipFamily{familyIPv4, familyIPv6} {
+		for _, jump := range allJumps() {
+			for jumpExists(family, jump) {
+				if _, err := runCommand(family.bin, "-t", jump.table, "-D", jump.from, "-j", jump.to); err != nil {
+					errs = append(errs, fmt.Errorf("delete %s jump %s -> %s: %w", family.bin, jump.from, jump.to, err))
+					break
+				}
+			}
+		}
+		for _, jump := range allJumps() {
+			if _, err := runCommand(family.bin, "-t", jump.table, "-n", "-L", jump.to); err != nil {
+				continue
+			}
+			if _, err := runCommand(family.bin, "-t", jump.table, "-F", jump.to); err != nil {
+				errs = append(errs, fmt.Errorf("flush %s chain %s: %w", family.bin, jump.to, err))
+				continue
+			}
+			if _, err := runCommand(family.bin, "-t", jump.table, "-X", jump.to); err != nil {
+				errs = append(errs, fmt.Errorf("delete %s chain %s: %w", family.bin, jump.to, err))
+			}
+		}
 	}
-	return runCommands(commands)
+	return errors.Join(errs...)
 }
 
-func runCommands(cmds [][]string) error {
-	for _, cmd := range cmds {
-		if len(cmd) == 0 {
-			continue
+// iptablesRuleset renders the iptables-restore input. Declaring a user chain under
+// --noflush resets its contents, so re-applying replaces rather than appends.
+func iptablesRuleset(cfg FirewallConfig, family ipFamily) string {
+	wgIface, uplink := cfg.WireGuardInterface, cfg.UplinkInterface
+	source := cfg.SourceCIDR
+	if family.v6 {
+		source = cfg.SourceCIDR6
+	}
+
+	var b strings.Builder
+	b.WriteString("*filter\n")
+	fmt.Fprintf(&b, ":%s - [0:0]\n", ChainForward)
+	if cfg.EnableKillSwitch {
+		fmt.Fprintf(&b, ":%s - [0:0]\n", ChainInput)
+		fmt.Fprintf(&b, ":%s - [0:0]\n", ChainOutput)
+	}
+	if cfg.IsolateClients {
+		for _, group := range cfg.MeshGroups {
+			if members := meshFamily(group, family.v6); members != nil {
+				list := strings.Join(members, ",")
+				fmt.Fprintf(&b, "-A %s -i %s -o %s -s %s -d %s -j ACCEPT\n", ChainForward, wgIface, wgIface, list, list)
+			}
 		}
-		if _, err := runCommand(cmd[0], cmd[1:]...); err != nil {
-			return fmt.Errorf("command %v failed: %w", cmd, err)
+		fmt.Fprintf(&b, "-A %s -i %s -o %s -j DROP\n", ChainForward, wgIface, wgIface)
+	}
+	if uplink != "" {
+		fmt.Fprintf(&b, "-A %s -i %s -o %s -j ACCEPT\n", ChainForward, wgIface, uplink)
+		fmt.Fprintf(&b, "-A %s -i %s -o %s -m conntrack --ctstate RELATED,ESTABLISHED -j ACCEPT\n", ChainForward, uplink, wgIface)
+	} else {
+		fmt.Fprintf(&b, "-A %s -i %s -j ACCEPT\n", ChainForward, wgIface)
+		fmt.Fprintf(&b, "-A %s -o %s -m conntrack --ctstate RELATED,ESTABLISHED -j ACCEPT\n", ChainForward, wgIface)
+	}
+	if cfg.EnableKillSwitch {
+		fmt.Fprintf(&b, "-A %s ! -i %s -m conntrack --ctstate NEW -j DROP\n", ChainInput, wgIface)
+		fmt.Fprintf(&b, "-A %s ! -o %s -m conntrack --ctstate NEW -j DROP\n", ChainOutput, wgIface)
+	}
+	b.WriteString("COMMIT\n")
+
+	if cfg.EnableNAT {
+		b.WriteString("*nat\n")
+		fmt.Fprintf(&b, ":%s - [0:0]\n", ChainNAT)
+		if source != "" {
+			fmt.Fprintf(&b, "-A %s -s %s -o %s -j MASQUERADE\n", ChainNAT, source, uplink)
+		} else {
+			fmt.Fprintf(&b, "-A %s -o %s -j MASQUERADE\n", ChainNAT, uplink)
 		}
+		b.WriteString("COMMIT\n")
 	}
-	return nil
+	return b.String()
+}
+
+func iptablesJumps(cfg FirewallConfig) []chainJump {
+	jumps := []chainJump{{table: "filter", from: "FORWARD", to: ChainForward}}
+	if cfg.EnableKillSwitch {
+		jumps = append(jumps,
+			chainJump{table: "filter", from: "INPUT", to: ChainInput},
+			chainJump{table: "filter", from: "OUTPUT", to: ChainOutput},
+		)
+	}
+	if cfg.EnableNAT {
+		jumps = append(jumps, chainJump{table: "nat", from: "POSTROUTING", to: ChainNAT})
+	}
+	return jumps
+}
+
+// allJumps lists every jump the manager may have created, so Teardown also
+// cleans up features that were enabled by a previous run.
+func allJumps() []chainJump {
+	return iptablesJumps(FirewallConfig{EnableNAT: true, EnableKillSwitch: true})
+}
+
+func jumpExists(family ipFamily, jump chainJump) bool {
+	_, err := runCommand(family.bin, "-t", jump.table, "-C", jump.from, "-j", jump.to)
+	return err == nil
 }
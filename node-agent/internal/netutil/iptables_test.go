@@ -2,42 +2,190 @@ package netutil
 
 import (
 	"errors"
+	"os"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/require"
 )
 
-func TestApplyNATRules(t *testing.T) {
-	var commands [][]string
-	orig := runCommand
-	runCommand = func(name string, args ...string) ([]byte, error) {
-		cmd := append([]string{name}, args...)
-		commands = append(commands, cmd)
+// fakeIPTables tracks jumps and chains so idempotency can be asserted.
+type fakeIPTables struct {
+	jumps    map[string]int
+	chains   map[string]bool
+	rulesets []string
+	commands [][]string
+}
+
+func installFakeIPTables(t *testing.T) *fakeIPTables {
+	t.Helper()
+	fake := &fakeIPTables{jumps: map[string]int{}, chains: map[string]bool{}}
+	t.Cleanup(WithCommandRunner(fake.run))
+	return fake
+}
+
+func (f *fakeIPTables) run(name string, args ...string) ([]byte, error) {
+	f.commands = append(f.commands, append([]string{name}, args...))
+	// ip6tables keeps its own tables; prefix its state so families don't mix.
+	family := ""
+	if strings.HasPrefix(name, "ip6tables") {
+		family = "v6:"
+	}
+	if name == "iptables-restore" || name == "ip6tables-restore" {
+		raw, err := os.ReadFile(args[len(args)-1])
+		if err != nil {
+			return nil, err
+		}
+		f.rulesets = append(f.rulesets, string(raw))
+		for _, line := range strings.Split(string(raw), "\n") {
+			if strings.HasPrefix(line, ":") {
+				f.chains[family+strings.Fields(line)[0][1:]] = true
+			}
+		}
 		return nil, nil
 	}
-	t.Cleanup(func() { runCommand = orig })
 
-	require.NoError(t, ApplyNATRules("wg0"))
-	require.Len(t, commands, 3)
+	// iptables -t <table> <op> <chain> ...
+	op, chain := args[2], family+args[3]
+	switch op {
+	case "-C":
+		if f.jumps[chain+">"+args[5]] == 0 {
+			return nil, errors.New("rule does not exist")
+		}
+	case "-I":
+		f.jumps[chain+">"+args[6]]++
+	case "-D":
+		f.jumps[chain+">"+args[5]]--
+	case "-L":
+		if !f.chains[family+args[4]] {
+			return nil, errors.New("no chain")
+		}
+	case "-X":
+		delete(f.chains, chain)
+	}
+	return nil, nil
 }
 
-func TestEnableKillSwitch(t *testing.T) {
-	var commands [][]string
-	orig := runCommand
-	runCommand = func(name string, args ...string) ([]byte, error) {
-		commands = append(commands, append([]string{name}, args...))
-		return nil, nil
+func testFirewallConfig() FirewallConfig {
+	return FirewallConfig{
+		Backend:            BackendIPTables,
+		WireGuardInterface: "wg0",
+		UplinkInterface:    "eth0",
+		SourceCIDR:         "10.8.0.0/24",
+		EnableNAT:          true,
+		EnableKillSwitch:   true,
+	}
+}
+
+func TestFirewallApplyIsIdempotent(t *testing.T) {
+	fake := installFakeIPTables(t)
+	fw := NewFirewall(testFirewallConfig())
+
+	require.NoError(t, fw.Apply())
+	require.NoError(t, fw.Apply())
+
+	require.Equal(t, map[string]int{
+		"FORWARD>VPN-FWD":     1,
+		"INPUT>VPN-IN":        1,
+		"OUTPUT>VPN-OUT":      1,
+		"POSTROUTING>VPN-NAT": 1,
+	}, fake.jumps)
+	require.Len(t, fake.rulesets, 2)
+	require.Equal(t, fake.rulesets[0], fake.rulesets[1])
+	require.Contains(t, fake.rulesets[0], "-A VPN-NAT -s 10.8.0.0/24 -o eth0 -j MASQUERADE")
+	require.Contains(t, fake.rulesets[0], "-A VPN-FWD -i wg0 -o eth0 -j ACCEPT")
+	for _, cmd := range fake.commands {
+		require.NotContains(t, cmd, "-A", "built-in chains must not be appended to")
 	}
-	t.Cleanup(func() { runCommand = orig })
+}
+
+func TestFirewallNATRequiresUplink(t *testing.T) {
+	installFakeIPTables(t)
+	cfg := testFirewallConfig()
+	cfg.UplinkInterface = ""
+
+	require.Error(t, NewFirewall(cfg).Apply())
+}
+
+func TestFirewallTeardownRemovesChains(t *testing.T) {
+	fake := installFakeIPTables(t)
+	fw := NewFirewall(testFirewallConfig())
+	require.NoError(t, fw.Apply())
+	// A duplicate jump left behind by an older agent is removed as well.
+	fake.jumps["FORWARD>VPN-FWD"]++
+
+	require.NoError(t, fw.Teardown())
+	for jump, count := range fake.jumps {
+		require.Zero(t, count, jump)
+	}
+	require.Empty(t, fake.chains)
+}
+
+func TestFirewallApplyReportsRestoreFailure(t *testing.T) {
+	t.Cleanup(WithCommandRunner(func(name string, args ...string) ([]byte, error) {
+		return []byte("line 3 failed"), errors.New("exit status 1")
+	}))
+
+	err := NewFirewall(testFirewallConfig()).Apply()
+	require.ErrorContains(t, err, "line 3 failed")
+}
+
+func TestFirewallAppliesIPv6Rules(t *testing.T) {
+	fake := installFakeIPTables(t)
+	cfg := testFirewallConfig()
+	cfg.EnableIPv6 = true
+	cfg.SourceCIDR6 = "fd12:3456:789a::/64"
+
+	require.NoError(t, NewFirewall(cfg).Apply())
+	require.Len(t, fake.rulesets, 2)
+	require.Contains(t, fake.rulesets[1], "-A VPN-NAT -s fd12:3456:789a::/64 -o eth0 -j MASQUERADE")
+	var v6Jumps int
+	for _, cmd := range fake.commands {
+		if cmd[0] == "ip6tables" && cmd[3] == "-I" {
+			v6Jumps++
+		}
+	}
+	require.Equal(t, 4, v6Jumps)
+	require.Equal(t, 1, fake.jumps["v6:POSTROUTING>VPN-NAT"])
+}
+
+func TestFirewallIsolatesClientsExceptMeshGroups(t *testing.T) {
+	fake := installFakeIPTables(t)
+	cfg := testFirewallConfig()
+	cfg.IsolateClients = true
+	cfg.EnableIPv6 = true
+	cfg.SourceCIDR6 = "fd00::/64"
+	fw := NewFirewall(cfg)
+
+	// Groups set before Apply are only stored.
+	require.NoError(t, fw.SetMeshGroups([][]string{{"10.8.0.3/32", "fd00::3/128", "10.8.0.2/32", "fd00::2/128"}, {"10.8.0.9/32"}}))
+	require.Empty(t, fake.rulesets)
+	require.NoError(t, fw.Apply())
+	require.Len(t, fake.rulesets, 2)
+
+	v4, v6 := fake.rulesets[0], fake.rulesets[1]
+	mesh := "-A VPN-FWD -i wg0 -o wg0 -s 10.8.0.2/32,10.8.0.3/32 -d 10.8.0.2/32,10.8.0.3/32 -j ACCEPT\n"
+	drop := "-A VPN-FWD -i wg0 -o wg0 -j DROP\n"
+	require.Contains(t, v4, mesh+drop+"-A VPN-FWD -i wg0 -o eth0 -j ACCEPT")
+	require.NotContains(t, v4, "10.8.0.9")
+	require.Contains(t, v6, "-s fd00::2/128,fd00::3/128 -d fd00::2/128,fd00::3/128 -j ACCEPT")
+
+	// The same groups in another order do not reload the rules.
+	require.NoError(t, fw.SetMeshGroups([][]string{{"fd00::2/128", "10.8.0.2/32", "10.8.0.3/32", "fd00::3/128"}}))
+	require.Len(t, fake.rulesets, 2)
 
-	require.NoError(t, EnableKillSwitch("wg0"))
-	require.Len(t, commands, 2)
+	require.NoError(t, fw.SetMeshGroups(nil))
+	require.Len(t, fake.rulesets, 4)
+	require.NotContains(t, fake.rulesets[2], "-s 10.8.0.2/32")
+	require.Contains(t, fake.rulesets[2], drop)
 }
 
-func TestRunCommandsError(t *testing.T) {
-	orig := runCommand
-	runCommand = func(name string, args ...string) ([]byte, error) { return nil, errors.New("fail") }
-	t.Cleanup(func() { runCommand = orig })
+func TestFirewallWithoutIsolationAllowsClientTraffic(t *testing.T) {
+	fake := installFakeIPTables(t)
+	fw := NewFirewall(testFirewallConfig())
+	require.NoError(t, fw.Apply())
 
-	require.Error(t, ApplyNATRules("wg0"))
+	require.NoError(t, fw.SetMeshGroups([][]string{{"10.8.0.2/32", "10.8.0.3/32"}}))
+	require.Len(t, fake.rulesets, 1)
+	require.NotContains(t, fake.rulesets[0], "-o wg0 -j DROP")
 }
@@ -0,0 +1,106 @@
+package netutil
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// NFTable is the single inet table owned by the nftables backend.
+const NFTable = "vpn_agent"
+
+type nftablesBackend struct{}
+
+// apply replaces the agent's table in one nft transaction. The empty table
+// declaration makes the delete valid on a host that has no table yet.
+func (nftablesBackend) apply(cfg FirewallConfig) error {
+	return loadRulesFile(nftablesRuleset(cfg), "nft", "-f")
+}
+
+func (nftablesBackend) teardown() error {
+	if _, err := runCommand("nft", "list", "table", "inet", NFTable); err != nil {
+		return nil
+	}
+	if out, err := runCommand("nft", "delete", "table", "inet", NFTable); err != nil {
+		return fmt.Errorf("delete table %s: %w: %s", NFTable, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// nftablesRuleset renders the same policy as iptablesRuleset as one table
+// with its own base chains.
+func nftablesRuleset(cfg FirewallConfig) string {
+	wgIface, uplink := cfg.WireGuardInterface, cfg.UplinkInterface
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "table inet %s {}\n", NFTable)
+	fmt.Fprintf(&b, "delete table inet %s\n", NFTable)
+	fmt.Fprintf(&b, "table inet %s {\n", NFTable)
+
+	b.WriteString("\tchain forward {\n")
+	b.WriteString("\t\ttype filter hook forward priority filter; policy accept;\n")
+	if cfg.IsolateClients {
+		for _, group := range cfg.MeshGroups {
+			for _, family := range []struct {
+				match string
+				v6    bool
+			}{{"ip", false}, {"ip6", true}} {
+				if members := meshFamily(group, family.v6); members != nil {
+					set := "{ " + strings.Join(members, ", ") + " }"
+					fmt.Fprintf(&b, "\t\tiifname %q oifname %q %s saddr %s %s daddr %s accept\n", wgIface, wgIface, family.match, set, family.match, set)
+				}
+			}
+		}
+		fmt.Fprintf(&b, "\t\tiifname %q oifname %q drop\n", wgIface, wgIface)
+	}
+	if uplink != "" {
+		fmt.Fprintf(&b, "\t\tiifname %q oifname %q accept\n", wgIface, uplink)
+		fmt.Fprintf(&b, "\t\tiifname %q oifname %q ct state related,established accept\n", uplink, wgIface)
+	} else {
+		fmt.Fprintf(&b, "\t\tiifname %q accept\n", wgIface)
+		fmt.Fprintf(&b, "\t\toifname %q ct state related,established accept\n", wgIface)
+	}
+	b.WriteString("\t}\n")
+
+	if cfg.EnableKillSwitch {
+		b.WriteString("\tchain input {\n")
+		b.WriteString("\t\ttype filter hook input priority filter; policy accept;\n")
+		fmt.Fprintf(&b, "\t\tiifname != %q ct state new drop\n", wgIface)
+		b.WriteString("\t}\n")
+		b.WriteString("\tchain output {\n")
+		b.WriteString("\t\ttype filter hook output priority filter; policy accept;\n")
+		fmt.Fprintf(&b, "\t\toifname != %q ct state new drop\n", wgIface)
+		b.WriteString("\t}\n")
+	}
+
+	if cfg.EnableNAT {
+		b.WriteString("\tchain postrouting {\n")
+		b.WriteString("\t\ttype nat hook postrouting priority srcnat; policy accept;\n")
+		sources := []string{cfg.SourceCIDR}
+		if cfg.EnableIPv6 && cfg.SourceCIDR6 != "" {
+			sources = append(sources, cfg.SourceCIDR6)
+		}
+		for _, source := range sources {
+			if match := nftSourceMatch(source); match != "" {
+				fmt.Fprintf(&b, "\t\t%s oifname %q masquerade\n", match, uplink)
+			} else {
+				fmt.Fprintf(&b, "\t\toifname %q masquerade\n", uplink)
+			}
+		}
+		b.WriteString("\t}\n")
+	}
+
+	b.WriteString("}\n")
+	return b.String()
+}
+
+func nftSourceMatch(cidr string) string {
+	prefix, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		return ""
+	}
+	if prefix.Addr().Is6() {
+		return "ip6 saddr " + prefix.String()
+	}
+	return "ip saddr " + prefix.String()
+}
@@ -0,0 +1,125 @@
+package netutil
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNFTablesApplyIsSingleTransaction(t *testing.T) {
+	var (
+		commands [][]string
+		ruleset  string
+	)
+	t.Cleanup(WithCommandRunner(func(name string, args ...string) ([]byte, error) {
+		commands = append(commands, append([]string{name}, args...))
+		if name == "nft" && args[0] == "-f" {
+			raw, err := os.ReadFile(args[1])
+			require.NoError(t, err)
+			ruleset = string(raw)
+		}
+		return nil, nil
+	}))
+
+	cfg := testFirewallConfig()
+	cfg.Backend = BackendNFTables
+	require.NoError(t, NewFirewall(cfg).Apply())
+
+	require.Len(t, commands, 1)
+	require.Equal(t, "nft", commands[0][0])
+	// Re-applying recreates the table instead of adding to it.
+	require.True(t, strings.HasPrefix(ruleset, "table inet vpn_agent {}\ndelete table inet vpn_agent\n"))
+	require.Contains(t, ruleset, `iifname "wg0" oifname "eth0" accept`)
+	require.Contains(t, ruleset, `iifname != "wg0" ct state new drop`)
+	require.Contains(t, ruleset, `oifname != "wg0" ct state new drop`)
+	require.Contains(t, ruleset, "type nat hook postrouting priority srcnat; policy accept;")
+	require.Contains(t, ruleset, `ip saddr 10.8.0.0/24 oifname "eth0" masquerade`)
+}
+
+func TestNFTablesRulesetOmitsDisabledChains(t *testing.T) {
+	ruleset := nftablesRuleset(FirewallConfig{WireGuardInterface: "wg0", UplinkInterface: "eth0"})
+	require.NotContains(t, ruleset, "chain input")
+	require.NotContains(t, ruleset, "masquerade")
+}
+
+func TestNFTablesRulesetMasqueradesIPv6(t *testing.T) {
+	cfg := testFirewallConfig()
+	cfg.EnableIPv6 = true
+	cfg.SourceCIDR6 = "fd12:3456:789a::/64"
+
+	ruleset := nftablesRuleset(cfg)
+	require.Contains(t, ruleset, `ip saddr 10.8.0.0/24 oifname "eth0" masquerade`)
+	require.Contains(t, ruleset, `ip6 saddr fd12:3456:789a::/64 oifname "eth0" masquerade`)
+}
+
+func TestNFTablesRulesetIsolatesClients(t *testing.T) {
+	cfg := testFirewallConfig()
+	cfg.IsolateClients = true
+	cfg.MeshGroups = [][]string{{"10.8.0.2/32", "10.8.0.3/32", "fd00::2/128", "fd00::3/128"}}
+
+	ruleset := nftablesRuleset(cfg)
+	mesh := `iifname "wg0" oifname "wg0" ip saddr { 10.8.0.2/32, 10.8.0.3/32 } ip daddr { 10.8.0.2/32, 10.8.0.3/32 } accept`
+	mesh6 := `iifname "wg0" oifname "wg0" ip6 saddr { fd00::2/128, fd00::3/128 } ip6 daddr { fd00::2/128, fd00::3/128 } accept`
+	drop := `iifname "wg0" oifname "wg0" drop`
+	require.Contains(t, ruleset, mesh)
+	require.Contains(t, ruleset, mesh6)
+	require.Less(t, strings.Index(ruleset, mesh6), strings.Index(ruleset, drop))
+	require.Less(t, strings.Index(ruleset, drop), strings.Index(ruleset, `iifname "wg0" oifname "eth0" accept`))
+}
+
+func TestNFTablesTeardown(t *testing.T) {
+	tableExists := true
+	var deleted bool
+	t.Cleanup(WithCommandRunner(func(name string, args ...string) ([]byte, error) {
+		switch args[0] {
+		case "list":
+			if !tableExists {
+				return nil, errors.New("no such table")
+			}
+		case "delete":
+			deleted = true
+		}
+		return nil, nil
+	}))
+
+	fw := NewFirewall(FirewallConfig{Backend: BackendNFTables})
+	require.NoError(t, fw.Teardown())
+	require.True(t, deleted)
+
+	deleted, tableExists = false, false
+	require.NoError(t, fw.Teardown())
+	require.False(t, deleted)
+}
+
+func TestDetectFirewallBackend(t *testing.T) {
+	cases := []struct {
+		name     string
+		iptables string
+		nftErr   error
+		want     string
+	}{
+		{name: "legacy iptables", iptables: "iptables v1.8.7 (legacy)", want: BackendIPTables},
+		{name: "nft shim", iptables: "iptables v1.8.9 (nf_tables)", want: BackendNFTables},
+		{name: "no nft", iptables: "iptables v1.8.9 (nf_tables)", nftErr: errors.New("not found"), want: BackendIPTables},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Cleanup(WithCommandRunner(func(name string, args ...string) ([]byte, error) {
+				if name == "nft" {
+					return nil, tc.nftErr
+				}
+				return []byte(tc.iptables), nil
+			}))
+			require.Equal(t, tc.want, DetectFirewallBackend())
+		})
+	}
+}
+
+func TestFirewallRejectsUnknownBackend(t *testing.T) {
+	cfg := testFirewallConfig()
+	cfg.Backend = "pf"
+	require.ErrorContains(t, NewFirewall(cfg).Apply(), "unknown firewall backend")
+}
@@ -0,0 +1,46 @@
+package netutil
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+)
+
+var interfaceAddrs = net.InterfaceAddrs
+
+// DetectPublicIPs returns the first globally routable IPv4 and IPv6 address
+// bound to a local interface. Empty strings are returned when none is found.
+func DetectPublicIPs() (ipv4, ipv6 string, err error) {
+	addrs, err := interfaceAddrs()
+	if err != nil {
+		return "", "", fmt.Errorf("list interface addresses: %w", err)
+	}
+	for _, addr := range addrs {
+		prefix, err := netip.ParsePrefix(addr.String())
+		if err != nil {
+			continue
+		}
+		ip := prefix.Addr().Unmap()
+		if !isPublic(ip) {
+			continue
+		}
+		if ip.Is4() && ipv4 == "" {
+			ipv4 = ip.String()
+		}
+		if ip.Is6() && ipv6 == "" {
+			ipv6 = ip.String()
+		}
+	}
+	return ipv4, ipv6, nil
+}
+
+func isPublic(ip netip.Addr) bool {
+	if !ip.IsValid() || !ip.IsGlobalUnicast() || ip.IsPrivate() {
+		return false
+	}
+	// Carrier-grade NAT space is not reachable from the internet either.
+	if ip.Is4() && netip.MustParsePrefix("100.64.0.0/10").Contains(ip) {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,37 @@
+package netutil
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDetectPublicIPs(t *testing.T) {
+	orig := interfaceAddrs
+	interfaceAddrs = func() ([]net.Addr, error) {
+		return []net.Addr{
+			mustCIDR(t, "127.0.0.1/8"),
+			mustCIDR(t, "10.0.0.5/24"),
+			mustCIDR(t, "100.64.1.2/10"),
+			mustCIDR(t, "203.0.113.10/24"),
+			mustCIDR(t, "fe80::1/64"),
+			mustCIDR(t, "fd00::1/64"),
+			mustCIDR(t, "2001:db8::10/64"),
+		}, nil
+	}
+	t.Cleanup(func() { interfaceAddrs = orig })
+
+	v4, v6, err := DetectPublicIPs()
+	require.NoError(t, err)
+	require.Equal(t, "203.0.113.10", v4)
+	require.Equal(t, "2001:db8::10", v6)
+}
+
+func mustCIDR(t *testing.T, cidr string) net.Addr {
+	t.Helper()
+	ip, network, err := net.ParseCIDR(cidr)
+	require.NoError(t, err)
+	network.IP = ip
+	return network
+}
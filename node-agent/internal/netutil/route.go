@@ -0,0 +1,57 @@
+package netutil
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+var procNetRoute = "/proc/net/route"
+
+// ErrNoDefaultRoute is returned when the host has no IPv4 default route.
+var ErrNoDefaultRoute = errors.New("no default route")
+
+// DefaultRouteInterface returns the interface carrying the IPv4 default route
+// with the lowest metric, which is the node's uplink.
+func DefaultRouteInterface() (string, error) {
+	f, err := os.Open(procNetRoute)
+	if err != nil {
+		return "", fmt.Errorf("read routes: %w", err)
+	}
+	defer f.Close()
+
+	var (
+		best       string
+		bestMetric = -1
+	)
+	scanner := bufio.NewScanner(f)
+	scanner.Scan() // header
+	for scanner.Scan() {
+		// Iface Destination Gateway Flags RefCnt Use Metric Mask ...
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 8 || fields[1] != "00000000" || fields[7] != "00000000" {
+			continue
+		}
+		flags, err := strconv.ParseUint(fields[3], 16, 32)
+		if err != nil || flags&0x1 == 0 { // RTF_UP
+			continue
+		}
+		metric, err := strconv.Atoi(fields[6])
+		if err != nil {
+			continue
+		}
+		if bestMetric < 0 || metric < bestMetric {
+			best, bestMetric = fields[0], metric
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", fmt.Errorf("read routes: %w", err)
+	}
+	if best == "" {
+		return "", ErrNoDefaultRoute
+	}
+	return best, nil
+}
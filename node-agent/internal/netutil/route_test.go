@@ -0,0 +1,38 @@
+package netutil
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const routeHeader = "Iface\tDestination\tGateway \tFlags\tRefCnt\tUse\tMetric\tMask\t\tMTU\tWindow\tIRTT\n"
+
+func withRouteTable(t *testing.T, table string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "route")
+	require.NoError(t, os.WriteFile(path, []byte(routeHeader+table), 0o644))
+	prev := procNetRoute
+	procNetRoute = path
+	t.Cleanup(func() { procNetRoute = prev })
+}
+
+func TestDefaultRouteInterfacePicksLowestMetric(t *testing.T) {
+	withRouteTable(t,
+		"wg0\t0008000A\t00000000\t0001\t0\t0\t0\t00FFFFFF\t0\t0\t0\n"+
+			"eth1\t00000000\t0101A8C0\t0003\t0\t0\t200\t00000000\t0\t0\t0\n"+
+			"eth0\t00000000\t010010AC\t0003\t0\t0\t100\t00000000\t0\t0\t0\n")
+
+	iface, err := DefaultRouteInterface()
+	require.NoError(t, err)
+	require.Equal(t, "eth0", iface)
+}
+
+func TestDefaultRouteInterfaceMissing(t *testing.T) {
+	withRouteTable(t, "wg0\t0008000A\t00000000\t0001\t0\t0\t0\t00FFFFFF\t0\t0\t0\n")
+
+	_, err := DefaultRouteInterface()
+	require.ErrorIs(t, err, ErrNoDefaultRoute)
+}
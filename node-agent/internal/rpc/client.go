@@ -0,0 +1,100 @@
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/emrecetinkayadev/vpn-tridot/node-agent/internal/agent"
+)
+
+// Client talks to a running agent's admin socket.
+type Client struct {
+	http *http.Client
+}
+
+// NewClient returns a client for the admin socket at path.
+func NewClient(path string) *Client {
+	var dialer net.Dialer
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "unix", path)
+		},
+	}
+	return &Client{http: &http.Client{Transport: transport, Timeout: 30 * time.Second}}
+}
+
+// Status returns the agent status.
+func (c *Client) Status(ctx context.Context) (agent.Status, error) {
+	var status agent.Status
+	err := c.do(ctx, http.MethodGet, pathStatus, nil, &status)
+	return status, err
+}
+
+// Peers lists the peers applied on the node.
+func (c *Client) Peers(ctx context.Context) ([]agent.PeerStatus, error) {
+	var peers []agent.PeerStatus
+	err := c.do(ctx, http.MethodGet, pathPeers, nil, &peers)
+	return peers, err
+}
+
+// SetDrain toggles drain mode and returns the resulting status.
+func (c *Client) SetDrain(ctx context.Context, enabled bool) (agent.Status, error) {
+	var status agent.Status
+	err := c.do(ctx, http.MethodPut, pathDrain, DrainRequest{Enabled: enabled}, &status)
+	return status, err
+}
+
+// Resync asks the agent to fetch and apply the complete peer set.
+func (c *Client) Resync(ctx context.Context) error {
+	return c.do(ctx, http.MethodPost, pathResync, nil, nil)
+}
+
+// Doctor runs the host checks inside the agent.
+func (c *Client) Doctor(ctx context.Context) (DoctorReport, error) {
+	var report DoctorReport
+	err := c.do(ctx, http.MethodGet, pathDoctor, nil, &report)
+	return report, err
+}
+
+func (c *Client) do(ctx context.Context, method, path string, body, out any) error {
+	var payload bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&payload).Encode(body); err != nil {
+			return err
+		}
+	}
+	// The host is ignored; every request goes to the socket.
+	req, err := http.NewRequestWithContext(ctx, method, "http://agent"+path, &payload)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		var failure errorResponse
+		if err := json.NewDecoder(resp.Body).Decode(&failure); err == nil && failure.Error != "" {
+			return fmt.Errorf("agent: %s", failure.Error)
+		}
+		return fmt.Errorf("agent: status %d", resp.StatusCode)
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("decode %s response: %w", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+// Package rpc serves the agent's local admin API over a Unix socket and
+// provides the client used by the node-agent subcommands.
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/emrecetinkayadev/vpn-tridot/node-agent/internal/agent"
+	"github.com/emrecetinkayadev/vpn-tridot/node-agent/internal/doctor"
+)
+
+const (
+	pathStatus = "/v1/status"
+	pathPeers  = "/v1/peers"
+	pathDrain  = "/v1/drain"
+	pathResync = "/v1/resync"
+	pathDoctor = "/v1/doctor"
+)
+
+// Agent is the part of the agent exposed on the admin socket.
+type Agent interface {
+	Status() agent.Status
+	Peers() []agent.PeerStatus
+	SetDrain(bool) error
+	Resync()
+}
+
+// DrainRequest toggles drain mode.
+type DrainRequest struct {
+	Enabled bool `json:"enabled"`
+}
+
+// DoctorReport is the result of the host checks.
+type DoctorReport struct {
+	Healthy bool           `json:"healthy"`
+	Checks  []doctor.Check `json:"checks"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// Server is the admin API. Access is controlled by the socket's file
+// permissions: only root and the socket's group can connect.
+type Server struct {
+	path   string
+	agent  Agent
+	doctor func() []doctor.Check
+}
+
+// NewServer creates an admin server listening on the Unix socket at path.
+// runDoctor performs the host checks for the doctor endpoint.
+func NewServer(path string, ag Agent, runDoctor func() []doctor.Check) *Server {
+	return &Server{path: path, agent: ag, doctor: runDoctor}
+}
+
+// Handler returns the admin API routes.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET "+pathStatus, func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, http.StatusOK, s.agent.Status())
+	})
+	mux.HandleFunc("GET "+pathPeers, func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, http.StatusOK, s.agent.Peers())
+	})
+	mux.HandleFunc("PUT "+pathDrain, func(w http.ResponseWriter, r *http.Request) {
+		var req DrainRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, errorResponse{Error: "invalid request body"})
+			return
+		}
+		if err := s.agent.SetDrain(req.Enabled); err != nil {
+			writeJSON(w, http.StatusInternalServerError, errorResponse{Error: err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, s.agent.Status())
+	})
+	mux.HandleFunc("POST "+pathResync, func(w http.ResponseWriter, _ *http.Request) {
+		s.agent.Resync()
+		w.WriteHeader(http.StatusAccepted)
+	})
+	mux.HandleFunc("GET "+pathDoctor, func(w http.ResponseWriter, _ *http.Request) {
+		checks := s.doctor()
+		writeJSON(w, http.StatusOK, DoctorReport{Healthy: doctor.Healthy(checks), Checks: checks})
+	})
+	return mux
+}
+
+// Serve accepts admin requests until ctx is done. A socket left behind by a
+// previous run is replaced; one held by a running agent is an error.
+func (s *Server) Serve(ctx context.Context) error {
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o750); err != nil {
+		return fmt.Errorf("create admin socket dir: %w", err)
+	}
+	if conn, err := net.DialTimeout("unix", s.path, time.Second); err == nil {
+		conn.Close()
+		return fmt.Errorf("admin socket %s is in use", s.path)
+	}
+	if err := os.Remove(s.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("remove stale admin socket: %w", err)
+	}
+
+	listener, err := s.listen()
+	if err != nil {
+		return err
+	}
+	defer os.Remove(s.path)
+
+	srv := &http.Server{Handler: s.Handler(), ReadHeaderTimeout: 5 * time.Second}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = srv.Shutdown(shutdownCtx)
+	}()
+	if err := srv.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// listen binds the socket inside a private directory, where the umask
+// cannot expose it, and moves it to s.path once its mode is restricted.
+func (s *Server) listen() (net.Listener, error) {
+	dir, err := os.MkdirTemp(filepath.Dir(s.path), ".admin-")
+	if err != nil {
+		return nil, fmt.Errorf("create admin socket dir: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	tmp := filepath.Join(dir, filepath.Base(s.path))
+	listener, err := net.Listen("unix", tmp)
+	if err != nil {
+		return nil, fmt.Errorf("listen on admin socket: %w", err)
+	}
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	if err := os.Chmod(tmp, 0o660); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("restrict admin socket: %w", err)
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("install admin socket: %w", err)
+	}
+	return listener, nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
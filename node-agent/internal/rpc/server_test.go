@@ -0,0 +1,108 @@
+package rpc_test
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/emrecetinkayadev/vpn-tridot/node-agent/internal/agent"
+	"github.com/emrecetinkayadev/vpn-tridot/node-agent/internal/doctor"
+	"github.com/emrecetinkayadev/vpn-tridot/node-agent/internal/rpc"
+)
+
+type agentStub struct {
+	drain   bool
+	resyncs int
+}
+
+func (a *agentStub) Status() agent.Status {
+	return agent.Status{NodeID: "node-1", Registered: true, PeerCount: 1, Drain: a.drain}
+}
+
+func (a *agentStub) Peers() []agent.PeerStatus {
+	return []agent.PeerStatus{{PublicKey: "pk", AllowedIPs: []string{"10.8.0.2/32"}}}
+}
+
+func (a *agentStub) SetDrain(enabled bool) error {
+	a.drain = enabled
+	return nil
+}
+
+func (a *agentStub) Resync() { a.resyncs++ }
+
+func serve(t *testing.T, ag rpc.Agent, checks []doctor.Check) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "admin.sock")
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- rpc.NewServer(path, ag, func() []doctor.Check { return checks }).Serve(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		require.NoError(t, <-done)
+	})
+	require.Eventually(t, func() bool {
+		conn, err := net.Dial("unix", path)
+		if err == nil {
+			conn.Close()
+		}
+		return err == nil
+	}, 2*time.Second, 10*time.Millisecond)
+	return path
+}
+
+func TestAdminRoundTrip(t *testing.T) {
+	stub := &agentStub{}
+	path := serve(t, stub, []doctor.Check{
+		{Name: "wireguard_module", Result: doctor.OK},
+		{Name: "ip_forward", Result: doctor.Fail, Detail: "disabled"},
+	})
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0o660), info.Mode().Perm())
+	entries, err := os.ReadDir(filepath.Dir(path))
+	require.NoError(t, err)
+	require.Len(t, entries, 1, "the socket is bound in a private directory that is removed")
+
+	client := rpc.NewClient(path)
+	ctx := context.Background()
+
+	status, err := client.Status(ctx)
+	require.NoError(t, err)
+	require.Equal(t, "node-1", status.NodeID)
+	require.False(t, status.Drain)
+
+	status, err = client.SetDrain(ctx, true)
+	require.NoError(t, err)
+	require.True(t, status.Drain)
+	require.True(t, stub.drain)
+
+	peers, err := client.Peers(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []agent.PeerStatus{{PublicKey: "pk", AllowedIPs: []string{"10.8.0.2/32"}}}, peers)
+
+	require.NoError(t, client.Resync(ctx))
+	require.Equal(t, 1, stub.resyncs)
+
+	report, err := client.Doctor(ctx)
+	require.NoError(t, err)
+	require.False(t, report.Healthy)
+	require.Len(t, report.Checks, 2)
+}
+
+func TestAdminSocketInUse(t *testing.T) {
+	path := serve(t, &agentStub{}, nil)
+
+	err := rpc.NewServer(path, &agentStub{}, nil).Serve(context.Background())
+	require.ErrorContains(t, err, "in use")
+}
+
+func TestAdminClientWithoutAgent(t *testing.T) {
+	client := rpc.NewClient(filepath.Join(t.TempDir(), "missing.sock"))
+	_, err := client.Status(context.Background())
+	require.Error(t, err)
+}
@@ -0,0 +1,117 @@
+package state
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// KeySize is the length of the state encryption key (AES-256).
+const KeySize = 32
+
+// fileMagic prefixes the state file and is bound to the ciphertext as
+// additional data, so the format can change without guessing.
+const fileMagic = "vpn-agent-state/1\n"
+
+// sealer encrypts the state document with AES-256-GCM.
+type sealer struct {
+	aead cipher.AEAD
+}
+
+func newSealer(key []byte) (*sealer, error) {
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("state key must be %d bytes, got %d", KeySize, len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &sealer{aead: aead}, nil
+}
+
+// seal returns magic || nonce || ciphertext.
+func (s *sealer) seal(plain []byte) ([]byte, error) {
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	out := append([]byte(fileMagic), nonce...)
+	return s.aead.Seal(out, nonce, plain, []byte(fileMagic)), nil
+}
+
+func (s *sealer) open(sealed []byte) ([]byte, error) {
+	if !strings.HasPrefix(string(sealed), fileMagic) {
+		return nil, errors.New("not an agent state file")
+	}
+	sealed = sealed[len(fileMagic):]
+	if len(sealed) < s.aead.NonceSize() {
+		return nil, errors.New("state file truncated")
+	}
+	nonce, ciphertext := sealed[:s.aead.NonceSize()], sealed[s.aead.NonceSize():]
+	plain, err := s.aead.Open(nil, nonce, ciphertext, []byte(fileMagic))
+	if err != nil {
+		return nil, errors.New("wrong state key or corrupted state file")
+	}
+	return plain, nil
+}
+
+// ParseKey decodes a base64 encoded state key as given in the agent config.
+func ParseKey(encoded string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("decode state key: %w", err)
+	}
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("state key must be %d bytes, got %d", KeySize, len(key))
+	}
+	return key, nil
+}
+
+// LoadOrCreateKey reads the base64 state key from path, generating and
+// persisting a new one when the file does not exist yet. Key files readable
+// by group or others are rejected. path may point at a credential that is
+// sealed at rest and decrypted by the service manager, e.g. systemd's
+// LoadCredentialEncrypted=.
+func LoadOrCreateKey(path string) ([]byte, error) {
+	if path == "" {
+		return nil, errors.New("state key file required")
+	}
+
+	info, err := os.Stat(path)
+	if err == nil {
+		if info.Mode().Perm()&0o077 != 0 {
+			return nil, fmt.Errorf("state key file %s must not be accessible by group or others", path)
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("read state key: %w", err)
+		}
+		return ParseKey(string(content))
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("read state key: %w", err)
+	}
+
+	key := make([]byte, KeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("generate state key: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return nil, fmt.Errorf("create key dir: %w", err)
+	}
+	encoded := base64.StdEncoding.EncodeToString(key)
+	if err := writeFileAtomic(path, []byte(encoded+"\n"), 0o600); err != nil {
+		return nil, fmt.Errorf("write state key: %w", err)
+	}
+	return key, nil
+}
@@ -0,0 +1,57 @@
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/emrecetinkayadev/vpn-tridot/node-agent/internal/wg"
+)
+
+// schemaVersion is the version of document written by this agent.
+//
+//	1: plaintext peers.json and node.json (imported, never written)
+//	2: one encrypted document
+const schemaVersion = 2
+
+// document is everything the agent persists besides the drain marker.
+type document struct {
+	Version int       `json:"version"`
+	NodeID  string    `json:"node_id,omitempty"`
+	Peers   []wg.Peer `json:"peers,omitempty"`
+}
+
+// migrations[v] upgrades a version v document to version v+1.
+var migrations = map[int]func(*document) error{
+	// Version 2 only changed how the document is stored.
+	1: func(*document) error { return nil },
+}
+
+// migrate upgrades doc to schemaVersion. Documents written by a newer agent
+// are rejected rather than silently losing fields on the next save.
+func (doc *document) migrate() error {
+	if doc.Version > schemaVersion {
+		return fmt.Errorf("state schema version %d is newer than supported %d", doc.Version, schemaVersion)
+	}
+	for doc.Version < schemaVersion {
+		step, ok := migrations[doc.Version]
+		if !ok {
+			return fmt.Errorf("no migration from state schema version %d", doc.Version)
+		}
+		if err := step(doc); err != nil {
+			return fmt.Errorf("migrate state schema %d: %w", doc.Version, err)
+		}
+		doc.Version++
+	}
+	return nil
+}
+
+func decodeDocument(plain []byte) (document, error) {
+	var doc document
+	if err := json.Unmarshal(plain, &doc); err != nil {
+		return document{}, err
+	}
+	if err := doc.migrate(); err != nil {
+		return document{}, err
+	}
+	return doc, nil
+}
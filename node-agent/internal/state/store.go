@@ -3,6 +3,7 @@ package state
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
 	"sync"
@@ -11,66 +12,196 @@ import (
 )
 
 const (
-	peersFile = "peers.json"
+	stateFile = "state.enc"
 	drainFile = "drain"
+
+	// Files of the plaintext layout (schema version 1), imported and removed
+	// on first start.
+	legacyPeersFile = "peers.json"
+	legacyNodeFile  = "node.json"
 )
 
-// Store persists agent runtime state to disk for crash-safe recovery.
+// Store persists agent runtime state for crash-safe recovery. Node identity
+// and peers, preshared keys included, are kept in one encrypted file that is
+// replaced atomically on every save. A memory-only store keeps everything in
+// process and never touches the disk.
 type Store struct {
-	dir string
-	mu  sync.Mutex
+	dir    string
+	sealer *sealer
+	mu     sync.Mutex
+	doc    document
+	drain  bool
 }
 
-// New creates a state store rooted at dir. Directory is created if missing.
-func New(dir string) (*Store, error) {
+// New creates an encrypted state store rooted at dir with a 32-byte key.
+// The directory is created if missing. State written by the plaintext layout
+// of earlier agents is migrated into the encrypted file and removed.
+func New(dir string, key []byte) (*Store, error) {
 	if dir == "" {
 		return nil, errors.New("state dir required")
 	}
+	sealer, err := newSealer(key)
+	if err != nil {
+		return nil, err
+	}
 	if err := os.MkdirAll(dir, 0o750); err != nil {
 		return nil, err
 	}
-	return &Store{dir: dir}, nil
+
+	s := &Store{dir: dir, sealer: sealer}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// NewMemory returns a store that keeps state in memory only. Nothing survives
+// a restart: the node re-registers and fetches its full peer set again.
+func NewMemory() *Store {
+	return &Store{doc: document{Version: schemaVersion}}
 }
 
-func (s *Store) peersPath() string { return filepath.Join(s.dir, peersFile) }
+// MemoryOnly reports whether the store never writes to disk.
+func (s *Store) MemoryOnly() bool { return s.dir == "" }
+
+func (s *Store) statePath() string { return filepath.Join(s.dir, stateFile) }
 func (s *Store) drainPath() string { return filepath.Join(s.dir, drainFile) }
 
-// SavePeers persists the latest WireGuard peer definition for recovery.
-func (s *Store) SavePeers(peers []wg.Peer) error {
+// load reads the state file, falling back to importing the legacy layout.
+func (s *Store) load() error {
+	content, err := os.ReadFile(s.statePath())
+	switch {
+	case err == nil:
+		plain, err := s.sealer.open(content)
+		if err != nil {
+			return fmt.Errorf("decrypt %s: %w", stateFile, err)
+		}
+		doc, err := decodeDocument(plain)
+		if err != nil {
+			return fmt.Errorf("%s: %w", stateFile, err)
+		}
+		s.doc = doc
+		return nil
+	case errors.Is(err, os.ErrNotExist):
+		return s.importLegacy()
+	default:
+		return err
+	}
+}
+
+// importLegacy moves plaintext peers.json/node.json into the encrypted file.
+// The plaintext files are removed only after the encrypted copy is on disk.
+func (s *Store) importLegacy() error {
+	doc := document{Version: 1}
+	found := false
+
+	if content, err := os.ReadFile(filepath.Join(s.dir, legacyPeersFile)); err == nil {
+		if err := json.Unmarshal(content, &doc.Peers); err != nil {
+			return fmt.Errorf("import %s: %w", legacyPeersFile, err)
+		}
+		found = true
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if content, err := os.ReadFile(filepath.Join(s.dir, legacyNodeFile)); err == nil {
+		var identity struct {
+			NodeID string `json:"node_id"`
+		}
+		if err := json.Unmarshal(content, &identity); err != nil {
+			return fmt.Errorf("import %s: %w", legacyNodeFile, err)
+		}
+		doc.NodeID = identity.NodeID
+		found = true
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	if !found {
+		s.doc = document{Version: schemaVersion}
+		return nil
+	}
+	if err := doc.migrate(); err != nil {
+		return err
+	}
+	s.doc = doc
+	if err := s.persist(); err != nil {
+		return err
+	}
+	for _, name := range []string{legacyPeersFile, legacyNodeFile} {
+		if err := os.Remove(filepath.Join(s.dir, name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// persist encrypts the current document and atomically replaces the state
+// file. It is a no-op for memory-only stores.
+func (s *Store) persist() error {
+	if s.MemoryOnly() {
+		return nil
+	}
+	plain, err := json.Marshal(s.doc)
+	if err != nil {
+		return err
+	}
+	sealed, err := s.sealer.seal(plain)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.statePath(), sealed, 0o600)
+}
+
+// update applies fn to the document and persists it, rolling back on failure
+// so memory and disk never disagree.
+func (s *Store) update(fn func(*document)) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	data, err := json.MarshalIndent(peers, "", "  ")
-	if err != nil {
+	prev := s.doc
+	fn(&s.doc)
+	if err := s.persist(); err != nil {
+		s.doc = prev
 		return err
 	}
-	return os.WriteFile(s.peersPath(), data, 0o600)
+	return nil
+}
+
+// SaveNodeID persists the node identifier assigned by the control plane.
+func (s *Store) SaveNodeID(id string) error {
+	return s.update(func(doc *document) { doc.NodeID = id })
+}
+
+// LoadNodeID returns the persisted node identifier, or an empty string when
+// the node has not registered yet.
+func (s *Store) LoadNodeID() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.doc.NodeID, nil
+}
+
+// SavePeers persists the latest WireGuard peer definition for recovery.
+func (s *Store) SavePeers(peers []wg.Peer) error {
+	saved := append([]wg.Peer(nil), peers...)
+	return s.update(func(doc *document) { doc.Peers = saved })
 }
 
 // LoadPeers loads the previously saved peer definitions.
 func (s *Store) LoadPeers() ([]wg.Peer, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-
-	content, err := os.ReadFile(s.peersPath())
-	if err != nil {
-		if errors.Is(err, os.ErrNotExist) {
-			return nil, nil
-		}
-		return nil, err
-	}
-	var peers []wg.Peer
-	if err := json.Unmarshal(content, &peers); err != nil {
-		return nil, err
-	}
-	return peers, nil
+	return append([]wg.Peer(nil), s.doc.Peers...), nil
 }
 
-// DrainEnabled reports whether drain mode is active.
+// DrainEnabled reports whether drain mode is active. On disk drain is a
+// marker file operators can create by hand.
 func (s *Store) DrainEnabled() (bool, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	if s.MemoryOnly() {
+		return s.drain, nil
+	}
 	_, err := os.Stat(s.drainPath())
 	if err != nil {
 		if errors.Is(err, os.ErrNotExist) {
@@ -86,6 +217,10 @@ func (s *Store) SetDrain(enabled bool) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	if s.MemoryOnly() {
+		s.drain = enabled
+		return nil
+	}
 	path := s.drainPath()
 	if enabled {
 		f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0o600)
@@ -100,5 +235,45 @@ func (s *Store) SetDrain(enabled bool) error {
 	return nil
 }
 
-// Dir exposes the store directory (useful for logging/tests).
+// Dir exposes the store directory (useful for logging/tests). It is empty
+// for memory-only stores.
 func (s *Store) Dir() string { return s.dir }
+
+// writeFileAtomic writes data to a temporary file next to path, syncs it and
+// renames it over path, so readers see either the old or the new content.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	f, err := os.CreateTemp(dir, "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	defer os.Remove(tmp)
+
+	if err := f.Chmod(perm); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+
+	// Sync the directory so the rename itself survives a crash.
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -1,6 +1,8 @@
 package state
 
 import (
+	"bytes"
+	"encoding/base64"
 	"os"
 	"path/filepath"
 	"testing"
@@ -10,50 +12,182 @@ import (
 	"github.com/emrecetinkayadev/vpn-tridot/node-agent/internal/wg"
 )
 
+func testKey() []byte {
+	return bytes.Repeat([]byte{7}, KeySize)
+}
+
 func TestStorePeersPersistence(t *testing.T) {
 	dir := t.TempDir()
-	store, err := New(dir)
+	store, err := New(dir, testKey())
 	require.NoError(t, err)
 
-	peers := []wg.Peer{{PublicKey: "pk", AllowedIPs: []string{"0.0.0.0/0"}}}
+	peers := []wg.Peer{{PublicKey: "pk", PresharedKey: "psk-secret", AllowedIPs: []string{"0.0.0.0/0"}}}
 	require.NoError(t, store.SavePeers(peers))
 
 	loaded, err := store.LoadPeers()
 	require.NoError(t, err)
 	require.Equal(t, peers, loaded)
 
-	// Ensure file written with restrictive permissions.
-	info, err := os.Stat(filepath.Join(dir, "peers.json"))
+	reopened, err := New(dir, testKey())
+	require.NoError(t, err)
+	loaded, err = reopened.LoadPeers()
+	require.NoError(t, err)
+	require.Equal(t, peers, loaded)
+
+	// Ensure file written with restrictive permissions and no plaintext.
+	path := filepath.Join(dir, "state.enc")
+	info, err := os.Stat(path)
 	require.NoError(t, err)
 	require.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+	raw, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.NotContains(t, string(raw), "psk-secret")
+
+	// No temporary files are left behind.
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
 }
 
-func TestStoreDrainToggle(t *testing.T) {
+func TestStoreRejectsWrongKey(t *testing.T) {
 	dir := t.TempDir()
-	store, err := New(dir)
+	store, err := New(dir, testKey())
 	require.NoError(t, err)
+	require.NoError(t, store.SaveNodeID("node-123"))
+
+	_, err = New(dir, bytes.Repeat([]byte{8}, KeySize))
+	require.ErrorContains(t, err, "wrong state key")
+	_, err = New(dir, []byte("short"))
+	require.Error(t, err)
+}
 
-	enabled, err := store.DrainEnabled()
+func TestStoreMigratesLegacyPlaintext(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "peers.json"), []byte(`[{"public_key":"pk","preshared_key":"psk","allowed_ips":["10.8.0.2/32"]}]`), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "node.json"), []byte(`{"node_id":"node-123"}`), 0o600))
+
+	store, err := New(dir, testKey())
 	require.NoError(t, err)
-	require.False(t, enabled)
 
-	require.NoError(t, store.SetDrain(true))
-	enabled, err = store.DrainEnabled()
+	id, err := store.LoadNodeID()
 	require.NoError(t, err)
-	require.True(t, enabled)
+	require.Equal(t, "node-123", id)
+	peers, err := store.LoadPeers()
+	require.NoError(t, err)
+	require.Equal(t, []wg.Peer{{PublicKey: "pk", PresharedKey: "psk", AllowedIPs: []string{"10.8.0.2/32"}}}, peers)
+
+	require.NoFileExists(t, filepath.Join(dir, "peers.json"))
+	require.NoFileExists(t, filepath.Join(dir, "node.json"))
+	require.FileExists(t, filepath.Join(dir, "state.enc"))
+}
 
-	require.NoError(t, store.SetDrain(false))
-	enabled, err = store.DrainEnabled()
+func TestStoreRejectsNewerSchema(t *testing.T) {
+	dir := t.TempDir()
+	s, err := newSealer(testKey())
 	require.NoError(t, err)
-	require.False(t, enabled)
+	sealed, err := s.seal([]byte(`{"version":99}`))
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "state.enc"), sealed, 0o600))
+
+	_, err = New(dir, testKey())
+	require.ErrorContains(t, err, "newer than supported")
+}
+
+func TestStoreDrainToggle(t *testing.T) {
+	for name, store := range map[string]func(t *testing.T) *Store{
+		"disk": func(t *testing.T) *Store {
+			store, err := New(t.TempDir(), testKey())
+			require.NoError(t, err)
+			return store
+		},
+		"memory": func(*testing.T) *Store { return NewMemory() },
+	} {
+		t.Run(name, func(t *testing.T) {
+			store := store(t)
+
+			enabled, err := store.DrainEnabled()
+			require.NoError(t, err)
+			require.False(t, enabled)
+
+			require.NoError(t, store.SetDrain(true))
+			enabled, err = store.DrainEnabled()
+			require.NoError(t, err)
+			require.True(t, enabled)
+
+			require.NoError(t, store.SetDrain(false))
+			enabled, err = store.DrainEnabled()
+			require.NoError(t, err)
+			require.False(t, enabled)
+		})
+	}
 }
 
 func TestLoadPeersMissingFile(t *testing.T) {
 	dir := t.TempDir()
-	store, err := New(dir)
+	store, err := New(dir, testKey())
 	require.NoError(t, err)
 
 	peers, err := store.LoadPeers()
 	require.NoError(t, err)
 	require.Nil(t, peers)
 }
+
+func TestStoreNodeIDPersistence(t *testing.T) {
+	dir := t.TempDir()
+	store, err := New(dir, testKey())
+	require.NoError(t, err)
+
+	id, err := store.LoadNodeID()
+	require.NoError(t, err)
+	require.Empty(t, id)
+
+	require.NoError(t, store.SaveNodeID("node-123"))
+
+	reopened, err := New(dir, testKey())
+	require.NoError(t, err)
+	id, err = reopened.LoadNodeID()
+	require.NoError(t, err)
+	require.Equal(t, "node-123", id)
+}
+
+func TestMemoryStoreKeepsNothingOnDisk(t *testing.T) {
+	store := NewMemory()
+	require.True(t, store.MemoryOnly())
+
+	peers := []wg.Peer{{PublicKey: "pk", PresharedKey: "psk"}}
+	require.NoError(t, store.SavePeers(peers))
+	require.NoError(t, store.SaveNodeID("node-123"))
+
+	loaded, err := store.LoadPeers()
+	require.NoError(t, err)
+	require.Equal(t, peers, loaded)
+	id, err := store.LoadNodeID()
+	require.NoError(t, err)
+	require.Equal(t, "node-123", id)
+	require.Empty(t, store.Dir())
+}
+
+func TestLoadOrCreateKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys", "state.key")
+
+	key, err := LoadOrCreateKey(path)
+	require.NoError(t, err)
+	require.Len(t, key, KeySize)
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+
+	again, err := LoadOrCreateKey(path)
+	require.NoError(t, err)
+	require.Equal(t, key, again)
+
+	require.NoError(t, os.Chmod(path, 0o644))
+	_, err = LoadOrCreateKey(path)
+	require.ErrorContains(t, err, "group or others")
+
+	parsed, err := ParseKey(base64.StdEncoding.EncodeToString(key))
+	require.NoError(t, err)
+	require.Equal(t, key, parsed)
+	_, err = ParseKey("c2hvcnQ=")
+	require.Error(t, err)
+}
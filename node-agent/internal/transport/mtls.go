@@ -31,49 +31,71 @@ func NewMTLSClient(cfg config.MTLSConfig, timeout time.Duration) (*http.Client,
 		return nil, errors.New("failed to append ca cert")
 	}
 
+	cert, err := clientKeyPair(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      rootPool,
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	transport := &http.Transport{
+		TLSClientConfig: tlsConfig,
+	}
+
+	client := &http.Client{
+		Transport: transport,
+		Timeout:   timeout,
+	}
+
+	return client, nil
+}
+
+// ClientCertificate parses the configured client certificate after checking
+// that it matches the key, e.g. to inspect its validity period.
+func ClientCertificate(cfg config.MTLSConfig) (*x509.Certificate, error) {
+	cert, err := clientKeyPair(cfg)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("parse client certificate: %w", err)
+	}
+	return leaf, nil
+}
+
+func clientKeyPair(cfg config.MTLSConfig) (tls.Certificate, error) {
 	certPEM := cfg.Cert
 	if certPEM == "" && cfg.CertFile != "" {
 		bytes, err := ioutil.ReadFile(cfg.CertFile)
 		if err != nil {
-			return nil, fmt.Errorf("read cert file: %w", err)
+			return tls.Certificate{}, fmt.Errorf("read cert file: %w", err)
 		}
 		certPEM = string(bytes)
 	}
 	if certPEM == "" {
-		return nil, errors.New("client certificate missing")
+		return tls.Certificate{}, errors.New("client certificate missing")
 	}
 
 	keyPEM := cfg.Key
 	if keyPEM == "" && cfg.KeyFile != "" {
 		bytes, err := ioutil.ReadFile(cfg.KeyFile)
 		if err != nil {
-			return nil, fmt.Errorf("read key file: %w", err)
+			return tls.Certificate{}, fmt.Errorf("read key file: %w", err)
 		}
 		keyPEM = string(bytes)
 	}
 	if keyPEM == "" {
-		return nil, errors.New("client key missing")
+		return tls.Certificate{}, errors.New("client key missing")
 	}
 
 	cert, err := tls.X509KeyPair([]byte(certPEM), []byte(keyPEM))
 	if err != nil {
-		return nil, fmt.Errorf("load client key pair: %w", err)
-	}
-
-	tlsConfig := &tls.Config{
-		Certificates: []tls.Certificate{cert},
-		RootCAs:      rootPool,
-		MinVersion:   tls.VersionTLS12,
+		return tls.Certificate{}, fmt.Errorf("load client key pair: %w", err)
 	}
-
-	transport := &http.Transport{
-		TLSClientConfig: tlsConfig,
-	}
-
-	client := &http.Client{
-		Transport: transport,
-		Timeout:   timeout,
-	}
-
-	return client, nil
+	return cert, nil
 }
@@ -0,0 +1,156 @@
+package wg
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// ApplyPeers reconciles the device's peers with the desired set. Only peers
+// that were added, removed or changed are sent to the kernel, so existing
+// sessions are left untouched and large peer sets are not reloaded wholesale.
+func (m *Manager) ApplyPeers(peers []Peer) error {
+	if m.cfg.InterfaceName == "" {
+		return fmt.Errorf("interface name required")
+	}
+	if m.client == nil {
+		return fmt.Errorf("wireguard client not configured")
+	}
+
+	dev, err := m.client.Device(m.cfg.InterfaceName)
+	if err != nil {
+		return fmt.Errorf("read device %s: %w", m.cfg.InterfaceName, err)
+	}
+
+	cfg, err := m.diff(dev, peers)
+	if err != nil {
+		return err
+	}
+	if cfg.PrivateKey == nil && cfg.ListenPort == nil && len(cfg.Peers) == 0 {
+		return nil
+	}
+	if err := m.client.ConfigureDevice(m.cfg.InterfaceName, cfg); err != nil {
+		return fmt.Errorf("configure device %s: %w", m.cfg.InterfaceName, err)
+	}
+	return nil
+}
+
+func (m *Manager) diff(dev *wgtypes.Device, peers []Peer) (wgtypes.Config, error) {
+	var cfg wgtypes.Config
+
+	if m.privateKey != "" {
+		key, err := wgtypes.ParseKey(m.privateKey)
+		if err != nil {
+			return wgtypes.Config{}, fmt.Errorf("parse private key: %w", err)
+		}
+		if key != dev.PrivateKey {
+			cfg.PrivateKey = &key
+		}
+	}
+	if m.cfg.ListenPort > 0 && m.cfg.ListenPort != dev.ListenPort {
+		port := m.cfg.ListenPort
+		cfg.ListenPort = &port
+	}
+
+	current := make(map[wgtypes.Key]wgtypes.Peer, len(dev.Peers))
+	for _, peer := range dev.Peers {
+		current[peer.PublicKey] = peer
+	}
+
+	desired := make(map[wgtypes.Key]struct{}, len(peers))
+	var errs []error
+	for _, peer := range peers {
+		pc, err := m.peerConfig(peer)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		desired[pc.PublicKey] = struct{}{}
+		if existing, ok := current[pc.PublicKey]; ok && peerMatches(existing, pc) {
+			continue
+		}
+		cfg.Peers = append(cfg.Peers, pc)
+	}
+	if len(errs) > 0 {
+		return wgtypes.Config{}, errors.Join(errs...)
+	}
+
+	for key := range current {
+		if _, ok := desired[key]; !ok {
+			cfg.Peers = append(cfg.Peers, wgtypes.PeerConfig{PublicKey: key, Remove: true})
+		}
+	}
+	return cfg, nil
+}
+
+func (m *Manager) peerConfig(peer Peer) (wgtypes.PeerConfig, error) {
+	key, err := wgtypes.ParseKey(peer.PublicKey)
+	if err != nil {
+		return wgtypes.PeerConfig{}, fmt.Errorf("peer %q: invalid public key: %w", peer.PublicKey, err)
+	}
+	pc := wgtypes.PeerConfig{PublicKey: key, ReplaceAllowedIPs: true}
+
+	// Always send the preshared key so that clearing it removes it on the device.
+	var psk wgtypes.Key
+	if peer.PresharedKey != "" {
+		psk, err = wgtypes.ParseKey(peer.PresharedKey)
+		if err != nil {
+			return wgtypes.PeerConfig{}, fmt.Errorf("peer %q: invalid preshared key: %w", peer.PublicKey, err)
+		}
+	}
+	pc.PresharedKey = &psk
+
+	for _, cidr := range peer.AllowedIPs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return wgtypes.PeerConfig{}, fmt.Errorf("peer %q: invalid allowed ip %q: %w", peer.PublicKey, cidr, err)
+		}
+		pc.AllowedIPs = append(pc.AllowedIPs, *network)
+	}
+
+	if peer.Endpoint != "" {
+		addr, err := net.ResolveUDPAddr("udp", peer.Endpoint)
+		if err != nil {
+			return wgtypes.PeerConfig{}, fmt.Errorf("peer %q: invalid endpoint %q: %w", peer.PublicKey, peer.Endpoint, err)
+		}
+		pc.Endpoint = addr
+	}
+
+	keepalive := peer.PersistentKeep
+	if keepalive == 0 {
+		keepalive = m.cfg.PersistentKeepalive
+	}
+	interval := time.Duration(keepalive) * time.Second
+	pc.PersistentKeepaliveInterval = &interval
+
+	return pc, nil
+}
+
+// peerMatches reports whether the device already carries the desired peer
+// configuration. Endpoints are only compared when one is requested, because
+// the kernel learns client endpoints on its own as they roam.
+func peerMatches(existing wgtypes.Peer, desired wgtypes.PeerConfig) bool {
+	if desired.PresharedKey != nil && *desired.PresharedKey != existing.PresharedKey {
+		return false
+	}
+	if desired.PersistentKeepaliveInterval != nil && *desired.PersistentKeepaliveInterval != existing.PersistentKeepaliveInterval {
+		return false
+	}
+	if desired.Endpoint != nil && (existing.Endpoint == nil || existing.Endpoint.String() != desired.Endpoint.String()) {
+		return false
+	}
+	return slices.Equal(sortedCIDRs(existing.AllowedIPs), sortedCIDRs(desired.AllowedIPs))
+}
+
+func sortedCIDRs(networks []net.IPNet) []string {
+	out := make([]string, 0, len(networks))
+	for _, network := range networks {
+		out = append(out, network.String())
+	}
+	slices.Sort(out)
+	return out
+}
@@ -1,58 +1,59 @@
 package wg
 
 import (
-	"bufio"
 	"fmt"
-	"os/exec"
-	"strconv"
-	"strings"
 	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
 var activePeerWindow = 3 * time.Minute
 
+// defaultClient talks to the kernel (or userspace) WireGuard implementation
+// through wgctrl. A handle is opened per call so a device that is recreated
+// underneath the agent never leaves it holding a stale socket.
 type defaultClient struct{}
 
-func (defaultClient) DeviceStats(interfaceName string) (DeviceStats, error) {
-	if interfaceName == "" {
-		return DeviceStats{}, fmt.Errorf("interface name required")
+func (defaultClient) Device(name string) (*wgtypes.Device, error) {
+	c, err := wgctrl.New()
+	if err != nil {
+		return nil, fmt.Errorf("open wgctrl: %w", err)
 	}
-	out, err := exec.Command("wg", "show", interfaceName, "dump").Output()
+	defer c.Close()
+	return c.Device(name)
+}
+
+func (defaultClient) ConfigureDevice(name string, cfg wgtypes.Config) error {
+	c, err := wgctrl.New()
 	if err != nil {
-		return DeviceStats{}, fmt.Errorf("wg show dump: %w", err)
+		return fmt.Errorf("open wgctrl: %w", err)
 	}
-	stats := DeviceStats{}
-	now := time.Now()
-	scanner := bufio.NewScanner(strings.NewReader(string(out)))
-	first := true
-	for scanner.Scan() {
-		line := scanner.Text()
-		if first {
-			first = false
-			continue // interface line
-		}
-		fields := strings.Split(line, "\t")
-		if len(fields) < 8 {
+	defer c.Close()
+	return c.ConfigureDevice(name, cfg)
+}
+
+func statsFromDevice(dev *wgtypes.Device, now time.Time) DeviceStats {
+	stats := DeviceStats{Peers: make([]PeerStats, 0, len(dev.Peers))}
+	for _, peer := range dev.Peers {
+		stats.Peers = append(stats.Peers, PeerStats{
+			PublicKey:     peer.PublicKey.String(),
+			ReceiveBytes:  uint64(peer.ReceiveBytes),
+			TransmitBytes: uint64(peer.TransmitBytes),
+			LastHandshake: peer.LastHandshakeTime,
+		})
+		stats.PeerCount++
+		stats.ReceiveBytes += uint64(peer.ReceiveBytes)
+		stats.TransmitBytes += uint64(peer.TransmitBytes)
+		if peer.LastHandshakeTime.IsZero() {
 			continue
 		}
-		handshake, _ := strconv.ParseInt(fields[5], 10, 64)
-		rx, _ := strconv.ParseUint(fields[6], 10, 64)
-		tx, _ := strconv.ParseUint(fields[7], 10, 64)
-		stats.PeerCount++
-		stats.ReceiveBytes += rx
-		stats.TransmitBytes += tx
-		if handshake > 0 {
-			t := time.Unix(handshake, 0)
-			if t.After(stats.LastHandshake) {
-				stats.LastHandshake = t
-			}
-			if now.Sub(t) <= activePeerWindow {
-				stats.ActivePeers++
-			}
+		if peer.LastHandshakeTime.After(stats.LastHandshake) {
+			stats.LastHandshake = peer.LastHandshakeTime
+		}
+		if now.Sub(peer.LastHandshakeTime) <= activePeerWindow {
+			stats.ActivePeers++
 		}
 	}
-	if err := scanner.Err(); err != nil {
-		return DeviceStats{}, err
-	}
-	return stats, nil
+	return stats
 }
@@ -0,0 +1,27 @@
+package wg
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// bootIDPath holds a random id the kernel picks on every boot.
+const bootIDPath = "/proc/sys/kernel/random/boot_id"
+
+// deviceEpoch identifies the current instance of interface name. The kernel
+// hands out a new ifindex when an interface is recreated, and the boot id
+// tells apart interfaces that got the same ifindex after a reboot. Counters
+// only grow within one epoch. It returns "" when either is unavailable.
+var deviceEpoch = func(name string) string {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return ""
+	}
+	bootID, err := os.ReadFile(bootIDPath)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(bootID)) + ":" + strconv.Itoa(iface.Index)
+}
@@ -1,33 +1,212 @@
 package wg
 
 import (
+	"errors"
 	"fmt"
-	"os/exec"
+	"net"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/emrecetinkayadev/vpn-tridot/node-agent/internal/config"
+)
+
+var (
+	// ErrWireGuardUnsupported means the kernel refused to create a wireguard link.
+	ErrWireGuardUnsupported = errors.New("wireguard link type not supported by kernel (is the wireguard module loaded?)")
+	// ErrAddressConflict means a tunnel address is already assigned to another interface.
+	ErrAddressConflict = errors.New("address already assigned to another interface")
+	// ErrLinkTypeMismatch means an interface with the configured name exists but is not wireguard.
+	ErrLinkTypeMismatch = errors.New("interface exists with a different link type")
+	// ErrNetlinkPermission means the agent lacks CAP_NET_ADMIN.
+	ErrNetlinkPermission = errors.New("netlink operation not permitted (CAP_NET_ADMIN required)")
 )
 
-// SetupInterface ensures the WireGuard interface is created using wg-quick.
-func SetupInterface(configPath string) error {
-	cmd := exec.Command("wg-quick", "up", configPath)
-	if output, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("wg-quick up failed: %w: %s", err, string(output))
+// netlinkOps is the subset of netlink used for the interface lifecycle.
+// Address listing with linkIndex 0 returns addresses of all links.
+type netlinkOps interface {
+	LinkByName(name string) (netlink.Link, error)
+	LinkAdd(link netlink.Link) error
+	LinkDel(link netlink.Link) error
+	LinkSetMTU(link netlink.Link, mtu int) error
+	LinkSetUp(link netlink.Link) error
+	AddrList(linkIndex int) ([]netlink.Addr, error)
+	AddrAdd(link netlink.Link, addr *netlink.Addr) error
+	AddrDel(link netlink.Link, addr *netlink.Addr) error
+	RouteReplace(linkIndex int, dst *net.IPNet) error
+}
+
+// Link manages the WireGuard network interface over netlink: creating the
+// link, assigning addresses, MTU and routes, and removing it again.
+type Link struct {
+	cfg config.WireGuardConfig
+	nl  netlinkOps
+}
+
+// NewLink creates a lifecycle manager for the configured interface.
+func NewLink(cfg config.WireGuardConfig) *Link {
+	return &Link{cfg: cfg, nl: kernelNetlink{}}
+}
+
+// WithNetlink allows injecting a custom netlink implementation (useful for tests).
+func (l *Link) WithNetlink(ops netlinkOps) {
+	l.nl = ops
+}
+
+// Up brings the interface to the configured state. It is safe to call on an
+// interface left behind by a previous run: existing settings are reused and
+// only differences are applied.
+func (l *Link) Up() error {
+	name := l.cfg.InterfaceName
+	if name == "" {
+		return fmt.Errorf("interface name required")
+	}
+	addrs, err := parseAddrs(interfaceAddresses(l.cfg))
+	if err != nil {
+		return err
+	}
+	routes, err := parseRoutes(l.cfg.Routes)
+	if err != nil {
+		return err
+	}
+
+	link, err := l.ensureLink(name)
+	if err != nil {
+		return err
+	}
+	if l.cfg.MTU > 0 && link.Attrs().MTU != l.cfg.MTU {
+		if err := l.nl.LinkSetMTU(link, l.cfg.MTU); err != nil {
+			return fmt.Errorf("set mtu %d on %s: %w", l.cfg.MTU, name, classifyNetlinkErr(err))
+		}
+	}
+	if err := l.syncAddrs(link, addrs); err != nil {
+		return err
+	}
+	if err := l.nl.LinkSetUp(link); err != nil {
+		return fmt.Errorf("set %s up: %w", name, classifyNetlinkErr(err))
+	}
+	for _, dst := range routes {
+		if err := l.nl.RouteReplace(link.Attrs().Index, dst); err != nil {
+			return fmt.Errorf("route %s via %s: %w", dst, name, classifyNetlinkErr(err))
+		}
 	}
 	return nil
 }
 
-// TeardownInterface brings down a WireGuard interface via wg-quick.
-func TeardownInterface(configPath string) error {
-	cmd := exec.Command("wg-quick", "down", configPath)
-	if output, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("wg-quick down failed: %w: %s", err, string(output))
+// Down deletes the interface; the kernel drops its addresses and routes with it.
+func (l *Link) Down() error {
+	link, err := l.nl.LinkByName(l.cfg.InterfaceName)
+	if err != nil {
+		if isLinkNotFound(err) {
+			return nil
+		}
+		return fmt.Errorf("lookup %s: %w", l.cfg.InterfaceName, classifyNetlinkErr(err))
+	}
+	if err := l.nl.LinkDel(link); err != nil {
+		return fmt.Errorf("delete %s: %w", l.cfg.InterfaceName, classifyNetlinkErr(err))
 	}
 	return nil
 }
 
-// SyncPeers reloads the configuration to apply peer changes.
-func SyncPeers(interfaceName, configPath string) error {
-	cmd := exec.Command("wg", "syncconf", interfaceName, configPath)
-	if output, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("wg syncconf failed: %w: %s", err, string(output))
+func (l *Link) ensureLink(name string) (netlink.Link, error) {
+	link, err := l.nl.LinkByName(name)
+	if err == nil {
+		if link.Type() != "wireguard" {
+			return nil, fmt.Errorf("%s is %q: %w", name, link.Type(), ErrLinkTypeMismatch)
+		}
+		return link, nil
+	}
+	if !isLinkNotFound(err) {
+		return nil, fmt.Errorf("lookup %s: %w", name, classifyNetlinkErr(err))
+	}
+
+	attrs := netlink.NewLinkAttrs()
+	attrs.Name = name
+	if l.cfg.MTU > 0 {
+		attrs.MTU = l.cfg.MTU
+	}
+	if err := l.nl.LinkAdd(&netlink.Wireguard{LinkAttrs: attrs}); err != nil {
+		return nil, fmt.Errorf("create %s: %w", name, classifyNetlinkErr(err))
+	}
+	link, err = l.nl.LinkByName(name)
+	if err != nil {
+		return nil, fmt.Errorf("lookup %s after create: %w", name, classifyNetlinkErr(err))
+	}
+	return link, nil
+}
+
+func (l *Link) syncAddrs(link netlink.Link, desired []*netlink.Addr) error {
+	index := link.Attrs().Index
+	all, err := l.nl.AddrList(0)
+	if err != nil {
+		return fmt.Errorf("list addresses: %w", classifyNetlinkErr(err))
+	}
+
+	present := make(map[string]bool)
+	for _, addr := range all {
+		if addr.LinkIndex == index {
+			present[addr.IPNet.String()] = true
+		}
+	}
+
+	want := make(map[string]bool, len(desired))
+	for _, addr := range desired {
+		want[addr.IPNet.String()] = true
+		if present[addr.IPNet.String()] {
+			continue
+		}
+		for _, other := range all {
+			if other.LinkIndex != index && other.IP.Equal(addr.IP) {
+				return fmt.Errorf("%s on link index %d: %w", addr.IP, other.LinkIndex, ErrAddressConflict)
+			}
+		}
+		if err := l.nl.AddrAdd(link, addr); err != nil {
+			return fmt.Errorf("add address %s to %s: %w", addr.IPNet, link.Attrs().Name, classifyNetlinkErr(err))
+		}
+	}
+
+	// Drop addresses left over from a previous configuration.
+	for _, addr := range all {
+		if addr.LinkIndex != index || want[addr.IPNet.String()] || addr.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		stale := addr
+		if err := l.nl.AddrDel(link, &stale); err != nil {
+			return fmt.Errorf("remove stale address %s from %s: %w", addr.IPNet, link.Attrs().Name, classifyNetlinkErr(err))
+		}
 	}
 	return nil
 }
+
+func parseAddrs(raw string) ([]*netlink.Addr, error) {
+	var addrs []*netlink.Addr
+	for _, part := range strings.Split(raw, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		addr, err := netlink.ParseAddr(part)
+		if err != nil {
+			return nil, fmt.Errorf("invalid interface address %q: %w", part, err)
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs, nil
+}
+
+func parseRoutes(raw []string) ([]*net.IPNet, error) {
+	routes := make([]*net.IPNet, 0, len(raw))
+	for _, cidr := range raw {
+		_, dst, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			return nil, fmt.Errorf("invalid route %q: %w", cidr, err)
+		}
+		routes = append(routes, dst)
+	}
+	return routes, nil
+}
+
+func isLinkNotFound(err error) bool {
+	var notFound netlink.LinkNotFoundError
+	return errors.As(err, &notFound)
+}
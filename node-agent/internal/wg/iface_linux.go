@@ -0,0 +1,56 @@
+package wg
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+type kernelNetlink struct{}
+
+func (kernelNetlink) LinkByName(name string) (netlink.Link, error) { return netlink.LinkByName(name) }
+func (kernelNetlink) LinkAdd(link netlink.Link) error              { return netlink.LinkAdd(link) }
+func (kernelNetlink) LinkDel(link netlink.Link) error              { return netlink.LinkDel(link) }
+func (kernelNetlink) LinkSetMTU(link netlink.Link, mtu int) error {
+	return netlink.LinkSetMTU(link, mtu)
+}
+func (kernelNetlink) LinkSetUp(link netlink.Link) error { return netlink.LinkSetUp(link) }
+
+func (kernelNetlink) AddrList(linkIndex int) ([]netlink.Addr, error) {
+	if linkIndex == 0 {
+		return netlink.AddrList(nil, netlink.FAMILY_ALL)
+	}
+	link, err := netlink.LinkByIndex(linkIndex)
+	if err != nil {
+		return nil, err
+	}
+	return netlink.AddrList(link, netlink.FAMILY_ALL)
+}
+
+func (kernelNetlink) AddrAdd(link netlink.Link, addr *netlink.Addr) error {
+	return netlink.AddrAdd(link, addr)
+}
+
+func (kernelNetlink) AddrDel(link netlink.Link, addr *netlink.Addr) error {
+	return netlink.AddrDel(link, addr)
+}
+
+func (kernelNetlink) RouteReplace(linkIndex int, dst *net.IPNet) error {
+	return netlink.RouteReplace(&netlink.Route{LinkIndex: linkIndex, Dst: dst, Scope: netlink.SCOPE_LINK})
+}
+
+func classifyNetlinkErr(err error) error {
+	switch {
+	case errors.Is(err, unix.EOPNOTSUPP):
+		return fmt.Errorf("%w: %v", ErrWireGuardUnsupported, err)
+	case errors.Is(err, unix.EPERM), errors.Is(err, unix.EACCES):
+		return fmt.Errorf("%w: %v", ErrNetlinkPermission, err)
+	case errors.Is(err, unix.EADDRINUSE):
+		return fmt.Errorf("%w: %v", ErrAddressConflict, err)
+	default:
+		return err
+	}
+}
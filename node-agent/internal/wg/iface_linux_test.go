@@ -0,0 +1,15 @@
+package wg
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestClassifyNetlinkErr(t *testing.T) {
+	require.ErrorIs(t, classifyNetlinkErr(fmt.Errorf("add: %w", unix.EOPNOTSUPP)), ErrWireGuardUnsupported)
+	require.ErrorIs(t, classifyNetlinkErr(unix.EPERM), ErrNetlinkPermission)
+	require.ErrorIs(t, classifyNetlinkErr(unix.EADDRINUSE), ErrAddressConflict)
+}
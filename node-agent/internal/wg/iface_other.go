@@ -0,0 +1,26 @@
+//go:build !linux
+
+package wg
+
+import (
+	"errors"
+	"net"
+
+	"github.com/vishvananda/netlink"
+)
+
+var errNetlinkUnavailable = errors.New("netlink is only available on linux")
+
+type kernelNetlink struct{}
+
+func (kernelNetlink) LinkByName(string) (netlink.Link, error)   { return nil, errNetlinkUnavailable }
+func (kernelNetlink) LinkAdd(netlink.Link) error                { return errNetlinkUnavailable }
+func (kernelNetlink) LinkDel(netlink.Link) error                { return errNetlinkUnavailable }
+func (kernelNetlink) LinkSetMTU(netlink.Link, int) error        { return errNetlinkUnavailable }
+func (kernelNetlink) LinkSetUp(netlink.Link) error              { return errNetlinkUnavailable }
+func (kernelNetlink) AddrList(int) ([]netlink.Addr, error)      { return nil, errNetlinkUnavailable }
+func (kernelNetlink) AddrAdd(netlink.Link, *netlink.Addr) error { return errNetlinkUnavailable }
+func (kernelNetlink) AddrDel(netlink.Link, *netlink.Addr) error { return errNetlinkUnavailable }
+func (kernelNetlink) RouteReplace(int, *net.IPNet) error        { return errNetlinkUnavailable }
+
+func classifyNetlinkErr(err error) error { return err }
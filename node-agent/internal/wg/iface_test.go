@@ -0,0 +1,189 @@
+package wg
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink"
+
+	"github.com/emrecetinkayadev/vpn-tridot/node-agent/internal/config"
+)
+
+type fakeNetlink struct {
+	links  map[string]netlink.Link
+	addrs  []netlink.Addr
+	routes []string
+	added  int
+	addErr error
+}
+
+func newFakeNetlink() *fakeNetlink {
+	return &fakeNetlink{links: make(map[string]netlink.Link)}
+}
+
+func (f *fakeNetlink) LinkByName(name string) (netlink.Link, error) {
+	link, ok := f.links[name]
+	if !ok {
+		return nil, netlink.LinkNotFoundError{}
+	}
+	return link, nil
+}
+
+func (f *fakeNetlink) LinkAdd(link netlink.Link) error {
+	if f.addErr != nil {
+		return f.addErr
+	}
+	f.added++
+	link.Attrs().Index = 10 + len(f.links)
+	f.links[link.Attrs().Name] = link
+	return nil
+}
+
+func (f *fakeNetlink) LinkDel(link netlink.Link) error {
+	delete(f.links, link.Attrs().Name)
+	return nil
+}
+
+func (f *fakeNetlink) LinkSetMTU(link netlink.Link, mtu int) error {
+	link.Attrs().MTU = mtu
+	return nil
+}
+
+func (f *fakeNetlink) LinkSetUp(link netlink.Link) error {
+	link.Attrs().Flags |= net.FlagUp
+	return nil
+}
+
+func (f *fakeNetlink) AddrList(int) ([]netlink.Addr, error) {
+	return append([]netlink.Addr(nil), f.addrs...), nil
+}
+
+func (f *fakeNetlink) AddrAdd(link netlink.Link, addr *netlink.Addr) error {
+	a := *addr
+	a.LinkIndex = link.Attrs().Index
+	f.addrs = append(f.addrs, a)
+	return nil
+}
+
+func (f *fakeNetlink) AddrDel(link netlink.Link, addr *netlink.Addr) error {
+	for i, a := range f.addrs {
+		if a.LinkIndex == link.Attrs().Index && a.IPNet.String() == addr.IPNet.String() {
+			f.addrs = append(f.addrs[:i], f.addrs[i+1:]...)
+			return nil
+		}
+	}
+	return nil
+}
+
+func (f *fakeNetlink) RouteReplace(_ int, dst *net.IPNet) error {
+	f.routes = append(f.routes, dst.String())
+	return nil
+}
+
+func TestLinkUpCreatesAndIsIdempotent(t *testing.T) {
+	nl := newFakeNetlink()
+	link := NewLink(config.WireGuardConfig{
+		InterfaceName: "wg0",
+		AddressCIDR:   "10.8.0.1/24",
+		MTU:           1420,
+		Routes:        []string{"10.9.0.0/16"},
+	})
+	link.WithNetlink(nl)
+
+	require.NoError(t, link.Up())
+	require.NoError(t, link.Up())
+
+	require.Equal(t, 1, nl.added)
+	wg0 := nl.links["wg0"]
+	require.Equal(t, 1420, wg0.Attrs().MTU)
+	require.NotZero(t, wg0.Attrs().Flags&net.FlagUp)
+	require.Len(t, nl.addrs, 1)
+	require.Equal(t, "10.8.0.1/24", nl.addrs[0].IPNet.String())
+	require.Equal(t, []string{"10.9.0.0/16", "10.9.0.0/16"}, nl.routes)
+}
+
+func TestLinkUpReplacesStaleAddress(t *testing.T) {
+	nl := newFakeNetlink()
+	link := NewLink(config.WireGuardConfig{InterfaceName: "wg0", AddressCIDR: "10.8.0.1/24"})
+	link.WithNetlink(nl)
+	require.NoError(t, link.Up())
+
+	link = NewLink(config.WireGuardConfig{InterfaceName: "wg0", AddressCIDR: "10.20.0.1/24"})
+	link.WithNetlink(nl)
+	require.NoError(t, link.Up())
+
+	require.Len(t, nl.addrs, 1)
+	require.Equal(t, "10.20.0.1/24", nl.addrs[0].IPNet.String())
+}
+
+func TestLinkUpAddsIPv6AddressWhenEnabled(t *testing.T) {
+	nl := newFakeNetlink()
+	cfg := config.WireGuardConfig{InterfaceName: "wg0", AddressCIDR: "10.8.0.1/24", AddressCIDR6: "fd00:1::1/64"}
+	link := NewLink(cfg)
+	link.WithNetlink(nl)
+	require.NoError(t, link.Up())
+	require.Len(t, nl.addrs, 1, "address6 is ignored while ipv6 is disabled")
+
+	cfg.EnableIPv6 = true
+	link = NewLink(cfg)
+	link.WithNetlink(nl)
+	require.NoError(t, link.Up())
+	require.Len(t, nl.addrs, 2)
+	require.Equal(t, "fd00:1::1/64", nl.addrs[1].IPNet.String())
+}
+
+func TestULAAddressIsStablePerKey(t *testing.T) {
+	a := ULAAddress("key-a")
+	require.Equal(t, a, ULAAddress("key-a"))
+	require.NotEqual(t, a.Masked(), ULAAddress("key-b").Masked())
+	require.Equal(t, 64, a.Bits())
+	require.Equal(t, byte(0xfd), a.Addr().As16()[0])
+	require.Equal(t, a.Masked().Addr().Next(), a.Addr())
+}
+
+func TestLinkUpAddressConflict(t *testing.T) {
+	nl := newFakeNetlink()
+	ip, network, _ := net.ParseCIDR("10.8.0.1/24")
+	network.IP = ip
+	nl.addrs = []netlink.Addr{{IPNet: network, LinkIndex: 2}}
+
+	link := NewLink(config.WireGuardConfig{InterfaceName: "wg0", AddressCIDR: "10.8.0.1/24"})
+	link.WithNetlink(nl)
+
+	require.ErrorIs(t, link.Up(), ErrAddressConflict)
+}
+
+func TestLinkUpTypeMismatch(t *testing.T) {
+	nl := newFakeNetlink()
+	attrs := netlink.NewLinkAttrs()
+	attrs.Name = "wg0"
+	nl.links["wg0"] = &netlink.Dummy{LinkAttrs: attrs}
+
+	link := NewLink(config.WireGuardConfig{InterfaceName: "wg0"})
+	link.WithNetlink(nl)
+
+	require.ErrorIs(t, link.Up(), ErrLinkTypeMismatch)
+}
+
+func TestLinkUpCreateFailure(t *testing.T) {
+	nl := newFakeNetlink()
+	nl.addErr = errors.New("boom")
+
+	link := NewLink(config.WireGuardConfig{InterfaceName: "wg0"})
+	link.WithNetlink(nl)
+
+	require.ErrorContains(t, link.Up(), "create wg0")
+}
+
+func TestLinkDown(t *testing.T) {
+	nl := newFakeNetlink()
+	link := NewLink(config.WireGuardConfig{InterfaceName: "wg0"})
+	link.WithNetlink(nl)
+
+	require.NoError(t, link.Down(), "missing link is not an error")
+	require.NoError(t, link.Up())
+	require.NoError(t, link.Down())
+	require.Empty(t, nl.links)
+}
@@ -0,0 +1,65 @@
+package wg
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// KeyPair holds a base64 encoded WireGuard (X25519) key pair.
+type KeyPair struct {
+	PrivateKey string
+	PublicKey  string
+}
+
+// LoadOrCreateKey reads the interface private key from path, generating and
+// persisting a new one when the file does not exist yet.
+func LoadOrCreateKey(path string) (KeyPair, error) {
+	if path == "" {
+		return KeyPair{}, fmt.Errorf("private key file required")
+	}
+
+	content, err := os.ReadFile(path)
+	if err == nil {
+		return keyPairFromPrivate(strings.TrimSpace(string(content)))
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return KeyPair{}, fmt.Errorf("read private key: %w", err)
+	}
+
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return KeyPair{}, fmt.Errorf("generate private key: %w", err)
+	}
+	encoded := base64.StdEncoding.EncodeToString(priv.Bytes())
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return KeyPair{}, fmt.Errorf("create key dir: %w", err)
+	}
+	if err := os.WriteFile(path, []byte(encoded+"\n"), 0o600); err != nil {
+		return KeyPair{}, fmt.Errorf("write private key: %w", err)
+	}
+	return KeyPair{
+		PrivateKey: encoded,
+		PublicKey:  base64.StdEncoding.EncodeToString(priv.PublicKey().Bytes()),
+	}, nil
+}
+
+func keyPairFromPrivate(encoded string) (KeyPair, error) {
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return KeyPair{}, fmt.Errorf("decode private key: %w", err)
+	}
+	priv, err := ecdh.X25519().NewPrivateKey(raw)
+	if err != nil {
+		return KeyPair{}, fmt.Errorf("parse private key: %w", err)
+	}
+	return KeyPair{
+		PrivateKey: encoded,
+		PublicKey:  base64.StdEncoding.EncodeToString(priv.PublicKey().Bytes()),
+	}, nil
+}
@@ -0,0 +1,36 @@
+package wg
+
+import (
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadOrCreateKeyPersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys", "wg0.key")
+
+	created, err := LoadOrCreateKey(path)
+	require.NoError(t, err)
+	raw, err := base64.StdEncoding.DecodeString(created.PublicKey)
+	require.NoError(t, err)
+	require.Len(t, raw, 32)
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+
+	loaded, err := LoadOrCreateKey(path)
+	require.NoError(t, err)
+	require.Equal(t, created, loaded)
+}
+
+func TestLoadOrCreateKeyRejectsGarbage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wg0.key")
+	require.NoError(t, os.WriteFile(path, []byte("not-a-key"), 0o600))
+
+	_, err := LoadOrCreateKey(path)
+	require.Error(t, err)
+}
@@ -2,11 +2,11 @@ package wg
 
 import (
 	"fmt"
-	"os"
 	"path/filepath"
-	"strings"
 	"time"
 
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
 	"github.com/emrecetinkayadev/vpn-tridot/node-agent/internal/config"
 )
 
@@ -17,15 +17,19 @@ type Peer struct {
 	AllowedIPs     []string `json:"allowed_ips"`
 	Endpoint       string   `json:"endpoint"`
 	PersistentKeep int      `json:"persistent_keepalive"`
+	// Group is the control plane's mesh marker. It is not part of the
+	// device configuration; the agent uses it for client isolation.
+	Group string `json:"group,omitempty"`
 }
 
-// Manager writes WireGuard configuration files to disk.
+// Manager configures the WireGuard device and reads its statistics.
 type Manager struct {
-	cfg    config.WireGuardConfig
-	client wireGuardClient
+	cfg        config.WireGuardConfig
+	client     wireGuardClient
+	privateKey string
 }
 
-// NewManager creates a config manager for WireGuard interface.
+// NewManager creates a manager for the configured WireGuard interface.
 func NewManager(cfg config.WireGuardConfig) *Manager {
 	return &Manager{cfg: cfg, client: defaultClient{}}
 }
@@ -35,16 +39,45 @@ func (m *Manager) WithClient(client wireGuardClient) {
 	m.client = client
 }
 
+// WithPrivateKey sets the interface private key applied to the device.
+func (m *Manager) WithPrivateKey(key string) {
+	m.privateKey = key
+}
+
+// PrivateKeyPath returns the configured private key file, defaulting to
+// <configDir>/<interface>.key.
+func (m *Manager) PrivateKeyPath() string {
+	if m.cfg.PrivateKeyFile != "" {
+		return m.cfg.PrivateKeyFile
+	}
+	if m.cfg.ConfigDirectory == "" || m.cfg.InterfaceName == "" {
+		return ""
+	}
+	return filepath.Join(m.cfg.ConfigDirectory, m.cfg.InterfaceName+".key")
+}
+
 type wireGuardClient interface {
-	DeviceStats(interfaceName string) (DeviceStats, error)
+	Device(name string) (*wgtypes.Device, error)
+	ConfigureDevice(name string, cfg wgtypes.Config) error
 }
 
 type DeviceStats struct {
+	// Epoch changes whenever the interface is recreated; see deviceEpoch.
+	Epoch         string
 	LastHandshake time.Time
 	ReceiveBytes  uint64
 	TransmitBytes uint64
 	PeerCount     int
 	ActivePeers   int
+	Peers         []PeerStats
+}
+
+// PeerStats holds the raw device counters of a single peer.
+type PeerStats struct {
+	PublicKey     string
+	ReceiveBytes  uint64
+	TransmitBytes uint64
+	LastHandshake time.Time
 }
 
 // Stats returns aggregated WireGuard device metrics.
@@ -52,84 +85,14 @@ func (m *Manager) Stats() (DeviceStats, error) {
 	if m.client == nil {
 		return DeviceStats{}, fmt.Errorf("wireguard client not configured")
 	}
-	return m.client.DeviceStats(m.cfg.InterfaceName)
-}
-
-// EnsureBaseConfig writes the base interface configuration (without peers).
-func (m *Manager) EnsureBaseConfig() (string, error) {
-	return m.WritePeers(nil)
-}
-
-// WritePeers renders WireGuard config with provided peers and writes to config directory.
-func (m *Manager) WritePeers(peers []Peer) (string, error) {
 	if m.cfg.InterfaceName == "" {
-		return "", fmt.Errorf("interface name required")
-	}
-	if m.cfg.ConfigDirectory == "" {
-		return "", fmt.Errorf("config directory required")
-	}
-
-	if err := os.MkdirAll(m.cfg.ConfigDirectory, 0o750); err != nil {
-		return "", fmt.Errorf("create config dir: %w", err)
-	}
-
-	filePath := filepath.Join(m.cfg.ConfigDirectory, fmt.Sprintf("%s.conf", m.cfg.InterfaceName))
-	content := m.render(peers)
-	if err := os.WriteFile(filePath, []byte(content), 0o600); err != nil {
-		return "", fmt.Errorf("write config: %w", err)
-	}
-
-	return filePath, nil
-}
-
-func (m *Manager) render(peers []Peer) string {
-	var b strings.Builder
-	b.WriteString("[Interface]\n")
-	if m.cfg.AddressCIDR != "" {
-		b.WriteString("Address = ")
-		b.WriteString(m.cfg.AddressCIDR)
-		b.WriteString("\n")
-	}
-	b.WriteString(fmt.Sprintf("ListenPort = %d\n", m.cfg.ListenPort))
-	if m.cfg.MTU > 0 {
-		b.WriteString(fmt.Sprintf("MTU = %d\n", m.cfg.MTU))
+		return DeviceStats{}, fmt.Errorf("interface name required")
 	}
-	if len(m.cfg.DNS) > 0 {
-		b.WriteString("DNS = ")
-		b.WriteString(strings.Join(m.cfg.DNS, ","))
-		b.WriteString("\n")
+	dev, err := m.client.Device(m.cfg.InterfaceName)
+	if err != nil {
+		return DeviceStats{}, fmt.Errorf("read device %s: %w", m.cfg.InterfaceName, err)
 	}
-	b.WriteString("\n")
-
-	for _, peer := range peers {
-		b.WriteString("[Peer]\n")
-		b.WriteString("PublicKey = ")
-		b.WriteString(peer.PublicKey)
-		b.WriteString("\n")
-		if peer.PresharedKey != "" {
-			b.WriteString("PresharedKey = ")
-			b.WriteString(peer.PresharedKey)
-			b.WriteString("\n")
-		}
-		if len(peer.AllowedIPs) > 0 {
-			b.WriteString("AllowedIPs = ")
-			b.WriteString(strings.Join(peer.AllowedIPs, ","))
-			b.WriteString("\n")
-		}
-		if peer.Endpoint != "" {
-			b.WriteString("Endpoint = ")
-			b.WriteString(peer.Endpoint)
-			b.WriteString("\n")
-		}
-		keepalive := peer.PersistentKeep
-		if keepalive == 0 {
-			keepalive = m.cfg.PersistentKeepalive
-		}
-		if keepalive > 0 {
-			b.WriteString(fmt.Sprintf("PersistentKeepalive = %d\n", keepalive))
-		}
-		b.WriteString("\n")
-	}
-
-	return b.String()
+	stats := statsFromDevice(dev, time.Now())
+	stats.Epoch = deviceEpoch(m.cfg.InterfaceName)
+	return stats, nil
 }
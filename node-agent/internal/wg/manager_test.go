@@ -1,81 +1,123 @@
 package wg
 
 import (
-	"os"
+	"net"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/require"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 
 	"github.com/emrecetinkayadev/vpn-tridot/node-agent/internal/config"
 )
 
-func TestWritePeersCreatesConfig(t *testing.T) {
-	dir := t.TempDir()
-	mgr := NewManager(config.WireGuardConfig{
-		InterfaceName:       "wg0",
-		ListenPort:          51820,
-		AddressCIDR:         "10.0.0.2/32",
-		DNS:                 []string{"1.1.1.1", "8.8.8.8"},
-		MTU:                 1420,
-		PersistentKeepalive: 25,
-		ConfigDirectory:     dir,
-	})
+func TestManagerStats(t *testing.T) {
+	origEpoch := deviceEpoch
+	deviceEpoch = func(name string) string { return "boot:" + name }
+	defer func() { deviceEpoch = origEpoch }()
 
-	path, err := mgr.WritePeers([]Peer{{
-		PublicKey:      "server-public",
-		AllowedIPs:     []string{"0.0.0.0/0"},
-		Endpoint:       "vpn.example.com:51820",
-		PersistentKeep: 30,
-	}})
-	require.NoError(t, err)
-	require.FileExists(t, path)
-	content, err := os.ReadFile(path)
+	recent := time.Now().Add(-time.Minute).Truncate(time.Second)
+	mgr := NewManager(config.WireGuardConfig{InterfaceName: "wg0"})
+	mgr.WithClient(&mockWGClient{device: &wgtypes.Device{Peers: []wgtypes.Peer{
+		{PublicKey: mustKey(t), ReceiveBytes: 1000, TransmitBytes: 5000, LastHandshakeTime: recent},
+		{PublicKey: mustKey(t), ReceiveBytes: 234, TransmitBytes: 678, LastHandshakeTime: time.Unix(10, 0)},
+	}}})
+
+	stats, err := mgr.Stats()
 	require.NoError(t, err)
-	require.Contains(t, string(content), "[Interface]")
-	require.Contains(t, string(content), "DNS = 1.1.1.1,8.8.8.8")
-	require.Contains(t, string(content), "PersistentKeepalive = 30")
+	require.Equal(t, "boot:wg0", stats.Epoch)
+	require.Equal(t, 2, stats.PeerCount)
+	require.Equal(t, 1, stats.ActivePeers)
+	require.Equal(t, uint64(1234), stats.ReceiveBytes)
+	require.Equal(t, uint64(5678), stats.TransmitBytes)
+	require.Equal(t, recent, stats.LastHandshake)
+	require.Len(t, stats.Peers, 2)
+	require.Equal(t, uint64(1000), stats.Peers[0].ReceiveBytes)
+	require.Equal(t, recent, stats.Peers[0].LastHandshake)
 }
 
-func TestEnsureBaseConfig(t *testing.T) {
-	dir := t.TempDir()
-	mgr := NewManager(config.WireGuardConfig{
-		InterfaceName:   "wg0",
-		ListenPort:      51820,
-		ConfigDirectory: dir,
-	})
+func TestApplyPeersIncremental(t *testing.T) {
+	keep, change, stale, added := mustKey(t), mustKey(t), mustKey(t), mustKey(t)
+	keepalive := 25 * time.Second
+	client := &mockWGClient{device: &wgtypes.Device{
+		ListenPort: 51820,
+		Peers: []wgtypes.Peer{
+			{PublicKey: keep, AllowedIPs: []net.IPNet{mustCIDR(t, "10.0.0.2/32")}, PersistentKeepaliveInterval: keepalive},
+			{PublicKey: change, AllowedIPs: []net.IPNet{mustCIDR(t, "10.0.0.3/32")}, PersistentKeepaliveInterval: keepalive},
+			{PublicKey: stale, AllowedIPs: []net.IPNet{mustCIDR(t, "10.0.0.4/32")}, PersistentKeepaliveInterval: keepalive},
+		},
+	}}
+	mgr := NewManager(config.WireGuardConfig{InterfaceName: "wg0", ListenPort: 51820, PersistentKeepalive: 25})
+	mgr.WithClient(client)
 
-	path, err := mgr.EnsureBaseConfig()
-	require.NoError(t, err)
-	content, err := os.ReadFile(path)
+	err := mgr.ApplyPeers([]Peer{
+		{PublicKey: keep.String(), AllowedIPs: []string{"10.0.0.2/32"}},
+		{PublicKey: change.String(), AllowedIPs: []string{"10.0.0.30/32"}},
+		{PublicKey: added.String(), AllowedIPs: []string{"10.0.0.5/32"}},
+	})
 	require.NoError(t, err)
-	require.Contains(t, string(content), "[Interface]")
+	require.Len(t, client.configured, 1)
+
+	cfg := client.configured[0]
+	require.Nil(t, cfg.ListenPort)
+	byKey := make(map[wgtypes.Key]wgtypes.PeerConfig)
+	for _, pc := range cfg.Peers {
+		byKey[pc.PublicKey] = pc
+	}
+	require.Len(t, byKey, 3)
+	require.NotContains(t, byKey, keep)
+	require.True(t, byKey[stale].Remove)
+	require.True(t, byKey[change].ReplaceAllowedIPs)
+	require.Equal(t, "10.0.0.30/32", byKey[change].AllowedIPs[0].String())
+	require.False(t, byKey[added].Remove)
 }
 
-func TestManagerValidation(t *testing.T) {
-	mgr := NewManager(config.WireGuardConfig{})
-	_, err := mgr.WritePeers(nil)
-	require.Error(t, err)
+func TestApplyPeersNoChanges(t *testing.T) {
+	key := mustKey(t)
+	client := &mockWGClient{device: &wgtypes.Device{Peers: []wgtypes.Peer{
+		{PublicKey: key, AllowedIPs: []net.IPNet{mustCIDR(t, "10.0.0.2/32")}},
+	}}}
+	mgr := NewManager(config.WireGuardConfig{InterfaceName: "wg0"})
+	mgr.WithClient(client)
+
+	require.NoError(t, mgr.ApplyPeers([]Peer{{PublicKey: key.String(), AllowedIPs: []string{"10.0.0.2/32"}}}))
+	require.Empty(t, client.configured)
 }
 
-func TestManagerStats(t *testing.T) {
+func TestApplyPeersRejectsInvalidKey(t *testing.T) {
+	client := &mockWGClient{device: &wgtypes.Device{}}
 	mgr := NewManager(config.WireGuardConfig{InterfaceName: "wg0"})
-	mgr.WithClient(mockWGClient{stats: DeviceStats{PeerCount: 2, ActivePeers: 1, ReceiveBytes: 1234, TransmitBytes: 5678, LastHandshake: time.Unix(10, 0)}})
+	mgr.WithClient(client)
 
-	stats, err := mgr.Stats()
-	require.NoError(t, err)
-	require.Equal(t, 2, stats.PeerCount)
-	require.Equal(t, 1, stats.ActivePeers)
-	require.Equal(t, uint64(1234), stats.ReceiveBytes)
-	require.Equal(t, uint64(5678), stats.TransmitBytes)
-	require.Equal(t, time.Unix(10, 0), stats.LastHandshake)
+	require.Error(t, mgr.ApplyPeers([]Peer{{PublicKey: "not-a-key"}}))
+	require.Empty(t, client.configured)
 }
 
 type mockWGClient struct {
-	stats DeviceStats
-	err   error
+	device     *wgtypes.Device
+	err        error
+	configured []wgtypes.Config
 }
 
-func (m mockWGClient) DeviceStats(string) (DeviceStats, error) {
-	return m.stats, m.err
+func (m *mockWGClient) Device(string) (*wgtypes.Device, error) {
+	return m.device, m.err
+}
+
+func (m *mockWGClient) ConfigureDevice(_ string, cfg wgtypes.Config) error {
+	m.configured = append(m.configured, cfg)
+	return m.err
+}
+
+func mustKey(t *testing.T) wgtypes.Key {
+	t.Helper()
+	key, err := wgtypes.GeneratePrivateKey()
+	require.NoError(t, err)
+	return key.PublicKey()
+}
+
+func mustCIDR(t *testing.T, cidr string) net.IPNet {
+	t.Helper()
+	_, network, err := net.ParseCIDR(cidr)
+	require.NoError(t, err)
+	return *network
 }
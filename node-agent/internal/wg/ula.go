@@ -0,0 +1,35 @@
+package wg
+
+import (
+	"crypto/sha256"
+	"net/netip"
+	"strings"
+
+	"github.com/emrecetinkayadev/vpn-tridot/node-agent/internal/config"
+)
+
+// ULAAddress derives the interface's IPv6 tunnel address from its public key:
+// an RFC 4193 prefix whose 40-bit global ID is taken from the key hash, subnet
+// 0, host ::1. The same key always yields the same /64, so the prefix survives
+// restarts without being stored.
+func ULAAddress(publicKey string) netip.Prefix {
+	sum := sha256.Sum256([]byte(publicKey))
+	var addr [16]byte
+	addr[0] = 0xfd
+	copy(addr[1:6], sum[:5])
+	addr[15] = 1
+	return netip.PrefixFrom(netip.AddrFrom16(addr), 64)
+}
+
+// interfaceAddresses lists every address the interface carries, IPv6 included
+// when enabled.
+func interfaceAddresses(cfg config.WireGuardConfig) string {
+	addrs := []string{}
+	if cfg.AddressCIDR != "" {
+		addrs = append(addrs, cfg.AddressCIDR)
+	}
+	if cfg.EnableIPv6 && cfg.AddressCIDR6 != "" {
+		addrs = append(addrs, cfg.AddressCIDR6)
+	}
+	return strings.Join(addrs, ", ")
+}
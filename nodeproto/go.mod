@@ -0,0 +1,3 @@
+module github.com/emrecetinkayadev/vpn-tridot/nodeproto
+
+go 1.23
@@ -0,0 +1,251 @@
+package nodeproto
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/netip"
+	"time"
+)
+
+// Default control plane endpoints.
+const (
+	PathRegister  = "/api/v1/nodes/register"
+	PathHealth    = "/api/v1/nodes/health"
+	PathPeers     = "/api/v1/nodes/peers"
+	PathPeerStats = "/api/v1/nodes/peers/stats"
+	// PathStream is the WebSocket the control plane pushes StreamMessages on.
+	PathStream = "/api/v1/nodes/stream"
+)
+
+// Node capabilities announced on registration.
+const (
+	// CapabilityIPv6 means the node routes IPv6 for its peers, so clients
+	// may send ::/0 through the tunnel.
+	CapabilityIPv6 = "ipv6"
+)
+
+// MaxPeerStatsBatch caps the number of peers in a single PeerStatsReport.
+const MaxPeerStatsBatch = 5000
+
+// RegisterRequest announces a node to the control plane.
+type RegisterRequest struct {
+	RegionCode string  `json:"region_code"`
+	Hostname   string  `json:"hostname"`
+	PublicIPv4 *string `json:"public_ipv4,omitempty"`
+	PublicIPv6 *string `json:"public_ipv6,omitempty"`
+	PublicKey  string  `json:"public_key"`
+	Endpoint   string  `json:"endpoint"`
+	TunnelPort int     `json:"tunnel_port"`
+	// TunnelAddress is the node's IPv4 interface address with its subnet
+	// (e.g. 10.8.0.1/24). Peers get addresses from that subnet.
+	TunnelAddress string `json:"tunnel_address,omitempty"`
+	// TunnelIPv6Prefix is the ULA /64 the node hands out to peers.
+	TunnelIPv6Prefix string   `json:"tunnel_ipv6_prefix,omitempty"`
+	Capabilities     []string `json:"capabilities,omitempty"`
+}
+
+// HasCapability reports whether the node announced capability c.
+func (r RegisterRequest) HasCapability(c string) bool {
+	for _, have := range r.Capabilities {
+		if have == c {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate checks the fields the control plane needs to route clients to the node.
+func (r RegisterRequest) Validate() error {
+	switch {
+	case r.RegionCode == "":
+		return errors.New("region_code is required")
+	case r.Hostname == "":
+		return errors.New("hostname is required")
+	case r.PublicKey == "":
+		return errors.New("public_key is required")
+	case r.Endpoint == "":
+		return errors.New("endpoint is required")
+	case r.TunnelPort <= 0 || r.TunnelPort > 65535:
+		return errors.New("tunnel_port must be between 1 and 65535")
+	}
+	if _, _, err := net.SplitHostPort(r.Endpoint); err != nil {
+		return errors.New("endpoint must be host:port")
+	}
+	if r.TunnelAddress != "" {
+		prefix, err := netip.ParsePrefix(r.TunnelAddress)
+		if err != nil || !prefix.Addr().Is4() || prefix.Bits() > 30 {
+			return errors.New("tunnel_address must be an IPv4 address with a /30 or shorter prefix")
+		}
+	}
+	if r.TunnelIPv6Prefix != "" {
+		prefix, err := netip.ParsePrefix(r.TunnelIPv6Prefix)
+		if err != nil || !prefix.Addr().Is6() || prefix.Addr().Is4In6() || prefix.Bits() > 64 {
+			return errors.New("tunnel_ipv6_prefix must be an IPv6 prefix of /64 or shorter")
+		}
+	}
+	if r.HasCapability(CapabilityIPv6) && r.TunnelIPv6Prefix == "" {
+		return errors.New("ipv6 capability requires tunnel_ipv6_prefix")
+	}
+	return nil
+}
+
+// RegisterResponse is returned after a successful registration.
+type RegisterResponse struct {
+	NodeID string `json:"node_id"`
+}
+
+// HealthReport is sent periodically by the agent.
+type HealthReport struct {
+	NodeID         string     `json:"node_id"`
+	Timestamp      time.Time  `json:"timestamp"`
+	ActivePeers    int        `json:"active_peers"`
+	PeerCount      int        `json:"peer_count"`
+	HandshakeRatio float64    `json:"handshake_ratio"`
+	LastHandshake  *time.Time `json:"last_handshake,omitempty"`
+	RxBytes        uint64     `json:"rx_bytes"`
+	TxBytes        uint64     `json:"tx_bytes"`
+	RxBps          float64    `json:"rx_bps"`
+	TxBps          float64    `json:"tx_bps"`
+	ThroughputMbps float64    `json:"throughput_mbps"`
+	CPUPercent     float64    `json:"cpu_percent"`
+	SoftirqPercent float64    `json:"softirq_percent"`
+	MemoryPercent  float64    `json:"memory_percent"`
+	PacketLoss     float64    `json:"packet_loss"`
+	Drain          bool       `json:"drain"`
+}
+
+// Validate checks that the report can be attributed to a node and carries sane values.
+func (r HealthReport) Validate() error {
+	switch {
+	case r.NodeID == "":
+		return errors.New("node_id is required")
+	case r.ActivePeers < 0 || r.PeerCount < 0:
+		return errors.New("peer counts must not be negative")
+	case r.CPUPercent < 0 || r.CPUPercent > 100:
+		return errors.New("cpu_percent must be between 0 and 100")
+	case r.SoftirqPercent < 0 || r.SoftirqPercent > 100:
+		return errors.New("softirq_percent must be between 0 and 100")
+	case r.MemoryPercent < 0 || r.MemoryPercent > 100:
+		return errors.New("memory_percent must be between 0 and 100")
+	case r.PacketLoss < 0 || r.PacketLoss > 1:
+		return errors.New("packet_loss must be between 0 and 1")
+	case r.ThroughputMbps < 0:
+		return errors.New("throughput_mbps must not be negative")
+	}
+	return nil
+}
+
+// HealthResponse carries the capacity score computed from a report.
+type HealthResponse struct {
+	CapacityScore int `json:"capacity_score"`
+}
+
+// Peer is a WireGuard peer as desired by the control plane.
+type Peer struct {
+	PublicKey           string   `json:"public_key"`
+	PresharedKey        string   `json:"preshared_key,omitempty"`
+	AllowedIPs          []string `json:"allowed_ips"`
+	PersistentKeepalive int      `json:"persistent_keepalive,omitempty"`
+	// Group is an opaque marker shared by the peers of one user who enabled
+	// the device mesh. Nodes isolate peers from each other except within a
+	// group; empty means the peer is isolated.
+	Group string `json:"group,omitempty"`
+}
+
+// DesiredPeersResponse lists the peers a node should have configured. When
+// Full is false, Peers and Removed are changes since the requested revision.
+type DesiredPeersResponse struct {
+	NodeID   string   `json:"node_id"`
+	Revision int64    `json:"revision"`
+	Full     bool     `json:"full"`
+	Peers    []Peer   `json:"peers"`
+	Removed  []string `json:"removed"`
+}
+
+// PeerStat carries the raw WireGuard counters of one peer as seen by the node.
+// Counters are cumulative since the peer was added to the device and restart
+// from zero when the interface or peer is recreated.
+type PeerStat struct {
+	PublicKey     string     `json:"public_key"`
+	RxBytes       uint64     `json:"rx_bytes"`
+	TxBytes       uint64     `json:"tx_bytes"`
+	LastHandshake *time.Time `json:"last_handshake,omitempty"`
+}
+
+// PeerStatsReport is a batch of per-peer counters sent by a node.
+type PeerStatsReport struct {
+	NodeID      string    `json:"node_id"`
+	CollectedAt time.Time `json:"collected_at"`
+	// Epoch identifies the WireGuard device the counters were read from. It
+	// changes whenever the interface is recreated, which restarts every
+	// counter on it. Empty when the node cannot tell.
+	Epoch string     `json:"epoch,omitempty"`
+	Peers []PeerStat `json:"peers"`
+}
+
+// Validate checks the batch size and that every entry names a peer.
+func (r PeerStatsReport) Validate() error {
+	if r.NodeID == "" {
+		return errors.New("node_id is required")
+	}
+	if len(r.Peers) > MaxPeerStatsBatch {
+		return fmt.Errorf("at most %d peers per report", MaxPeerStatsBatch)
+	}
+	for _, peer := range r.Peers {
+		if peer.PublicKey == "" {
+			return errors.New("peer public_key is required")
+		}
+		if peer.RxBytes > math.MaxInt64 || peer.TxBytes > math.MaxInt64 {
+			return fmt.Errorf("peer %s: counter out of range", peer.PublicKey)
+		}
+	}
+	return nil
+}
+
+// PeerStatsResponse reports how many peers of a batch matched the node.
+type PeerStatsResponse struct {
+	Updated int `json:"updated"`
+}
+
+// Stream message types.
+const (
+	// StreamPeers announces the node's current peer revision; a node behind
+	// it syncs right away instead of waiting for its next poll.
+	StreamPeers = "peers"
+	// StreamDrain tells the node to enter or leave drain mode.
+	StreamDrain = "drain"
+	// StreamConfig carries agent settings chosen by the control plane. It is
+	// the first message on every stream.
+	StreamConfig = "config"
+	// StreamPing keeps idle streams alive; nodes ignore it.
+	StreamPing = "ping"
+)
+
+// StreamMessage is one message pushed over PathStream. Revision is set for
+// StreamPeers, Drain for StreamDrain and Config for StreamConfig.
+type StreamMessage struct {
+	Type     string         `json:"type"`
+	Revision int64          `json:"revision,omitempty"`
+	Drain    *bool          `json:"drain,omitempty"`
+	Config   *AgentSettings `json:"config,omitempty"`
+}
+
+// AgentSettings holds the settings a node adopts while its stream is up.
+// Zero values leave the node's own configuration in place.
+type AgentSettings struct {
+	// PingInterval is how often the control plane sends StreamPing; a node
+	// that hears nothing for several intervals reconnects.
+	PingInterval int `json:"ping_interval_seconds,omitempty"`
+	// PollInterval replaces the node's peer poll interval while the stream
+	// is connected. Changes arrive over the stream, so polling only has to
+	// catch what it missed; health and stats reports keep their interval.
+	PollInterval int `json:"poll_interval_seconds,omitempty"`
+}
+
+// ErrorResponse is the body of any non-2xx response.
+type ErrorResponse struct {
+	Error            string `json:"error"`
+	SupportedVersion string `json:"supported_version,omitempty"`
+}
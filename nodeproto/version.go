@@ -0,0 +1,64 @@
+// Package nodeproto defines the wire protocol spoken between node agents and
+// the control plane. Both sides import it so request and response shapes,
+// headers and the protocol version cannot drift apart.
+package nodeproto
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	// Version is the protocol version spoken by this build.
+	Version = 1
+	// MinVersion is the oldest peer version this build still accepts. Bump it
+	// together with Version when a change is not backwards compatible.
+	MinVersion = 1
+
+	// HeaderVersion carries the sender's protocol version on every request
+	// and response.
+	HeaderVersion = "X-Node-Protocol-Version"
+	// HeaderProvisionToken carries the shared node provisioning token.
+	HeaderProvisionToken = "X-Provision-Token"
+)
+
+// ErrIncompatibleVersion is returned when the remote side speaks a protocol
+// version outside [MinVersion, Version] or does not announce one.
+var ErrIncompatibleVersion = errors.New("incompatible node protocol version")
+
+// CheckVersion validates a raw HeaderVersion value.
+func CheckVersion(raw string) error {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return fmt.Errorf("%w: missing %s header (supported %s)", ErrIncompatibleVersion, HeaderVersion, SupportedRange())
+	}
+	v, err := strconv.Atoi(raw)
+	if err != nil {
+		return fmt.Errorf("%w: malformed version %q (supported %s)", ErrIncompatibleVersion, raw, SupportedRange())
+	}
+	if v < MinVersion || v > Version {
+		return fmt.Errorf("%w: got %d (supported %s)", ErrIncompatibleVersion, v, SupportedRange())
+	}
+	return nil
+}
+
+// CheckHeader validates the protocol version announced in h.
+func CheckHeader(h http.Header) error {
+	return CheckVersion(h.Get(HeaderVersion))
+}
+
+// SetHeader stamps the local protocol version onto h.
+func SetHeader(h http.Header) {
+	h.Set(HeaderVersion, strconv.Itoa(Version))
+}
+
+// SupportedRange renders the accepted version range for error messages.
+func SupportedRange() string {
+	if MinVersion == Version {
+		return strconv.Itoa(Version)
+	}
+	return fmt.Sprintf("%d-%d", MinVersion, Version)
+}
@@ -0,0 +1,119 @@
+package nodeproto
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+func TestCheckVersion(t *testing.T) {
+	cases := map[string]bool{
+		strconv.Itoa(Version):        true,
+		"":                           false,
+		"abc":                        false,
+		strconv.Itoa(Version + 1):    false,
+		strconv.Itoa(MinVersion - 1): false,
+	}
+	for raw, ok := range cases {
+		err := CheckVersion(raw)
+		if ok && err != nil {
+			t.Fatalf("CheckVersion(%q) unexpected error: %v", raw, err)
+		}
+		if !ok && !errors.Is(err, ErrIncompatibleVersion) {
+			t.Fatalf("CheckVersion(%q) = %v, want ErrIncompatibleVersion", raw, err)
+		}
+	}
+}
+
+func TestSetHeaderRoundTrip(t *testing.T) {
+	h := http.Header{}
+	SetHeader(h)
+	if err := CheckHeader(h); err != nil {
+		t.Fatalf("CheckHeader after SetHeader: %v", err)
+	}
+}
+
+func TestRegisterRequestValidate(t *testing.T) {
+	valid := RegisterRequest{
+		RegionCode: "TR-IST",
+		Hostname:   "ist-1",
+		PublicKey:  "pk",
+		Endpoint:   "203.0.113.10:51820",
+		TunnelPort: 51820,
+	}
+	if err := valid.Validate(); err != nil {
+		t.Fatalf("valid request rejected: %v", err)
+	}
+
+	noPort := valid
+	noPort.Endpoint = "203.0.113.10"
+	if noPort.Validate() == nil {
+		t.Fatal("endpoint without port accepted")
+	}
+
+	noKey := valid
+	noKey.PublicKey = ""
+	if noKey.Validate() == nil {
+		t.Fatal("missing public key accepted")
+	}
+
+	dual := valid
+	dual.TunnelIPv6Prefix = "fd12:3456:789a::/64"
+	dual.Capabilities = []string{CapabilityIPv6}
+	if err := dual.Validate(); err != nil {
+		t.Fatalf("dual-stack request rejected: %v", err)
+	}
+
+	noPrefix := dual
+	noPrefix.TunnelIPv6Prefix = ""
+	if noPrefix.Validate() == nil {
+		t.Fatal("ipv6 capability without prefix accepted")
+	}
+
+	v4Prefix := dual
+	v4Prefix.TunnelIPv6Prefix = "10.0.0.0/24"
+	if v4Prefix.Validate() == nil {
+		t.Fatal("ipv4 tunnel_ipv6_prefix accepted")
+	}
+
+	withPool := valid
+	withPool.TunnelAddress = "10.8.0.1/24"
+	if err := withPool.Validate(); err != nil {
+		t.Fatalf("tunnel address rejected: %v", err)
+	}
+	withPool.TunnelAddress = "10.8.0.1/32"
+	if withPool.Validate() == nil {
+		t.Fatal("host-only tunnel_address accepted")
+	}
+}
+
+func TestHealthReportValidate(t *testing.T) {
+	if (HealthReport{}).Validate() == nil {
+		t.Fatal("report without node_id accepted")
+	}
+	if (HealthReport{NodeID: "n", CPUPercent: 120}).Validate() == nil {
+		t.Fatal("cpu over 100 accepted")
+	}
+	if (HealthReport{NodeID: "n", MemoryPercent: -1}).Validate() == nil {
+		t.Fatal("negative memory accepted")
+	}
+	if err := (HealthReport{NodeID: "n", CPUPercent: 40, PacketLoss: 0.01}).Validate(); err != nil {
+		t.Fatalf("valid report rejected: %v", err)
+	}
+}
+
+func TestPeerStatsReportValidate(t *testing.T) {
+	if (PeerStatsReport{Peers: []PeerStat{{PublicKey: "pk"}}}).Validate() == nil {
+		t.Fatal("report without node_id accepted")
+	}
+	if (PeerStatsReport{NodeID: "n", Peers: []PeerStat{{}}}).Validate() == nil {
+		t.Fatal("peer without public key accepted")
+	}
+	if (PeerStatsReport{NodeID: "n", Peers: make([]PeerStat, MaxPeerStatsBatch+1)}).Validate() == nil {
+		t.Fatal("oversized batch accepted")
+	}
+	if err := (PeerStatsReport{NodeID: "n", Peers: []PeerStat{{PublicKey: "pk", RxBytes: 10}}}).Validate(); err != nil {
+		t.Fatalf("valid report rejected: %v", err)
+	}
+}
@@ -46,6 +46,15 @@ export interface WireGuardTunnelSpec {
   allowedIPs: string[];
   persistentKeepalive: number;
   mtu?: number;
+  presharedKey?: string;
+}
+
+export interface ClientConfigDocument {
+  version: 1;
+  peerId: string;
+  name: string;
+  privateKey?: string;
+  tunnel: WireGuardTunnelSpec;
 }
 
 export interface ProvisioningFailure {